@@ -22,17 +22,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"path/filepath"
 
+	"github.com/crunchydata/postgresql-prometheus-adapter/pkg/influx"
+	"github.com/crunchydata/postgresql-prometheus-adapter/pkg/loadgen"
+	"github.com/crunchydata/postgresql-prometheus-adapter/pkg/otlp"
 	"github.com/crunchydata/postgresql-prometheus-adapter/pkg/postgresql"
+	"github.com/crunchydata/postgresql-prometheus-adapter/pkg/selector"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -58,11 +76,43 @@ type config struct {
 	remoteTimeout      time.Duration
 	listenAddr         string
 	telemetryPath      string
+	enableAdminAPI     bool
+	statusTokenFile    string
+	adminTokenFile     string
+	statusTokens       apiTokens
+	adminTokens        apiTokens
 	pgPrometheusConfig postgresql.Config
 	logLevel           string
 	haGroupLockId      int
 	prometheusTimeout  time.Duration
 	promlogConfig      promlog.Config
+	tenantRates        map[string]string
+	enableOTLP         bool
+	otlpConfig         otlp.Config
+	enableInflux       bool
+	enableQueryAPI     bool
+	backfillHeader     string
+	duplicateLabels    string
+	readyDegradedCode  int
+
+	verifySchema         bool
+	schemaDryRun         bool
+	createPartitionsFrom string
+	createPartitionsTo   string
+	migratePartitioned   bool
+	migrateBatch         time.Duration
+	compactDuplicates    bool
+	compactApply         bool
+	compactKeep          string
+	compactBatch         time.Duration
+	repairLabels         bool
+	repairLabelsApply    bool
+	reconcileFrom        string
+	reconcileTo          string
+	loadgen              bool
+	loadgenTarget        string
+	loadgenDuration      time.Duration
+	loadgenWorkload      loadgen.Workload
 }
 
 const (
@@ -70,9 +120,37 @@ const (
 	promLivenessCheck = time.Second
 	maxBgWriter       = 10
 	maxBgParser       = 20
+	retryAfter        = 5 * time.Second
+)
+
+// What --loadgen drives its load through.
+const (
+	loadgenTargetWrite  = "write"
+	loadgenTargetParser = "parser"
+)
+
+// What happens to a remote write series with a label name given more than
+// once: keep the last or first value, or reject the series.
+const (
+	duplicateLabelsLast   = "last"
+	duplicateLabelsFirst  = "first"
+	duplicateLabelsReject = "reject"
 )
 
+// version and commit are set at build time, see the makefile.
 var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+var (
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "adapter_build_info",
+			Help: "Version of the adapter and the Go release it was built with, always 1.",
+		},
+		[]string{"version", "commit", "go_version"},
+	)
 	receivedSamples = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "received_samples_total",
@@ -101,6 +179,19 @@ var (
 		},
 		[]string{"remote"},
 	)
+	duplicateLabelSeries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_duplicate_label_series_total",
+			Help: "Total number of remote write series with a label name given more than once, by action: last, first or reject.",
+		},
+		[]string{"action"},
+	)
+	influxDroppedFields = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "influx_dropped_fields_total",
+			Help: "Total number of non-numeric Influx line protocol fields which were dropped.",
+		},
+	)
 	httpRequestDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "http_request_duration_ms",
@@ -114,19 +205,33 @@ var (
 var worker [maxBgWriter]postgresql.PGWriter
 
 func init() {
+	prometheus.MustRegister(buildInfo)
+	buildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
 	prometheus.MustRegister(receivedSamples)
 	prometheus.MustRegister(sentSamples)
 	prometheus.MustRegister(failedSamples)
 	prometheus.MustRegister(sentBatchDuration)
+	prometheus.MustRegister(duplicateLabelSeries)
+	prometheus.MustRegister(influxDroppedFields)
 	prometheus.MustRegister(httpRequestDuration)
 }
 
 func main() {
 	cfg := parseFlags()
 	logger := promlog.New(&cfg.promlogConfig)
-	level.Info(logger).Log("config", fmt.Sprintf("%+v", cfg))
+	level.Info(logger).Log("config", redactedConfig(cfg))
 	level.Info(logger).Log("pgPrometheusConfig", fmt.Sprintf("%+v", cfg.pgPrometheusConfig))
 
+	if cfg.pgPrometheusConfig.PGWriters == 0 || cfg.pgPrometheusConfig.PGParsers == 0 {
+		cpus := postgresql.AvailableCPUs()
+		writers, parsers := postgresql.DefaultWorkers(cpus)
+		if cfg.pgPrometheusConfig.PGWriters == 0 {
+			cfg.pgPrometheusConfig.PGWriters = writers
+		}
+		if cfg.pgPrometheusConfig.PGParsers == 0 {
+			cfg.pgPrometheusConfig.PGParsers = parsers
+		}
+	}
 	if cfg.pgPrometheusConfig.PGWriters < 0 {
 		cfg.pgPrometheusConfig.PGWriters = 1
 	}
@@ -140,9 +245,41 @@ func main() {
 	if cfg.pgPrometheusConfig.PGParsers > maxBgParser {
 		cfg.pgPrometheusConfig.PGParsers = maxBgParser
 	}
+	level.Info(logger).Log("msg", "Workers", "writers", cfg.pgPrometheusConfig.PGWriters, "parsers", cfg.pgPrometheusConfig.PGParsers)
+
+	if cfg.createPartitionsFrom != "" {
+		os.Exit(createPartitions(logger, cfg))
+	}
+	if cfg.migratePartitioned {
+		os.Exit(migratePartitioned(logger, cfg))
+	}
+	if cfg.compactDuplicates {
+		os.Exit(compactDuplicates(logger, cfg))
+	}
+	if cfg.repairLabels {
+		os.Exit(repairLabels(logger, cfg))
+	}
+	if cfg.reconcileFrom != "" {
+		os.Exit(reconcile(logger, cfg))
+	}
+	if cfg.verifySchema {
+		os.Exit(verifySchema(logger, cfg))
+	}
+	if cfg.loadgen {
+		os.Exit(runLoadgen(logger, cfg))
+	}
+	if cfg.schemaDryRun {
+		script, err := postgresql.SchemaSQL(&cfg.pgPrometheusConfig, time.Now())
+		if err != nil {
+			level.Error(logger).Log("msg", "Generating schema SQL failed", "err", err)
+			os.Exit(1)
+		}
+		fmt.Print(script)
+		os.Exit(0)
+	}
 
 	http.Handle(cfg.telemetryPath, promhttp.Handler())
-	writer, reader := buildClients(logger, cfg)
+	writer, reader, admin := buildClients(logger, cfg)
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -162,15 +299,56 @@ func main() {
 			os.Exit(0)
 		}
 	}()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			rules, err := postgresql.ReloadValidationRules(&cfg.pgPrometheusConfig)
+			if err != nil {
+				level.Error(logger).Log("msg", "Reloading validation rules failed, keeping the old ones", "err", err)
+				continue
+			}
+			level.Info(logger).Log("msg", "Reloaded validation rules", "rules", rules)
+		}
+	}()
+	if err := postgresql.StartSecondary(logger, &cfg.pgPrometheusConfig); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: Unable to connect to secondary database", err)
+		os.Exit(1)
+	}
+	go postgresql.RunLeaderElection(logger, &cfg.pgPrometheusConfig)
 	for t := 0; t < cfg.pgPrometheusConfig.PGWriters; t++ {
-		go worker[t].RunPGWriter(logger, t, cfg.pgPrometheusConfig.CommitSecs, cfg.pgPrometheusConfig.CommitRows, cfg.pgPrometheusConfig.PGParsers, cfg.pgPrometheusConfig.PartitionScheme)
+		go worker[t].RunPGWriter(logger, t, &cfg.pgPrometheusConfig)
 		defer worker[t].PGWriterShutdown()
 	}
 
 	level.Info(logger).Log("msg", "Starting HTTP Listerner")
 
-	http.Handle("/write", timeHandler("write", write(logger, writer)))
+	http.Handle("/write", timeHandler("write", write(logger, writer, cfg.backfillHeader, cfg.duplicateLabels)))
 	http.Handle("/read", timeHandler("read", read(logger, reader)))
+	http.Handle("/ready", timeHandler("ready", ready(admin, cfg.readyDegradedCode)))
+	if len(cfg.statusTokens) > 0 || len(cfg.adminTokens) > 0 {
+		http.Handle("/status", timeHandler("status", authorize(logger, cfg, true, status(admin))))
+	}
+	if cfg.enableOTLP {
+		http.Handle("/v1/metrics", timeHandler("otlp", otlpWrite(logger, writer, cfg.otlpConfig, cfg.backfillHeader)))
+	}
+	if cfg.enableInflux {
+		http.Handle("/influx/write", timeHandler("influx", influxWrite(logger, writer, cfg.backfillHeader)))
+	}
+	if cfg.enableQueryAPI {
+		http.Handle("/api/v1/query", timeHandler("query", instantQuery(logger, reader)))
+	}
+	if cfg.enableAdminAPI {
+		level.Warn(logger).Log("msg", "Admin API enabled")
+		http.Handle("/admin/delete_series", timeHandler("delete_series", authorize(logger, cfg, false, deleteSeries(logger, admin))))
+		http.Handle("/admin/commit_thresholds", timeHandler("commit_thresholds", authorize(logger, cfg, false, commitThresholds(logger, admin))))
+		http.Handle("/admin/series_limit", timeHandler("series_limit", authorize(logger, cfg, false, seriesLimit(logger, admin))))
+		http.Handle("/admin/explain", timeHandler("explain", authorize(logger, cfg, false, explainMatchers(logger, admin))))
+		http.Handle("/admin/reconcile", timeHandler("reconcile", authorize(logger, cfg, false, reconcileHandler(logger, admin))))
+		http.Handle("/admin/tombstone_series", timeHandler("tombstone_series", authorize(logger, cfg, false, tombstoneSeries(logger, admin))))
+		http.Handle("/admin/delete_before", timeHandler("delete_before", authorize(logger, cfg, false, deleteBefore(logger, admin))))
+		http.Handle("/admin/metric_catalog", timeHandler("metric_catalog", authorize(logger, cfg, false, metricCatalog(logger, admin))))
+	}
 
 	level.Info(logger).Log("msg", "Starting up...")
 	level.Info(logger).Log("msg", "Listening", "addr", cfg.listenAddr)
@@ -196,13 +374,125 @@ func parseFlags() *config {
 	a.Flag("adapter-send-timeout", "The timeout to use when sending samples to the remote storage.").Default("30s").DurationVar(&cfg.remoteTimeout)
 	a.Flag("web-listen-address", "Address to listen on for web endpoints.").Default(":9201").StringVar(&cfg.listenAddr)
 	a.Flag("web-telemetry-path", "Address to listen on for web endpoints.").Default("/metrics").StringVar(&cfg.telemetryPath)
+	a.Flag("web-enable-admin-api", "Enable the admin endpoints, e.g. series deletion.").Default("false").BoolVar(&cfg.enableAdminAPI)
+	a.Flag("web-admin-token-file", "File with the bearer tokens allowed to call every admin endpoint, one CALLER:TOKEN per line, required by --web-enable-admin-api.").Default("").StringVar(&cfg.adminTokenFile)
+	a.Flag("web-status-token-file", "File with the bearer tokens allowed to read /status only, one CALLER:TOKEN per line.").Default("").StringVar(&cfg.statusTokenFile)
+	a.Flag("web-enable-otlp", "Accept OTLP/HTTP protobuf metrics on /v1/metrics.").Default("false").BoolVar(&cfg.enableOTLP)
+	a.Flag("otlp-resource-prefix", "Prefix of labels made from OTLP resource attributes.").Default("").StringVar(&cfg.otlpConfig.ResourcePrefix)
+	a.Flag("otlp-scope-prefix", "Prefix of labels made from OTLP instrumentation scope attributes.").Default("otel_scope_").StringVar(&cfg.otlpConfig.ScopePrefix)
+	a.Flag("web-enable-influx", "Accept Influx line protocol writes on /influx/write.").Default("false").BoolVar(&cfg.enableInflux)
+	a.Flag("web-enable-query-api", "Answer instant queries of plain vector selectors on /api/v1/query.").Default("false").BoolVar(&cfg.enableQueryAPI)
+	a.Flag("instant-query-lookback", "How far back instant queries look for the latest sample of a series.").Default("5m").DurationVar(&cfg.pgPrometheusConfig.InstantQueryLookback)
 	flag.AddFlags(a, &cfg.promlogConfig)
 
-	a.Flag("pg-partition", "daily or hourly partitions, default: hourly").Default("hourly").StringVar(&cfg.pgPrometheusConfig.PartitionScheme)
+	a.Flag("pg-partition", "daily, hourly or an interval dividing 24h like 6h or 12h, default: hourly").Default(postgresql.PartitionHourly).StringVar(&cfg.pgPrometheusConfig.PartitionScheme)
 	a.Flag("pg-commit-secs", "Write data to database every N seconds").Default("15").IntVar(&cfg.pgPrometheusConfig.CommitSecs)
 	a.Flag("pg-commit-rows", "Write data to database every N Rows").Default("20000").IntVar(&cfg.pgPrometheusConfig.CommitRows)
-	a.Flag("pg-threads", "Writer DB threads to run 1-10").Default("1").IntVar(&cfg.pgPrometheusConfig.PGWriters)
-	a.Flag("parser-threads", "parser threads to run per DB writer 1-10").Default("5").IntVar(&cfg.pgPrometheusConfig.PGParsers)
+	a.Flag("pg-threads", "Writer DB threads to run 1-10, 0 to derive from CPUs").Default("0").IntVar(&cfg.pgPrometheusConfig.PGWriters)
+	a.Flag("parser-threads", "parser threads to run per DB writer 1-20, 0 to derive from CPUs").Default("0").IntVar(&cfg.pgPrometheusConfig.PGParsers)
+	a.Flag("pg-sort-batches", "Sort each COPY batch by time and name, use --no-pg-sort-batches for raw throughput").Default("true").BoolVar(&cfg.pgPrometheusConfig.SortBatches)
+	a.Flag("pg-labels-cache-series", "Series whose encoded labels each parser remembers, 0 to encode the labels of every sample").Default("20000").IntVar(&cfg.pgPrometheusConfig.LabelsCacheSeries)
+	a.Flag("pg-label-value-encoding", "How label values with invalid UTF-8 or NUL bytes are stored: replace them with U+FFFD, base64 encode them under NAME__b64, or drop the label").Default(postgresql.LabelEncodingReplace).EnumVar(&cfg.pgPrometheusConfig.LabelValueEncoding, postgresql.LabelEncodingReplace, postgresql.LabelEncodingBase64, postgresql.LabelEncodingDrop)
+	a.Flag("downsample", "Keep one sample per INTERVAL of series whose metric name matches REGEX, REGEX=INTERVAL (repeatable)").StringsVar(&cfg.pgPrometheusConfig.DownsampleRules)
+	a.Flag("downsample-series", "Series remembered for downsampling, least recently seen ones are forgotten").Default("1000000").IntVar(&cfg.pgPrometheusConfig.DownsampleSeries)
+	a.Flag("suppress-unchanged-max-gap", "Skip samples repeating the last stored value of their series until this much time has passed since it, 0 to store every sample").Default("0s").DurationVar(&cfg.pgPrometheusConfig.SuppressUnchangedMaxGap)
+	a.Flag("suppress-unchanged-series", "Series remembered for --suppress-unchanged-max-gap, least recently seen ones are forgotten").Default("1000000").IntVar(&cfg.pgPrometheusConfig.SuppressUnchangedSeries)
+	a.Flag("validate", "Drop or clamp values of series whose metric name matches REGEX, REGEX=CHECKS with CHECKS a comma separated list of min:VALUE, max:VALUE, monotonic and clamp (repeatable)").StringsVar(&cfg.pgPrometheusConfig.ValidationRules)
+	a.Flag("validate-file", "File with more --validate rules, one per line, read again on SIGHUP").Default("").StringVar(&cfg.pgPrometheusConfig.ValidationRulesFile)
+	a.Flag("validate-series", "Series remembered for monotonic checks, least recently seen ones are forgotten").Default("1000000").IntVar(&cfg.pgPrometheusConfig.ValidationSeries)
+	a.Flag("pg-infinity-mode", "keep sample values of +Inf and -Inf, drop them, or clamp them to --pg-infinity-clamp").Default(postgresql.InfinityKeep).EnumVar(&cfg.pgPrometheusConfig.InfinityMode, postgresql.InfinityKeep, postgresql.InfinityDrop, postgresql.InfinityClamp)
+	a.Flag("pg-infinity-clamp", "Magnitude infinite values are clamped to").Default("1e300").Float64Var(&cfg.pgPrometheusConfig.InfinityClampMax)
+	a.Flag("pg-timestamp-rounding", "Round sample timestamps to this granularity, e.g. 1s or 15s, 0 to keep them (lossy)").Default("0s").DurationVar(&cfg.pgPrometheusConfig.TimestampRounding)
+	a.Flag("pg-copy-concurrency", "Concurrent COPY streams per flush, capped by the connection pool size").Default("1").IntVar(&cfg.pgPrometheusConfig.CopyConcurrency)
+	a.Flag("pg-saturation-ratio", "Warn when a flush takes longer than this fraction of pg-commit-secs").Default("0.8").Float64Var(&cfg.pgPrometheusConfig.SaturationRatio)
+	a.Flag("pg-saturation-intervals", "Report degraded after more than N consecutive saturated flushes").Default("3").IntVar(&cfg.pgPrometheusConfig.SaturationIntervals)
+	a.Flag("ready-soft-watermark", "Queued samples at which /ready reports degraded, 0 to disable").Default("0").IntVar(&cfg.pgPrometheusConfig.ReadySoftWatermark)
+	a.Flag("ready-hard-watermark", "Queued samples at which /ready reports unavailable with 503, 0 to disable").Default("0").IntVar(&cfg.pgPrometheusConfig.ReadyHardWatermark)
+	a.Flag("ready-degraded-status", "HTTP status /ready answers with while degraded").Default("200").IntVar(&cfg.readyDegradedCode)
+	a.Flag("pg-writer-async-commit", "Set synchronous_commit=off on writer connections").Default("false").BoolVar(&cfg.pgPrometheusConfig.WriterAsyncCommit)
+	a.Flag("pg-writer-guc", "Session setting for writer connections, NAME=VALUE (repeatable)").StringMapVar(&cfg.pgPrometheusConfig.WriterSessionGUCs)
+	a.Flag("pg-leader-lock-id", "Advisory lock key used to elect the instance performing DDL and maintenance").Default("7250726571").Int64Var(&cfg.pgPrometheusConfig.LeaderLockID)
+	a.Flag("pg-partition-create-hook", "SQL run on every new partition, {partition} is replaced by its name (repeatable)").StringsVar(&cfg.pgPrometheusConfig.PartitionCreateHookSQL)
+	a.Flag("pg-deferred-indexes", "Create partitions without the name/time index and build it once their range has closed").Default("false").BoolVar(&cfg.pgPrometheusConfig.DeferredIndexes)
+	a.Flag("pg-maintenance-analyze", "ANALYZE partitions once their range has closed").Default("false").BoolVar(&cfg.pgPrometheusConfig.MaintenanceAnalyze)
+	a.Flag("pg-maintenance-cluster", "CLUSTER partitions on the name/time index once their range has closed").Default("false").BoolVar(&cfg.pgPrometheusConfig.MaintenanceCluster)
+	a.Flag("pg-maintenance-brin-summarize", "Summarize the BRIN index of partitions once their range has closed").Default("false").BoolVar(&cfg.pgPrometheusConfig.MaintenanceSummarize)
+	a.Flag("pg-maintenance-grace", "Time after a partition's range closed to wait for late samples before maintenance").Default("1h").DurationVar(&cfg.pgPrometheusConfig.MaintenanceGrace)
+	a.Flag("admin-delete-safety-margin", "How long before now the cutoff of /admin/delete_before has to be at least").Default("24h").DurationVar(&cfg.pgPrometheusConfig.DeleteSafetyMargin)
+	a.Flag("pg-require-tls", "Refuse to start unless every connection uses TLS of at least --pg-min-sslmode, and log the TLS state of each pool's first connection").Default("false").BoolVar(&cfg.pgPrometheusConfig.RequireTLS)
+	a.Flag("pg-min-sslmode", "Weakest sslmode allowed with --pg-require-tls, verify-ca or verify-full").Default(postgresql.SSLModeVerifyFull).EnumVar(&cfg.pgPrometheusConfig.MinSSLMode, postgresql.SSLModeVerifyCA, postgresql.SSLModeVerifyFull)
+	a.Flag("pg-cardinality-interval", "How often to sample series cardinality, 0 to disable").Default("1h").DurationVar(&cfg.pgPrometheusConfig.CardinalityInterval)
+	a.Flag("pg-cardinality-top", "Number of metric names reported by the cardinality sampler").Default("50").IntVar(&cfg.pgPrometheusConfig.CardinalityTopN)
+	a.Flag("pg-cardinality-warn", "Warn when a metric name has more series than this, 0 to disable").Default("0").Int64Var(&cfg.pgPrometheusConfig.CardinalityWarn)
+	a.Flag("pg-partition-size-interval", "How often to collect partition sizes, 0 to disable").Default("5m").DurationVar(&cfg.pgPrometheusConfig.PartitionSizeInterval)
+	a.Flag("pg-partition-size-recent", "Number of newest partitions exported as size metrics").Default("48").IntVar(&cfg.pgPrometheusConfig.PartitionSizeRecent)
+	a.Flag("pg-ingest-stats-interval", "How often to add the samples stored per metric name to the ingest_stats table, 0 to disable").Default("0s").DurationVar(&cfg.pgPrometheusConfig.IngestStatsInterval)
+	a.Flag("pg-ingest-stats-top", "Number of metric names recorded in ingest_stats per interval, the others are summed up as __other__").Default("1000").IntVar(&cfg.pgPrometheusConfig.IngestStatsTopN)
+	a.Flag("pg-checkpoint-interval", "How often to add the rows committed per hour of sample time to the ingest_checkpoints table for --reconcile-from, 0 to disable").Default("0s").DurationVar(&cfg.pgPrometheusConfig.CheckpointInterval)
+	a.Flag("pg-metrics-catalog", "Keep the first and last sample time and the label keys of every metric name in the metrics_catalog table, updated with every flush").Default("false").BoolVar(&cfg.pgPrometheusConfig.MetricsCatalog)
+	a.Flag("secondary-table", "Table on the SECONDARY_DATABASE_URL target batches are also copied to").Default("metrics").StringVar(&cfg.pgPrometheusConfig.SecondaryTable)
+	a.Flag("secondary-queue-batches", "Batches allowed to wait for the secondary before they are dropped").Default("100").IntVar(&cfg.pgPrometheusConfig.SecondaryQueueBatches)
+	a.Flag("secondary-retries", "Retries of a batch failing on the secondary before it is dropped").Default("5").IntVar(&cfg.pgPrometheusConfig.SecondaryRetries)
+	a.Flag("pg-eager-read-pool", "Connect the read pool at startup instead of on the first read").Default("false").BoolVar(&cfg.pgPrometheusConfig.EagerReadPool)
+	a.Flag("pg-max-read-lookback", "How far back reads may go, 0 for no limit").Default("0s").DurationVar(&cfg.pgPrometheusConfig.MaxReadLookback)
+	a.Flag("pg-read-lookback-mode", "clamp the start of reads going further back than --pg-max-read-lookback, or reject them with 422").Default(postgresql.LookbackClamp).EnumVar(&cfg.pgPrometheusConfig.ReadLookbackMode, postgresql.LookbackClamp, postgresql.LookbackReject)
+	a.Flag("pg-max-query-rows", "Reject reads with 422 that are estimated to read more rows than this, 0 to disable the estimate").Default("0").Int64Var(&cfg.pgPrometheusConfig.MaxQueryRows)
+	a.Flag("pg-query-scrape-interval", "Interval between the samples of a series assumed by --pg-max-query-rows").Default("15s").DurationVar(&cfg.pgPrometheusConfig.ResolutionScrapeInterval)
+	a.Flag("pg-read-order", "Order of read query rows: time sorts all rows in the database, series sorts by name and time, none sorts each series in the adapter").Default(postgresql.ReadOrderTime).EnumVar(&cfg.pgPrometheusConfig.ReadOrder, postgresql.ReadOrderTime, postgresql.ReadOrderSeries, postgresql.ReadOrderNone)
+	a.Flag("pg-read-empty-cache-ttl", "How long a read that found no series is answered from a cache, for queries with the same matchers and a range in the same TTL buckets, 0 to disable").Default("0s").DurationVar(&cfg.pgPrometheusConfig.EmptyReadCacheTTL)
+	a.Flag("pg-read-empty-cache-recent", "Reads ending less than this ago are never answered from the empty read cache, 0 for one TTL").Default("0s").DurationVar(&cfg.pgPrometheusConfig.EmptyReadCacheRecent)
+	a.Flag("pg-read-report-invalid-labels", "Return read rows whose labels cannot be decoded in a series labeled __parse_error__ instead of skipping them").Default("false").BoolVar(&cfg.pgPrometheusConfig.ReportInvalidLabels)
+	a.Flag("pg-legacy-table", "Table from before a schema migration to also read from, NAME or NAME:FLAVOR, flavor adapter (repeatable)").StringsVar(&cfg.pgPrometheusConfig.LegacyTables)
+	a.Flag("pg-explain-slow-reads", "Log the query plan of reads slower than this, 0 to disable").Default("0s").DurationVar(&cfg.pgPrometheusConfig.ExplainSlowReads)
+	a.Flag("shadow-read-rate", "Fraction of reads also run on the SECONDARY_DATABASE_URL target and compared, 0 to disable").Default("0").Float64Var(&cfg.pgPrometheusConfig.ShadowReadRate)
+	a.Flag("shadow-read-compare-values", "Compare every sample value of shadow reads, not only series and sample counts").Default("false").BoolVar(&cfg.pgPrometheusConfig.ShadowReadValues)
+	a.Flag("shadow-read-tolerance", "Largest difference between sample values considered equal by shadow reads").Default("0").Float64Var(&cfg.pgPrometheusConfig.ShadowReadTolerance)
+	a.Flag("tenant-label", "Label identifying the tenant of a sample, enables per-tenant throttling").Default("").StringVar(&cfg.pgPrometheusConfig.TenantLabel)
+	a.Flag("tenant-rate", "Samples per second allowed per tenant, 0 for unlimited").Default("0").Float64Var(&cfg.pgPrometheusConfig.TenantRate)
+	a.Flag("tenant-rate-override", "Samples per second for a single tenant, TENANT=RATE (repeatable)").StringMapVar(&cfg.tenantRates)
+	a.Flag("tenant-burst", "Samples a tenant may send at once, at least one second of its rate; set it to the largest request in reject mode").Default("0").Float64Var(&cfg.pgPrometheusConfig.TenantBurst)
+	a.Flag("tenant-max", "Tenants throttled and counted on their own, later ones without an override share one bucket, 0 for no limit").Default("1000").IntVar(&cfg.pgPrometheusConfig.MaxTenants)
+	a.Flag("tenant-throttle-mode", "drop samples over a tenant's rate or reject the request with 429").Default(postgresql.ThrottleDrop).EnumVar(&cfg.pgPrometheusConfig.TenantThrottleMode, postgresql.ThrottleDrop, postgresql.ThrottleReject)
+	a.Flag("pg-schema-check", "Check the metrics table against the configuration at startup: warn, fail to exit, or off").Default(postgresql.SchemaCheckWarn).EnumVar(&cfg.pgPrometheusConfig.SchemaCheck, postgresql.SchemaCheckWarn, postgresql.SchemaCheckFail, postgresql.SchemaCheckOff)
+	a.Flag("pg-time-column", "Column of the metrics table holding the timestamps").Default("time").StringVar(&cfg.pgPrometheusConfig.Columns.Time)
+	a.Flag("pg-name-column", "Column of the metrics table holding the metric names").Default("name").StringVar(&cfg.pgPrometheusConfig.Columns.Name)
+	a.Flag("pg-value-column", "Column of the metrics table holding the sample values").Default("value").StringVar(&cfg.pgPrometheusConfig.Columns.Value)
+	a.Flag("pg-labels-column", "Column of the metrics table holding the labels").Default("labels").StringVar(&cfg.pgPrometheusConfig.Columns.Labels)
+	a.Flag("pg-skip-schema-setup", "Run against a schema created beforehand, creating neither tables, indexes nor partitions").Default("false").BoolVar(&cfg.pgPrometheusConfig.SkipSchemaSetup)
+	a.Flag("schema-dry-run", "Print the SQL setting up the schema and today's and tomorrow's partitions, then exit").Default("false").BoolVar(&cfg.schemaDryRun)
+	a.Flag("verify-schema", "Check the metrics table against the configuration, then exit 0 if it matches and 1 if not").Default("false").BoolVar(&cfg.verifySchema)
+	a.Flag("max-active-series", "Series with a sample within --active-series-window allowed before new series are refused, 0 for no limit").Default("0").IntVar(&cfg.pgPrometheusConfig.MaxActiveSeries)
+	a.Flag("active-series-window", "Time after its last sample a series stops counting as active").Default("1h").DurationVar(&cfg.pgPrometheusConfig.ActiveSeriesWindow)
+	a.Flag("series-limit-mode", "drop samples of new series over --max-active-series or reject the request with 429").Default(postgresql.ThrottleDrop).EnumVar(&cfg.pgPrometheusConfig.SeriesLimitMode, postgresql.ThrottleDrop, postgresql.ThrottleReject)
+	a.Flag("create-partitions-from", "Create all partitions from this day (YYYY-MM-DD) through --create-partitions-to, then exit").Default("").StringVar(&cfg.createPartitionsFrom)
+	a.Flag("create-partitions-to", "Last day (YYYY-MM-DD) to create partitions for, defaults to --create-partitions-from").Default("").StringVar(&cfg.createPartitionsTo)
+	a.Flag("migrate-to-partitioned", "Convert an unpartitioned metrics table into a partitioned one, keeping the old one as metrics_old, then exit").Default("false").BoolVar(&cfg.migratePartitioned)
+	a.Flag("migrate-batch", "Time range of the rows copied per statement by --migrate-to-partitioned").Default("1h").DurationVar(&cfg.migrateBatch)
+	a.Flag("compact-duplicates", "Report the duplicate (time, name, labels) rows of every closed partition, or delete them with --compact-apply, then exit").Default("false").BoolVar(&cfg.compactDuplicates)
+	a.Flag("compact-apply", "Delete the duplicates found by --compact-duplicates instead of only counting them").Default("false").BoolVar(&cfg.compactApply)
+	a.Flag("compact-keep", "Which of the duplicate rows --compact-duplicates keeps: first or last inserted").Default(postgresql.CompactKeepFirst).EnumVar(&cfg.compactKeep, postgresql.CompactKeepFirst, postgresql.CompactKeepLast)
+	a.Flag("compact-batch", "Time range of the rows deleted from per statement by --compact-duplicates").Default("1h").DurationVar(&cfg.compactBatch)
+	a.Flag("repair-labels", "Report the rows of every partition whose labels reads cannot decode, or repair them with --repair-labels-apply, then exit").Default("false").BoolVar(&cfg.repairLabels)
+	a.Flag("repair-labels-apply", "Stringify number and boolean label values and move unrepairable rows to adapter_invalid_labels").Default("false").BoolVar(&cfg.repairLabelsApply)
+	a.Flag("reconcile-from", "Compare the rows committed according to ingest_checkpoints with the rows stored, per hour from this time (RFC 3339 or YYYY-MM-DD) through --reconcile-to, print JSON, then exit 1 if they differ").Default("").StringVar(&cfg.reconcileFrom)
+	a.Flag("reconcile-to", "End of the range compared by --reconcile-from, defaults to now").Default("").StringVar(&cfg.reconcileTo)
+	a.Flag("loadgen", "Write a synthetic workload to the database for --loadgen-duration, print a JSON report of the throughput, queue and flush latencies, then exit").Default("false").BoolVar(&cfg.loadgen)
+	a.Flag("loadgen-target", "What --loadgen drives the load through: the whole write path into the database, or only the parsers, discarding the rows").Default(loadgenTargetWrite).EnumVar(&cfg.loadgenTarget, loadgenTargetWrite, loadgenTargetParser)
+	a.Flag("loadgen-duration", "How long --loadgen writes").Default("1m").DurationVar(&cfg.loadgenDuration)
+	a.Flag("loadgen-series", "Series written by --loadgen").Default("10000").IntVar(&cfg.loadgenWorkload.Series)
+	a.Flag("loadgen-metrics", "Metric names the --loadgen series are spread over").Default("100").IntVar(&cfg.loadgenWorkload.Metrics)
+	a.Flag("loadgen-labels", "Labels of every --loadgen series besides its name and id").Default("5").IntVar(&cfg.loadgenWorkload.Labels)
+	a.Flag("loadgen-label-values", "Distinct values of every --loadgen label").Default("10").IntVar(&cfg.loadgenWorkload.LabelValues)
+	a.Flag("loadgen-scrape-interval", "Time between two samples of a --loadgen series").Default("15s").DurationVar(&cfg.loadgenWorkload.ScrapeInterval)
+	a.Flag("loadgen-churn", "Fraction of the --loadgen series replaced by new ones every scrape").Default("0").Float64Var(&cfg.loadgenWorkload.Churn)
+	a.Flag("loadgen-batch", "Samples per write of --loadgen").Default("1000").IntVar(&cfg.loadgenWorkload.BatchSize)
+	a.Flag("max-queue-samples", "Samples allowed to wait for a parser before writes get 429, 0 for unbounded").Default("0").IntVar(&cfg.pgPrometheusConfig.MaxQueueSamples)
+	a.Flag("queue-max-age", "Evict sample batches that waited longer than this while the queue is above --queue-evict-watermark, 0 to disable").Default("0s").DurationVar(&cfg.pgPrometheusConfig.QueueMaxAge)
+	a.Flag("queue-evict-watermark", "Queued samples above which old batches are evicted").Default("1000000").IntVar(&cfg.pgPrometheusConfig.QueueEvictWatermark)
+	a.Flag("queue-shards", "Independent sub-queues samples wait in for a parser, 0 for one per GOMAXPROCS").Default("0").IntVar(&cfg.pgPrometheusConfig.QueueShards)
+	a.Flag("backfill-header", "Request header marking writes as backfill when true, empty to treat all writes as live").Default("X-Adapter-Backfill").StringVar(&cfg.backfillHeader)
+	a.Flag("backfill-watermark", "Queued live samples below which parsers take backfill samples, 0 only when none are queued").Default("10000").IntVar(&cfg.pgPrometheusConfig.BackfillWatermark)
+	a.Flag("duplicate-labels", "What happens to a remote write series with a label name given more than once: keep the last value, the first one, or reject the series").Default(duplicateLabelsLast).EnumVar(&cfg.duplicateLabels, duplicateLabelsLast, duplicateLabelsFirst, duplicateLabelsReject)
 
 	_, err := a.Parse(os.Args[1:])
 	if err != nil {
@@ -211,27 +501,234 @@ func parseFlags() *config {
 		os.Exit(2)
 	}
 
+	if err := cfg.pgPrometheusConfig.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(2)
+	}
+
+	for _, f := range []struct {
+		path   string
+		tokens *apiTokens
+	}{{cfg.adminTokenFile, &cfg.adminTokens}, {cfg.statusTokenFile, &cfg.statusTokens}} {
+		if f.path == "" {
+			continue
+		}
+		tokens, err := readAPITokens(f.path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading token file %s: %v\n", f.path, err)
+			os.Exit(2)
+		}
+		*f.tokens = tokens
+	}
+	if cfg.readyDegradedCode < 200 || cfg.readyDegradedCode > 599 {
+		fmt.Fprintf(os.Stderr, "Error: --ready-degraded-status %d is not an HTTP status\n", cfg.readyDegradedCode)
+		os.Exit(2)
+	}
+	if cfg.enableAdminAPI && len(cfg.adminTokens) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: --web-enable-admin-api needs a token in --web-admin-token-file")
+		os.Exit(2)
+	}
+
+	cfg.pgPrometheusConfig.TenantRates = make(map[string]float64, len(cfg.tenantRates))
+	for tenant, rate := range cfg.tenantRates {
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing rate for tenant %s: %v\n", tenant, err)
+			os.Exit(2)
+		}
+		cfg.pgPrometheusConfig.TenantRates[tenant] = r
+	}
+
 	return cfg
 }
 
+// createPartitions runs the --create-partitions-from maintenance command and
+// returns the exit code.
+func createPartitions(logger log.Logger, cfg *config) int {
+	if cfg.createPartitionsTo == "" {
+		cfg.createPartitionsTo = cfg.createPartitionsFrom
+	}
+	from, err := time.Parse("2006-01-02", cfg.createPartitionsFrom)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid --create-partitions-from", "err", err)
+		return 2
+	}
+	to, err := time.Parse("2006-01-02", cfg.createPartitionsTo)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid --create-partitions-to", "err", err)
+		return 2
+	}
+
+	if err := postgresql.CreatePartitions(context.Background(), log.With(logger, "storage", "PostgreSQL"), &cfg.pgPrometheusConfig, from, to); err != nil {
+		level.Error(logger).Log("msg", "Creating partitions failed", "err", err)
+		return 1
+	}
+	return 0
+}
+
 type writer interface {
-	Write(samples model.Samples) error
+	WriteWithOptions(samples model.Samples, opts postgresql.WriteOptions) error
 	Name() string
 }
 
 type reader interface {
 	Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error)
+	QueryInstant(ctx context.Context, matchers []*prompb.LabelMatcher, at time.Time) ([]postgresql.InstantSample, error)
 	Name() string
 	HealthCheck() error
 }
 
-func buildClients(logger log.Logger, cfg *config) (writer, reader) {
+type admin interface {
+	Status() postgresql.Status
+	Readiness() postgresql.Readiness
+	DeleteSeries(ctx context.Context, matchers []*prompb.LabelMatcher, start time.Time, end time.Time, force bool) (int64, error)
+	TombstoneSeries(ctx context.Context, matchers []*prompb.LabelMatcher, start time.Time, end time.Time, force bool) (int64, error)
+	DeleteBefore(ctx context.Context, cutoff time.Time, batchSize int) (*postgresql.DeleteBeforeResult, error)
+	SetCommitThresholds(t postgresql.CommitThresholds) (postgresql.CommitThresholds, error)
+	SeriesLimit() (int, time.Duration)
+	SetSeriesLimit(maxSeries int, window time.Duration) error
+	ExplainMatchers(ctx context.Context, matchers []*prompb.LabelMatcher, start time.Time, end time.Time, plan bool) (*postgresql.MatchersExplanation, error)
+	Reconcile(ctx context.Context, from time.Time, to time.Time) (*postgresql.Reconciliation, error)
+	MetricCatalog(ctx context.Context) ([]postgresql.CatalogMetric, error)
+}
+
+// compactDuplicates runs the --compact-duplicates maintenance command and
+// returns the exit code.
+func compactDuplicates(logger log.Logger, cfg *config) int {
+	opts := postgresql.CompactOptions{Keep: cfg.compactKeep, Batch: cfg.compactBatch, DryRun: !cfg.compactApply}
+	if err := postgresql.CompactDuplicates(context.Background(), log.With(logger, "storage", "PostgreSQL"), &cfg.pgPrometheusConfig, opts); err != nil {
+		level.Error(logger).Log("msg", "Compacting duplicates failed", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// repairLabels runs the --repair-labels maintenance command and returns the
+// exit code.
+func repairLabels(logger log.Logger, cfg *config) int {
+	if err := postgresql.RepairLabels(context.Background(), log.With(logger, "storage", "PostgreSQL"), &cfg.pgPrometheusConfig, !cfg.repairLabelsApply); err != nil {
+		level.Error(logger).Log("msg", "Repairing labels failed", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// parseTime parses a time given as RFC 3339 or as a day, YYYY-MM-DD in UTC.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// reconcile runs the --reconcile-from command, printing the reconciliation
+// as JSON, and returns the exit code: 1 if any window differs.
+func reconcile(logger log.Logger, cfg *config) int {
+	from, err := parseTime(cfg.reconcileFrom)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid --reconcile-from", "err", err)
+		return 2
+	}
+	to := time.Now()
+	if cfg.reconcileTo != "" {
+		if to, err = parseTime(cfg.reconcileTo); err != nil {
+			level.Error(logger).Log("msg", "Invalid --reconcile-to", "err", err)
+			return 2
+		}
+	}
+
+	client := postgresql.NewPoolClient(log.With(logger, "storage", "PostgreSQL"), &cfg.pgPrometheusConfig)
+	reconciliation, err := client.Reconcile(context.Background(), from, to)
+	if err != nil {
+		level.Error(logger).Log("msg", "Reconciliation failed", "err", err)
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(reconciliation); err != nil {
+		level.Error(logger).Log("msg", "Writing reconciliation failed", "err", err)
+		return 1
+	}
+	if reconciliation.Discrepancies > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runLoadgen runs the --loadgen command and returns the exit code. Only
+// for the write target are the writers started, as the adapter does.
+func runLoadgen(logger log.Logger, cfg *config) int {
+	var target loadgen.Target
+	flushes := &loadgen.FlushRecorder{}
+	if cfg.loadgenTarget == loadgenTargetParser {
+		target = postgresql.NewParserTarget(&cfg.pgPrometheusConfig)
+	} else {
+		cfg.pgPrometheusConfig.StatsListener = flushes
+		target = postgresql.NewClient(log.With(logger, "storage", "PostgreSQL"), &cfg.pgPrometheusConfig)
+		for t := 0; t < cfg.pgPrometheusConfig.PGWriters; t++ {
+			go worker[t].RunPGWriter(logger, t, &cfg.pgPrometheusConfig)
+			defer worker[t].PGWriterShutdown()
+		}
+	}
+	generator, err := loadgen.New(cfg.loadgenWorkload, target, flushes)
+	if err != nil {
+		level.Error(logger).Log("msg", "Invalid load generator workload", "err", err)
+		return 2
+	}
+	level.Info(logger).Log("msg", "Generating load", "target", cfg.loadgenTarget, "duration", cfg.loadgenDuration, "series", cfg.loadgenWorkload.Series)
+	report, err := generator.Run(context.Background(), cfg.loadgenDuration, time.Second, time.Minute)
+	if err != nil {
+		level.Error(logger).Log("msg", "Generating load failed", "err", err)
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		level.Error(logger).Log("msg", "Writing load report failed", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// migratePartitioned runs the --migrate-to-partitioned command and returns
+// the exit code.
+func migratePartitioned(logger log.Logger, cfg *config) int {
+	if err := postgresql.MigrateToPartitioned(context.Background(), log.With(logger, "storage", "PostgreSQL"), &cfg.pgPrometheusConfig, cfg.migrateBatch); err != nil {
+		level.Error(logger).Log("msg", "Migrating to a partitioned table failed", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// verifySchema runs the --verify-schema command and returns the exit code.
+func verifySchema(logger log.Logger, cfg *config) int {
+	client := postgresql.NewPoolClient(log.With(logger, "storage", "PostgreSQL"), &cfg.pgPrometheusConfig)
+	err := client.VerifySchema(context.Background())
+	var schemaErr *postgresql.SchemaError
+	switch {
+	case errors.As(err, &schemaErr):
+		for _, problem := range schemaErr.Problems {
+			level.Error(logger).Log("msg", "Schema mismatch", "problem", problem)
+		}
+		return 1
+	case err != nil:
+		level.Error(logger).Log("msg", "Verifying schema failed", "err", err)
+		return 1
+	}
+	level.Info(logger).Log("msg", "Schema matches the configuration")
+	return 0
+}
+
+// buildClients creates the client behind the endpoints. Unlike the one-off
+// commands it uses NewClient, for the samplers and collectors the status
+// endpoints report.
+func buildClients(logger log.Logger, cfg *config) (writer, reader, admin) {
 	pgClient := postgresql.NewClient(log.With(logger, "storage", "PostgreSQL"), &cfg.pgPrometheusConfig)
 
-	return pgClient, pgClient
+	return pgClient, pgClient, pgClient
 }
 
-func write(logger log.Logger, writer writer) http.Handler {
+func write(logger log.Logger, writer writer, backfillHeader string, duplicateLabels string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		compressed, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -254,14 +751,151 @@ func write(logger log.Logger, writer writer) http.Handler {
 			return
 		}
 
-		samples := protoToSamples(&req)
+		opts := writeOptions(r, backfillHeader)
+		opts.Rejected = &postgresql.RejectionSummary{}
+		samples := protoToSamples(&req, duplicateLabels, opts.Rejected)
 		receivedSamples.Add(float64(len(samples)))
 
-		err = sendSamples(writer, samples)
+		err = sendSamples(writer, samples, opts)
 		if err != nil {
 			level.Warn(logger).Log("msg", "Error sending samples to remote storage", "err", err, "storage", writer.Name(), "num_samples", len(samples))
+			http.Error(w, err.Error(), writeErrorStatus(w, err))
+			return
+		}
+
+	})
+}
+
+// writeErrorStatus maps an error from the writer to an HTTP status code.
+// Prometheus retries 429 and 5xx responses, so only transient conditions get
+// a Retry-After hint.
+func writeErrorStatus(w http.ResponseWriter, err error) int {
+	switch {
+	case errors.Is(err, postgresql.ErrQueueFull), errors.Is(err, postgresql.ErrThrottled):
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		return http.StatusTooManyRequests
+	case errors.Is(err, postgresql.ErrShuttingDown):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// readErrorStatus maps an error from the reader to an HTTP status code by its
+// kind, so that clients can tell a bad query from a failing server.
+func readErrorStatus(err error) int {
+	var re *postgresql.ReadError
+	if !errors.As(err, &re) {
+		return http.StatusInternalServerError
+	}
+	switch re.Kind {
+	case postgresql.ReadInvalidQuery:
+		return http.StatusBadRequest
+	case postgresql.ReadLimitExceeded:
+		return http.StatusUnprocessableEntity
+	case postgresql.ReadTimeout, postgresql.ReadUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// otlpWrite accepts OTLP/HTTP protobuf export requests and feeds the
+// translated samples through the same writer as remote write.
+func otlpWrite(logger log.Logger, writer writer, otlpConfig otlp.Config, backfillHeader string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+			http.Error(w, "unsupported content type "+ct+", only application/x-protobuf is accepted", http.StatusUnsupportedMediaType)
+			return
+		}
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			level.Error(logger).Log("msg", "Read error", "err", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := otlp.Translate(buf, otlpConfig)
+		if err != nil {
+			level.Error(logger).Log("msg", "OTLP decode error", "err", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if result.Rejected > 0 {
+			level.Debug(logger).Log("msg", "Rejected OTLP data points", "count", result.Rejected, "reason", result.Message)
+		}
+		receivedSamples.Add(float64(len(result.Samples)))
+
+		if len(result.Samples) > 0 {
+			if err := sendSamples(writer, result.Samples, writeOptions(r, backfillHeader)); err != nil {
+				level.Warn(logger).Log("msg", "Error sending samples to remote storage", "err", err, "storage", writer.Name(), "num_samples", len(result.Samples))
+				http.Error(w, err.Error(), writeErrorStatus(w, err))
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(otlp.Response(result))
+	})
+}
+
+// influxWrite accepts Influx line protocol writes, as sent by Telegraf's
+// influxdb output, and feeds the parsed samples through the same writer as
+// remote write.
+func influxWrite(logger log.Logger, writer writer, backfillHeader string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		buf, err := ioutil.ReadAll(body)
+		if err != nil {
+			level.Error(logger).Log("msg", "Read error", "err", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result, err := influx.Parse(buf, r.URL.Query().Get("precision"), time.Now())
+		if err != nil {
+			level.Error(logger).Log("msg", "Line protocol parse error", "err", err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		influxDroppedFields.Add(float64(result.Dropped))
+		receivedSamples.Add(float64(len(result.Samples)))
 
+		if len(result.Samples) > 0 {
+			if err := sendSamples(writer, result.Samples, writeOptions(r, backfillHeader)); err != nil {
+				level.Warn(logger).Log("msg", "Error sending samples to remote storage", "err", err, "storage", writer.Name(), "num_samples", len(result.Samples))
+				http.Error(w, err.Error(), writeErrorStatus(w, err))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
 	})
 }
 
@@ -293,7 +927,7 @@ func read(logger log.Logger, reader reader) http.Handler {
 		if err != nil {
 			fmt.Printf("MAIN req.Queries: %v\n", req.Queries)
 			level.Warn(logger).Log("msg", "Error executing query", "query", req, "storage", reader.Name(), "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), readErrorStatus(err))
 			return
 		}
 
@@ -314,6 +948,585 @@ func read(logger log.Logger, reader reader) http.Handler {
 	})
 }
 
+// matcherRequest is a label matcher in the body of an admin request.
+type matcherRequest struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// parseMatchers converts the matchers of an admin request, of type =, !=,
+// =~ or !~, with = if none is given.
+func parseMatchers(requested []matcherRequest) ([]*prompb.LabelMatcher, error) {
+	matchers := make([]*prompb.LabelMatcher, 0, len(requested))
+	for _, m := range requested {
+		var t prompb.LabelMatcher_Type
+		switch m.Type {
+		case "=", "":
+			t = prompb.LabelMatcher_EQ
+		case "!=":
+			t = prompb.LabelMatcher_NEQ
+		case "=~":
+			t = prompb.LabelMatcher_RE
+		case "!~":
+			t = prompb.LabelMatcher_NRE
+		default:
+			return nil, fmt.Errorf("unknown matcher type %q", m.Type)
+		}
+		matchers = append(matchers, &prompb.LabelMatcher{Type: t, Name: m.Name, Value: m.Value})
+	}
+	if len(matchers) == 0 {
+		return nil, errors.New("no matchers given")
+	}
+	return matchers, nil
+}
+
+type deleteSeriesRequest struct {
+	Matchers []matcherRequest `json:"matchers"`
+	// Start and End are milliseconds since epoch.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Force bool  `json:"force"`
+}
+
+func deleteSeries(logger log.Logger, admin admin) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req deleteSeriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		matchers, err := parseMatchers(req.Matchers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end := req.End
+		if end == 0 {
+			end = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+
+		deleted, err := admin.DeleteSeries(r.Context(), matchers, time.Unix(0, req.Start*int64(time.Millisecond)), time.Unix(0, end*int64(time.Millisecond)), req.Force)
+		if errors.Is(err, postgresql.ErrUnsafeDelete) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Delete series failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"deleted": deleted})
+	})
+}
+
+// tombstoneSeries takes the same request as deleteSeries, but only records
+// the tombstone and returns its id.
+func tombstoneSeries(logger log.Logger, admin admin) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req deleteSeriesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		matchers, err := parseMatchers(req.Matchers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end := req.End
+		if end == 0 {
+			end = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+
+		id, err := admin.TombstoneSeries(r.Context(), matchers, time.Unix(0, req.Start*int64(time.Millisecond)), time.Unix(0, end*int64(time.Millisecond)), req.Force)
+		if errors.Is(err, postgresql.ErrUnsafeDelete) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Tombstone series failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"id": id})
+	})
+}
+
+type deleteBeforeRequest struct {
+	// Cutoff is milliseconds since epoch.
+	Cutoff    int64 `json:"cutoff"`
+	BatchSize int   `json:"batch_size"`
+}
+
+// deleteBefore drops and deletes everything before a cutoff, for reclaiming
+// space in an emergency.
+func deleteBefore(logger log.Logger, admin admin) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req := deleteBeforeRequest{BatchSize: 10000}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Cutoff == 0 || req.BatchSize <= 0 {
+			http.Error(w, "cutoff and a positive batch_size are required", http.StatusBadRequest)
+			return
+		}
+
+		result, err := admin.DeleteBefore(r.Context(), time.Unix(0, req.Cutoff*int64(time.Millisecond)), req.BatchSize)
+		if errors.Is(err, postgresql.ErrUnsafeCutoff) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Delete before cutoff failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+type explainRequest struct {
+	Matchers []matcherRequest `json:"matchers"`
+	// Start and End are milliseconds since epoch.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Plan  bool  `json:"plan"`
+}
+
+// explainMatchers returns the SQL a read for the given matchers and time
+// range runs, without reading any data.
+func explainMatchers(logger log.Logger, admin admin) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req explainRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		matchers, err := parseMatchers(req.Matchers)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end := req.End
+		if end == 0 {
+			end = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+
+		explanation, err := admin.ExplainMatchers(r.Context(), matchers, time.Unix(0, req.Start*int64(time.Millisecond)), time.Unix(0, end*int64(time.Millisecond)), req.Plan)
+		if err != nil {
+			level.Error(logger).Log("msg", "Explaining matchers failed", "err", err)
+			http.Error(w, err.Error(), readErrorStatus(err))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(explanation)
+	})
+}
+
+// metricCatalog serves the metrics_catalog table.
+func metricCatalog(logger log.Logger, admin admin) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		catalog, err := admin.MetricCatalog(r.Context())
+		if err != nil {
+			level.Error(logger).Log("msg", "Reading the metrics catalog failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(catalog)
+	})
+}
+
+// reconcileHandler compares the committed and stored rows between the from
+// and to query parameters, RFC 3339 or YYYY-MM-DD, to defaulting to now.
+func reconcileHandler(logger log.Logger, admin admin) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		from, err := parseTime(r.URL.Query().Get("from"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+		to := time.Now()
+		if s := r.URL.Query().Get("to"); s != "" {
+			if to, err = parseTime(s); err != nil {
+				http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		reconciliation, err := admin.Reconcile(r.Context(), from, to)
+		if err != nil {
+			level.Error(logger).Log("msg", "Reconciliation failed", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reconciliation)
+	})
+}
+
+// commitThresholds changes the writers' commit thresholds until restart.
+// Fields left out or zero are not changed.
+func commitThresholds(logger log.Logger, admin admin) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req postgresql.CommitThresholds
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		previous, err := admin.SetCommitThresholds(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		current := req
+		if current.CommitRows == 0 {
+			current.CommitRows = previous.CommitRows
+		}
+		if current.CommitSecs == 0 {
+			current.CommitSecs = previous.CommitSecs
+		}
+		level.Warn(logger).Log("msg", "Commit thresholds changed", "remote", r.RemoteAddr, "user_agent", r.UserAgent(),
+			"commit_rows", current.CommitRows, "previous_commit_rows", previous.CommitRows,
+			"commit_secs", current.CommitSecs, "previous_commit_secs", previous.CommitSecs)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]postgresql.CommitThresholds{"previous": previous, "current": current})
+	})
+}
+
+// seriesLimit shows the active series limit on GET and changes it until
+// restart on POST. Fields left out are not changed.
+func seriesLimit(logger log.Logger, admin admin) http.Handler {
+	type limit struct {
+		MaxSeries int    `json:"max_series"`
+		Window    string `json:"window"`
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		maxSeries, window := admin.SeriesLimit()
+		previous := limit{MaxSeries: maxSeries, Window: window.String()}
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(previous)
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			MaxSeries *int    `json:"max_series"`
+			Window    *string `json:"window"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.MaxSeries != nil {
+			maxSeries = *req.MaxSeries
+		}
+		if req.Window != nil {
+			d, err := time.ParseDuration(*req.Window)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+		if err := admin.SetSeriesLimit(maxSeries, window); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		current := limit{MaxSeries: maxSeries, Window: window.String()}
+		level.Warn(logger).Log("msg", "Series limit changed", "remote", r.RemoteAddr, "user_agent", r.UserAgent(),
+			"max_series", current.MaxSeries, "previous_max_series", previous.MaxSeries,
+			"window", current.Window, "previous_window", previous.Window)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]limit{"previous": previous, "current": current})
+	})
+}
+
+// apiTokens maps the bearer tokens accepted by the admin endpoints to the
+// caller they identify.
+type apiTokens map[string]string
+
+// readAPITokens reads a token file with one CALLER:TOKEN per line, ignoring
+// empty lines and lines starting with #.
+func readAPITokens(path string) (apiTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tokens := apiTokens{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 || i == len(line)-1 {
+			return nil, fmt.Errorf("line %d is not CALLER:TOKEN", n)
+		}
+		tokens[line[i+1:]] = line[:i]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("no tokens")
+	}
+	return tokens, nil
+}
+
+// callers returns the sorted names of the callers holding a token.
+func (t apiTokens) callers() []string {
+	var callers []string
+	for _, c := range t {
+		callers = append(callers, c)
+	}
+	sort.Strings(callers)
+	return callers
+}
+
+// redactedConfig formats cfg for the startup log. The tokens are left out,
+// only their number and the callers holding them are shown.
+func redactedConfig(cfg *config) string {
+	logged := *cfg
+	logged.adminTokens, logged.statusTokens = nil, nil
+	return fmt.Sprintf("%+v adminTokens:%d%v statusTokens:%d%v", logged,
+		len(cfg.adminTokens), cfg.adminTokens.callers(), len(cfg.statusTokens), cfg.statusTokens.callers())
+}
+
+// caller returns the caller identified by token. Every token is compared in
+// constant time.
+func (t apiTokens) caller(token string) (string, bool) {
+	var caller string
+	var found bool
+	for candidate, c := range t {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			caller, found = c, true
+		}
+	}
+	return caller, found
+}
+
+// authorize requires a bearer token for handler. Status tokens are only
+// accepted for GET and HEAD requests where statusAllowed, i.e. on /status;
+// every other request needs an admin token, and those changing anything are
+// logged with the caller and their parameters before they are served.
+// Requests without a known token get 401, status tokens anywhere else 403.
+func authorize(logger log.Logger, cfg *config, statusAllowed bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var caller string
+		var admin bool
+		if token := r.Header.Get("Authorization"); strings.HasPrefix(token, "Bearer ") {
+			token = strings.TrimPrefix(token, "Bearer ")
+			caller, admin = cfg.adminTokens.caller(token)
+			if !admin {
+				caller, _ = cfg.statusTokens.caller(token)
+			}
+		}
+		if caller == "" {
+			level.Warn(logger).Log("msg", "Unauthenticated admin request", "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "missing or unknown bearer token", http.StatusUnauthorized)
+			return
+		}
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if !admin && !(statusAllowed && read) {
+			level.Warn(logger).Log("msg", "Admin request with a status token refused", "caller", caller, "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+			http.Error(w, "token only allows reading /status", http.StatusForbidden)
+			return
+		}
+		if read {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		level.Warn(logger).Log("msg", "Admin call", "caller", caller, "remote", r.RemoteAddr, "user_agent", r.UserAgent(),
+			"method", r.Method, "path", r.URL.Path, "query", r.URL.RawQuery, "body", string(body))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ready answers load balancer health checks: 200 when ready, degradedCode
+// when degraded and 503 when unavailable, with the readiness as JSON.
+func ready(admin admin, degradedCode int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		readiness := admin.Readiness()
+		code := http.StatusOK
+		switch readiness.State {
+		case postgresql.ReadinessDegraded:
+			code = degradedCode
+		case postgresql.ReadinessUnavailable:
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(readiness)
+	})
+}
+
+func status(admin admin) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(admin.Status()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// queryResponse is the envelope of the Prometheus HTTP API.
+type queryResponse struct {
+	Status    string     `json:"status"`
+	Data      *queryData `json:"data,omitempty"`
+	ErrorType string     `json:"errorType,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType string         `json:"resultType"`
+	Result     []vectorSample `json:"result"`
+}
+
+// vectorSample has its value as [<unix seconds>, "<value>"].
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+// instantQuery answers instant queries of plain vector selectors in the
+// format of Prometheus' /api/v1/query, with the latest sample of every
+// matching series.
+func instantQuery(logger log.Logger, reader reader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fail := func(status int, errorType string, err error) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(queryResponse{Status: "error", ErrorType: errorType, Error: err.Error()})
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		matchers, err := selector.Parse(r.FormValue("query"))
+		if err != nil {
+			fail(http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		at := time.Now()
+		if t := r.FormValue("time"); t != "" {
+			if at, err = parseQueryTime(t); err != nil {
+				fail(http.StatusBadRequest, "bad_data", err)
+				return
+			}
+		}
+
+		samples, err := reader.QueryInstant(r.Context(), matchers, at)
+		if err != nil {
+			level.Warn(logger).Log("msg", "Error executing instant query", "query", r.FormValue("query"), "err", err)
+			status := readErrorStatus(err)
+			errorType := "internal"
+			switch status {
+			case http.StatusBadRequest, http.StatusUnprocessableEntity:
+				errorType = "bad_data"
+			case http.StatusServiceUnavailable:
+				errorType = "unavailable"
+			}
+			fail(status, errorType, err)
+			return
+		}
+
+		result := make([]vectorSample, 0, len(samples))
+		for _, s := range samples {
+			metric := make(map[string]string, len(s.Labels))
+			for _, l := range s.Labels {
+				metric[l.Name] = l.Value
+			}
+			result = append(result, vectorSample{
+				Metric: metric,
+				Value: [2]interface{}{
+					json.Number(strconv.FormatFloat(float64(s.Sample.Timestamp)/1000, 'f', -1, 64)),
+					strconv.FormatFloat(s.Sample.Value, 'f', -1, 64),
+				},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(queryResponse{Status: "success", Data: &queryData{ResultType: "vector", Result: result}})
+	})
+}
+
+// parseQueryTime parses a time given as Unix seconds, with a fraction, or
+// in RFC 3339, as the Prometheus API accepts it.
+func parseQueryTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a time, expected Unix seconds or RFC 3339", s)
+}
+
 func health(reader reader) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		err := reader.HealthCheck()
@@ -325,12 +1538,30 @@ func health(reader reader) http.Handler {
 	})
 }
 
-func protoToSamples(req *prompb.WriteRequest) model.Samples {
+// protoToSamples converts the series of a remote write request to samples.
+// A series with a label name given more than once keeps its last or first
+// value, or is left out with duplicateLabelsReject and added to rejected.
+func protoToSamples(req *prompb.WriteRequest, duplicateLabels string, rejected *postgresql.RejectionSummary) model.Samples {
 	var samples model.Samples
 	for _, ts := range req.Timeseries {
 		metric := make(model.Metric, len(ts.Labels))
+		duplicate := false
 		for _, l := range ts.Labels {
-			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			name := model.LabelName(l.Name)
+			if _, ok := metric[name]; ok {
+				duplicate = true
+				if duplicateLabels == duplicateLabelsFirst {
+					continue
+				}
+			}
+			metric[name] = model.LabelValue(l.Value)
+		}
+		if duplicate {
+			duplicateLabelSeries.WithLabelValues(duplicateLabels).Inc()
+			if duplicateLabels == duplicateLabelsReject {
+				rejected.Add(postgresql.RejectDuplicateLabels, metric, len(ts.Samples))
+				continue
+			}
 		}
 
 		for _, s := range ts.Samples {
@@ -344,10 +1575,20 @@ func protoToSamples(req *prompb.WriteRequest) model.Samples {
 	return samples
 }
 
-func sendSamples(w writer, samples model.Samples) error {
+// writeOptions returns the options of a write request: it is a backfill if
+// its backfillHeader is true.
+func writeOptions(r *http.Request, backfillHeader string) postgresql.WriteOptions {
+	var opts postgresql.WriteOptions
+	if backfillHeader != "" {
+		opts.Backfill, _ = strconv.ParseBool(r.Header.Get(backfillHeader))
+	}
+	return opts
+}
+
+func sendSamples(w writer, samples model.Samples, opts postgresql.WriteOptions) error {
 	begin := time.Now()
 	var err error
-	err = w.Write(samples)
+	err = w.WriteWithOptions(samples, opts)
 	duration := time.Since(begin).Seconds()
 	if err != nil {
 		failedSamples.WithLabelValues(w.Name()).Add(float64(len(samples)))
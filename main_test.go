@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/crunchydata/postgresql-prometheus-adapter/pkg/postgresql"
+
+	"github.com/go-kit/kit/log"
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// fakeWriter fails every write with err.
+type fakeWriter struct {
+	err error
+}
+
+func (f *fakeWriter) WriteWithOptions(samples model.Samples, opts postgresql.WriteOptions) error {
+	return f.err
+}
+
+func (f *fakeWriter) Name() string { return "fake" }
+
+// rejectingWriter rejects every sample as over its tenant's rate, as
+// Client.WriteWithOptions does.
+type rejectingWriter struct{}
+
+func (rejectingWriter) WriteWithOptions(samples model.Samples, opts postgresql.WriteOptions) error {
+	for _, s := range samples {
+		opts.Rejected.Add(postgresql.RejectTenantRate, s.Metric, 1)
+	}
+	return &postgresql.RejectionError{Err: postgresql.ErrThrottled, Summary: opts.Rejected}
+}
+
+func (rejectingWriter) Name() string { return "rejecting" }
+
+func TestWriteErrorStatus(t *testing.T) {
+	retry := strconv.Itoa(int(retryAfter.Seconds()))
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		retryAfter string
+	}{
+		{"queue full", postgresql.ErrQueueFull, http.StatusTooManyRequests, retry},
+		{"throttled", postgresql.ErrThrottled, http.StatusTooManyRequests, retry},
+		{"wrapped throttled", fmt.Errorf("tenant a: %w", postgresql.ErrThrottled), http.StatusTooManyRequests, retry},
+		{"shutting down", postgresql.ErrShuttingDown, http.StatusServiceUnavailable, ""},
+		{"wrapped shutting down", fmt.Errorf("writer 0: %w", postgresql.ErrShuttingDown), http.StatusServiceUnavailable, ""},
+		{"other error", errors.New("connection refused"), http.StatusInternalServerError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if got := writeErrorStatus(rec, tt.err); got != tt.status {
+				t.Errorf("status %d, want %d", got, tt.status)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestWriteHandlerErrorStatus(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "up"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}},
+	}}}
+	buf, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := snappy.Encode(nil, buf)
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, http.StatusOK},
+		{postgresql.ErrQueueFull, http.StatusTooManyRequests},
+		{postgresql.ErrThrottled, http.StatusTooManyRequests},
+		{postgresql.ErrShuttingDown, http.StatusServiceUnavailable},
+		{errors.New("connection refused"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		handler := write(log.NewNopLogger(), &fakeWriter{err: tt.err}, "", "")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(body)))
+		if rec.Code != tt.status {
+			t.Errorf("write failing with %v: status %d, want %d", tt.err, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestReadErrorStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"invalid query", &postgresql.ReadError{Kind: postgresql.ReadInvalidQuery, Err: errors.New("invalid regexp")}, http.StatusBadRequest},
+		{"limit exceeded", &postgresql.ReadError{Kind: postgresql.ReadLimitExceeded, Err: postgresql.ErrTooManyRows}, http.StatusUnprocessableEntity},
+		{"timeout", &postgresql.ReadError{Kind: postgresql.ReadTimeout, Err: errors.New("statement timeout")}, http.StatusServiceUnavailable},
+		{"unavailable", &postgresql.ReadError{Kind: postgresql.ReadUnavailable, Err: errors.New("connection refused")}, http.StatusServiceUnavailable},
+		{"internal", &postgresql.ReadError{Kind: postgresql.ReadInternal, Err: errors.New("scan failed")}, http.StatusInternalServerError},
+		{"wrapped", fmt.Errorf("query 2: %w", &postgresql.ReadError{Kind: postgresql.ReadInvalidQuery, Err: errors.New("bad")}), http.StatusBadRequest},
+		{"not a read error", errors.New("encoding failed"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readErrorStatus(tt.err); got != tt.status {
+				t.Errorf("status %d, want %d", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestProtoToSamplesDuplicateLabels(t *testing.T) {
+	req := &prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "up"},
+				{Name: "job", Value: "first"},
+				{Name: "instance", Value: "a"},
+				{Name: "job", Value: "last"},
+			},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "clean"}},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: 1000}},
+		},
+	}}
+	tests := []struct {
+		mode     string
+		job      model.LabelValue
+		samples  int
+		rejected int
+	}{
+		{duplicateLabelsLast, "last", 3, 0},
+		{duplicateLabelsFirst, "first", 3, 0},
+		{duplicateLabelsReject, "", 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			counted := testutil.ToFloat64(duplicateLabelSeries.WithLabelValues(tt.mode))
+			rejected := &postgresql.RejectionSummary{}
+			samples := protoToSamples(req, tt.mode, rejected)
+			if len(samples) != tt.samples {
+				t.Fatalf("%d samples, want %d", len(samples), tt.samples)
+			}
+			if got := rejected.Samples[postgresql.RejectDuplicateLabels]; got != tt.rejected {
+				t.Errorf("%d samples rejected, want %d", got, tt.rejected)
+			}
+			if d := testutil.ToFloat64(duplicateLabelSeries.WithLabelValues(tt.mode)) - counted; d != 1 {
+				t.Errorf("%v series counted, want 1", d)
+			}
+			for _, s := range samples {
+				if s.Metric["job"] == "clean" {
+					continue
+				}
+				if s.Metric["job"] != tt.job || s.Metric["instance"] != "a" || len(s.Metric) != 3 {
+					t.Errorf("series %s, want job %q", s.Metric, tt.job)
+				}
+			}
+			if samples[len(samples)-1].Metric["job"] != "clean" {
+				t.Errorf("series without duplicates lost: %v", samples)
+			}
+		})
+	}
+}
+
+func TestWriteHandlerRejections(t *testing.T) {
+	var req prompb.WriteRequest
+	for i := 0; i < 1000; i++ {
+		labels := []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "series", Value: strconv.Itoa(i)}}
+		if i%4 == 0 {
+			labels = append(labels, prompb.Label{Name: "series", Value: "again"})
+		}
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1000}, {Value: 2, Timestamp: 2000}},
+		})
+	}
+	buf, err := proto.Marshal(&req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := write(log.NewNopLogger(), rejectingWriter{}, "", duplicateLabelsReject)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/write", bytes.NewReader(snappy.Encode(nil, buf))))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"rejected 2000 samples", "duplicate_labels=500", "tenant_rate=1500", `up{"series": "again"} (duplicate_labels)`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body %q does not contain %q", body, want)
+		}
+	}
+	if len(body) > 2000 {
+		t.Errorf("%d byte body for 1000 series", len(body))
+	}
+}
+
+func TestAuthorizeScopes(t *testing.T) {
+	cfg := &config{
+		adminTokens:  apiTokens{"admin-token": "oncall"},
+		statusTokens: apiTokens{"status-token": "monitoring"},
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name          string
+		statusAllowed bool
+		method        string
+		token         string
+		code          int
+	}{
+		{"status without token", true, http.MethodGet, "", http.StatusUnauthorized},
+		{"status with unknown token", true, http.MethodGet, "other", http.StatusUnauthorized},
+		{"status with status token", true, http.MethodGet, "status-token", http.StatusOK},
+		{"status with admin token", true, http.MethodGet, "admin-token", http.StatusOK},
+		{"status post with status token", true, http.MethodPost, "status-token", http.StatusForbidden},
+		{"admin get with status token", false, http.MethodGet, "status-token", http.StatusForbidden},
+		{"admin head with status token", false, http.MethodHead, "status-token", http.StatusForbidden},
+		{"admin post with status token", false, http.MethodPost, "status-token", http.StatusForbidden},
+		{"admin get with admin token", false, http.MethodGet, "admin-token", http.StatusOK},
+		{"admin post with admin token", false, http.MethodPost, "admin-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/admin/reconcile", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			authorize(log.NewNopLogger(), cfg, tt.statusAllowed, ok).ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Errorf("status %d, want %d", rec.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	cfg := &config{
+		listenAddr:   ":9201",
+		adminTokens:  apiTokens{"3b0d6c1f9e8a4b7d": "oncall", "a41f07c2d95e6b38": "deploy-bot"},
+		statusTokens: apiTokens{"5e2c9d0b7a13f846": "monitoring"},
+	}
+	logged := redactedConfig(cfg)
+	for token := range cfg.adminTokens {
+		if strings.Contains(logged, token) {
+			t.Errorf("admin token %s logged: %s", token, logged)
+		}
+	}
+	for token := range cfg.statusTokens {
+		if strings.Contains(logged, token) {
+			t.Errorf("status token %s logged: %s", token, logged)
+		}
+	}
+	for _, want := range []string{"listenAddr::9201", "adminTokens:2[deploy-bot oncall]", "statusTokens:1[monitoring]"} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("%q does not contain %q", logged, want)
+		}
+	}
+	if len(cfg.adminTokens) != 2 || len(cfg.statusTokens) != 1 {
+		t.Error("redacting changed the config")
+	}
+}
@@ -0,0 +1,218 @@
+// Package influx parses InfluxDB line protocol into Prometheus samples.
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Result is the outcome of parsing one write request. Fields with string or
+// boolean values have no Prometheus representation and are dropped.
+type Result struct {
+	Samples model.Samples
+	Dropped int64
+}
+
+// precisionMillis converts a timestamp in the given precision to
+// milliseconds. An empty precision means nanoseconds, as in InfluxDB.
+func precisionMillis(precision string) (func(int64) int64, error) {
+	switch precision {
+	case "", "n", "ns":
+		return func(ts int64) int64 { return ts / 1e6 }, nil
+	case "u", "us":
+		return func(ts int64) int64 { return ts / 1e3 }, nil
+	case "ms":
+		return func(ts int64) int64 { return ts }, nil
+	case "s":
+		return func(ts int64) int64 { return ts * 1e3 }, nil
+	}
+	return nil, fmt.Errorf("unsupported precision %q, expected ns, us, ms or s", precision)
+}
+
+// Parse parses a line protocol body. Every field of a point becomes a sample
+// named measurement_field with the point's tags as labels; points without a
+// timestamp get now. A malformed line fails the whole request.
+func Parse(body []byte, precision string, now time.Time) (Result, error) {
+	var result Result
+	toMillis, err := precisionMillis(precision)
+	if err != nil {
+		return result, err
+	}
+	for n, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if err := parseLine(string(line), toMillis, now, &result); err != nil {
+			return result, fmt.Errorf("line %d: %w", n+1, err)
+		}
+	}
+	return result, nil
+}
+
+func parseLine(line string, toMillis func(int64) int64, now time.Time, result *Result) error {
+	keyEnd := indexUnescaped(line, 0, ' ', false)
+	if keyEnd < 0 {
+		return fmt.Errorf("missing fields")
+	}
+	fieldsEnd := indexUnescaped(line, keyEnd+1, ' ', true)
+	if fieldsEnd < 0 {
+		fieldsEnd = len(line)
+	}
+
+	timestamp := model.TimeFromUnixNano(now.UnixNano())
+	if rest := strings.TrimSpace(line[fieldsEnd:]); rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q", rest)
+		}
+		timestamp = model.Time(toMillis(ts))
+	}
+
+	key := splitUnescaped(line[:keyEnd], ',', false)
+	measurement := unescape(key[0])
+	if measurement == "" {
+		return fmt.Errorf("missing measurement")
+	}
+	labels := make(model.Metric, len(key))
+	for _, tag := range key[1:] {
+		name, value, err := splitPair(tag)
+		if err != nil {
+			return fmt.Errorf("tag %q: %w", tag, err)
+		}
+		labels[model.LabelName(sanitize(name))] = model.LabelValue(value)
+	}
+
+	for _, field := range splitUnescaped(line[keyEnd+1:fieldsEnd], ',', true) {
+		name, raw, err := splitPair(field)
+		if err != nil {
+			return fmt.Errorf("field %q: %w", field, err)
+		}
+		value, numeric, err := fieldValue(raw)
+		if err != nil {
+			return fmt.Errorf("field %q: %w", name, err)
+		}
+		if !numeric {
+			result.Dropped++
+			continue
+		}
+		metric := make(model.Metric, len(labels)+1)
+		for k, v := range labels {
+			metric[k] = v
+		}
+		metric[model.MetricNameLabel] = model.LabelValue(sanitize(measurement + "_" + name))
+		result.Samples = append(result.Samples, &model.Sample{
+			Metric:    metric,
+			Value:     model.SampleValue(value),
+			Timestamp: timestamp,
+		})
+	}
+	return nil
+}
+
+// fieldValue parses a field value: floats, integers with an i suffix and
+// unsigned integers with a u suffix are numeric; quoted strings and booleans
+// are valid but not numeric.
+func fieldValue(raw string) (float64, bool, error) {
+	if raw == "" {
+		return 0, false, fmt.Errorf("missing value")
+	}
+	if raw[0] == '"' {
+		if len(raw) < 2 || raw[len(raw)-1] != '"' {
+			return 0, false, fmt.Errorf("unterminated string %s", raw)
+		}
+		return 0, false, nil
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE", "f", "F", "false", "False", "FALSE":
+		return 0, false, nil
+	}
+	switch raw[len(raw)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return float64(v), err == nil, err
+	case 'u':
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		return float64(v), err == nil, err
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	return v, err == nil, err
+}
+
+// indexUnescaped returns the index of the first sep at or after start that
+// is not escaped by a backslash, nor, if quoted is set, inside a double
+// quoted field value. It returns -1 if there is none.
+func indexUnescaped(s string, start int, sep byte, quoted bool) int {
+	inQuotes := false
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+		case quoted && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			return i
+		}
+	}
+	return -1
+}
+
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var parts []string
+	for {
+		i := indexUnescaped(s, 0, sep, quoted)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// splitPair splits key=value at the first unescaped equals sign and
+// unescapes the key. The value is unescaped unless it is a quoted string.
+func splitPair(s string) (string, string, error) {
+	i := indexUnescaped(s, 0, '=', false)
+	if i <= 0 {
+		return "", "", fmt.Errorf("expected key=value")
+	}
+	key, value := unescape(s[:i]), s[i+1:]
+	if !strings.HasPrefix(value, `"`) {
+		value = unescape(value)
+	}
+	return key, value, nil
+}
+
+// unescape removes the backslash in front of commas, spaces and equals signs.
+// Other backslashes are kept, as InfluxDB does.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == ',' || s[i+1] == ' ' || s[i+1] == '=') {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// sanitize replaces characters not allowed in Prometheus metric and label
+// names with underscores.
+func sanitize(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,167 @@
+package influx
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+var testNow = time.Unix(1600000000, 0)
+
+// sampleSet indexes samples by series and timestamp.
+func sampleSet(samples model.Samples) map[string]float64 {
+	set := make(map[string]float64, len(samples))
+	for _, s := range samples {
+		set[s.Metric.String()+"@"+s.Timestamp.String()] = float64(s.Value)
+	}
+	return set
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    map[string]float64
+		dropped int64
+	}{
+		{
+			"floats and integers",
+			"cpu,host=a,region=eu usage=0.5,idle=99i 1600000000000000000",
+			map[string]float64{
+				`cpu_usage{host="a", region="eu"}@1600000000`: 0.5,
+				`cpu_idle{host="a", region="eu"}@1600000000`:  99,
+			},
+			0,
+		},
+		{
+			"no tags and no timestamp",
+			"load value=1.25e2",
+			map[string]float64{`load_value@1600000000`: 125},
+			0,
+		},
+		{
+			"escaped measurement, tags and fields",
+			`disk\ io,path=C:\,\ drive,na\=me=x\ y read\ bytes=10u,w\,x=2 1600000000000000000`,
+			map[string]float64{
+				`disk_io_read_bytes{na_me="x y", path="C:, drive"}@1600000000`: 10,
+				`disk_io_w_x{na_me="x y", path="C:, drive"}@1600000000`:        2,
+			},
+			0,
+		},
+		{
+			"quoted strings and booleans are dropped",
+			`svc,host=a msg="hello, world = x",ok=true,n=1i,quote="say \"hi\" now",f=F 1600000000000000000`,
+			map[string]float64{`svc_n{host="a"}@1600000000`: 1},
+			4,
+		},
+		{
+			"integer and unsigned limits",
+			"m i=-9223372036854775808i,u=18446744073709551615u,z=0i 1600000000000000000",
+			map[string]float64{
+				`m_i@1600000000`: -9223372036854775808,
+				`m_u@1600000000`: 18446744073709551615,
+				`m_z@1600000000`: 0,
+			},
+			0,
+		},
+		{
+			"comments and blank lines",
+			"# a comment\n\n  m v=1 1600000000000000000  \n\r\nm v=2 1600000001000000000\n",
+			map[string]float64{
+				`m_v@1600000000`: 1,
+				`m_v@1600000001`: 2,
+			},
+			0,
+		},
+		{
+			"names made valid",
+			"http.requests,service-name=api 2xx=3i 1600000000000000000",
+			map[string]float64{`http_requests_2xx{service_name="api"}@1600000000`: 3},
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Parse([]byte(tt.body), "", testNow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Dropped != tt.dropped {
+				t.Errorf("%d dropped, want %d", result.Dropped, tt.dropped)
+			}
+			got := sampleSet(result.Samples)
+			if len(got) != len(tt.want) || len(result.Samples) != len(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			for key, value := range tt.want {
+				if v, ok := got[key]; !ok || v != value {
+					t.Errorf("sample %s = %v (found %v), want %v", key, v, ok, value)
+				}
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"missing fields", "cpu", "line 1: missing fields"},
+		{"missing measurement", ",host=a v=1", "missing measurement"},
+		{"tag without value", "cpu,host v=1", `tag "host"`},
+		{"field without value", "cpu v=", `field "v": missing value`},
+		{"unterminated string", `m s="abc`, "unterminated string"},
+		{"negative unsigned", "m v=-1u", `field "v"`},
+		{"fractional integer", "m v=1.5i", `field "v"`},
+		{"integer overflow", "m v=9223372036854775808i", `field "v"`},
+		{"not a number", "m v=abc", `field "v"`},
+		{"invalid timestamp", "m v=1 soon", `invalid timestamp "soon"`},
+		{"error on a later line", "m v=1\n# ok\nm v=x", "line 3:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.body), "", testNow)
+			if err == nil {
+				t.Fatalf("parsed %q without an error", tt.body)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %q does not contain %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParsePrecision(t *testing.T) {
+	tests := []struct {
+		precision string
+		timestamp string
+	}{
+		{"", "1600000000123456789"},
+		{"n", "1600000000123456789"},
+		{"ns", "1600000000123456789"},
+		{"u", "1600000000123456"},
+		{"us", "1600000000123456"},
+		{"ms", "1600000000123"},
+		{"s", "1600000000"},
+	}
+	for _, tt := range tests {
+		result, err := Parse([]byte("m v=1 "+tt.timestamp), tt.precision, testNow)
+		if err != nil {
+			t.Fatalf("precision %q: %v", tt.precision, err)
+		}
+		want := model.Time(1600000000123)
+		if tt.precision == "s" {
+			want = model.Time(1600000000000)
+		}
+		if got := result.Samples[0].Timestamp; got != want {
+			t.Errorf("precision %q: timestamp %d, want %d", tt.precision, got, want)
+		}
+	}
+	if _, err := Parse([]byte("m v=1"), "h", testNow); err == nil {
+		t.Error("precision h accepted")
+	}
+}
@@ -0,0 +1,279 @@
+// Package loadgen synthesizes workloads of series and drives them through
+// the write path of the adapter, or only its parsers, to measure it.
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/crunchydata/postgresql-prometheus-adapter/pkg/postgresql"
+	"github.com/prometheus/common/model"
+)
+
+// Target is what the load is driven through: *postgresql.Client for the
+// whole write path, *postgresql.ParserTarget for the parsers alone.
+type Target interface {
+	Write(samples model.Samples) error
+	Stats() postgresql.Stats
+}
+
+// Workload describes the series a load generator writes. Every scrape
+// writes one sample of every series, BatchSize samples per Write.
+type Workload struct {
+	// Series is the number of series, spread over Metrics metric names.
+	Series  int
+	Metrics int
+	// Labels is the number of labels of every series besides the name and
+	// the series id, each taking one of LabelValues values.
+	Labels      int
+	LabelValues int
+	// ScrapeInterval is the time between two samples of a series.
+	ScrapeInterval time.Duration
+	// Churn is the fraction of series replaced by new ones every scrape,
+	// as targets coming and going do.
+	Churn     float64
+	BatchSize int
+}
+
+// DefaultWorkload is a moderate workload of 10k series scraped every 15s.
+var DefaultWorkload = Workload{
+	Series:         10000,
+	Metrics:        100,
+	Labels:         5,
+	LabelValues:    10,
+	ScrapeInterval: 15 * time.Second,
+	BatchSize:      1000,
+}
+
+func (w Workload) validate() error {
+	switch {
+	case w.Series <= 0 || w.Metrics <= 0 || w.BatchSize <= 0:
+		return fmt.Errorf("series %d, metrics %d and batch size %d must be positive", w.Series, w.Metrics, w.BatchSize)
+	case w.Labels < 0 || w.LabelValues <= 0 && w.Labels > 0:
+		return fmt.Errorf("%d labels with %d values each", w.Labels, w.LabelValues)
+	case w.ScrapeInterval <= 0:
+		return fmt.Errorf("scrape interval %s is not positive", w.ScrapeInterval)
+	case w.Churn < 0 || w.Churn > 1:
+		return fmt.Errorf("churn %g is not between 0 and 1", w.Churn)
+	}
+	return nil
+}
+
+// QueuePoint is the state of the write path at one time during a run.
+type QueuePoint struct {
+	Time     time.Time `json:"time"`
+	Queued   int       `json:"queued"`
+	InFlight int64     `json:"in_flight"`
+}
+
+// Latencies sums up flush durations.
+type Latencies struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// Report is the outcome of a run. Sent counts the samples passed to Write,
+// Failed those of batches Write returned an error for, Written those
+// committed during the run and the drain after it.
+type Report struct {
+	Workload Workload      `json:"workload"`
+	Duration time.Duration `json:"duration"`
+	Scrapes  int           `json:"scrapes"`
+	Sent     int64         `json:"sent"`
+	Failed   int64         `json:"failed"`
+	Written  int64         `json:"written"`
+	// SentPerSecond is the load offered, WrittenPerSecond the load
+	// achieved, both over Duration.
+	SentPerSecond    float64      `json:"sent_per_second"`
+	WrittenPerSecond float64      `json:"written_per_second"`
+	Queue            []QueuePoint `json:"queue"`
+	Flushes          Latencies    `json:"flushes"`
+	// Drained is false if samples were still in flight when the drain
+	// timed out.
+	Drained bool `json:"drained"`
+}
+
+// FlushRecorder collects the duration of every flush. Set it as
+// Config.StatsListener before creating the client.
+type FlushRecorder struct {
+	mutex     sync.Mutex
+	durations []time.Duration
+}
+
+// Flushed implements postgresql.StatsListener.
+func (r *FlushRecorder) Flushed(f postgresql.FlushStats) {
+	r.mutex.Lock()
+	r.durations = append(r.durations, f.Duration)
+	r.mutex.Unlock()
+}
+
+func (r *FlushRecorder) latencies() Latencies {
+	r.mutex.Lock()
+	durations := append([]time.Duration(nil), r.durations...)
+	r.mutex.Unlock()
+	if len(durations) == 0 {
+		return Latencies{}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	quantile := func(q float64) time.Duration {
+		return durations[int(q*float64(len(durations)-1))]
+	}
+	return Latencies{Count: len(durations), P50: quantile(0.5), P90: quantile(0.9), P99: quantile(0.99), Max: durations[len(durations)-1]}
+}
+
+// Generator writes a Workload to a Target.
+type Generator struct {
+	workload Workload
+	target   Target
+	flushes  *FlushRecorder
+	random   *rand.Rand
+
+	// generation is bumped for a series every time churn replaces it,
+	// giving it a new label set.
+	generation []int
+	values     []float64
+}
+
+// New returns a generator of w against target. flushes may be
+// nil, the report then has no flush latencies.
+func New(w Workload, target Target, flushes *FlushRecorder) (*Generator, error) {
+	if err := w.validate(); err != nil {
+		return nil, err
+	}
+	return &Generator{
+		workload:   w,
+		target:     target,
+		flushes:    flushes,
+		random:     rand.New(rand.NewSource(1)),
+		generation: make([]int, w.Series),
+		values:     make([]float64, w.Series),
+	}, nil
+}
+
+// metric returns the label set of series i in its current generation.
+func (g *Generator) metric(i int) model.Metric {
+	w := g.workload
+	m := make(model.Metric, w.Labels+2)
+	m[model.MetricNameLabel] = model.LabelValue(fmt.Sprintf("loadgen_metric_%d", i%w.Metrics))
+	m["series"] = model.LabelValue(fmt.Sprintf("%d_%d", i, g.generation[i]))
+	for l := 0; l < w.Labels; l++ {
+		m[model.LabelName(fmt.Sprintf("label_%d", l))] = model.LabelValue(fmt.Sprintf("value_%d", (i/w.Metrics+l)%w.LabelValues))
+	}
+	return m
+}
+
+// scrape writes one sample of every series at ts, after replacing the
+// churned series, and returns the samples sent and failed.
+func (g *Generator) scrape(ts time.Time, churn *float64) (sent, failed int64) {
+	w := g.workload
+	*churn += w.Churn * float64(w.Series)
+	for ; *churn >= 1; *churn-- {
+		i := g.random.Intn(w.Series)
+		g.generation[i]++
+		g.values[i] = 0
+	}
+	batch := make(model.Samples, 0, w.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		sent += int64(len(batch))
+		if err := g.target.Write(batch); err != nil {
+			failed += int64(len(batch))
+		}
+		batch = make(model.Samples, 0, w.BatchSize)
+	}
+	timestamp := model.TimeFromUnixNano(ts.UnixNano())
+	for i := 0; i < w.Series; i++ {
+		g.values[i] += g.random.Float64()
+		batch = append(batch, &model.Sample{Metric: g.metric(i), Value: model.SampleValue(g.values[i]), Timestamp: timestamp})
+		if len(batch) == w.BatchSize {
+			flush()
+		}
+	}
+	flush()
+	return sent, failed
+}
+
+// Run writes the workload for duration, sampling the queue every
+// sampleInterval, then waits up to drain for the samples in flight to reach
+// an outcome and reports. A scrape taking longer than the scrape interval
+// delays the next one, the offered load then falls short of the workload.
+func (g *Generator) Run(ctx context.Context, duration, sampleInterval, drain time.Duration) (*Report, error) {
+	if duration <= 0 || sampleInterval <= 0 {
+		return nil, errors.New("duration and sample interval must be positive")
+	}
+	report := &Report{Workload: g.workload}
+	start := g.target.Stats()
+	begin := time.Now()
+
+	sampler := time.NewTicker(sampleInterval)
+	defer sampler.Stop()
+	done := make(chan struct{})
+	var queue []QueuePoint
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-sampler.C:
+				stats := g.target.Stats()
+				queue = append(queue, QueuePoint{Time: now, Queued: stats.Queued + stats.BackfillQueued, InFlight: stats.InFlight})
+			}
+		}
+	}()
+
+	var churn float64
+	deadline := begin.Add(duration)
+	for next := begin; next.Before(deadline) && ctx.Err() == nil; next = next.Add(g.workload.ScrapeInterval) {
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(wait):
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		sent, failed := g.scrape(time.Now(), &churn)
+		report.Scrapes++
+		report.Sent += sent
+		report.Failed += failed
+	}
+	report.Duration = time.Since(begin)
+
+	for wait := time.Duration(0); ; wait += sampleInterval {
+		if g.target.Stats().InFlight == 0 {
+			report.Drained = true
+			break
+		}
+		if wait >= drain || ctx.Err() != nil {
+			break
+		}
+		time.Sleep(sampleInterval)
+	}
+	close(done)
+	wg.Wait()
+
+	end := g.target.Stats()
+	report.Queue = queue
+	report.Written = end.Written - start.Written
+	seconds := report.Duration.Seconds()
+	report.SentPerSecond = float64(report.Sent) / seconds
+	report.WrittenPerSecond = float64(report.Written) / seconds
+	if g.flushes != nil {
+		report.Flushes = g.flushes.latencies()
+	}
+	return report, nil
+}
@@ -0,0 +1,617 @@
+// Package otlp translates OTLP/HTTP metric export requests into Prometheus
+// samples.
+package otlp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Config controls how OTLP attributes become labels.
+type Config struct {
+	// ResourcePrefix and ScopePrefix are put in front of the names of
+	// resource and instrumentation scope attributes.
+	ResourcePrefix string
+	ScopePrefix    string
+}
+
+// Result is the outcome of translating one export request. Data points that
+// cannot be represented as Prometheus samples are rejected; the rest of the
+// request is still accepted.
+type Result struct {
+	Samples  model.Samples
+	Rejected int64
+	Message  string
+}
+
+// OTLP aggregation temporality, only cumulative sums and histograms can be
+// stored as Prometheus samples.
+const temporalityCumulative = 2
+
+type labelSet map[model.LabelName]model.LabelValue
+
+func (l labelSet) with(other labelSet) labelSet {
+	merged := make(labelSet, len(l)+len(other))
+	for k, v := range l {
+		merged[k] = v
+	}
+	for k, v := range other {
+		merged[k] = v
+	}
+	return merged
+}
+
+// translator collects samples and rejections while a request is decoded.
+type translator struct {
+	cfg    Config
+	result Result
+}
+
+func (t *translator) reject(n int64, format string, args ...interface{}) {
+	t.result.Rejected += n
+	if t.result.Message == "" {
+		t.result.Message = fmt.Sprintf(format, args...)
+	}
+}
+
+func (t *translator) add(name string, labels labelSet, timeNanos uint64, value float64) {
+	metric := make(model.Metric, len(labels)+1)
+	for k, v := range labels {
+		metric[k] = v
+	}
+	metric[model.MetricNameLabel] = model.LabelValue(name)
+	t.result.Samples = append(t.result.Samples, &model.Sample{
+		Metric:    metric,
+		Value:     model.SampleValue(value),
+		Timestamp: model.Time(int64(timeNanos / 1e6)),
+	})
+}
+
+// Translate decodes an uncompressed ExportMetricsServiceRequest. Gauges and
+// sums become one sample per data point, histograms their _bucket, _sum and
+// _count series. An error means the request as a whole could not be decoded.
+func Translate(body []byte, cfg Config) (Result, error) {
+	t := &translator{cfg: cfg}
+	d := decoder{b: body}
+	for {
+		field, wire, done, err := d.next()
+		if err != nil {
+			return Result{}, err
+		}
+		if done {
+			return t.result, nil
+		}
+		if field != 1 || wire != wireBytes {
+			if err := d.skip(wire); err != nil {
+				return Result{}, err
+			}
+			continue
+		}
+		b, err := d.bytes()
+		if err != nil {
+			return Result{}, err
+		}
+		if err := t.resourceMetrics(b); err != nil {
+			return Result{}, err
+		}
+	}
+}
+
+func (t *translator) resourceMetrics(b []byte) error {
+	var resource labelSet
+	var scopes [][]byte
+	d := decoder{b: b}
+	for {
+		field, wire, done, err := d.next()
+		if err != nil || done {
+			if err != nil {
+				return err
+			}
+			break
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			v, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			if resource, err = attributesOf(v, 1, t.cfg.ResourcePrefix); err != nil {
+				return err
+			}
+		case field == 2 && wire == wireBytes:
+			v, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			scopes = append(scopes, v)
+		default:
+			if err := d.skip(wire); err != nil {
+				return err
+			}
+		}
+	}
+	// The resource may follow its scopes on the wire.
+	for _, scope := range scopes {
+		if err := t.scopeMetrics(scope, resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *translator) scopeMetrics(b []byte, resource labelSet) error {
+	labels := resource
+	var metrics [][]byte
+	d := decoder{b: b}
+	for {
+		field, wire, done, err := d.next()
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			v, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			scope, err := attributesOf(v, 3, t.cfg.ScopePrefix)
+			if err != nil {
+				return err
+			}
+			labels = resource.with(scope)
+		case field == 2 && wire == wireBytes:
+			v, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			metrics = append(metrics, v)
+		default:
+			if err := d.skip(wire); err != nil {
+				return err
+			}
+		}
+	}
+	for _, metric := range metrics {
+		if err := t.metric(metric, labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// attributesOf reads the KeyValue attributes in field of a Resource or
+// InstrumentationScope message.
+func attributesOf(b []byte, field int, prefix string) (labelSet, error) {
+	labels := labelSet{}
+	d := decoder{b: b}
+	for {
+		f, wire, done, err := d.next()
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return labels, nil
+		}
+		if f != field || wire != wireBytes {
+			if err := d.skip(wire); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		v, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := addAttribute(labels, v, prefix); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// addAttribute decodes a KeyValue into labels. Arrays and maps are not
+// representable as label values and are skipped.
+func addAttribute(labels labelSet, b []byte, prefix string) error {
+	var key, value string
+	var ok bool
+	d := decoder{b: b}
+	for {
+		field, wire, done, err := d.next()
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			v, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			key = string(v)
+		case field == 2 && wire == wireBytes:
+			v, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			if value, ok, err = anyValue(v); err != nil {
+				return err
+			}
+		default:
+			if err := d.skip(wire); err != nil {
+				return err
+			}
+		}
+	}
+	if ok && key != "" {
+		labels[model.LabelName(sanitize(prefix+key))] = model.LabelValue(value)
+	}
+	return nil
+}
+
+func anyValue(b []byte) (string, bool, error) {
+	d := decoder{b: b}
+	value, ok := "", false
+	for {
+		field, wire, done, err := d.next()
+		if err != nil {
+			return "", false, err
+		}
+		if done {
+			return value, ok, nil
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			v, err := d.bytes()
+			if err != nil {
+				return "", false, err
+			}
+			value, ok = string(v), true
+		case field == 2 && wire == wireVarint:
+			v, err := d.varint()
+			if err != nil {
+				return "", false, err
+			}
+			value, ok = strconv.FormatBool(v != 0), true
+		case field == 3 && wire == wireVarint:
+			v, err := d.varint()
+			if err != nil {
+				return "", false, err
+			}
+			value, ok = strconv.FormatInt(int64(v), 10), true
+		case field == 4 && wire == wireFixed64:
+			v, err := d.double()
+			if err != nil {
+				return "", false, err
+			}
+			value, ok = strconv.FormatFloat(v, 'g', -1, 64), true
+		default:
+			if err := d.skip(wire); err != nil {
+				return "", false, err
+			}
+		}
+	}
+}
+
+// Metric data fields.
+const (
+	fieldGauge                = 5
+	fieldSum                  = 7
+	fieldHistogram            = 9
+	fieldExponentialHistogram = 10
+	fieldSummary              = 11
+)
+
+func (t *translator) metric(b []byte, labels labelSet) error {
+	var name string
+	var kind int
+	var data []byte
+	d := decoder{b: b}
+	for {
+		field, wire, done, err := d.next()
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+		if wire != wireBytes {
+			if err := d.skip(wire); err != nil {
+				return err
+			}
+			continue
+		}
+		v, err := d.bytes()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			name = sanitize(string(v))
+		case fieldGauge, fieldSum, fieldHistogram, fieldExponentialHistogram, fieldSummary:
+			kind, data = field, v
+		}
+	}
+
+	switch kind {
+	case fieldGauge:
+		return t.numberPoints(data, name, labels, false)
+	case fieldSum:
+		return t.numberPoints(data, name, labels, true)
+	case fieldHistogram:
+		return t.histogramPoints(data, name, labels)
+	case 0:
+		return nil
+	default:
+		points, err := countPoints(data)
+		if err != nil {
+			return err
+		}
+		t.reject(points, "metric %s: exponential histograms and summaries are not supported", name)
+		return nil
+	}
+}
+
+// countPoints counts the data points of a metric that is rejected as a whole.
+func countPoints(b []byte) (int64, error) {
+	var n int64
+	d := decoder{b: b}
+	for {
+		field, wire, done, err := d.next()
+		if err != nil || done {
+			return n, err
+		}
+		if field == 1 && wire == wireBytes {
+			n++
+		}
+		if err := d.skip(wire); err != nil {
+			return n, err
+		}
+	}
+}
+
+// numberPoints translates a Gauge or, with sum set, a Sum message. Monotonic
+// sums get the _total suffix; delta sums are rejected.
+func (t *translator) numberPoints(b []byte, name string, labels labelSet, sum bool) error {
+	var points [][]byte
+	temporality, monotonic := uint64(0), false
+	d := decoder{b: b}
+	for {
+		field, wire, done, err := d.next()
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			v, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			points = append(points, v)
+		case sum && field == 2 && wire == wireVarint:
+			if temporality, err = d.varint(); err != nil {
+				return err
+			}
+		case sum && field == 3 && wire == wireVarint:
+			v, err := d.varint()
+			if err != nil {
+				return err
+			}
+			monotonic = v != 0
+		default:
+			if err := d.skip(wire); err != nil {
+				return err
+			}
+		}
+	}
+	if sum && temporality != temporalityCumulative {
+		t.reject(int64(len(points)), "metric %s: only cumulative sums are supported", name)
+		return nil
+	}
+	if monotonic && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+
+	for _, point := range points {
+		attributes := labelSet{}
+		var timeNanos uint64
+		value, hasValue := 0.0, false
+		d := decoder{b: point}
+		for {
+			field, wire, done, err := d.next()
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+			switch {
+			case field == 3 && wire == wireFixed64:
+				if timeNanos, err = d.fixed64(); err != nil {
+					return err
+				}
+			case field == 4 && wire == wireFixed64:
+				if value, err = d.double(); err != nil {
+					return err
+				}
+				hasValue = true
+			case field == 6 && wire == wireFixed64:
+				v, err := d.fixed64()
+				if err != nil {
+					return err
+				}
+				value, hasValue = float64(int64(v)), true
+			case field == 7 && wire == wireBytes:
+				v, err := d.bytes()
+				if err != nil {
+					return err
+				}
+				if err := addAttribute(attributes, v, ""); err != nil {
+					return err
+				}
+			default:
+				if err := d.skip(wire); err != nil {
+					return err
+				}
+			}
+		}
+		if !hasValue {
+			t.reject(1, "metric %s: data point without value", name)
+			continue
+		}
+		t.add(name, labels.with(attributes), timeNanos, value)
+	}
+	return nil
+}
+
+// histogramPoints explodes each histogram data point into cumulative _bucket
+// series, one per explicit bound plus +Inf, and _sum and _count.
+func (t *translator) histogramPoints(b []byte, name string, labels labelSet) error {
+	var points [][]byte
+	temporality := uint64(0)
+	d := decoder{b: b}
+	for {
+		field, wire, done, err := d.next()
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+		switch {
+		case field == 1 && wire == wireBytes:
+			v, err := d.bytes()
+			if err != nil {
+				return err
+			}
+			points = append(points, v)
+		case field == 2 && wire == wireVarint:
+			if temporality, err = d.varint(); err != nil {
+				return err
+			}
+		default:
+			if err := d.skip(wire); err != nil {
+				return err
+			}
+		}
+	}
+	if temporality != temporalityCumulative {
+		t.reject(int64(len(points)), "metric %s: only cumulative histograms are supported", name)
+		return nil
+	}
+
+	for _, point := range points {
+		attributes := labelSet{}
+		var timeNanos, count uint64
+		var buckets, bounds []uint64
+		sum, hasSum := 0.0, false
+		d := decoder{b: point}
+		for {
+			field, wire, done, err := d.next()
+			if err != nil {
+				return err
+			}
+			if done {
+				break
+			}
+			switch {
+			case field == 3 && wire == wireFixed64:
+				if timeNanos, err = d.fixed64(); err != nil {
+					return err
+				}
+			case field == 4 && wire == wireFixed64:
+				if count, err = d.fixed64(); err != nil {
+					return err
+				}
+			case field == 5 && wire == wireFixed64:
+				if sum, err = d.double(); err != nil {
+					return err
+				}
+				hasSum = true
+			case field == 6 && (wire == wireBytes || wire == wireFixed64):
+				v, err := d.packedFixed64(wire)
+				if err != nil {
+					return err
+				}
+				buckets = append(buckets, v...)
+			case field == 7 && (wire == wireBytes || wire == wireFixed64):
+				v, err := d.packedFixed64(wire)
+				if err != nil {
+					return err
+				}
+				bounds = append(bounds, v...)
+			case field == 9 && wire == wireBytes:
+				v, err := d.bytes()
+				if err != nil {
+					return err
+				}
+				if err := addAttribute(attributes, v, ""); err != nil {
+					return err
+				}
+			default:
+				if err := d.skip(wire); err != nil {
+					return err
+				}
+			}
+		}
+		if len(buckets) > 0 && len(buckets) != len(bounds)+1 {
+			t.reject(1, "metric %s: %d bucket counts for %d bounds", name, len(buckets), len(bounds))
+			continue
+		}
+
+		series := labels.with(attributes)
+		var cumulative uint64
+		for i, bound := range bounds {
+			if len(buckets) > 0 {
+				cumulative += buckets[i]
+			}
+			le := strconv.FormatFloat(math.Float64frombits(bound), 'g', -1, 64)
+			bucket := labelSet{model.BucketLabel: model.LabelValue(le)}
+			t.add(name+"_bucket", series.with(bucket), timeNanos, float64(cumulative))
+		}
+		t.add(name+"_bucket", series.with(labelSet{model.BucketLabel: "+Inf"}), timeNanos, float64(count))
+		if hasSum {
+			t.add(name+"_sum", series, timeNanos, sum)
+		}
+		t.add(name+"_count", series, timeNanos, float64(count))
+	}
+	return nil
+}
+
+// sanitize turns an OTLP metric or attribute name into a valid Prometheus
+// name by replacing invalid characters, e.g. dots or a leading digit, with
+// underscores.
+func sanitize(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Response encodes the ExportMetricsServiceResponse for a result, with a
+// partial success when data points were rejected.
+func Response(result Result) []byte {
+	if result.Rejected == 0 {
+		return nil
+	}
+	var partial encoder
+	partial.varint(1, uint64(result.Rejected))
+	partial.bytes(2, []byte(result.Message))
+	var response encoder
+	response.bytes(1, partial.b)
+	return response.b
+}
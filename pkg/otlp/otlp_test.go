@@ -0,0 +1,478 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+// The helpers below encode the OTLP messages the tests send, field by
+// field, so that the decoder is checked against the wire format rather
+// than against itself.
+
+func (e *encoder) fixed64(field int, v uint64) {
+	e.uvarint(uint64(field)<<3 | wireFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	e.b = append(e.b, buf[:]...)
+}
+
+func (e *encoder) double(field int, v float64) {
+	e.fixed64(field, math.Float64bits(v))
+}
+
+func (e *encoder) fixed32(field int, v uint32) {
+	e.uvarint(uint64(field)<<3 | wireFixed32)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	e.b = append(e.b, buf[:]...)
+}
+
+// packed encodes a packed repeated fixed64 or double field.
+func (e *encoder) packed(field int, values []uint64) {
+	var buf []byte
+	for _, v := range values {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], v)
+		buf = append(buf, b[:]...)
+	}
+	e.bytes(field, buf)
+}
+
+func message(build func(e *encoder)) []byte {
+	var e encoder
+	build(&e)
+	return e.b
+}
+
+func stringAttr(key, value string) []byte {
+	return message(func(e *encoder) {
+		e.bytes(1, []byte(key))
+		e.bytes(2, message(func(e *encoder) { e.bytes(1, []byte(value)) }))
+	})
+}
+
+func intAttr(key string, value int64) []byte {
+	return message(func(e *encoder) {
+		e.bytes(1, []byte(key))
+		e.bytes(2, message(func(e *encoder) { e.varint(3, uint64(value)) }))
+	})
+}
+
+func boolAttr(key string, value bool) []byte {
+	return message(func(e *encoder) {
+		e.bytes(1, []byte(key))
+		e.bytes(2, message(func(e *encoder) {
+			v := uint64(0)
+			if value {
+				v = 1
+			}
+			e.varint(2, v)
+		}))
+	})
+}
+
+func doubleAttr(key string, value float64) []byte {
+	return message(func(e *encoder) {
+		e.bytes(1, []byte(key))
+		e.bytes(2, message(func(e *encoder) { e.double(4, value) }))
+	})
+}
+
+// arrayAttr has an ArrayValue, which is not representable as a label.
+func arrayAttr(key string) []byte {
+	return message(func(e *encoder) {
+		e.bytes(1, []byte(key))
+		e.bytes(2, message(func(e *encoder) { e.bytes(5, nil) }))
+	})
+}
+
+// testTime is 2020-09-13T12:26:40.123456789Z in nanoseconds.
+const testTime = 1600000000123456789
+
+func doublePoint(value float64, attrs ...[]byte) []byte {
+	return message(func(e *encoder) {
+		for _, a := range attrs {
+			e.bytes(7, a)
+		}
+		e.fixed64(2, testTime-1e9)
+		e.fixed64(3, testTime)
+		e.double(4, value)
+	})
+}
+
+func intPoint(value int64, attrs ...[]byte) []byte {
+	return message(func(e *encoder) {
+		e.fixed64(3, testTime)
+		e.fixed64(6, uint64(value))
+		for _, a := range attrs {
+			e.bytes(7, a)
+		}
+	})
+}
+
+func gauge(points ...[]byte) []byte {
+	return message(func(e *encoder) {
+		for _, p := range points {
+			e.bytes(1, p)
+		}
+	})
+}
+
+func sum(temporality uint64, monotonic bool, points ...[]byte) []byte {
+	return message(func(e *encoder) {
+		for _, p := range points {
+			e.bytes(1, p)
+		}
+		e.varint(2, temporality)
+		if monotonic {
+			e.varint(3, 1)
+		}
+	})
+}
+
+func metric(name string, kind int, data []byte) []byte {
+	return message(func(e *encoder) {
+		e.bytes(1, []byte(name))
+		e.bytes(2, []byte("a description"))
+		e.bytes(3, []byte("s"))
+		e.bytes(kind, data)
+	})
+}
+
+// request wraps metrics in one ResourceMetrics with one ScopeMetrics.
+func request(resource [][]byte, scope [][]byte, metrics ...[]byte) []byte {
+	return message(func(e *encoder) {
+		e.bytes(1, message(func(e *encoder) {
+			e.bytes(1, message(func(e *encoder) {
+				for _, a := range resource {
+					e.bytes(1, a)
+				}
+			}))
+			e.bytes(2, message(func(e *encoder) {
+				e.bytes(1, message(func(e *encoder) {
+					e.bytes(1, []byte("io.opentelemetry.test"))
+					e.bytes(2, []byte("1.0"))
+					for _, a := range scope {
+						e.bytes(3, a)
+					}
+				}))
+				for _, m := range metrics {
+					e.bytes(2, m)
+				}
+			}))
+		}))
+	})
+}
+
+// sampleSet indexes samples by series and timestamp.
+func sampleSet(samples model.Samples) map[string]float64 {
+	set := make(map[string]float64, len(samples))
+	for _, s := range samples {
+		set[s.Metric.String()+"@"+s.Timestamp.String()] = float64(s.Value)
+	}
+	return set
+}
+
+// testMs is testTime in milliseconds, as the samples are stamped.
+const testMs = "1600000000.123"
+
+func checkSamples(t *testing.T, got model.Samples, want map[string]float64) {
+	t.Helper()
+	set := sampleSet(got)
+	if len(set) != len(got) {
+		t.Errorf("%d samples for %d series and timestamps", len(got), len(set))
+	}
+	for key, value := range want {
+		v, ok := set[key]
+		switch {
+		case !ok:
+			t.Errorf("missing sample %s", key)
+		case v != value && !(math.IsNaN(v) && math.IsNaN(value)):
+			t.Errorf("sample %s = %v, want %v", key, v, value)
+		}
+	}
+	for key := range set {
+		if _, ok := want[key]; !ok {
+			t.Errorf("unexpected sample %s", key)
+		}
+	}
+}
+
+func TestTranslateGauge(t *testing.T) {
+	body := request(
+		[][]byte{stringAttr("service.name", "checkout"), intAttr("process.pid", 42)},
+		[][]byte{boolAttr("sampled", true)},
+		metric("system.cpu.utilization", fieldGauge, gauge(
+			doublePoint(0.25, stringAttr("cpu", "0"), doubleAttr("weight", 1.5)),
+			intPoint(-3, stringAttr("cpu", "1"), arrayAttr("ignored")),
+		)),
+	)
+	result, err := Translate(body, Config{ResourcePrefix: "resource_", ScopePrefix: "scope_"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rejected != 0 {
+		t.Errorf("%d rejected: %s", result.Rejected, result.Message)
+	}
+	common := `resource_process_pid="42", resource_service_name="checkout", scope_sampled="true"`
+	checkSamples(t, result.Samples, map[string]float64{
+		`system_cpu_utilization{cpu="0", ` + common + `, weight="1.5"}@` + testMs: 0.25,
+		`system_cpu_utilization{cpu="1", ` + common + `}@` + testMs:               -3,
+	})
+}
+
+func TestTranslateSum(t *testing.T) {
+	tests := []struct {
+		name     string
+		sum      []byte
+		want     map[string]float64
+		rejected int64
+	}{
+		{
+			"cumulative monotonic",
+			sum(temporalityCumulative, true, intPoint(17, stringAttr("code", "200")), intPoint(3, stringAttr("code", "500"))),
+			map[string]float64{
+				`http_requests_total{code="200"}@` + testMs: 17,
+				`http_requests_total{code="500"}@` + testMs: 3,
+			},
+			0,
+		},
+		{
+			"cumulative non-monotonic",
+			sum(temporalityCumulative, false, doublePoint(-2.5)),
+			map[string]float64{`http_requests@` + testMs: -2.5},
+			0,
+		},
+		{
+			"delta",
+			sum(1, true, intPoint(1), intPoint(2)),
+			map[string]float64{},
+			2,
+		},
+		{
+			"unspecified temporality",
+			sum(0, false, intPoint(1)),
+			map[string]float64{},
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Translate(request(nil, nil, metric("http.requests", fieldSum, tt.sum)), Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Rejected != tt.rejected {
+				t.Errorf("%d rejected, want %d", result.Rejected, tt.rejected)
+			}
+			if tt.rejected > 0 && !strings.Contains(result.Message, "only cumulative sums") {
+				t.Errorf("message %q does not explain the rejection", result.Message)
+			}
+			checkSamples(t, result.Samples, tt.want)
+		})
+	}
+}
+
+func histogram(temporality uint64, packed bool, count uint64, sum float64, buckets []uint64, bounds []float64) []byte {
+	point := message(func(e *encoder) {
+		e.bytes(9, stringAttr("route", "/api"))
+		e.fixed64(3, testTime)
+		e.fixed64(4, count)
+		e.double(5, sum)
+		bits := make([]uint64, len(bounds))
+		for i, b := range bounds {
+			bits[i] = math.Float64bits(b)
+		}
+		if packed {
+			e.packed(6, buckets)
+			e.packed(7, bits)
+			return
+		}
+		for _, b := range buckets {
+			e.fixed64(6, b)
+		}
+		for _, b := range bits {
+			e.fixed64(7, b)
+		}
+	})
+	return message(func(e *encoder) {
+		e.bytes(1, point)
+		e.varint(2, temporality)
+	})
+}
+
+func TestTranslateHistogram(t *testing.T) {
+	want := map[string]float64{
+		`latency_seconds_bucket{le="0.1", route="/api"}@` + testMs:  2,
+		`latency_seconds_bucket{le="1", route="/api"}@` + testMs:    5,
+		`latency_seconds_bucket{le="+Inf", route="/api"}@` + testMs: 10,
+		`latency_seconds_sum{route="/api"}@` + testMs:               4.5,
+		`latency_seconds_count{route="/api"}@` + testMs:             10,
+	}
+	tests := []struct {
+		name      string
+		histogram []byte
+		want      map[string]float64
+		rejected  int64
+	}{
+		{"packed", histogram(temporalityCumulative, true, 10, 4.5, []uint64{2, 3, 5}, []float64{0.1, 1}), want, 0},
+		{"unpacked", histogram(temporalityCumulative, false, 10, 4.5, []uint64{2, 3, 5}, []float64{0.1, 1}), want, 0},
+		{"delta", histogram(1, true, 10, 4.5, []uint64{2, 3, 5}, []float64{0.1, 1}), map[string]float64{}, 1},
+		{"bucket counts not matching the bounds", histogram(temporalityCumulative, true, 10, 4.5, []uint64{2, 3}, []float64{0.1, 1}), map[string]float64{}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Translate(request(nil, nil, metric("latency.seconds", fieldHistogram, tt.histogram)), Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Rejected != tt.rejected {
+				t.Errorf("%d rejected, want %d: %s", result.Rejected, tt.rejected, result.Message)
+			}
+			checkSamples(t, result.Samples, tt.want)
+		})
+	}
+}
+
+func TestTranslateSummaryRejected(t *testing.T) {
+	summary := message(func(e *encoder) {
+		for i := 0; i < 3; i++ {
+			e.bytes(1, message(func(e *encoder) {
+				e.fixed64(3, testTime)
+				e.fixed64(4, 10)
+				e.double(5, 4.5)
+			}))
+		}
+	})
+	body := request(nil, nil,
+		metric("rpc.duration", fieldSummary, summary),
+		metric("up", fieldGauge, gauge(doublePoint(1))),
+	)
+	result, err := Translate(body, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Rejected != 3 {
+		t.Errorf("%d rejected, want 3", result.Rejected)
+	}
+	if !strings.Contains(result.Message, "rpc_duration") {
+		t.Errorf("message %q does not name the metric", result.Message)
+	}
+	checkSamples(t, result.Samples, map[string]float64{`up@` + testMs: 1})
+}
+
+func TestTranslateWireFormat(t *testing.T) {
+	points := gauge(doublePoint(1))
+	tests := []struct {
+		name string
+		body []byte
+		want map[string]float64
+	}{
+		{
+			"unknown fields of every wire type",
+			message(func(e *encoder) {
+				e.varint(99, 7)
+				e.fixed32(98, 7)
+				e.fixed64(97, 7)
+				e.bytes(96, []byte("ignored"))
+				e.b = append(e.b, request(nil, nil, metric("up", fieldGauge, points))...)
+			}),
+			map[string]float64{`up@` + testMs: 1},
+		},
+		{
+			"resource after its scopes",
+			message(func(e *encoder) {
+				e.bytes(1, message(func(e *encoder) {
+					e.bytes(2, message(func(e *encoder) { e.bytes(2, metric("up", fieldGauge, points)) }))
+					e.bytes(1, message(func(e *encoder) { e.bytes(1, stringAttr("host", "a")) }))
+				}))
+			}),
+			map[string]float64{`up{host="a"}@` + testMs: 1},
+		},
+		{
+			"point attributes override the resource",
+			request([][]byte{stringAttr("host", "resource")}, nil,
+				metric("up", fieldGauge, gauge(doublePoint(1, stringAttr("host", "point"))))),
+			map[string]float64{`up{host="point"}@` + testMs: 1},
+		},
+		{
+			"empty request",
+			nil,
+			map[string]float64{},
+		},
+		{
+			"metric without data",
+			request(nil, nil, message(func(e *encoder) { e.bytes(1, []byte("up")) })),
+			map[string]float64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Translate(tt.body, Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSamples(t, result.Samples, tt.want)
+		})
+	}
+}
+
+func TestTranslateMalformed(t *testing.T) {
+	body := request(nil, nil, metric("up", fieldGauge, gauge(doublePoint(1))))
+	for n := 1; n < len(body); n++ {
+		if _, err := Translate(body[:n], Config{}); err == nil {
+			t.Errorf("request cut to %d of %d bytes decoded without an error", n, len(body))
+		}
+	}
+	if _, err := Translate([]byte{1<<3 | 3}, Config{}); err == nil {
+		t.Error("group wire type accepted")
+	}
+}
+
+func TestResponse(t *testing.T) {
+	if b := Response(Result{Samples: model.Samples{&model.Sample{}}}); b != nil {
+		t.Errorf("response without rejections is %x, want empty", b)
+	}
+	b := Response(Result{Rejected: 3, Message: "metric x: not supported"})
+	d := decoder{b: b}
+	field, wire, _, err := d.next()
+	if err != nil || field != 1 || wire != wireBytes {
+		t.Fatalf("partial_success field %d wire %d: %v", field, wire, err)
+	}
+	partial, err := d.bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := decoder{b: partial}
+	if field, _, _, _ := p.next(); field != 1 {
+		t.Fatalf("rejected_data_points is field %d", field)
+	}
+	if n, _ := p.varint(); n != 3 {
+		t.Errorf("rejected_data_points %d, want 3", n)
+	}
+	if field, _, _, _ := p.next(); field != 2 {
+		t.Fatalf("error_message is field %d", field)
+	}
+	if msg, _ := p.bytes(); string(msg) != "metric x: not supported" {
+		t.Errorf("error_message %q", msg)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := map[string]string{
+		"http.server.duration": "http_server_duration",
+		"9lives":               "_lives",
+		"ok_name:sub":          "ok_name:sub",
+		"with-dash space":      "with_dash_space",
+		"ünïcode":              "__n__code",
+	}
+	for in, want := range tests {
+		if got := sanitize(in); got != want {
+			t.Errorf("sanitize(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
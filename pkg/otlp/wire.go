@@ -0,0 +1,136 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// decoder reads the fields of one protobuf message. The OTLP messages are
+// decoded by hand so that the adapter does not need the generated OTLP code.
+type decoder struct {
+	b []byte
+}
+
+// next returns the number and wire type of the next field, done once the
+// message is consumed.
+func (d *decoder) next() (field int, wire int, done bool, err error) {
+	if len(d.b) == 0 {
+		return 0, 0, true, nil
+	}
+	key, err := d.varint()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return int(key >> 3), int(key & 7), false, nil
+}
+
+func (d *decoder) varint() (uint64, error) {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *decoder) fixed64() (uint64, error) {
+	if len(d.b) < 8 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v, nil
+}
+
+func (d *decoder) double() (float64, error) {
+	v, err := d.fixed64()
+	return math.Float64frombits(v), err
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(d.b)) < n {
+		return nil, errTruncated
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v, nil
+}
+
+// skip discards a field of the given wire type.
+func (d *decoder) skip(wire int) error {
+	switch wire {
+	case wireVarint:
+		_, err := d.varint()
+		return err
+	case wireFixed64:
+		_, err := d.fixed64()
+		return err
+	case wireBytes:
+		_, err := d.bytes()
+		return err
+	case wireFixed32:
+		if len(d.b) < 4 {
+			return errTruncated
+		}
+		d.b = d.b[4:]
+		return nil
+	}
+	return errors.New("unsupported protobuf wire type")
+}
+
+// packedFixed64 reads a repeated fixed64 or double field, packed or not.
+func (d *decoder) packedFixed64(wire int) ([]uint64, error) {
+	if wire == wireFixed64 {
+		v, err := d.fixed64()
+		return []uint64{v}, err
+	}
+	b, err := d.bytes()
+	if err != nil {
+		return nil, err
+	}
+	if len(b)%8 != 0 {
+		return nil, errTruncated
+	}
+	values := make([]uint64, 0, len(b)/8)
+	for ; len(b) > 0; b = b[8:] {
+		values = append(values, binary.LittleEndian.Uint64(b))
+	}
+	return values, nil
+}
+
+// encoder builds a protobuf message.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	e.b = append(e.b, buf[:n]...)
+}
+
+func (e *encoder) varint(field int, v uint64) {
+	e.uvarint(uint64(field)<<3 | wireVarint)
+	e.uvarint(v)
+}
+
+func (e *encoder) bytes(field int, v []byte) {
+	e.uvarint(uint64(field)<<3 | wireBytes)
+	e.uvarint(uint64(len(v)))
+	e.b = append(e.b, v...)
+}
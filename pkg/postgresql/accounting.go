@@ -0,0 +1,148 @@
+package postgresql
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sample outcomes. Every sample given to Client.Write ends in exactly one of
+// them, or is still in flight.
+const (
+	// OutcomeRejected samples were refused with an error, the sender retries them.
+	OutcomeRejected = "rejected"
+	// OutcomeDropped samples were discarded by policy, e.g. tenant throttling.
+	OutcomeDropped = "dropped"
+	// OutcomeDownsampled samples fell within the keep interval of a
+	// downsampling rule.
+	OutcomeDownsampled = "downsampled"
+	// OutcomeSuppressed samples repeated the value of their series within
+	// the maximum gap of unchanged sample suppression.
+	OutcomeSuppressed = "suppressed"
+	// OutcomeEvicted samples waited in a backlogged queue for too long.
+	OutcomeEvicted = "evicted"
+	// OutcomeDeduplicated samples collided with another one after rounding.
+	OutcomeDeduplicated = "deduplicated"
+	// OutcomeCommitted samples were copied to the metrics table.
+	OutcomeCommitted = "committed"
+	// OutcomeFailed samples were part of a COPY that failed.
+	OutcomeFailed = "failed"
+)
+
+// sampleBooks accounts for every sample received. All fields are updated
+// atomically.
+type sampleBooks struct {
+	received int64
+	outcomes map[string]*int64
+
+	// parserPending counts the samples popped by parsers and not yet handed
+	// to a writer, flushing the rows taken from a writer's buffer by a flush
+	// that has not finished.
+	parserPending int64
+	flushing      int64
+}
+
+var books = sampleBooks{
+	outcomes: map[string]*int64{
+		OutcomeRejected:     new(int64),
+		OutcomeDropped:      new(int64),
+		OutcomeEvicted:      new(int64),
+		OutcomeDownsampled:  new(int64),
+		OutcomeSuppressed:   new(int64),
+		OutcomeDeduplicated: new(int64),
+		OutcomeCommitted:    new(int64),
+		OutcomeFailed:       new(int64),
+	},
+}
+
+func (b *sampleBooks) receive(n int) {
+	atomic.AddInt64(&b.received, int64(n))
+}
+
+func (b *sampleBooks) settle(outcome string, n int64) {
+	if n != 0 {
+		atomic.AddInt64(b.outcomes[outcome], n)
+	}
+}
+
+// inFlight counts the samples that are queued, live or backfill, held by a
+// parser, buffered by a writer or being flushed.
+func (b *sampleBooks) inFlight() int64 {
+	pending := int64(QueueLength()+BackfillQueueLength()) + atomic.LoadInt64(&b.parserPending) + atomic.LoadInt64(&b.flushing)
+	writersMutex.Lock()
+	for _, w := range writers {
+		writerLockWait.lock(&w.PGWriterMutex)
+		pending += int64(len(w.valueRows))
+		w.PGWriterMutex.Unlock()
+	}
+	writersMutex.Unlock()
+	return pending
+}
+
+// unaccounted is the number of samples received that neither reached an
+// outcome nor are in flight. The parts are read one after another while
+// samples move on, so it can be off briefly; a value that stays away from 0
+// means samples are lost or counted twice.
+func (b *sampleBooks) unaccounted() int64 {
+	settled := int64(0)
+	for _, n := range b.outcomes {
+		settled += atomic.LoadInt64(n)
+	}
+	inFlight := b.inFlight()
+	return atomic.LoadInt64(&b.received) - settled - inFlight
+}
+
+// BooksStatus is the sample accounting shown on the status endpoint.
+type BooksStatus struct {
+	Received    int64            `json:"received"`
+	Outcomes    map[string]int64 `json:"outcomes"`
+	InFlight    int64            `json:"in_flight"`
+	Unaccounted int64            `json:"unaccounted"`
+}
+
+func (b *sampleBooks) status() BooksStatus {
+	status := BooksStatus{
+		Received: atomic.LoadInt64(&b.received),
+		Outcomes: make(map[string]int64, len(b.outcomes)),
+		InFlight: b.inFlight(),
+	}
+	for outcome, n := range b.outcomes {
+		status.Outcomes[outcome] = atomic.LoadInt64(n)
+	}
+	status.Unaccounted = b.unaccounted()
+	return status
+}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name: "adapter_samples_received_total",
+			Help: "Total number of samples given to the write endpoint.",
+		},
+		func() float64 {
+			return float64(atomic.LoadInt64(&books.received))
+		},
+	))
+	for outcome, n := range books.outcomes {
+		n := n
+		prometheus.MustRegister(prometheus.NewCounterFunc(
+			prometheus.CounterOpts{
+				Name:        "adapter_samples_outcome_total",
+				Help:        "Total number of received samples by final outcome.",
+				ConstLabels: prometheus.Labels{"outcome": outcome},
+			},
+			func() float64 {
+				return float64(atomic.LoadInt64(n))
+			},
+		))
+	}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "adapter_samples_unaccounted",
+			Help: "Samples received that reached no outcome and are not in flight; should stay at 0.",
+		},
+		func() float64 {
+			return float64(books.unaccounted())
+		},
+	))
+}
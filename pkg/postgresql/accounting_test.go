@@ -0,0 +1,161 @@
+package postgresql
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+)
+
+// ledger is a snapshot of the books, for checking what a test moved.
+type ledger struct {
+	received int64
+	outcomes map[string]int64
+}
+
+func readLedger() ledger {
+	l := ledger{received: atomic.LoadInt64(&books.received), outcomes: make(map[string]int64)}
+	for outcome, n := range books.outcomes {
+		l.outcomes[outcome] = atomic.LoadInt64(n)
+	}
+	return l
+}
+
+// since returns the samples received and settled by outcome after l.
+func (l ledger) since() (int64, map[string]int64) {
+	now := readLedger()
+	settled := make(map[string]int64)
+	for outcome, n := range now.outcomes {
+		if d := n - l.outcomes[outcome]; d != 0 {
+			settled[outcome] = d
+		}
+	}
+	return now.received - l.received, settled
+}
+
+// parseQueued runs a parser of w until the queue is empty and its rows are
+// handed to w.
+func parseQueued(t *testing.T, w *PGWriter) {
+	p := &PGParser{}
+	done := make(chan struct{})
+	go func() {
+		p.RunPGParser(0, PartitionDaily, w)
+		close(done)
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for QueueLength() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d samples still queued", QueueLength())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.PGParserShutdown()
+	<-done
+}
+
+// TestBooksBalance sends samples down every path a write can take and checks
+// that, after each stage, every sample received is settled or in flight:
+// received = rejected + dropped + committed + failed + in flight.
+func TestBooksBalance(t *testing.T) {
+	if QueueLength() != 0 || BackfillQueueLength() != 0 {
+		t.Fatalf("%d samples queued before the test", QueueLength()+BackfillQueueLength())
+	}
+	cfg := &Config{MaxQueueSamples: 1000, SkipSchemaSetup: true, InfinityMode: InfinityDrop}
+	c := &Client{cfg: cfg, limiter: &tenantLimiter{
+		label:   "tenant",
+		rates:   map[string]float64{"small": 5},
+		mode:    ThrottleDrop,
+		buckets: make(map[string]*tokenBucket),
+	}}
+	copier := &fakeCopier{}
+	w := &PGWriter{cfg: cfg, logger: log.NewNopLogger(), wake: make(chan struct{}, 1), copyTarget: copier}
+
+	// The only writer, so that its buffer counts as in flight.
+	writersMutex.Lock()
+	savedWriters := writers
+	writers = []*PGWriter{w}
+	writersMutex.Unlock()
+	defer func() {
+		writersMutex.Lock()
+		writers = savedWriters
+		writersMutex.Unlock()
+	}()
+
+	start := readLedger()
+	unaccounted := books.unaccounted()
+	balanced := func(stage string, inFlight int64) {
+		t.Helper()
+		received, settled := start.since()
+		var sum int64
+		for _, n := range settled {
+			sum += n
+		}
+		if got := books.inFlight(); got != inFlight {
+			t.Errorf("%s: %d samples in flight, want %d", stage, got, inFlight)
+		}
+		if received != sum+inFlight {
+			t.Errorf("%s: %d samples received, %d settled %v and %d in flight", stage, received, sum, settled, inFlight)
+		}
+		if got := books.unaccounted(); got != unaccounted {
+			t.Errorf("%s: %d samples unaccounted, want %d", stage, got, unaccounted)
+		}
+	}
+
+	// The tenant limiter drops 15, a full queue rejects a whole write.
+	if err := c.Write(tenantSamples("small", 20)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write(tenantSamples("big", 2000)); err == nil {
+		t.Fatal("write beyond MaxQueueSamples accepted")
+	}
+	// The parser drops the infinite values.
+	infinite := tenantSamples("other", 10)
+	for _, s := range infinite[:4] {
+		s.Value = model.SampleValue(math.Inf(1))
+	}
+	if err := c.Write(infinite); err != nil {
+		t.Fatal(err)
+	}
+	balanced("queued", 5+10)
+
+	parseQueued(t, w)
+	balanced("parsed", 5+6)
+
+	w.PGWriterSave()
+	balanced("committed", 0)
+
+	// A COPY the database refuses fails every row of the flush.
+	copier.reject = rejectPoison
+	poison := tenantSamples("other", 7)
+	for _, s := range poison {
+		s.Metric[model.MetricNameLabel] = "poison"
+	}
+	if err := c.Write(poison); err != nil {
+		t.Fatal(err)
+	}
+	parseQueued(t, w)
+	w.PGWriterSave()
+	balanced("failed", 0)
+
+	received, settled := start.since()
+	want := map[string]int64{
+		OutcomeDropped:   15 + 4,
+		OutcomeRejected:  2000,
+		OutcomeCommitted: 5 + 6,
+		OutcomeFailed:    7,
+	}
+	if received != 20+2000+10+7 {
+		t.Errorf("%d samples received, want %d", received, 20+2000+10+7)
+	}
+	if len(settled) != len(want) {
+		t.Errorf("outcomes %v, want %v", settled, want)
+	}
+	for outcome, n := range want {
+		if settled[outcome] != n {
+			t.Errorf("%d samples %s, want %d", settled[outcome], outcome, n)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ErrUnsafeDelete is returned by DeleteSeries when the matchers could select
+// every series and force was not given.
+var ErrUnsafeDelete = errors.New("refusing to delete without an equality matcher, use force to override")
+
+// deleteBatchSize bounds the rows removed by a single DELETE so that locks
+// on a partition are held only briefly.
+const deleteBatchSize = 10000
+
+// DeleteSeries removes all samples matching the given matchers between start
+// and end, returning the number of rows deleted. Unless force is set, at least
+// one non-empty equality matcher is required so that a typo cannot wipe the
+// whole table.
+func (c *Client) DeleteSeries(ctx context.Context, matchers []*prompb.LabelMatcher, start time.Time, end time.Time, force bool) (int64, error) {
+	if !force && !hasEqualityMatcher(matchers) {
+		return 0, ErrUnsafeDelete
+	}
+
+	level.Info(c.logger).Log("msg", "Deleting series", "matchers", matchersString(matchers), "start", start, "end", end, "force", force)
+
+	db, err := c.pool()
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := deleteMatching(ctx, db, c.logger, c.cfg.columns(), matchers, start, end)
+	if err != nil {
+		return deleted, err
+	}
+	level.Info(c.logger).Log("msg", "Deleted series", "matchers", matchersString(matchers), "rows", deleted)
+	return deleted, nil
+}
+
+// deleteMatching removes the rows matching matchers between start and end
+// from every partition holding any, in batches of deleteBatchSize, and
+// returns the number of rows deleted.
+func deleteMatching(ctx context.Context, db *pgxpool.Pool, logger log.Logger, columns Columns, matchers []*prompb.LabelMatcher, start time.Time, end time.Time) (int64, error) {
+	var args sqlArgs
+	where, err := buildWhere(columns, matchers, fromTimestamp(start), fromTimestamp(end), &args)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only partitions holding matching rows are visited; the time predicates
+	// let the planner prune the rest.
+	rows, err := db.Query(ctx, fmt.Sprintf("SELECT tableoid::regclass::text FROM metrics WHERE %s GROUP BY 1", where), args...)
+	if err != nil {
+		return 0, err
+	}
+	var partitions []string
+	for rows.Next() {
+		var partition string
+		if err := rows.Scan(&partition); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		partitions = append(partitions, partition)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, partition := range partitions {
+		command := fmt.Sprintf("DELETE FROM %s WHERE ctid IN (SELECT ctid FROM %s WHERE %s LIMIT %d)", partition, partition, where, deleteBatchSize)
+		for {
+			tag, err := db.Exec(ctx, command, args...)
+			if err != nil {
+				level.Error(logger).Log("msg", "Delete failed", "partition", partition, "deleted", deleted, "err", err)
+				return deleted, err
+			}
+			deleted += tag.RowsAffected()
+			if tag.RowsAffected() < deleteBatchSize {
+				break
+			}
+		}
+		level.Debug(logger).Log("msg", "Deleted series from partition", "partition", partition)
+	}
+	return deleted, nil
+}
+
+func hasEqualityMatcher(matchers []*prompb.LabelMatcher) bool {
+	for _, m := range matchers {
+		if m.Type == prompb.LabelMatcher_EQ && m.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func matchersString(matchers []*prompb.LabelMatcher) string {
+	parts := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		var op string
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			op = "="
+		case prompb.LabelMatcher_NEQ:
+			op = "!="
+		case prompb.LabelMatcher_RE:
+			op = "=~"
+		case prompb.LabelMatcher_NRE:
+			op = "!~"
+		}
+		parts = append(parts, fmt.Sprintf("%s%s%q", m.Name, op, m.Value))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
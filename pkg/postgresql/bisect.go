@@ -0,0 +1,131 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4"
+)
+
+// bisectMaxDepth bounds the recursion of bisectCopy; 2^20 rows is far above
+// any sensible batch, so single rows are always reached.
+const bisectMaxDepth = 20
+
+// copier is the part of the pool used to copy rows, so that bisection can be
+// run against anything accepting a COPY.
+type copier interface {
+	CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error)
+}
+
+// poisonRow is a row the database rejected on its own.
+type poisonRow struct {
+	row []interface{}
+	err error
+}
+
+// isDataError reports whether err was raised by the server because of the
+// rows copied, a data exception or constraint violation, rather than by the
+// connection or server state. Only such failures are worth bisecting. A
+// missing partition shares its SQLSTATE with check violations but is not
+// one: every row of its range fails alike, so it is not a data error.
+func isDataError(err error) bool {
+	var sqlErr interface{ SQLState() string }
+	if !errors.As(err, &sqlErr) || isMissingPartition(err) {
+		return false
+	}
+	state := sqlErr.SQLState()
+	return strings.HasPrefix(state, "22") || strings.HasPrefix(state, "23")
+}
+
+// copyMetrics copies rows to the metrics table and counts them for the
+// ingest checkpoints if the COPY succeeded.
+func copyMetrics(ctx context.Context, db copier, columns Columns, rows [][]interface{}) (int64, error) {
+	n, err := db.CopyFrom(ctx, pgx.Identifier{"metrics"}, columns.list(), pgx.CopyFromRows(rows))
+	if err == nil {
+		countCommitted(rows)
+	}
+	return n, err
+}
+
+// bisectCopy isolates the rows of a batch that failed with err by copying
+// each half on its own and recursing into the halves that fail again. It
+// returns the rows copied and the poison rows isolated. A non-nil error means
+// the rest could not be resolved, because a failure was not data-dependent
+// or the deadline passed; those rows were neither copied nor isolated.
+func bisectCopy(ctx context.Context, db copier, columns Columns, rows [][]interface{}, err error, depth int, deadline time.Time) (int64, []poisonRow, error) {
+	if len(rows) == 1 {
+		return 0, []poisonRow{{row: rows[0], err: err}}, nil
+	}
+	if depth >= bisectMaxDepth || time.Now().After(deadline) {
+		return 0, nil, err
+	}
+
+	var copied int64
+	var poison []poisonRow
+	var unresolved error
+	mid := len(rows) / 2
+	for _, half := range [][][]interface{}{rows[:mid], rows[mid:]} {
+		n, err := copyMetrics(ctx, db, columns, half)
+		if err == nil {
+			copied += n
+			continue
+		}
+		if !isDataError(err) {
+			unresolved = err
+			continue
+		}
+		n, p, err := bisectCopy(ctx, db, columns, half, err, depth+1, deadline)
+		copied += n
+		poison = append(poison, p...)
+		if err != nil {
+			unresolved = err
+		}
+	}
+	return copied, poison, unresolved
+}
+
+// copyOrBisect copies rows on a connection of its own, after ensuring the
+// partitions of their time range on that connection, and, if the database
+// rejects them because of their data, bisects the batch within one commit
+// interval so that only the offending rows are dropped. A batch failing
+// because a partition was dropped or detached behind the adapter's back is
+// retried once after the partitions were ensured again; if a partition
+// still cannot be created the flush fails without bisecting, so that its
+// rows are not dropped one by one as poison.
+func (c *PGWriter) copyOrBisect(rows [][]interface{}) (int64, error) {
+	ctx := context.Background()
+	conn, err := c.DB.Acquire(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Release()
+
+	if err := c.ensureBatchPartitions(ctx, conn, rows); err != nil {
+		level.Error(c.logger).Log("msg", "Ensuring the partitions of a batch failed", "rows", len(rows), "err", err)
+	}
+	n, err := copyMetrics(ctx, conn, c.cfg.columns(), rows)
+	if err != nil && isMissingPartition(err) {
+		level.Warn(c.logger).Log("msg", "COPY found a partition missing, recreating partitions of the batch", "rows", len(rows), "err", err)
+		if ensureErr := c.ensureBatchPartitions(ctx, conn, rows); ensureErr != nil {
+			level.Error(c.logger).Log("msg", "Recreating partitions failed", "err", ensureErr)
+		} else {
+			n, err = copyMetrics(ctx, conn, c.cfg.columns(), rows)
+		}
+	}
+	if err == nil || !isDataError(err) {
+		return n, err
+	}
+
+	begin := time.Now()
+	level.Warn(c.logger).Log("msg", "COPY rejected by the database, bisecting batch", "rows", len(rows), "err", err)
+	copied, poison, err := bisectCopy(ctx, conn, c.cfg.columns(), rows, err, 0, begin.Add(time.Duration(c.CommitSecs())*time.Second))
+	for _, p := range poison {
+		level.Error(c.logger).Log("msg", "Dropped poison row", "name", p.row[1], "time", p.row[0], "err", p.err)
+	}
+	poisonRows.Add(float64(len(poison)))
+	level.Info(c.logger).Log("msg", "Bisected batch", "copied", copied, "poison", len(poison), "duration", time.Since(begin), "unresolved", err)
+	return copied, err
+}
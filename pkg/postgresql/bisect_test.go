@@ -0,0 +1,177 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// sqlError is an error carrying a SQLSTATE, like the server's.
+type sqlError struct {
+	state string
+	msg   string
+}
+
+func (e *sqlError) Error() string    { return e.msg }
+func (e *sqlError) SQLState() string { return e.state }
+
+// fakeCopier accepts a COPY unless it contains a row for which reject
+// returns an error, and then copies nothing, like the server.
+type fakeCopier struct {
+	reject func(row []interface{}) error
+	copies int
+	copied [][]interface{}
+}
+
+func (f *fakeCopier) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	f.copies++
+	var rows [][]interface{}
+	for rowSrc.Next() {
+		row, err := rowSrc.Values()
+		if err != nil {
+			return 0, err
+		}
+		if f.reject != nil {
+			if err := f.reject(row); err != nil {
+				return 0, err
+			}
+		}
+		rows = append(rows, row)
+	}
+	f.copied = append(f.copied, rows...)
+	return int64(len(rows)), rowSrc.Err()
+}
+
+// rejectPoison rejects the rows named "poison" with a data exception.
+func rejectPoison(row []interface{}) error {
+	if row[1] == "poison" {
+		return &sqlError{state: "22P02", msg: fmt.Sprintf("invalid input in row at %v", row[0])}
+	}
+	return nil
+}
+
+// testRows returns n rows a second apart, those at the indexes in poison
+// named "poison".
+func testRows(n int, poison ...int) [][]interface{} {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := make([][]interface{}, n)
+	for i := range rows {
+		rows[i] = []interface{}{start.Add(time.Duration(i) * time.Second), "up", float64(i), "{}"}
+	}
+	for _, i := range poison {
+		rows[i][1] = "poison"
+	}
+	return rows
+}
+
+func TestBisectCopy(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	tests := []struct {
+		name   string
+		rows   int
+		poison []int
+	}{
+		{"one poison row", 8, []int{5}},
+		{"first and last row", 8, []int{0, 7}},
+		{"several poison rows", 100, []int{3, 4, 50, 98}},
+		{"odd batch", 7, []int{6}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakeCopier{reject: rejectPoison}
+			rows := testRows(tt.rows, tt.poison...)
+			_, err := copyMetrics(context.Background(), db, defaultColumns, rows)
+			if !isDataError(err) {
+				t.Fatalf("copy of the whole batch: got %v, want a data error", err)
+			}
+			copied, poison, err := bisectCopy(context.Background(), db, defaultColumns, rows, err, 0, deadline)
+			if err != nil {
+				t.Fatalf("unexpected unresolved error: %v", err)
+			}
+			if want := int64(tt.rows - len(tt.poison)); copied != want || int64(len(db.copied)) != want {
+				t.Errorf("copied %d rows, the copier got %d, want %d", copied, len(db.copied), want)
+			}
+			if len(poison) != len(tt.poison) {
+				t.Fatalf("isolated %d poison rows, want %d", len(poison), len(tt.poison))
+			}
+			for i, p := range poison {
+				if want := rows[tt.poison[i]]; p.row[0] != want[0] {
+					t.Errorf("poison row %d is at %v, want %v", i, p.row[0], want[0])
+				}
+				if p.err == nil {
+					t.Errorf("poison row %d has no error", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBisectCopyDepthLimit(t *testing.T) {
+	db := &fakeCopier{reject: rejectPoison}
+	rows := testRows(4, 1)
+	batchErr := &sqlError{state: "22P02", msg: "invalid input"}
+	// One level is left: the halves are copied, the failing one is not
+	// split any further.
+	copied, poison, err := bisectCopy(context.Background(), db, defaultColumns, rows, batchErr, bisectMaxDepth-1, time.Now().Add(time.Minute))
+	if err == nil {
+		t.Fatal("expected the failing half to stay unresolved")
+	}
+	if copied != 2 || len(poison) != 0 {
+		t.Errorf("copied %d rows and isolated %d, want 2 and 0", copied, len(poison))
+	}
+}
+
+func TestBisectCopyDeadline(t *testing.T) {
+	db := &fakeCopier{reject: rejectPoison}
+	batchErr := &sqlError{state: "22P02", msg: "invalid input"}
+	copied, poison, err := bisectCopy(context.Background(), db, defaultColumns, testRows(8, 2), batchErr, 0, time.Now().Add(-time.Second))
+	if err != batchErr {
+		t.Errorf("got %v, want the batch error back", err)
+	}
+	if copied != 0 || len(poison) != 0 || db.copies != 0 {
+		t.Errorf("copied %d rows, isolated %d in %d copies after the deadline, want none", copied, len(poison), db.copies)
+	}
+}
+
+func TestBisectCopyMissingPartition(t *testing.T) {
+	missing := &sqlError{state: "23514", msg: `no partition of relation "metrics" found for row`}
+	db := &fakeCopier{reject: func(row []interface{}) error { return missing }}
+	copied, poison, err := bisectCopy(context.Background(), db, defaultColumns, testRows(8), missing, 0, time.Now().Add(time.Minute))
+	if err != missing {
+		t.Errorf("got %v, want the missing partition error", err)
+	}
+	if copied != 0 || len(poison) != 0 {
+		t.Errorf("copied %d rows and isolated %d, want none", copied, len(poison))
+	}
+	// Both halves were tried once and not split further.
+	if db.copies != 2 {
+		t.Errorf("%d copies, want 2", db.copies)
+	}
+}
+
+func TestIsDataError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"data exception", &sqlError{state: "22P02", msg: "invalid input syntax"}, true},
+		{"unique violation", &sqlError{state: "23505", msg: "duplicate key value"}, true},
+		{"check violation", &sqlError{state: "23514", msg: `new row for relation "metrics" violates check constraint`}, true},
+		{"missing partition", &sqlError{state: "23514", msg: `no partition of relation "metrics" found for row`}, false},
+		{"wrapped missing partition", fmt.Errorf("copy: %w", &sqlError{state: "23514", msg: `no partition of relation "metrics" found for row`}), false},
+		{"connection failure", &sqlError{state: "08006", msg: "connection failure"}, false},
+		{"no SQLSTATE", errors.New("closed pool"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDataError(tt.err); got != tt.want {
+				t.Errorf("isDataError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// cardinalityWindow is how far back the sampler looks. It is kept short so
+// that only the newest partition is scanned.
+const cardinalityWindow = time.Hour
+
+// SeriesCardinality is the number of distinct label sets seen for a metric name.
+type SeriesCardinality struct {
+	Name   string `json:"name"`
+	Series int64  `json:"series"`
+}
+
+// runCardinalitySampler periodically records the metric names with the most
+// distinct label sets until the client is closed. Only the leader samples.
+func (c *Client) runCardinalitySampler() {
+	ticker := time.NewTicker(c.cfg.CardinalityInterval)
+	defer ticker.Stop()
+
+	for {
+		if !IsLeader() {
+			level.Debug(c.logger).Log("msg", "Not leader, skipping cardinality sampling")
+		} else if err := c.sampleCardinality(context.Background()); err != nil {
+			level.Error(c.logger).Log("msg", "Cardinality sampling failed", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) sampleCardinality(ctx context.Context) error {
+	db, err := c.pool()
+	if err != nil {
+		return err
+	}
+	col := c.cfg.columns().quoted()
+	begin := time.Now()
+	rows, err := db.Query(ctx, fmt.Sprintf("SELECT %s, count(DISTINCT %s) FROM metrics WHERE %s > $1 GROUP BY 1 ORDER BY 2 DESC LIMIT $2", col.Name, col.Labels, col.Time),
+		time.Now().Add(-cardinalityWindow).UTC(), c.cfg.CardinalityTopN)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var top []SeriesCardinality
+	for rows.Next() {
+		var sc SeriesCardinality
+		if err := rows.Scan(&sc.Name, &sc.Series); err != nil {
+			return err
+		}
+		top = append(top, sc)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	seriesCardinality.Reset()
+	for _, sc := range top {
+		seriesCardinality.WithLabelValues(sc.Name).Set(float64(sc.Series))
+		if c.cfg.CardinalityWarn > 0 && sc.Series > c.cfg.CardinalityWarn {
+			level.Warn(c.logger).Log("msg", "Series cardinality above threshold", "name", sc.Name, "series", sc.Series, "threshold", c.cfg.CardinalityWarn)
+		}
+	}
+
+	c.statusMutex.Lock()
+	c.cardinality = top
+	c.statusMutex.Unlock()
+
+	level.Debug(c.logger).Log("msg", "Sampled series cardinality", "names", len(top), "duration", time.Since(begin))
+	return nil
+}
@@ -0,0 +1,166 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const catalogTable = `CREATE TABLE IF NOT EXISTS metrics_catalog (
+	name TEXT PRIMARY KEY,
+	last_seen timestamptz NOT NULL,
+	label_keys TEXT[] NOT NULL,
+	first_seen timestamptz NOT NULL
+)`
+
+// catalogUpsert records the metric names seen since the last flush in a
+// single statement. The label keys of each name are passed as a JSON array,
+// as unnest would flatten a two-dimensional array, and are added to those
+// already known.
+const catalogUpsert = `INSERT INTO metrics_catalog (name, last_seen, label_keys, first_seen)
+SELECT n, l, ARRAY(SELECT jsonb_array_elements_text(k::jsonb)), f
+FROM unnest($1::text[], $2::timestamptz[], $3::text[], $4::timestamptz[]) AS t(n, l, k, f)
+ON CONFLICT (name) DO UPDATE
+SET last_seen = GREATEST(metrics_catalog.last_seen, excluded.last_seen),
+	first_seen = LEAST(metrics_catalog.first_seen, excluded.first_seen),
+	label_keys = ARRAY(SELECT DISTINCT unnest(metrics_catalog.label_keys || excluded.label_keys) ORDER BY 1)`
+
+// catalogEntry is what is known of one metric name since the last flush.
+type catalogEntry struct {
+	firstSeen, lastSeen int64 // milliseconds
+	labelKeys           map[string]struct{}
+}
+
+// catalogDirty holds the metric names seen since the last flush. Parsers
+// note into their own map without locking and merge it here when they hand
+// their rows to the writer, like the ingest counts.
+var (
+	catalogMutex sync.Mutex
+	catalogDirty = make(map[string]*catalogEntry)
+)
+
+// noteCatalog records one stored sample in the parser's map.
+func (p *PGParser) noteCatalog(metric model.Metric, ms int64) {
+	name := string(metric[model.MetricNameLabel])
+	e := p.catalog[name]
+	if e == nil {
+		e = &catalogEntry{firstSeen: ms, lastSeen: ms, labelKeys: make(map[string]struct{}, len(metric))}
+		p.catalog[name] = e
+	} else if ms > e.lastSeen {
+		e.lastSeen = ms
+	} else if ms < e.firstSeen {
+		e.firstSeen = ms
+	}
+	for k := range metric {
+		if k == model.MetricNameLabel {
+			continue
+		}
+		e.labelKeys[string(k)] = struct{}{}
+	}
+}
+
+// mergeCatalog moves the parser's entries to catalogDirty.
+func (p *PGParser) mergeCatalog() {
+	if len(p.catalog) == 0 {
+		return
+	}
+	catalogMutex.Lock()
+	for name, e := range p.catalog {
+		total := catalogDirty[name]
+		if total == nil {
+			catalogDirty[name] = e
+			continue
+		}
+		if e.lastSeen > total.lastSeen {
+			total.lastSeen = e.lastSeen
+		}
+		if e.firstSeen < total.firstSeen {
+			total.firstSeen = e.firstSeen
+		}
+		for k := range e.labelKeys {
+			total.labelKeys[k] = struct{}{}
+		}
+	}
+	catalogMutex.Unlock()
+	p.catalog = make(map[string]*catalogEntry, len(p.catalog))
+}
+
+// flushCatalog upserts the metric names seen since the last call. It runs
+// after every successful flush of a writer, so the catalog lags the stored
+// rows by at most a commit interval. The entries are dropped if the upsert
+// fails; the next sample of a name records it again.
+func (c *PGWriter) flushCatalog(ctx context.Context) error {
+	catalogMutex.Lock()
+	entries := catalogDirty
+	catalogDirty = make(map[string]*catalogEntry, len(entries))
+	catalogMutex.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(entries))
+	lastSeen := make([]time.Time, 0, len(entries))
+	labelKeys := make([]string, 0, len(entries))
+	firstSeen := make([]time.Time, 0, len(entries))
+	for name, e := range entries {
+		keys := make([]string, 0, len(e.labelKeys))
+		for k := range e.labelKeys {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		raw, err := json.Marshal(keys)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		lastSeen = append(lastSeen, toTimestamp(e.lastSeen))
+		labelKeys = append(labelKeys, string(raw))
+		firstSeen = append(firstSeen, toTimestamp(e.firstSeen))
+	}
+	_, err := c.DB.Exec(ctx, catalogUpsert, names, lastSeen, labelKeys, firstSeen)
+	return err
+}
+
+// CatalogMetric is a metric name as recorded in metrics_catalog, with the
+// sample times of the first and last sample stored and every label key
+// seen with it.
+type CatalogMetric struct {
+	Name      string    `json:"name"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	LabelKeys []string  `json:"label_keys"`
+}
+
+// MetricCatalog returns every metric name in metrics_catalog, ordered by
+// name, or none if the table was never created.
+func (c *Client) MetricCatalog(ctx context.Context) ([]CatalogMetric, error) {
+	db, err := c.pool()
+	if err != nil {
+		return nil, err
+	}
+	catalog := []CatalogMetric{}
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT to_regclass('metrics_catalog') IS NOT NULL").Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return catalog, nil
+	}
+	rows, err := db.Query(ctx, "SELECT name, first_seen, last_seen, label_keys FROM metrics_catalog ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m CatalogMetric
+		if err := rows.Scan(&m.Name, &m.FirstSeen, &m.LastSeen, &m.LabelKeys); err != nil {
+			return nil, err
+		}
+		catalog = append(catalog, m)
+	}
+	return catalog, rows.Err()
+}
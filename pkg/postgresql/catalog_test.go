@@ -0,0 +1,61 @@
+package postgresql
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/common/model"
+)
+
+// TestCatalogMerge notes samples out of time order in two parsers and
+// checks what their merge leaves to be upserted.
+func TestCatalogMerge(t *testing.T) {
+	catalogMutex.Lock()
+	saved := catalogDirty
+	catalogDirty = make(map[string]*catalogEntry)
+	catalogMutex.Unlock()
+	defer func() {
+		catalogMutex.Lock()
+		catalogDirty = saved
+		catalogMutex.Unlock()
+	}()
+
+	metric := func(name string, labels ...model.LabelName) model.Metric {
+		m := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+		for _, l := range labels {
+			m[l] = "x"
+		}
+		return m
+	}
+	a := &PGParser{catalog: make(map[string]*catalogEntry)}
+	a.noteCatalog(metric("up", "job"), 2000)
+	a.noteCatalog(metric("up", "job", "instance"), 1000)
+	a.noteCatalog(metric("up", "job"), 3000)
+	a.noteCatalog(metric("requests"), 5000)
+	b := &PGParser{catalog: make(map[string]*catalogEntry)}
+	b.noteCatalog(metric("up", "zone"), 500)
+	b.noteCatalog(metric("up"), 2500)
+	a.mergeCatalog()
+	b.mergeCatalog()
+	if len(a.catalog) != 0 || len(b.catalog) != 0 {
+		t.Errorf("parsers keep %d and %d names after merging", len(a.catalog), len(b.catalog))
+	}
+
+	want := map[string]string{
+		"up":       "500..3000 map[instance:{} job:{} zone:{}]",
+		"requests": "5000..5000 map[]",
+	}
+	if len(catalogDirty) != len(want) {
+		t.Errorf("%d names to upsert, want %d", len(catalogDirty), len(want))
+	}
+	for name, w := range want {
+		e := catalogDirty[name]
+		if e == nil {
+			t.Errorf("%s not to be upserted", name)
+			continue
+		}
+		if got := fmt.Sprintf("%d..%d %v", e.firstSeen, e.lastSeen, e.labelKeys); got != w {
+			t.Errorf("%s: %s, want %s", name, got, w)
+		}
+	}
+}
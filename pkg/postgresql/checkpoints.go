@@ -0,0 +1,184 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4"
+)
+
+// checkpointWindow is the range of sample times committed rows are counted
+// in, aligned to UTC.
+const checkpointWindow = time.Hour
+
+const checkpointsTable = `CREATE TABLE IF NOT EXISTS ingest_checkpoints (
+	window_start timestamptz PRIMARY KEY,
+	window_end timestamptz NOT NULL,
+	committed BIGINT NOT NULL
+)`
+
+// checkpointsUpsert adds the rows committed since the last checkpoint to the
+// totals of their windows. Every instance adds its own.
+const checkpointsUpsert = `INSERT INTO ingest_checkpoints (window_start, window_end, committed)
+SELECT s, e, n FROM unnest($1::timestamptz[], $2::timestamptz[], $3::bigint[]) AS t(s, e, n)
+ON CONFLICT (window_start) DO UPDATE SET committed = ingest_checkpoints.committed + excluded.committed`
+
+// checkpointCounts are the rows committed per window since the last
+// checkpoint, keyed by the window start in unix seconds. They are only
+// collected while checkpointsEnabled is set.
+var (
+	checkpointsEnabled int32
+	checkpointMutex    sync.Mutex
+	checkpointCounts   = make(map[int64]int64)
+)
+
+// countCommitted adds rows copied by a successful COPY to their windows.
+func countCommitted(rows [][]interface{}) {
+	if atomic.LoadInt32(&checkpointsEnabled) == 0 || len(rows) == 0 {
+		return
+	}
+	window := int64(checkpointWindow / time.Second)
+	counts := make(map[int64]int64)
+	for _, row := range rows {
+		start := row[0].(time.Time).Unix()
+		start -= ((start % window) + window) % window
+		counts[start]++
+	}
+	checkpointMutex.Lock()
+	for start, n := range counts {
+		checkpointCounts[start] += n
+	}
+	checkpointMutex.Unlock()
+}
+
+// runCheckpoints writes the committed rows counted every CheckpointInterval
+// to ingest_checkpoints for as long as the writer runs, and once more when
+// it stops.
+func (c *PGWriter) runCheckpoints() {
+	atomic.StoreInt32(&checkpointsEnabled, 1)
+	for c.KeepRunning {
+		for wait := time.Duration(0); wait < c.cfg.CheckpointInterval && c.KeepRunning; wait += time.Second {
+			time.Sleep(time.Second)
+		}
+		if err := c.flushCheckpoints(context.Background()); err != nil {
+			level.Error(c.logger).Log("msg", "Writing ingest checkpoints failed", "err", err)
+		}
+	}
+}
+
+// flushCheckpoints upserts the counts collected since the last call. The
+// counts are dropped if the upsert fails, which Reconcile then reports as
+// rows stored but not committed.
+func (c *PGWriter) flushCheckpoints(ctx context.Context) error {
+	checkpointMutex.Lock()
+	counts := checkpointCounts
+	checkpointCounts = make(map[int64]int64, len(counts))
+	checkpointMutex.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	starts := make([]time.Time, 0, len(counts))
+	ends := make([]time.Time, 0, len(counts))
+	committed := make([]int64, 0, len(counts))
+	for start, n := range counts {
+		s := time.Unix(start, 0).UTC()
+		starts = append(starts, s)
+		ends = append(ends, s.Add(checkpointWindow))
+		committed = append(committed, n)
+	}
+	_, err := c.DB.Exec(ctx, checkpointsUpsert, starts, ends, committed)
+	return err
+}
+
+// ReconcileWindow compares the rows committed in a window, as recorded in
+// ingest_checkpoints, with the rows the metrics table holds for it.
+type ReconcileWindow struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Committed int64     `json:"committed"`
+	Stored    int64     `json:"stored"`
+	// Difference is Stored minus Committed.
+	Difference int64 `json:"difference"`
+}
+
+// Reconciliation is the result of Reconcile.
+type Reconciliation struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Windows are those with committed or stored rows, in time order.
+	Windows       []ReconcileWindow `json:"windows"`
+	Discrepancies int               `json:"discrepancies"`
+}
+
+// Reconcile compares, for every window between from and to, widened to
+// whole windows, the rows the adapters recorded as committed with the rows
+// counted in metrics. Everything runs in a read-only transaction. Windows
+// still being written to, or before checkpoints were enabled, naturally
+// differ.
+func (c *Client) Reconcile(ctx context.Context, from time.Time, to time.Time) (*Reconciliation, error) {
+	if to.Before(from) {
+		return nil, fmt.Errorf("reconciliation range ends before it starts: %s > %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+	from = from.UTC().Truncate(checkpointWindow)
+	if end := to.UTC().Truncate(checkpointWindow); end.Before(to) {
+		to = end.Add(checkpointWindow)
+	} else {
+		to = end
+	}
+
+	db, err := c.pool()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	committed := make(map[time.Time]int64)
+	rows, err := tx.Query(ctx, "SELECT window_start, committed FROM ingest_checkpoints WHERE window_start >= $1 AND window_start < $2", from, to)
+	if err != nil {
+		return nil, fmt.Errorf("reading ingest_checkpoints: %w", err)
+	}
+	for rows.Next() {
+		var start time.Time
+		var n int64
+		if err := rows.Scan(&start, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		committed[start.UTC()] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// One count per window, so that every count prunes to the partitions
+	// of its window.
+	timeColumn := c.cfg.columns().quoted().Time
+	count := fmt.Sprintf("SELECT count(*) FROM metrics WHERE %s >= $1 AND %s < $2", timeColumn, timeColumn)
+	reconciliation := &Reconciliation{From: from, To: to}
+	for start := from; start.Before(to); start = start.Add(checkpointWindow) {
+		end := start.Add(checkpointWindow)
+		var stored int64
+		if err := tx.QueryRow(ctx, count, start, end).Scan(&stored); err != nil {
+			return nil, fmt.Errorf("counting rows from %s: %w", start.Format(time.RFC3339), err)
+		}
+		if stored == 0 && committed[start] == 0 {
+			continue
+		}
+		window := ReconcileWindow{Start: start, End: end, Committed: committed[start], Stored: stored, Difference: stored - committed[start]}
+		if window.Difference != 0 {
+			reconciliation.Discrepancies++
+		}
+		reconciliation.Windows = append(reconciliation.Windows, window)
+	}
+	return reconciliation, nil
+}
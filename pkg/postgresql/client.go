@@ -1,16 +1,19 @@
 package postgresql
 
 import (
-	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -30,21 +33,357 @@ type Config struct {
 	PGWriters       int
 	PGParsers       int
 	PartitionScheme string
+
+	// WriterAsyncCommit turns off synchronous_commit on writer connections.
+	WriterAsyncCommit bool
+	// WriterSessionGUCs are extra session settings applied to writer connections.
+	WriterSessionGUCs map[string]string
+
+	// CardinalityInterval is how often series cardinality is sampled, 0 disables it.
+	CardinalityInterval time.Duration
+	// CardinalityTopN is the number of metric names reported by the sampler.
+	CardinalityTopN int
+	// CardinalityWarn logs a warning for metric names with more series than this, 0 disables it.
+	CardinalityWarn int64
+
+	// PartitionSizeInterval is how often partition sizes are collected, 0 disables it.
+	PartitionSizeInterval time.Duration
+	// PartitionSizeRecent is the number of newest partitions exported as metrics.
+	PartitionSizeRecent int
+
+	// IngestStatsInterval is how often the samples and label bytes stored
+	// per metric name are added to the ingest_stats table, 0 disables it.
+	IngestStatsInterval time.Duration
+	// IngestStatsTopN is the number of metric names recorded per interval,
+	// the others are summed up under __other__.
+	IngestStatsTopN int
+	// CheckpointInterval is how often the rows committed per hour of
+	// sample time are added to the ingest_checkpoints table, for Reconcile,
+	// 0 disables it.
+	CheckpointInterval time.Duration
+	// MetricsCatalog keeps the metrics_catalog table, the first and last
+	// sample time and the label keys of every metric name, up to date.
+	MetricsCatalog bool
+
+	// TenantLabel enables per-tenant throttling keyed on this label's value.
+	TenantLabel string
+	// TenantRate is the default samples per second allowed per tenant, 0 is unlimited.
+	TenantRate float64
+	// TenantRates overrides TenantRate for individual tenants.
+	TenantRates map[string]float64
+	// TenantBurst is the samples a tenant may send at once, at least one
+	// second of its rate.
+	TenantBurst float64
+	// MaxTenants is the number of tenants throttled on their own, the rest
+	// share one bucket. 0 is unlimited.
+	MaxTenants int
+	// TenantThrottleMode is ThrottleDrop or ThrottleReject.
+	TenantThrottleMode string
+
+	// MaxActiveSeries caps the series with a sample within
+	// ActiveSeriesWindow, 0 for no limit. Samples of new series beyond it are
+	// handled according to SeriesLimitMode, ThrottleDrop or ThrottleReject.
+	MaxActiveSeries    int
+	ActiveSeriesWindow time.Duration
+	SeriesLimitMode    string
+
+	// MaxQueueSamples bounds the samples waiting for a parser, 0 is unbounded.
+	MaxQueueSamples int
+	// QueueMaxAge evicts batches that waited longer than this, but only while
+	// more than QueueEvictWatermark samples are queued. 0 never evicts.
+	QueueMaxAge         time.Duration
+	QueueEvictWatermark int
+	// QueueShards is the number of independent sub-queues samples are
+	// spread over, 0 for one per GOMAXPROCS.
+	QueueShards int
+	// ReadySoftWatermark and ReadyHardWatermark are the queued samples at
+	// which Readiness turns degraded and unavailable, 0 to disable either.
+	ReadySoftWatermark int
+	ReadyHardWatermark int
+	// LabelsCacheSeries is the number of series whose encoded labels each
+	// parser remembers, 0 to encode the labels of every sample.
+	LabelsCacheSeries int
+	// LabelValueEncoding is how label values jsonb cannot store are
+	// encoded, one of the LabelEncoding constants, LabelEncodingReplace if
+	// empty.
+	LabelValueEncoding string
+	// BackfillWatermark is the number of queued live samples below which
+	// parsers take backfill batches, 0 only when no live sample is queued.
+	BackfillWatermark int
+
+	// DownsampleRules are REGEX=INTERVAL rules keeping only one sample per
+	// interval of every series whose metric name matches.
+	DownsampleRules []string
+	// DownsampleSeries bounds the series remembered for downsampling.
+	DownsampleSeries int
+
+	// SuppressUnchangedMaxGap skips samples repeating the value of the last
+	// stored sample of their series until this much time has passed since
+	// it, 0 stores every sample. SuppressUnchangedSeries bounds the series
+	// remembered for it.
+	SuppressUnchangedMaxGap time.Duration
+	SuppressUnchangedSeries int
+
+	// ValidationRules are REGEX=CHECKS rules dropping or clamping sample
+	// values out of bounds or decreasing where they should not, followed
+	// by those in ValidationRulesFile, which ReloadValidationRules reads
+	// again. ValidationSeries bounds the series remembered for monotonic
+	// checks.
+	ValidationRules     []string
+	ValidationRulesFile string
+	ValidationSeries    int
+
+	// SortBatches orders each COPY batch by time and name to keep the heap
+	// correlated with time, which is what the BRIN index relies on.
+	SortBatches bool
+
+	// InfinityMode is how sample values of +Inf and -Inf are stored, one of
+	// InfinityKeep, InfinityDrop or InfinityClamp. Clamped values are set to
+	// plus or minus InfinityClampMax.
+	InfinityMode     string
+	InfinityClampMax float64
+
+	// TimestampRounding rounds sample timestamps to this granularity before
+	// they are stored, 0 keeps them as sent. This is lossy.
+	TimestampRounding time.Duration
+
+	// CopyConcurrency splits each flush over this many concurrent COPY
+	// streams, capped by the writer pool size.
+	CopyConcurrency int
+
+	// SaturationRatio is the fraction of the commit interval a flush may take
+	// before the writer is considered saturated, unused when CommitSecs is 0.
+	SaturationRatio float64
+	// SaturationIntervals is the number of consecutive saturated flushes after
+	// which the adapter reports itself degraded.
+	SaturationIntervals int
+
+	// SecondaryTable is the table batches are copied to on the secondary
+	// target named by SECONDARY_DATABASE_URL. When it is "metrics" the
+	// adapter creates the table and its partitions there as on the primary,
+	// any other table must exist already.
+	SecondaryTable string
+	// SecondaryQueueBatches bounds the batches waiting for the secondary;
+	// batches beyond it are dead-lettered.
+	SecondaryQueueBatches int
+	// SecondaryRetries is how often a failed batch is retried on the
+	// secondary before it is dead-lettered.
+	SecondaryRetries int
+
+	// InstantQueryLookback is how far back QueryInstant looks for the latest
+	// sample of a series.
+	InstantQueryLookback time.Duration
+
+	// StatsListener, if set, is told about every flush of every writer.
+	StatsListener StatsListener
+
+	// EagerReadPool connects the read pool in NewClient instead of on the
+	// first read.
+	EagerReadPool bool
+
+	// ReadOrder is how read queries order their rows, one of the ReadOrder
+	// constants.
+	ReadOrder string
+
+	// ReportInvalidLabels returns read rows whose labels cannot be decoded
+	// in a series labeled __parse_error__ instead of skipping them.
+	ReportInvalidLabels bool
+
+	// MaxReadLookback is how far back reads may go, 0 for no limit. Queries
+	// starting earlier are clamped to it or rejected as given by
+	// ReadLookbackMode, LookbackClamp or LookbackReject.
+	MaxReadLookback  time.Duration
+	ReadLookbackMode string
+
+	// MaxQueryRows rejects reads estimated to read more rows than this,
+	// 0 disables the estimate. ResolutionScrapeInterval is the interval
+	// between samples of a series it assumes.
+	MaxQueryRows             int64
+	ResolutionScrapeInterval time.Duration
+
+	// EmptyReadCacheTTL is how long a read query that found no series is
+	// answered without running it again, 0 disables the cache.
+	EmptyReadCacheTTL time.Duration
+	// EmptyReadCacheRecent is how long ago a query must end to be cached,
+	// 0 is EmptyReadCacheTTL.
+	EmptyReadCacheRecent time.Duration
+
+	// LegacyTables are tables from before a schema migration, NAME or
+	// NAME:FLAVOR, that reads merge into the result of metrics.
+	LegacyTables []string
+
+	// ExplainSlowReads logs the plan of read queries taking longer than this,
+	// 0 disables it.
+	ExplainSlowReads time.Duration
+
+	// ShadowReadRate is the fraction of remote reads, 0 to 1, that are also
+	// run against the secondary target and compared with the primary.
+	ShadowReadRate float64
+	// ShadowReadValues compares every sample value, within
+	// ShadowReadTolerance, not only series and sample counts.
+	ShadowReadValues    bool
+	ShadowReadTolerance float64
+
+	// LeaderLockID is the advisory lock key instances compete for to elect
+	// the one performing DDL and maintenance. Instances sharing a database
+	// must use the same key. The key after it serializes partition creation.
+	LeaderLockID int64
+
+	// PartitionCreateHookSQL are statements run on every new leaf partition
+	// right after it is created, with PartitionPlaceholder replaced by its
+	// quoted name.
+	PartitionCreateHookSQL []string
+
+	// Columns maps the columns of the metrics table to other names.
+	Columns Columns
+
+	// SkipSchemaSetup runs against a schema created beforehand: the writers
+	// create neither tables, indexes nor partitions.
+	SkipSchemaSetup bool
+	// SchemaCheck is what a writer does when VerifySchema finds the metrics
+	// table differing from the configuration at startup, one of the
+	// SchemaCheck constants.
+	SchemaCheck string
+
+	// DeferredIndexes creates partitions without the name/time index and
+	// builds it concurrently once a partition's range has closed.
+	DeferredIndexes bool
+
+	// MaintenanceAnalyze, MaintenanceCluster and MaintenanceSummarize switch
+	// on ANALYZE, CLUSTER on the name/time index and BRIN summarization of
+	// partitions once their range has closed.
+	MaintenanceAnalyze   bool
+	MaintenanceCluster   bool
+	MaintenanceSummarize bool
+	// MaintenanceGrace is how long after a partition's range closed late
+	// samples are still expected before maintenance runs on it.
+	MaintenanceGrace time.Duration
+	// DeleteSafetyMargin is how long before now the cutoff of DeleteBefore
+	// has to be at least.
+	DeleteSafetyMargin time.Duration
+
+	// RequireTLS refuses to connect any pool whose connections may be
+	// protected less than MinSSLMode, SSLModeVerifyCA or SSLModeVerifyFull,
+	// and logs the TLS state of the first connection of each pool.
+	RequireTLS bool
+	MinSSLMode string
+
+	// PoolConfigHook, when set, may modify the configuration of every
+	// connection pool before it connects. It is called once per pool: once
+	// for the read pool and once for the pool of each writer.
+	PoolConfigHook func(kind PoolKind, poolConfig *pgxpool.Config) error
 }
 
-var promSamples = list.New()
+// Read orders. Every series must be returned in time order; ReadOrderTime
+// has the database sort all rows by time, ReadOrderSeries by name and time,
+// and ReadOrderNone leaves sorting each series to the adapter.
+const (
+	ReadOrderTime   = "time"
+	ReadOrderSeries = "series"
+	ReadOrderNone   = "none"
+)
 
-// QueueMutex is used thread safe operations on promSamples list object.
-var QueueMutex sync.Mutex
+// PoolKind tells PoolConfigHook which pool is being configured.
+type PoolKind string
+
+// Pool kinds passed to PoolConfigHook.
+const (
+	WriterPool PoolKind = "writer"
+	ReadPool   PoolKind = "read"
+	LeaderPool PoolKind = "leader"
+	// SecondaryPool is the pool of the dual-write target.
+	SecondaryPool PoolKind = "secondary"
+)
+
+// newPool connects a pool to DATABASE_URL. configure, if not nil, is applied
+// before the PoolConfigHook so that the hook sees the final configuration.
+// Errors are redacted, they never contain the password.
+func newPool(cfg *Config, kind PoolKind, configure func(*pgxpool.Config)) (*pgxpool.Pool, error) {
+	return connectPool(cfg, kind, databaseURL(), configure)
+}
+
+// connectPool is newPool for an explicit connection string.
+func connectPool(cfg *Config, kind PoolKind, dsn string, configure func(*pgxpool.Config)) (*pgxpool.Pool, error) {
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, redactError(err, dsn)
+	}
+	if configure != nil {
+		configure(poolConfig)
+	}
+	if cfg.PoolConfigHook != nil {
+		if err := cfg.PoolConfigHook(kind, poolConfig); err != nil {
+			return nil, redactError(fmt.Errorf("%s pool config hook: %w", kind, err), dsn)
+		}
+	}
+	if cfg.RequireTLS {
+		if err := cfg.checkTLS(kind, poolConfig); err != nil {
+			return nil, redactError(err, dsn)
+		}
+		activeTLSAudit.wrap(kind, poolConfig)
+	}
+	pool, err := pgxpool.ConnectConfig(context.Background(), poolConfig)
+	return pool, redactError(err, dsn)
+}
+
+// shuttingDown is set once any writer has been asked to stop.
+var shuttingDown int32
+
+// writers are the started writers, for status reporting.
+var (
+	writersMutex sync.Mutex
+	writers      []*PGWriter
+)
 
 // PGWriter - Threaded writer
 type PGWriter struct {
+	// commitRows and commitSecs are the effective commit thresholds,
+	// initialized from Config and tunable at runtime. Accessed atomically
+	// and kept first for 64-bit alignment.
+	commitRows int64
+	commitSecs int64
+	// bufferedRows mirrors len(valueRows) for the dispatcher, which picks
+	// the writer with the fewest without taking every writer's lock.
+	bufferedRows int64
+
 	DB          *pgxpool.Pool
 	id          int
 	KeepRunning bool
 	Running     bool
 
+	cfg       *Config
 	valueRows [][]interface{}
+	spareRows [][]interface{}
+
+	lastFlushDuration time.Duration
+	saturatedFlushes  int
+	flushes           int64
+	flushedRows       int64
+	flushErrors       int64
+
+	// draining is set once the writer's own parsers have stopped and it is
+	// about to flush for the last time; parsers of other writers no longer
+	// hand rows to it then.
+	draining bool
+
+	// bufferedSince is when the oldest row in valueRows was handed to the
+	// writer, flushingSince the same for the rows being copied; zero while
+	// there are none.
+	bufferedSince time.Time
+	flushingSince time.Time
+
+	// parsers are the writer's parsers, set under PGWriterMutex once they
+	// are started.
+	parsers []*PGParser
+
+	// wake interrupts the writer's wait for the end of the commit
+	// interval, when the buffered rows cross CommitRows, the thresholds
+	// change or the writer shuts down.
+	wake chan struct{}
+
+	// copyTarget, if set, takes the COPY of every flush instead of the
+	// pool, without bisection. Benchmarks set it to a fake.
+	copyTarget copier
 
 	PGWriterMutex sync.Mutex
 	logger        log.Logger
@@ -52,12 +391,87 @@ type PGWriter struct {
 
 // PGParser - Threaded parser
 type PGParser struct {
+	// Activity counters, updated atomically and read by the metrics
+	// collector and Status. Kept first for 64-bit alignment.
+	batches      int64
+	samples      int64
+	parseErrors  int64
+	handoffNanos int64
+	lastActivity int64 // unix nanoseconds
+
 	id          int
 	KeepRunning bool
 	Running     bool
 
-	lastPartitionTS time.Time
-	valueRows       [][]interface{}
+	lastPartitionKey int
+	valueRows        [][]interface{}
+	// ingest counts the samples per metric name when ingest stats are
+	// enabled, nil otherwise.
+	ingest map[string]*ingestCount
+	// catalog holds the metric names seen since the last hand-off when
+	// MetricsCatalog is set, nil otherwise.
+	catalog map[string]*catalogEntry
+	// labels remembers the encoded labels of recent series, nil when
+	// LabelsCacheSeries is 0.
+	labels *labelsLRU
+
+	// batchSize is a moving average of the sample batches popped from the
+	// queue, used to size the hand-offs to the writer.
+	batchSize   int
+	lastHandoff time.Time
+}
+
+const (
+	// parserHandoffRows and parserHandoffInterval bound how many rows and how
+	// long a parser buffers before handing its rows to the writer.
+	parserHandoffRows     = 1000
+	parserHandoffInterval = 100 * time.Millisecond
+)
+
+// handoff moves the rows buffered by the parser to the writer picked by the
+// dispatcher, taking the writer lock once for the whole slice. A draining
+// writer is skipped for the parser's own writer c, which keeps accepting
+// rows until its parsers have stopped.
+func (p *PGParser) handoff(c *PGWriter) {
+	if len(p.valueRows) > 0 {
+		begin := time.Now()
+		w := dispatch(c)
+		writerLockWait.lock(&w.PGWriterMutex)
+		if w.draining && w != c {
+			w.PGWriterMutex.Unlock()
+			w = c
+			writerLockWait.lock(&w.PGWriterMutex)
+		}
+		if w.bufferedSince.IsZero() {
+			w.bufferedSince = begin
+		}
+		w.valueRows = append(w.valueRows, p.valueRows...)
+		atomic.StoreInt64(&w.bufferedRows, int64(len(w.valueRows)))
+		w.PGWriterMutex.Unlock()
+		if atomic.LoadInt64(&w.bufferedRows) > int64(w.CommitRows()) || w.CommitSecs() <= 0 {
+			w.notify()
+		}
+		atomic.AddInt64(&p.handoffNanos, int64(time.Since(begin)))
+		atomic.AddInt64(&books.parserPending, -int64(len(p.valueRows)))
+		for i := range p.valueRows {
+			p.valueRows[i] = nil
+		}
+		p.valueRows = p.valueRows[:0]
+	}
+	p.mergeIngest()
+	p.mergeCatalog()
+	p.lastHandoff = time.Now()
+}
+
+// handoffDue reports whether the buffered rows should go to the writer: once
+// they reach the usual popped batch size (but at least parserHandoffRows),
+// or after parserHandoffInterval.
+func (p *PGParser) handoffDue() bool {
+	threshold := p.batchSize
+	if threshold < parserHandoffRows {
+		threshold = parserHandoffRows
+	}
+	return len(p.valueRows) >= threshold || (len(p.valueRows) > 0 && time.Since(p.lastHandoff) >= parserHandoffInterval)
 }
 
 // RunPGParser starts the client and listens for a shutdown call.
@@ -67,100 +481,429 @@ func (p *PGParser) RunPGParser(tid int, partitionScheme string, c *PGWriter) {
 	level.Info(c.logger).Log(fmt.Sprintf("bgparser%d", p.id), "Started")
 	p.Running = true
 	p.KeepRunning = true
+	p.lastHandoff = time.Now()
+	if c.cfg.IngestStatsInterval > 0 {
+		p.ingest = make(map[string]*ingestCount)
+	}
+	if c.cfg.MetricsCatalog {
+		p.catalog = make(map[string]*catalogEntry)
+	}
+	if c.cfg.LabelsCacheSeries > 0 {
+		p.labels = newLabelsLRU(c.cfg.LabelsCacheSeries)
+	}
 
-	// Loop that runs forever
-	for p.KeepRunning {
-		samples = Pop()
+	// Every parser prefers its own shard and takes from the others when it
+	// is empty. Once asked to stop, it goes on until all shards are empty,
+	// Write accepts no more samples by then.
+	shards := sampleQueue(c.cfg)
+	home := c.id*c.cfg.PGParsers + p.id
+	for p.KeepRunning || QueueLength() > 0 || BackfillQueueLength() > 0 {
+		atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+		queue := "backfill"
+		samples = popBackfill(c.cfg.BackfillWatermark)
+		if samples == nil {
+			queue = "live"
+			samples = popFresh(shards, home, c.cfg.QueueMaxAge, c.cfg.QueueEvictWatermark)
+		}
 		if samples != nil {
-			for _, sample := range *samples {
-				sMetric := metricString(sample.Metric)
-				ts := time.Unix(sample.Timestamp.Unix(), 0)
-				milliseconds := sample.Timestamp.UnixNano() / 1000000
-
-				i := strings.Index(sMetric, "{")
-				jsonbMap := make(map[string]interface{})
-				json.Unmarshal([]byte(sMetric[i:]), &jsonbMap)
-
-				c.PGWriterMutex.Lock()
-				c.valueRows = append(c.valueRows, []interface{}{toTimestamp(milliseconds), sMetric[:i], float64(sample.Value), jsonbMap})
-				c.PGWriterMutex.Unlock()
-
-				if ts.Year() != p.lastPartitionTS.Year() ||
-					ts.Month() != p.lastPartitionTS.Month() ||
-					ts.Day() != p.lastPartitionTS.Day() {
-					p.lastPartitionTS = ts
-					_ = c.setupPgPartitions(partitionScheme, p.lastPartitionTS)
+			parsedSamples.WithLabelValues(queue).Add(float64(len(*samples)))
+			atomic.AddInt64(&p.batches, 1)
+			atomic.AddInt64(&p.samples, int64(len(*samples)))
+			atomic.AddInt64(&books.parserPending, int64(len(*samples)))
+			p.batchSize = (3*p.batchSize + len(*samples)) / 4
+			downsampled, dropped, suppressed := p.parseBatch(c.cfg, partitionScheme, *samples, func(ts time.Time) bool {
+				if err := c.ensurePartition(partitionScheme, ts); err != nil {
+					level.Error(c.logger).Log("msg", "Creating partition failed", "time", ts, "err", err)
+					return false
 				}
+				return true
+			})
+			if p.labels != nil {
+				p.labels.flushCounts()
+			}
+			if downsampled > 0 {
+				books.settle(OutcomeDownsampled, int64(downsampled))
+				atomic.AddInt64(&books.parserPending, -int64(downsampled))
+			}
+			if dropped > 0 {
+				books.settle(OutcomeDropped, int64(dropped))
+				atomic.AddInt64(&books.parserPending, -int64(dropped))
+			}
+			if suppressed > 0 {
+				suppressedSamples.Add(float64(suppressed))
+				books.settle(OutcomeSuppressed, int64(suppressed))
+				atomic.AddInt64(&books.parserPending, -int64(suppressed))
 			}
 			runtime.GC()
 		}
-		time.Sleep(10 * time.Millisecond)
+		if p.handoffDue() {
+			p.handoff(c)
+		}
+		if p.KeepRunning {
+			time.Sleep(10 * time.Millisecond)
+		}
 	}
+	p.handoff(c)
 	level.Info(c.logger).Log(fmt.Sprintf("bgparser%d", p.id), "Shutdown")
 	p.Running = false
 }
 
+// parseBatch converts samples to rows appended to p.valueRows, and returns
+// the samples downsampled, dropped as invalid and suppressed as unchanged on
+// the way. ensure is called with the first row of every partition the rows
+// enter and reports whether the partition is in place.
+func (p *PGParser) parseBatch(cfg *Config, partitionScheme string, samples model.Samples, ensure func(ts time.Time) bool) (downsampled, dropped, suppressed int) {
+	for _, sample := range samples {
+		if activeDownsampler != nil && !activeDownsampler.keep(sample.Metric, int64(sample.Timestamp)) {
+			downsampled++
+			continue
+		}
+		value, ok := cfg.infinity(float64(sample.Value))
+		if ok {
+			value, ok = activeValidator.check(sample.Metric, int64(sample.Timestamp), value)
+		}
+		if !ok {
+			dropped++
+			continue
+		}
+		if activeUnchanged != nil && !activeUnchanged.keep(sample.Metric, int64(sample.Timestamp), value) {
+			suppressed++
+			if p.ingest != nil {
+				p.countSuppressed(string(sample.Metric[model.MetricNameLabel]))
+			}
+			continue
+		}
+		name, labels, labelBytes, ok := p.encodeLabels(sample.Metric)
+		if !ok {
+			atomic.AddInt64(&p.parseErrors, 1)
+		}
+		milliseconds := int64(sample.Timestamp)
+		if cfg.TimestampRounding > 0 {
+			milliseconds = roundMilliseconds(milliseconds, int64(cfg.TimestampRounding/time.Millisecond))
+		}
+		ts := toTimestamp(milliseconds)
+
+		p.valueRows = append(p.valueRows, []interface{}{ts, name, value, labels})
+		if p.ingest != nil {
+			p.count(name, labelBytes)
+		}
+		if p.catalog != nil {
+			p.noteCatalog(sample.Metric, milliseconds)
+		}
+
+		if key := partitionKey(partitionScheme, ts); key != p.lastPartitionKey && ensure(ts) {
+			p.lastPartitionKey = key
+		}
+	}
+	return downsampled, dropped, suppressed
+}
+
 // PGParserShutdown is a graceful shutdown
 func (p *PGParser) PGParserShutdown() {
 	p.KeepRunning = false
 }
 
+// writerSessionGUCs returns the session settings applied to every writer connection.
+func writerSessionGUCs(cfg *Config) map[string]string {
+	gucs := make(map[string]string, len(cfg.WriterSessionGUCs)+1)
+	for name, value := range cfg.WriterSessionGUCs {
+		gucs[name] = value
+	}
+	if cfg.WriterAsyncCommit {
+		gucs["synchronous_commit"] = "off"
+	}
+	return gucs
+}
+
+// newWriterPool connects the pool of a writer, whose connections get gucs.
+func newWriterPool(cfg *Config, gucs map[string]string) (*pgxpool.Pool, error) {
+	return newPool(cfg, WriterPool, func(poolConfig *pgxpool.Config) {
+		if len(gucs) == 0 {
+			return
+		}
+		// Only writer pools get these; the read pool in NewClient keeps the server defaults.
+		poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			for name, value := range gucs {
+				if _, err := conn.Exec(ctx, "SELECT set_config($1, $2, false)", name, value); err != nil {
+					return fmt.Errorf("setting %s: %w", name, err)
+				}
+			}
+			return nil
+		}
+	})
+}
+
 // RunPGWriter starts the client and listens for a shutdown call.
-func (c *PGWriter) RunPGWriter(l log.Logger, tid int, commitSecs int, commitRows int, Parsers int, partitionScheme string) {
+func (c *PGWriter) RunPGWriter(l log.Logger, tid int, cfg *Config) {
 	c.logger = l
 	c.id = tid
-	period := commitSecs * 1000
+	c.cfg = cfg
+	c.wake = make(chan struct{}, 1)
+	c.valueRows = make([][]interface{}, 0, cfg.CommitRows)
+	c.spareRows = make([][]interface{}, 0, cfg.CommitRows)
+	atomic.StoreInt64(&c.commitRows, int64(cfg.CommitRows))
+	atomic.StoreInt64(&c.commitSecs, int64(cfg.CommitSecs))
+	downsamplerOnce.Do(func() {
+		activeDownsampler = newDownsampler(cfg)
+	})
+	unchangedOnce.Do(func() {
+		activeUnchanged = newUnchangedFilter(cfg)
+	})
+	validatorOnce.Do(func() {
+		configureValidator(l, cfg)
+	})
+	Parsers := cfg.PGParsers
+	partitionScheme := cfg.PartitionScheme
 	var err error
 	var parser [20]PGParser
 
-	c.DB, err = pgxpool.Connect(context.Background(), os.Getenv("DATABASE_URL"))
+	gucs := writerSessionGUCs(cfg)
+	if len(gucs) > 0 {
+		level.Info(c.logger).Log(fmt.Sprintf("bgwriter%d", c.id), "Session settings", "gucs", fmt.Sprintf("%v", gucs))
+	}
+	c.DB, err = newWriterPool(cfg, gucs)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error: Unable to connect to database using DATABASE_URL=", os.Getenv("DATABASE_URL"))
+		fmt.Fprintln(os.Stderr, "Error: Unable to connect to database using DATABASE_URL=", redactedDSN(databaseURL()), err)
 		os.Exit(1)
 	}
+	// Registered once connected, the health check may use its pool.
+	registerWriter(c)
 
+	// Set before the background tasks below start, their loops check it.
+	c.Running = true
+	c.KeepRunning = true
 	if c.id == 0 {
-		c.setupPgPrometheus()
-		_ = c.setupPgPartitions(partitionScheme, time.Now())
+		attached, err := c.setupPgPrometheus()
+		if err != nil {
+			level.Error(c.logger).Log("msg", "Schema setup failed", "err", err)
+		}
+		c.checkSchema(attached)
+		_ = c.ensurePartition(partitionScheme, time.Now())
+		go c.runPartitionPrecreation(partitionScheme)
+		if cfg.maintenanceEnabled() || len(cfg.PartitionCreateHookSQL) > 0 {
+			go c.runMaintenance()
+		}
+		if cfg.IngestStatsInterval > 0 {
+			go c.runIngestStats()
+		}
+		if cfg.CheckpointInterval > 0 {
+			go c.runCheckpoints()
+		}
+		go c.runTombstones()
 	}
 	level.Info(c.logger).Log(fmt.Sprintf("bgwriter%d", c.id), fmt.Sprintf("Starting %d Parsers", Parsers))
+	parsers := make([]*PGParser, Parsers)
+	for p := 0; p < Parsers; p++ {
+		parsers[p] = &parser[p]
+	}
+	writerLockWait.lock(&c.PGWriterMutex)
+	c.parsers = parsers
+	c.PGWriterMutex.Unlock()
 	for p := 0; p < Parsers; p++ {
 		go parser[p].RunPGParser(p, partitionScheme, c)
 		defer parser[p].PGParserShutdown()
 	}
 	level.Info(c.logger).Log(fmt.Sprintf("bgwriter%d", c.id), "Started")
-	c.Running = true
-	c.KeepRunning = true
-	// Loop that runs forever
-	for c.KeepRunning {
-		if (period <= 0 && len(c.valueRows) > 0) || (len(c.valueRows) > commitRows) {
-			c.PGWriterSave()
-			period = commitSecs * 1000
-		} else {
+	c.flushLoop(realClock{}, c.PGWriterSave)
+	// Stop the parsers first so that the rows they buffered make it into
+	// the final flush.
+	for p := 0; p < Parsers; p++ {
+		parser[p].PGParserShutdown()
+	}
+	for p := 0; p < Parsers; p++ {
+		for parser[p].Running {
 			time.Sleep(10 * time.Millisecond)
-			period -= 10
 		}
 	}
+	writerLockWait.lock(&c.PGWriterMutex)
+	c.draining = true
+	c.PGWriterMutex.Unlock()
 	c.PGWriterSave()
 	level.Info(c.logger).Log(fmt.Sprintf("bgwriter%d", c.id), "Shutdown")
 	c.Running = false
 }
 
+// writerClock is the time source of the writer's flush loop, faked in
+// tests.
+type writerClock interface {
+	Now() time.Time
+	// NewTimer returns a channel receiving the time once d has passed, and
+	// a function stopping the timer.
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// flushLoop calls flush until KeepRunning is unset. The writer sleeps
+// until the commit interval since the start of the last flush has passed or
+// it is woken up, and flushes if the interval is over or the rows crossed
+// CommitRows. Measuring from the start of the flush keeps the interval even
+// when flushes are slow, and the deadline is recomputed on every wake-up,
+// so that a changed CommitSecs applies to the current period. With
+// CommitSecs 0 every hand-off wakes the writer to flush.
+func (c *PGWriter) flushLoop(clock writerClock, flush func()) {
+	periodStart := clock.Now()
+	for c.KeepRunning {
+		var expired <-chan time.Time
+		var stop func() bool
+		if secs := c.CommitSecs(); secs > 0 {
+			expired, stop = clock.NewTimer(periodStart.Add(time.Duration(secs) * time.Second).Sub(clock.Now()))
+		}
+		select {
+		case <-expired:
+		case <-c.wake:
+		}
+		if stop != nil {
+			stop()
+		}
+		if !c.KeepRunning {
+			break
+		}
+		now := clock.Now()
+		due := !now.Before(periodStart.Add(time.Duration(c.CommitSecs()) * time.Second))
+		buffered := atomic.LoadInt64(&c.bufferedRows)
+		if buffered > int64(c.CommitRows()) || (due && buffered > 0) {
+			flush()
+			periodStart = now
+		} else if due {
+			// Nothing arrived during the period, the next one starts now.
+			periodStart = now
+		}
+	}
+}
+
+// dispatchNext rotates where dispatch starts looking, so that writers with
+// equally few rows take turns.
+var dispatchNext uint32
+
+// dispatch picks the writer the next rows are handed to: the one with the
+// fewest buffered rows, so that all writers flush evenly no matter whose
+// parsers popped the samples. fallback is returned if no writer has fewer.
+func dispatch(fallback *PGWriter) *PGWriter {
+	writersMutex.Lock()
+	candidates := writers
+	writersMutex.Unlock()
+	if len(candidates) <= 1 {
+		return fallback
+	}
+	best, bestRows := fallback, atomic.LoadInt64(&fallback.bufferedRows)
+	start := int(atomic.AddUint32(&dispatchNext, 1))
+	for i := range candidates {
+		w := candidates[(start+i)%len(candidates)]
+		if rows := atomic.LoadInt64(&w.bufferedRows); rows < bestRows {
+			best, bestRows = w, rows
+		}
+	}
+	return best
+}
+
+// registerWriter makes a running writer visible in the status snapshot.
+func registerWriter(c *PGWriter) {
+	writersMutex.Lock()
+	writers = append(writers, c)
+	writersMutex.Unlock()
+}
+
 // PGWriterShutdown - Set shutdown flag for graceful shutdown
 func (c *PGWriter) PGWriterShutdown() {
+	atomic.StoreInt32(&shuttingDown, 1)
 	c.KeepRunning = false
+	c.notify()
+}
+
+// notify wakes the writer up if it is waiting for the commit interval to
+// end. It never blocks: a pending wake-up covers any number of reasons.
+func (c *PGWriter) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
 }
 
 // PGWriterSave save data to DB
 func (c *PGWriter) PGWriterSave() {
 	var err error
 	begin := time.Now()
-	c.PGWriterMutex.Lock()
-	rowCount := int64(len(c.valueRows))
-	copyCount, err := c.DB.CopyFrom(context.Background(), pgx.Identifier{"metrics"}, []string{"time", "name", "value", "labels"}, pgx.CopyFromRows(c.valueRows))
-	c.valueRows = nil
+
+	// Swap in the spare buffer so the parsers keep appending while we copy.
+	writerLockWait.lock(&c.PGWriterMutex)
+	rows := c.valueRows
+	c.valueRows = c.spareRows
+	c.spareRows = nil
+	c.flushingSince = c.bufferedSince
+	c.bufferedSince = time.Time{}
+	atomic.StoreInt64(&c.bufferedRows, int64(len(c.valueRows)))
+	atomic.AddInt64(&books.flushing, int64(len(rows)))
+	c.PGWriterMutex.Unlock()
+
+	batch := rows
+	if c.cfg.TimestampRounding > 0 {
+		// Rounding makes samples of the same series collide, which would
+		// violate the unique constraint and fail the whole COPY.
+		batch = dedupRows(batch)
+	}
+	rowCount := int64(len(batch))
+	if c.cfg.SortBatches {
+		sortRows(batch)
+	}
+	copyCount, err := c.copyRows(batch)
+	books.settle(OutcomeDeduplicated, int64(len(rows)-len(batch)))
+	books.settle(OutcomeCommitted, copyCount)
+	books.settle(OutcomeFailed, rowCount-copyCount)
+	atomic.AddInt64(&books.flushing, -int64(len(rows)))
+	if err == nil {
+		targetBatches.WithLabelValues("primary", "success").Inc()
+		targetRows.WithLabelValues("primary").Add(float64(copyCount))
+		if secondary != nil {
+			secondary.enqueue(batch)
+		}
+		if c.cfg.MetricsCatalog {
+			if err := c.flushCatalog(context.Background()); err != nil {
+				level.Error(c.logger).Log("msg", "Updating the metrics catalog failed", "err", err)
+			}
+		}
+	} else {
+		targetBatches.WithLabelValues("primary", "error").Inc()
+	}
+
+	duration := time.Since(begin)
+	commitSecs := c.CommitSecs()
+	// Without a commit interval every flush starts as soon as rows arrive,
+	// there is no interval to fall behind.
+	saturated := c.cfg.SaturationRatio > 0 && commitSecs > 0 && duration.Seconds() > c.cfg.SaturationRatio*float64(commitSecs)
+	spare := c.recycleRows(rows)
+	writerLockWait.lock(&c.PGWriterMutex)
+	c.spareRows = spare
+	// Rows that could not be copied are dropped, so none of them are
+	// buffered anymore either way.
+	c.flushingSince = time.Time{}
+	c.lastFlushDuration = duration
+	c.flushes++
+	c.flushedRows += copyCount
+	if err != nil {
+		c.flushErrors++
+	}
+	if saturated {
+		c.saturatedFlushes++
+	} else {
+		c.saturatedFlushes = 0
+	}
 	c.PGWriterMutex.Unlock()
 
+	if saturated {
+		level.Warn(c.logger).Log("msg", "Flush is too slow for the commit interval", "writer", c.id, "duration", duration, "rows", rowCount, "commitSecs", commitSecs)
+		writerSaturated.WithLabelValues(strconv.Itoa(c.id)).Set(1)
+	} else {
+		writerSaturated.WithLabelValues(strconv.Itoa(c.id)).Set(0)
+	}
+
 	if err != nil {
 		level.Error(c.logger).Log("msg", "COPY failed for metrics", "err", err)
 	}
@@ -168,33 +911,158 @@ func (c *PGWriter) PGWriterSave() {
 		level.Error(c.logger).Log("msg", "All rows not copied metrics", "copyCount", copyCount, "rowCount", rowCount)
 	}
 
-	duration := time.Since(begin).Seconds()
-	level.Info(c.logger).Log("metric", fmt.Sprintf("BGWriter%d: Processed samples count,%d, duration,%v", c.id, rowCount, duration))
+	level.Info(c.logger).Log("metric", fmt.Sprintf("BGWriter%d: Processed samples count,%d, duration,%v", c.id, rowCount, duration.Seconds()))
+	c.notifyFlush(rowCount, copyCount, duration, err)
 }
 
-// Push - Push element at then end of list
-func Push(samples *model.Samples) {
-	QueueMutex.Lock()
-	promSamples.PushBack(samples)
-	QueueMutex.Unlock()
+// recycleRows empties a flushed buffer for reuse as the next fill buffer. A
+// buffer grown far beyond CommitRows by a one-off burst is released instead,
+// so that it does not pin memory forever.
+func (c *PGWriter) recycleRows(rows [][]interface{}) [][]interface{} {
+	if commitRows := c.CommitRows(); cap(rows) > 2*commitRows && len(rows) <= commitRows {
+		return make([][]interface{}, 0, commitRows)
+	}
+	rows = rows[:cap(rows)]
+	for i := range rows {
+		rows[i] = nil
+	}
+	return rows[:0]
 }
 
-// Pop - Pop first element from list
-func Pop() *model.Samples {
-	QueueMutex.Lock()
-	defer QueueMutex.Unlock()
-	p := promSamples.Front()
-	if p != nil {
-		return promSamples.Remove(p).(*model.Samples)
+// copyRows writes rows to the metrics table, split over up to
+// CopyConcurrency concurrent COPY streams.
+func (c *PGWriter) copyRows(rows [][]interface{}) (int64, error) {
+	if c.copyTarget != nil {
+		return copyMetrics(context.Background(), c.copyTarget, c.cfg.columns(), rows)
 	}
-	return nil
+	shards := c.cfg.CopyConcurrency
+	if maxConns := int(c.DB.Stat().MaxConns()); shards > maxConns {
+		shards = maxConns
+	}
+	if shards > len(rows) {
+		shards = len(rows)
+	}
+	if shards <= 1 {
+		return c.copyOrBisect(rows)
+	}
+
+	// Contiguous shards keep each stream in the order the batch was sorted in.
+	size := (len(rows) + shards - 1) / shards
+	errs := make([]error, shards)
+	var copied int64
+	var wg sync.WaitGroup
+	for shard := 0; shard < shards; shard++ {
+		start := shard * size
+		if start >= len(rows) {
+			break
+		}
+		end := start + size
+		if end > len(rows) {
+			end = len(rows)
+		}
+		wg.Add(1)
+		go func(shard int, part [][]interface{}) {
+			defer wg.Done()
+			n, err := c.copyOrBisect(part)
+			atomic.AddInt64(&copied, n)
+			errs[shard] = err
+		}(shard, rows[start:end])
+	}
+	wg.Wait()
+
+	var firstErr error
+	for shard, err := range errs {
+		if err != nil {
+			level.Error(c.logger).Log("msg", "COPY shard failed", "shard", shard, "err", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return copied, firstErr
+}
+
+// sortRows orders rows built by the parsers by time, then name.
+func sortRows(rows [][]interface{}) {
+	sort.Slice(rows, func(i, j int) bool {
+		ti, tj := rows[i][0].(time.Time), rows[j][0].(time.Time)
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return rows[i][1].(string) < rows[j][1].(string)
+	})
+}
+
+// dedupRows drops rows with the same time, name and labels as a later row,
+// so the last value received wins.
+func dedupRows(rows [][]interface{}) [][]interface{} {
+	seen := make(map[string]int, len(rows))
+	deduped := rows[:0]
+	for _, row := range rows {
+		var labels []byte
+		switch l := row[3].(type) {
+		case []byte:
+			labels = l
+		default:
+			labels, _ = json.Marshal(l)
+		}
+		key := fmt.Sprintf("%d\xff%s\xff%s", row[0].(time.Time).UnixNano(), row[1].(string), labels)
+		if i, ok := seen[key]; ok {
+			deduped[i] = row
+			continue
+		}
+		seen[key] = len(deduped)
+		deduped = append(deduped, row)
+	}
+	return deduped
+}
+
+// roundMilliseconds rounds ms to the nearest multiple of step, with halves
+// rounding up.
+func roundMilliseconds(ms int64, step int64) int64 {
+	if step <= 1 {
+		return ms
+	}
+	r := ms % step
+	if r < 0 {
+		r += step
+	}
+	rounded := ms - r
+	if 2*r >= step {
+		rounded += step
+	}
+	return rounded
 }
 
 // Client - struct to hold critical values
 type Client struct {
 	logger log.Logger
-	DB     *pgxpool.Pool
 	cfg    *Config
+	done   chan struct{}
+
+	// db is the read pool, nil until the first use of pool() unless
+	// EagerReadPool is set. A failed connect is retried after poolBackoff.
+	poolMutex   sync.Mutex
+	db          *pgxpool.Pool
+	poolErr     error
+	poolRetry   time.Time
+	poolBackoff time.Duration
+
+	limiter *tenantLimiter
+	shadow  *shadowReader
+	legacy  []*legacyTable
+	probes  seriesProbes
+
+	statusMutex sync.Mutex
+	cardinality []SeriesCardinality
+	partitions  []PartitionSize
+	slowQueries []SlowQuery
+	explained   []time.Time
+
+	tombstones tombstoneCache
+	// emptyReads remembers queries that found nothing, nil unless
+	// EmptyReadCacheTTL is set.
+	emptyReads *emptyReadCache
 }
 
 // NewClient creates a new PostgreSQL client
@@ -203,64 +1071,85 @@ func NewClient(logger log.Logger, cfg *Config) *Client {
 		logger = log.NewNopLogger()
 	}
 
-	pool, err := pgxpool.Connect(context.Background(), os.Getenv("DATABASE_URL"))
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error: Unable to connect to database using DATABASE_URL=", os.Getenv("DATABASE_URL"))
-		os.Exit(1)
-	}
+	client := NewPoolClient(logger, cfg)
+	client.limiter = newTenantLimiter(cfg)
+	client.emptyReads = newEmptyReadCache(cfg)
 
-	client := &Client{
-		logger: logger,
-		DB:     pool,
-		cfg:    cfg,
+	if cfg.EagerReadPool {
+		if _, err := client.pool(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: Unable to connect to database using DATABASE_URL=", redactedDSN(databaseURL()), err)
+			os.Exit(1)
+		}
 	}
 
-	return client
-}
+	activeSeriesBudget.configure(cfg)
+	activeReadiness.configure(logger, cfg)
+	activeInvalidLabels.configure(logger, cfg)
+	activeLabelEncoder.configure(logger, cfg)
+	setInfoConfig(cfg)
 
-func (c *PGWriter) setupPgPrometheus() error {
-	level.Info(c.logger).Log("msg", "creating tables")
+	// Validate has checked the legacy tables already.
+	client.legacy, _ = parseLegacyTables(cfg.LegacyTables)
 
-	_, err := c.DB.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS metrics ( time timestamptz, name TEXT NOT NULL, value FLOAT8, labels jsonb, UNIQUE(time, name, labels) ) PARTITION BY RANGE (time)")
-	if err != nil {
-		return err
+	if cfg.ShadowReadRate > 0 {
+		var err error
+		if client.shadow, err = newShadowReader(logger, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Error: Unable to connect to database using SECONDARY_DATABASE_URL=", redactedDSN(secondaryDatabaseURL()), err)
+			os.Exit(1)
+		}
 	}
 
-	_, err = c.DB.Exec(context.Background(), "CREATE INDEX IF NOT EXISTS metrics_time_brin_idx ON metrics USING BRIN (time)")
-	if err != nil {
-		return err
+	if cfg.CardinalityInterval > 0 {
+		go client.runCardinalitySampler()
 	}
-
-	_, err = c.DB.Exec(context.Background(), "CREATE INDEX IF NOT EXISTS metrics_name_time_idx on metrics USING btree (name, time DESC)")
-	if err != nil {
-		return err
+	if cfg.PartitionSizeInterval > 0 {
+		go client.runPartitionSizeCollector()
 	}
 
-	return nil
+	return client
 }
 
-func (c *PGWriter) setupPgPartitions(partitionScheme string, lastPartitionTS time.Time) error {
-	sDate := lastPartitionTS
-	eDate := sDate
-	if partitionScheme == "daily" {
-		level.Info(c.logger).Log("msg", "Creating partition, daily")
-		_, err := c.DB.Exec(context.Background(), fmt.Sprintf("CREATE TABLE IF NOT EXISTS metrics_%s PARTITION OF metrics FOR VALUES FROM ('%s 00:00:00') TO ('%s 00:00:00')", sDate.Format("20060102"), sDate.Format("2006-01-02"), eDate.AddDate(0, 0, 1).Format("2006-01-02")))
-		if err != nil {
-			return err
-		}
-	} else if partitionScheme == "hourly" {
-		sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS metrics_%s PARTITION OF metrics FOR VALUES FROM ('%s 00:00:00') TO ('%s 00:00:00') PARTITION BY RANGE (time);", sDate.Format("20060102"), sDate.Format("2006-01-02"), eDate.AddDate(0, 0, 1).Format("2006-01-02"))
-		var h int
-		for h = 0; h < 23; h++ {
-			sql = fmt.Sprintf("%s CREATE TABLE IF NOT EXISTS metrics_%s_%02d PARTITION OF metrics_%s FOR VALUES FROM ('%s %02d:00:00') TO ('%s %02d:00:00');", sql, sDate.Format("20060102"), h, sDate.Format("20060102"), sDate.Format("2006-01-02"), h, eDate.Format("2006-01-02"), h+1)
+// NewPoolClient creates a client for one-off commands such as Reconcile and
+// VerifySchema. It only connects the read pool, on first use, and starts
+// none of the background samplers and collectors of NewClient.
+func NewPoolClient(logger log.Logger, cfg *Config) *Client {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	activeTLSAudit.configure(logger)
+	return &Client{
+		logger: logger,
+		cfg:    cfg,
+		done:   make(chan struct{}),
+	}
+}
+
+// checkSchema verifies the metrics table once it has been created and logs
+// the differences found, exiting if SchemaCheck is SchemaCheckFail. A table
+// the adapter attached to rather than created gets each difference logged
+// on its own line, as it was likely set up outside of the adapter.
+func (c *PGWriter) checkSchema(attached bool) {
+	if c.cfg.SchemaCheck == SchemaCheckOff {
+		return
+	}
+	err := verifySchema(context.Background(), c.DB, c.cfg)
+	if err == nil {
+		if attached {
+			level.Info(c.logger).Log("msg", "Existing table metrics matches the configuration")
 		}
-		level.Info(c.logger).Log("msg", "Creating partition, hourly")
-		_, err := c.DB.Exec(context.Background(), fmt.Sprintf("%s CREATE TABLE IF NOT EXISTS metrics_%s_%02d PARTITION OF metrics_%s FOR VALUES FROM ('%s %02d:00:00') TO ('%s 00:00:00');", sql, sDate.Format("20060102"), h, sDate.Format("20060102"), sDate.Format("2006-01-02"), h, eDate.AddDate(0, 0, 1).Format("2006-01-02")))
-		if err != nil {
-			return err
+		return
+	}
+	var schemaErr *SchemaError
+	if attached && errors.As(err, &schemaErr) {
+		for _, problem := range schemaErr.Problems {
+			level.Error(c.logger).Log("msg", "Existing table metrics differs from the configuration, writes may fail", "problem", problem)
 		}
 	}
-	return nil
+	if c.cfg.SchemaCheck == SchemaCheckFail {
+		level.Error(c.logger).Log("msg", "Schema verification failed", "err", err)
+		os.Exit(1)
+	}
+	level.Warn(c.logger).Log("msg", "Schema verification failed", "err", err)
 }
 
 func metricString(m model.Metric) string {
@@ -288,9 +1177,82 @@ func metricString(m model.Metric) string {
 	}
 }
 
-// Write implements the Writer interface and writes metric samples to the database
+// WriteOptions change how Client.WriteWithOptions treats a batch.
+type WriteOptions struct {
+	// Backfill queues the samples apart from live ones, parsers take them
+	// only while fewer than BackfillWatermark live samples are queued.
+	Backfill bool
+	// Rejected holds the samples of the request the caller rejected
+	// already, if any; the write adds its own rejections to it.
+	Rejected *RejectionSummary
+}
+
+// Write implements the Writer interface and writes metric samples to the
+// database. See ErrQueueFull, ErrThrottled and ErrShuttingDown for the errors
+// callers are expected to handle; they are wrapped in a *RejectionError
+// describing the rejected samples, so test for them with errors.Is.
 func (c *Client) Write(samples model.Samples) error {
-	Push(&samples)
+	return c.WriteWithOptions(samples, WriteOptions{})
+}
+
+// WriteWithOptions is Write with options for the batch. MaxQueueSamples
+// bounds the live and the backfill queue separately.
+func (c *Client) WriteWithOptions(samples model.Samples, opts WriteOptions) error {
+	rejected := opts.Rejected
+	if rejected == nil {
+		rejected = &RejectionSummary{}
+	}
+	defer recordRejections(rejected)
+	rejectAll := func(reason string, err error) error {
+		for _, s := range samples {
+			rejected.Add(reason, s.Metric, 1)
+		}
+		return &RejectionError{Err: err, Summary: rejected}
+	}
+
+	books.receive(len(samples))
+	if atomic.LoadInt32(&shuttingDown) != 0 {
+		books.settle(OutcomeRejected, int64(len(samples)))
+		return rejectAll(RejectShuttingDown, ErrShuttingDown)
+	}
+	queued := QueueLength()
+	if opts.Backfill {
+		queued = BackfillQueueLength()
+	}
+	if c.cfg.MaxQueueSamples > 0 && queued+len(samples) > c.cfg.MaxQueueSamples {
+		books.settle(OutcomeRejected, int64(len(samples)))
+		return rejectAll(RejectQueueFull, ErrQueueFull)
+	}
+	if c.limiter != nil {
+		received := len(samples)
+		var err error
+		samples, err = c.limiter.admit(samples, rejected)
+		if err != nil {
+			books.settle(OutcomeRejected, int64(received))
+			return &RejectionError{Err: err, Summary: rejected}
+		}
+		books.settle(OutcomeDropped, int64(received-len(samples)))
+		if len(samples) == 0 {
+			return nil
+		}
+	}
+	received := len(samples)
+	samples, err := activeSeriesBudget.admit(samples, rejected)
+	if err != nil {
+		books.settle(OutcomeRejected, int64(received))
+		return &RejectionError{Err: err, Summary: rejected}
+	}
+	books.settle(OutcomeDropped, int64(received-len(samples)))
+	if len(samples) == 0 {
+		return nil
+	}
+	if opts.Backfill {
+		queuedSamplesTotal.WithLabelValues("backfill").Add(float64(len(samples)))
+		backfillQueue.push(&samples)
+		return nil
+	}
+	queuedSamplesTotal.WithLabelValues("live").Add(float64(len(samples)))
+	pushShard(sampleQueue(c.cfg), &samples)
 	return nil
 }
 
@@ -298,6 +1260,9 @@ type sampleLabels struct {
 	JSON        []byte
 	Map         map[string]string
 	OrderedKeys []string
+	// err is set instead of failing the scan when the labels cannot be
+	// decoded, see scanRows.
+	err error
 }
 
 func createOrderedKeys(m *map[string]string) []string {
@@ -311,9 +1276,12 @@ func createOrderedKeys(m *map[string]string) []string {
 
 // Close - Close database connections
 func (c *Client) Close() {
-	if c.DB != nil {
-		c.DB.Close()
+	close(c.done)
+	c.poolMutex.Lock()
+	if c.db != nil {
+		c.db.Close()
 	}
+	c.poolMutex.Unlock()
 }
 
 func (l *sampleLabels) Scan(value interface{}) error {
@@ -324,11 +1292,10 @@ func (l *sampleLabels) Scan(value interface{}) error {
 
 	switch t := value.(type) {
 	case []uint8:
-		m := make(map[string]string)
-		err := json.Unmarshal(t, &m)
-
+		m, err := decodeLabels(t)
 		if err != nil {
-			return err
+			*l = sampleLabels{JSON: t, err: err}
+			return nil
 		}
 
 		*l = sampleLabels{
@@ -362,80 +1329,52 @@ func (l *sampleLabels) len() int {
 	return len(l.OrderedKeys)
 }
 
-// Read implements the Reader interface and reads metrics samples from the database
+// Read implements the Reader interface and reads metrics samples from the
+// database. Errors are returned as a *ReadError.
 func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 
 	fmt.Printf("READ req.Queries: %v\n", req.Queries)
 	labelsToSeries := map[string]*prompb.TimeSeries{}
 
-	for _, q := range req.Queries {
-		command, err := c.buildCommand(q)
-
+	limited := &prompb.ReadRequest{Queries: make([]*prompb.Query, len(req.Queries))}
+	for i, q := range req.Queries {
+		q, err := c.limitLookback(q)
 		if err != nil {
-			return nil, err
+			return nil, readError(err)
 		}
+		if err := c.checkResolution(context.Background(), q); err != nil {
+			return nil, readError(err)
+		}
+		limited.Queries[i] = q
+	}
+	req = limited
 
-		level.Debug(c.logger).Log("msg", "Executed query", "query", command)
-
-		rows, err := c.DB.Query(context.Background(), command)
-
-		if err != nil {
-			rows.Close()
-			return nil, err
-		}
-
-		for rows.Next() {
-			var (
-				value  float64
-				name   string
-				labels sampleLabels
-				time   time.Time
-			)
-			err := rows.Scan(&time, &name, &value, &labels)
-
-			if err != nil {
-				rows.Close()
-				return nil, err
-			}
-
-			key := labels.key(name)
-			ts, ok := labelsToSeries[key]
-
-			if !ok {
-				labelPairs := make([]prompb.Label, 0, labels.len()+1)
-				labelPairs = append(labelPairs, prompb.Label{
-					Name:  model.MetricNameLabel,
-					Value: name,
-				})
-
-				for _, k := range labels.OrderedKeys {
-					labelPairs = append(labelPairs, prompb.Label{
-						Name:  k,
-						Value: labels.Map[k],
-					})
-				}
-
-				ts = &prompb.TimeSeries{
-					Labels:  labelPairs,
-					Samples: make([]prompb.Sample, 0, 100),
-				}
-				labelsToSeries[key] = ts
+	for _, q := range req.Queries {
+		err := c.querySeries(context.Background(), q, c.cfg.ReadOrder, func(labels []prompb.Label, samples []prompb.Sample) error {
+			key := labelsKey(labels)
+			if ts, ok := labelsToSeries[key]; ok {
+				ts.Samples = append(ts.Samples, samples...)
+				return nil
 			}
-
-			ts.Samples = append(ts.Samples, prompb.Sample{
-				Timestamp: time.UnixNano() / 1000000,
-				Value:     value,
-			})
+			labelsToSeries[key] = &prompb.TimeSeries{Labels: labels, Samples: samples}
+			return nil
+		})
+		if err != nil {
+			return nil, readError(err)
 		}
+	}
 
-		err = rows.Err()
-		rows.Close()
-
-		if err != nil {
-			return nil, err
+	// The samples of a series found by several queries are appended.
+	if len(req.Queries) > 1 {
+		for _, ts := range labelsToSeries {
+			ts.Samples = orderSamples(c.logger, ts.Labels, ts.Samples)
 		}
 	}
 
+	if c.shadow != nil {
+		c.shadow.compare(req, labelsToSeries)
+	}
+
 	resp := prompb.ReadResponse{
 		Results: []*prompb.QueryResult{
 			{
@@ -452,69 +1391,141 @@ func (c *Client) Read(req *prompb.ReadRequest) (*prompb.ReadResponse, error) {
 	return &resp, nil
 }
 
-// HealthCheck implements the healtcheck interface
-func (c *Client) HealthCheck() error {
-	rows, err := c.DB.Query(context.Background(), "SELECT 1")
-	defer rows.Close()
+// toTimestamp converts a Prometheus timestamp in milliseconds since the
+// epoch to a time. Before the epoch sec and nsec are both negative, which
+// time.Unix normalizes.
+func toTimestamp(milliseconds int64) time.Time {
+	sec := milliseconds / 1000
+	nsec := (milliseconds - (sec * 1000)) * 1000000
+	return time.Unix(sec, nsec).UTC()
+}
+
+// fromTimestamp is the inverse of toTimestamp. It floors sub-millisecond
+// parts, also before the epoch, and unlike t.UnixNano() does not overflow
+// outside the years 1678 to 2262.
+func fromTimestamp(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+}
+
+func (c *Client) buildQuery(q *prompb.Query) (string, []interface{}, error) {
+	return c.readQuery(context.Background(), q, c.cfg.ReadOrder)
+}
+
+// buildTableQuery builds the read query for q against table, which must be
+// a valid identifier, with the given columns and rows ordered as given by one
+// of the ReadOrder constants, leaving out the rows of tombstones, and returns
+// it with its parameters.
+func buildTableQuery(table string, columns Columns, q *prompb.Query, order string, tombstones []tombstone) (string, []interface{}, error) {
+	var args sqlArgs
+	where, err := buildWhere(columns, q.Matchers, q.StartTimestampMs, q.EndTimestampMs, &args)
+	if err != nil {
+		return "", nil, err
+	}
+	exclude, err := tombstoneWhere(columns, tombstones, q.StartTimestampMs, q.EndTimestampMs, &args)
 	if err != nil {
-		level.Debug(c.logger).Log("msg", "Health check error", "err", err)
-		return err
+		return "", nil, err
+	}
+	if exclude != "" {
+		where += " AND " + exclude
 	}
 
-	return nil
+	col := columns.quoted()
+	command := fmt.Sprintf("SELECT %s, %s, %s, %s FROM %s WHERE %s", col.Time, col.Name, col.Value, col.Labels, table, where)
+	switch order {
+	case ReadOrderNone:
+	case ReadOrderSeries:
+		command += fmt.Sprintf(" ORDER BY %s, %s", col.Name, col.Time)
+	case readOrderGrouped:
+		command += fmt.Sprintf(" ORDER BY %s, %s, %s", col.Name, col.Labels, col.Time)
+	default:
+		command += fmt.Sprintf(" ORDER BY %s", col.Time)
+	}
+	return command, args, nil
 }
 
-func toTimestamp(milliseconds int64) time.Time {
-	sec := milliseconds / 1000
-	nsec := (milliseconds - (sec * 1000)) * 1000000
-	return time.Unix(sec, nsec).UTC()
+// sortSeries orders the samples of every series by timestamp, as remote read
+// requires, for queries run without ORDER BY.
+func sortSeries(labelsToSeries map[string]*prompb.TimeSeries) {
+	for _, ts := range labelsToSeries {
+		samples := ts.Samples
+		sort.Slice(samples, func(i, j int) bool {
+			return samples[i].Timestamp < samples[j].Timestamp
+		})
+	}
+}
+
+// sqlArgs collects the parameters of a query, so that names and values from
+// matchers are passed as they are, whatever characters they hold, and never
+// spliced into the SQL.
+type sqlArgs []interface{}
+
+// add appends v and returns its placeholder.
+func (a *sqlArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// key adds a label name and returns its placeholder cast to text, since
+// ->> also takes an array index.
+func (a *sqlArgs) key(name string) string {
+	return a.add(name) + "::text"
 }
 
-func (c *Client) buildQuery(q *prompb.Query) (string, error) {
-	matchers := make([]string, 0, len(q.Matchers))
+// buildWhere translates label matchers and a time range in milliseconds into
+// the WHERE clause of a query against a table with the given columns, adding
+// its parameters to args.
+func buildWhere(columns Columns, labelMatchers []*prompb.LabelMatcher, startMs int64, endMs int64, args *sqlArgs) (string, error) {
+	col := columns.quoted()
+	matchers := make([]string, 0, len(labelMatchers))
 	labelEqualPredicates := make(map[string]string)
 
-	for _, m := range q.Matchers {
-		escapedName := escapeValue(m.Name)
-		escapedValue := escapeValue(m.Value)
+	for _, m := range labelMatchers {
+		// PostgreSQL would only reject an invalid regexp once the query
+		// runs, and then as a server error.
+		if m.Type == prompb.LabelMatcher_RE || m.Type == prompb.LabelMatcher_NRE {
+			if _, err := regexp.Compile(m.Value); err != nil {
+				return "", invalidQuery("invalid regexp for label %s: %v", m.Name, err)
+			}
+		}
 
 		if m.Name == model.MetricNameLabel {
 			switch m.Type {
 			case prompb.LabelMatcher_EQ:
-				if len(escapedValue) == 0 {
-					matchers = append(matchers, fmt.Sprintf("(name IS NULL OR name = '')"))
+				if len(m.Value) == 0 {
+					matchers = append(matchers, fmt.Sprintf("(%s IS NULL OR %s = '')", col.Name, col.Name))
 				} else {
-					matchers = append(matchers, fmt.Sprintf("name = '%s'", escapedValue))
+					matchers = append(matchers, fmt.Sprintf("%s = %s", col.Name, args.add(m.Value)))
 				}
 			case prompb.LabelMatcher_NEQ:
-				matchers = append(matchers, fmt.Sprintf("name != '%s'", escapedValue))
+				matchers = append(matchers, fmt.Sprintf("%s != %s", col.Name, args.add(m.Value)))
 			case prompb.LabelMatcher_RE:
-				matchers = append(matchers, fmt.Sprintf("name ~ '%s'", anchorValue(escapedValue)))
+				matchers = append(matchers, fmt.Sprintf("%s ~ %s", col.Name, args.add(anchorValue(m.Value))))
 			case prompb.LabelMatcher_NRE:
-				matchers = append(matchers, fmt.Sprintf("name !~ '%s'", anchorValue(escapedValue)))
+				matchers = append(matchers, fmt.Sprintf("%s !~ %s", col.Name, args.add(anchorValue(m.Value))))
 			default:
-				return "", fmt.Errorf("unknown metric name match type %v", m.Type)
+				return "", invalidQuery("unknown metric name match type %v", m.Type)
 			}
 		} else {
 			switch m.Type {
 			case prompb.LabelMatcher_EQ:
-				if len(escapedValue) == 0 {
+				if len(m.Value) == 0 {
+					label := args.key(m.Name)
 					// From the PromQL docs: "Label matchers that match
 					// empty label values also select all time series that
 					// do not have the specific label set at all."
-					matchers = append(matchers, fmt.Sprintf("((labels ? '%s') = false OR (labels->>'%s' = ''))",
-						escapedName, escapedName))
+					matchers = append(matchers, fmt.Sprintf("((%s ? %s) = false OR (%s->>%s = ''))",
+						col.Labels, label, col.Labels, label))
 				} else {
-					labelEqualPredicates[escapedName] = escapedValue
+					labelEqualPredicates[m.Name] = m.Value
 				}
 			case prompb.LabelMatcher_NEQ:
-				matchers = append(matchers, fmt.Sprintf("labels->>'%s' != '%s'", escapedName, escapedValue))
+				matchers = append(matchers, fmt.Sprintf("%s->>%s != %s", col.Labels, args.key(m.Name), args.add(m.Value)))
 			case prompb.LabelMatcher_RE:
-				matchers = append(matchers, fmt.Sprintf("labels->>'%s' ~ '%s'", escapedName, anchorValue(escapedValue)))
+				matchers = append(matchers, fmt.Sprintf("%s->>%s ~ %s", col.Labels, args.key(m.Name), args.add(anchorValue(m.Value))))
 			case prompb.LabelMatcher_NRE:
-				matchers = append(matchers, fmt.Sprintf("labels->>'%s' !~ '%s'", escapedName, anchorValue(escapedValue)))
+				matchers = append(matchers, fmt.Sprintf("%s->>%s !~ %s", col.Labels, args.key(m.Name), args.add(anchorValue(m.Value))))
 			default:
-				return "", fmt.Errorf("unknown match type %v", m.Type)
+				return "", invalidQuery("unknown match type %v", m.Type)
 			}
 		}
 	}
@@ -526,17 +1537,21 @@ func (c *Client) buildQuery(q *prompb.Query) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		equalsPredicate = fmt.Sprintf(" AND labels @> '%s'", labelsJSON)
+		equalsPredicate = fmt.Sprintf(" AND %s @> %s::jsonb", col.Labels, args.add(string(labelsJSON)))
 	}
 
-	matchers = append(matchers, fmt.Sprintf("time >= '%v'", toTimestamp(q.StartTimestampMs).Format(time.RFC3339)))
-	matchers = append(matchers, fmt.Sprintf("time <= '%v'", toTimestamp(q.EndTimestampMs).Format(time.RFC3339)))
+	matchers = append(matchers, fmt.Sprintf("%s >= %s", col.Time, args.add(toTimestamp(startMs))))
+	matchers = append(matchers, fmt.Sprintf("%s <= %s", col.Time, args.add(toTimestamp(endMs))))
+
+	return fmt.Sprintf("%s %s", strings.Join(matchers, " AND "), equalsPredicate), nil
+}
 
-	return fmt.Sprintf("SELECT time, name, value, labels FROM metrics WHERE %s %s ORDER BY time",
-		strings.Join(matchers, " AND "), equalsPredicate), nil
+// invalidQuery returns a *ReadError of kind ReadInvalidQuery.
+func invalidQuery(format string, args ...interface{}) error {
+	return &ReadError{Kind: ReadInvalidQuery, Err: fmt.Errorf(format, args...)}
 }
 
-func (c *Client) buildCommand(q *prompb.Query) (string, error) {
+func (c *Client) buildCommand(q *prompb.Query) (string, []interface{}, error) {
 	return c.buildQuery(q)
 }
 
@@ -0,0 +1,505 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// testSamples returns one sample of each of n series at ts, spread over 10
+// metric names with 5 labels each.
+func testSamples(n int, ts time.Time) model.Samples {
+	samples := make(model.Samples, n)
+	for i := range samples {
+		metric := model.Metric{
+			model.MetricNameLabel: model.LabelValue(fmt.Sprintf("bench_metric_%d", i%10)),
+			"series":              model.LabelValue(fmt.Sprint(i)),
+		}
+		for l := 0; l < 4; l++ {
+			metric[model.LabelName(fmt.Sprintf("label_%d", l))] = model.LabelValue(fmt.Sprintf("value_%d", (i+l)%10))
+		}
+		samples[i] = &model.Sample{Metric: metric, Value: model.SampleValue(i), Timestamp: model.TimeFromUnixNano(ts.UnixNano())}
+	}
+	return samples
+}
+
+// discardCopier accepts every COPY without keeping the rows.
+type discardCopier struct{}
+
+func (discardCopier) CopyFrom(ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource) (int64, error) {
+	var n int64
+	for rowSrc.Next() {
+		if _, err := rowSrc.Values(); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rowSrc.Err()
+}
+
+func benchmarkParseBatch(b *testing.B, cfg *Config) {
+	samples := testSamples(1000, time.Now())
+	var p PGParser
+	if cfg.LabelsCacheSeries > 0 {
+		p.labels = newLabelsLRU(cfg.LabelsCacheSeries)
+	}
+	ensure := func(time.Time) bool { return true }
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.parseBatch(cfg, PartitionHourly, samples, ensure)
+		if p.labels != nil {
+			p.labels.flushCounts()
+		}
+		p.valueRows = p.valueRows[:0]
+	}
+}
+
+func BenchmarkParseBatch(b *testing.B) {
+	benchmarkParseBatch(b, &Config{})
+}
+
+func BenchmarkParseBatchLabelsCache(b *testing.B) {
+	benchmarkParseBatch(b, &Config{LabelsCacheSeries: 10000})
+}
+
+func BenchmarkPGWriterSave(b *testing.B) {
+	for _, sorted := range []bool{false, true} {
+		b.Run(fmt.Sprintf("sorted=%v", sorted), func(b *testing.B) {
+			cfg := &Config{CommitRows: 20000, CommitSecs: 30, SortBatches: sorted}
+			w := &PGWriter{cfg: cfg, logger: log.NewNopLogger(), copyTarget: discardCopier{}}
+			atomic.StoreInt64(&w.commitRows, int64(cfg.CommitRows))
+			atomic.StoreInt64(&w.commitSecs, int64(cfg.CommitSecs))
+			var p PGParser
+			p.parseBatch(cfg, PartitionHourly, testSamples(cfg.CommitRows, time.Now()), func(time.Time) bool { return true })
+			rows := p.valueRows
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.valueRows = append(w.valueRows, rows...)
+				w.PGWriterSave()
+			}
+		})
+	}
+}
+
+// BenchmarkWriterBuffers hands a second of rows at 50k samples/s to a writer
+// in parser-sized slices per op, flushing every CommitRows. "fresh" drops
+// the flushed buffer like before double buffering, so that every fill
+// buffer grows from zero again.
+func BenchmarkWriterBuffers(b *testing.B) {
+	const rate, slice = 50000, 1000
+	for _, reuse := range []bool{true, false} {
+		name := "reused"
+		if !reuse {
+			name = "fresh"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := &Config{CommitRows: 20000, CommitSecs: 30}
+			w := &PGWriter{cfg: cfg, logger: log.NewNopLogger(), copyTarget: discardCopier{}}
+			atomic.StoreInt64(&w.commitRows, int64(cfg.CommitRows))
+			atomic.StoreInt64(&w.commitSecs, int64(cfg.CommitSecs))
+			var p PGParser
+			p.parseBatch(cfg, PartitionHourly, testSamples(slice, time.Now()), func(time.Time) bool { return true })
+			rows := p.valueRows
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for n := 0; n < rate; n += slice {
+					w.valueRows = append(w.valueRows, rows...)
+					if len(w.valueRows) >= cfg.CommitRows {
+						w.PGWriterSave()
+						if !reuse {
+							w.spareRows = nil
+						}
+					}
+				}
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "gcs/op")
+		})
+	}
+}
+
+// BenchmarkParserHandoff runs 8 parsers feeding one writer and reports the
+// writer lock acquisitions per sample: once per row as before parser
+// buffering, or once per handoff.
+func BenchmarkParserHandoff(b *testing.B) {
+	const parsers, batch = 8, 100
+	writersMutex.Lock()
+	savedWriters := writers
+	writers = nil
+	writersMutex.Unlock()
+	defer func() {
+		writersMutex.Lock()
+		writers = savedWriters
+		writersMutex.Unlock()
+	}()
+
+	for _, perSample := range []bool{true, false} {
+		name := "handoff"
+		if perSample {
+			name = "per-sample"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := &Config{CommitRows: 20000, CommitSecs: 30}
+			w := &PGWriter{cfg: cfg}
+			atomic.StoreInt64(&w.commitRows, int64(cfg.CommitRows))
+			atomic.StoreInt64(&w.commitSecs, int64(cfg.CommitSecs))
+			samples := testSamples(batch, time.Now())
+			ensure := func(time.Time) bool { return true }
+			// The writer's flushes, only emptying the buffer.
+			drain := func() {
+				if atomic.LoadInt64(&w.bufferedRows) > int64(cfg.CommitRows) {
+					writerLockWait.lock(&w.PGWriterMutex)
+					w.valueRows = w.valueRows[:0]
+					atomic.StoreInt64(&w.bufferedRows, 0)
+					w.PGWriterMutex.Unlock()
+				}
+			}
+
+			start := atomic.LoadUint32(&writerLockWait.acquisitions)
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i := 0; i < parsers; i++ {
+				wg.Add(1)
+				go func(batches int) {
+					defer wg.Done()
+					p := &PGParser{lastHandoff: time.Now()}
+					for n := 0; n < batches; n++ {
+						atomic.AddInt64(&books.parserPending, int64(len(samples)))
+						p.batchSize = (3*p.batchSize + len(samples)) / 4
+						p.parseBatch(cfg, PartitionHourly, samples, ensure)
+						if perSample {
+							for _, row := range p.valueRows {
+								writerLockWait.lock(&w.PGWriterMutex)
+								w.valueRows = append(w.valueRows, row)
+								atomic.StoreInt64(&w.bufferedRows, int64(len(w.valueRows)))
+								w.PGWriterMutex.Unlock()
+							}
+							atomic.AddInt64(&books.parserPending, -int64(len(p.valueRows)))
+							p.valueRows = p.valueRows[:0]
+						} else if p.handoffDue() {
+							p.handoff(w)
+						}
+						drain()
+					}
+					p.handoff(w)
+				}((b.N + parsers - 1) / parsers)
+			}
+			wg.Wait()
+			b.StopTimer()
+			locks := atomic.LoadUint32(&writerLockWait.acquisitions) - start
+			b.ReportMetric(float64(locks)/float64(b.N*batch), "locks/sample")
+		})
+	}
+}
+
+func TestSaturationWithoutCommitInterval(t *testing.T) {
+	for _, commitSecs := range []int{0, 30} {
+		cfg := &Config{CommitRows: 1000, CommitSecs: commitSecs, SaturationRatio: 0.8}
+		w := &PGWriter{cfg: cfg, logger: log.NewNopLogger(), copyTarget: discardCopier{}}
+		atomic.StoreInt64(&w.commitRows, int64(cfg.CommitRows))
+		atomic.StoreInt64(&w.commitSecs, int64(cfg.CommitSecs))
+		for i := 0; i < 3; i++ {
+			w.PGWriterSave()
+		}
+		if w.saturatedFlushes != 0 {
+			t.Errorf("commit interval %ds: %d empty flushes saturated", commitSecs, w.saturatedFlushes)
+		}
+	}
+}
+
+// fakeClock moves only when advanced. Every timer the flush loop arms is
+// reported on armed with its duration.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	armed  chan time.Duration
+}
+
+type fakeTimer struct {
+	at      time.Time
+	c       chan time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC), armed: make(chan time.Duration, 10)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	f.mutex.Lock()
+	timer := &fakeTimer{at: f.now.Add(d), c: make(chan time.Time, 1)}
+	f.timers = append(f.timers, timer)
+	f.mutex.Unlock()
+	f.armed <- d
+	return timer.c, func() bool {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		active := !timer.stopped
+		timer.stopped = true
+		return active
+	}
+}
+
+// advance moves the clock by d and fires the timers due by then.
+func (f *fakeClock) advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	for _, timer := range f.timers {
+		if !timer.stopped && !timer.at.After(f.now) {
+			timer.stopped = true
+			timer.c <- f.now
+		}
+	}
+}
+
+// TestFlushLoop drives the writer's flush loop with a fake clock, with
+// CommitSecs 10 and CommitRows 100.
+func TestFlushLoop(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	w := &PGWriter{wake: make(chan struct{}, 1), KeepRunning: true}
+	atomic.StoreInt64(&w.commitRows, 100)
+	atomic.StoreInt64(&w.commitSecs, 10)
+	flushed := make(chan time.Time, 10)
+	done := make(chan struct{})
+	go func() {
+		w.flushLoop(clock, func() {
+			atomic.StoreInt64(&w.bufferedRows, 0)
+			flushed <- clock.Now()
+		})
+		close(done)
+	}()
+
+	armed := func(want time.Duration) {
+		t.Helper()
+		select {
+		case d := <-clock.armed:
+			if d != want {
+				t.Errorf("timer armed for %s, want %s", d, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no timer armed, want one for %s", want)
+		}
+	}
+	flushedAt := func(want time.Time) {
+		t.Helper()
+		select {
+		case at := <-flushed:
+			if !at.Equal(want) {
+				t.Errorf("flushed at %s, want %s", at.Sub(start), want.Sub(start))
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no flush, want one at %s", want.Sub(start))
+		}
+	}
+
+	armed(10 * time.Second)
+
+	// Crossing CommitRows wakes the writer before its timer fires.
+	clock.advance(3 * time.Second)
+	atomic.StoreInt64(&w.bufferedRows, 150)
+	w.notify()
+	flushedAt(start.Add(3 * time.Second))
+	// The next period starts with the flush.
+	armed(10 * time.Second)
+
+	// A wake-up below the threshold waits for the rest of the period.
+	clock.advance(4 * time.Second)
+	atomic.StoreInt64(&w.bufferedRows, 5)
+	w.notify()
+	armed(6 * time.Second)
+
+	// The timer flushes the rows below the threshold without a wake-up.
+	clock.advance(6 * time.Second)
+	flushedAt(start.Add(13 * time.Second))
+	armed(10 * time.Second)
+
+	// A period without rows passes without a flush.
+	clock.advance(10 * time.Second)
+	armed(10 * time.Second)
+	select {
+	case at := <-flushed:
+		t.Errorf("flushed at %s without rows", at.Sub(start))
+	default:
+	}
+
+	w.KeepRunning = false
+	w.notify()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("flush loop did not stop")
+	}
+}
+
+// TestBuildWhereParameters checks that names and values of matchers, quotes,
+// dollar signs and regexp metacharacters included, are passed as parameters
+// and never spliced into the SQL.
+func TestBuildWhereParameters(t *testing.T) {
+	start, end := toTimestamp(0), toTimestamp(1000)
+	tests := []struct {
+		name    string
+		matcher *prompb.LabelMatcher
+		sql     string
+		args    []interface{}
+	}{
+		{
+			"name with quotes and a placeholder",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: `it's "up" $1`},
+			`"name" = $1 AND "time" >= $2 AND "time" <= $3 `,
+			[]interface{}{`it's "up" $1`, start, end},
+		},
+		{
+			"quoted UTF-8 name",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: "__name__", Value: "http.server.duration-µs"},
+			`"name" != $1 AND "time" >= $2 AND "time" <= $3 `,
+			[]interface{}{"http.server.duration-µs", start, end},
+		},
+		{
+			"empty name",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: ""},
+			`("name" IS NULL OR "name" = '') AND "time" >= $1 AND "time" <= $2 `,
+			[]interface{}{start, end},
+		},
+		{
+			"name regexp",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: `http\.server\..*|a+b?`},
+			`"name" ~ $1 AND "time" >= $2 AND "time" <= $3 `,
+			[]interface{}{`^http\.server\..*|a+b?$`, start, end},
+		},
+		{
+			"negated name regexp anchored already",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "__name__", Value: `^up$`},
+			`"name" !~ $1 AND "time" >= $2 AND "time" <= $3 `,
+			[]interface{}{`^up$`, start, end},
+		},
+		{
+			"label value with quotes",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "job", Value: `a'b"c`},
+			`"time" >= $2 AND "time" <= $3  AND "labels" @> $1::jsonb`,
+			[]interface{}{`{"job":"a'b\"c"}`, start, end},
+		},
+		{
+			"quoted label name",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_NEQ, Name: `k8s.pod"name'`, Value: "$9"},
+			`"labels"->>$1::text != $2 AND "time" >= $3 AND "time" <= $4 `,
+			[]interface{}{`k8s.pod"name'`, "$9", start, end},
+		},
+		{
+			"empty label value",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "k8s.pod", Value: ""},
+			`(("labels" ? $1::text) = false OR ("labels"->>$1::text = '')) AND "time" >= $2 AND "time" <= $3 `,
+			[]interface{}{"k8s.pod", start, end},
+		},
+		{
+			"label regexp with metacharacters",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "path", Value: `/api/(v1|v2)/[^/]+\?.*`},
+			`"labels"->>$1::text ~ $2 AND "time" >= $3 AND "time" <= $4 `,
+			[]interface{}{"path", `^/api/(v1|v2)/[^/]+\?.*$`, start, end},
+		},
+		{
+			"negated label regexp",
+			&prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "instance", Value: `10\.0\..*'`},
+			`"labels"->>$1::text !~ $2 AND "time" >= $3 AND "time" <= $4 `,
+			[]interface{}{"instance", `^10\.0\..*'$`, start, end},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args sqlArgs
+			sql, err := buildWhere(defaultColumns, []*prompb.LabelMatcher{tt.matcher}, 0, 1000, &args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sql != tt.sql {
+				t.Errorf("SQL\n%s\nwant\n%s", sql, tt.sql)
+			}
+			if !reflect.DeepEqual([]interface{}(args), tt.args) {
+				t.Errorf("args %q, want %q", args, tt.args)
+			}
+			if tt.matcher.Value != "" && strings.Contains(sql, tt.matcher.Value) {
+				t.Errorf("value %q spliced into %s", tt.matcher.Value, sql)
+			}
+		})
+	}
+}
+
+// TestPoolConfigHookAfterBuiltins checks that the PoolConfigHook is called
+// for the writer, read and leader pools with the configuration the adapter
+// built for each, and that an error it returns fails the connect.
+func TestPoolConfigHookAfterBuiltins(t *testing.T) {
+	defer withDatabaseURL("postgres://adapter@127.0.0.1:1/metrics?pool_max_conns=7")()
+
+	refused := errors.New("refused by the test")
+	seen := make(map[PoolKind]*pgxpool.Config)
+	cfg := &Config{WriterAsyncCommit: true, PoolConfigHook: func(kind PoolKind, poolConfig *pgxpool.Config) error {
+		seen[kind] = poolConfig
+		return refused
+	}}
+	tests := []struct {
+		kind    PoolKind
+		connect func() error
+		// afterConnect is whether the session settings are applied.
+		afterConnect bool
+		maxConns     int32
+	}{
+		{WriterPool, func() error {
+			_, err := newWriterPool(cfg, writerSessionGUCs(cfg))
+			return err
+		}, true, 7},
+		{ReadPool, func() error {
+			_, err := NewPoolClient(nil, cfg).pool()
+			return err
+		}, false, 7},
+		{LeaderPool, func() error {
+			_, err := newLeaderPool(cfg)
+			return err
+		}, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.kind), func(t *testing.T) {
+			err := tt.connect()
+			if !errors.Is(err, refused) || !strings.Contains(err.Error(), string(tt.kind)+" pool config hook") {
+				t.Errorf("error %v, want the hook's", err)
+			}
+			poolConfig := seen[tt.kind]
+			if poolConfig == nil {
+				t.Fatal("hook not called")
+			}
+			if got := poolConfig.AfterConnect != nil; got != tt.afterConnect {
+				t.Errorf("hook sees AfterConnect set %v, want %v", got, tt.afterConnect)
+			}
+			if poolConfig.MaxConns != tt.maxConns {
+				t.Errorf("hook sees MaxConns %d, want %d", poolConfig.MaxConns, tt.maxConns)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package postgresql
+
+import "fmt"
+
+// Columns names the columns of the metrics table, for a table created
+// outside the adapter with names of its own. Empty names are the adapter's:
+// time, name, value and labels.
+type Columns struct {
+	Time   string
+	Name   string
+	Value  string
+	Labels string
+}
+
+// defaultColumns are the names of the tables the adapter creates. Legacy
+// tables and the secondary always use them.
+var defaultColumns = Columns{Time: "time", Name: "name", Value: "value", Labels: "labels"}
+
+// withDefaults fills in the empty names.
+func (c Columns) withDefaults() Columns {
+	if c.Time == "" {
+		c.Time = defaultColumns.Time
+	}
+	if c.Name == "" {
+		c.Name = defaultColumns.Name
+	}
+	if c.Value == "" {
+		c.Value = defaultColumns.Value
+	}
+	if c.Labels == "" {
+		c.Labels = defaultColumns.Labels
+	}
+	return c
+}
+
+// validate checks the names against the identifier allowlist and that no
+// two are the same.
+func (c Columns) validate() error {
+	seen := make(map[string]bool, 4)
+	for _, name := range c.list() {
+		if _, err := sanitizeIdentifier(name); err != nil {
+			return fmt.Errorf("column name: %w", err)
+		}
+		if seen[name] {
+			return fmt.Errorf("column %q is mapped twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// list returns the names in the order rows are copied.
+func (c Columns) list() []string {
+	return []string{c.Time, c.Name, c.Value, c.Labels}
+}
+
+// quoted returns the names quoted for use in SQL. Names are checked by
+// Config.Validate before anything is built from them; a name outside the
+// identifier allowlist reaching quoted is a bug, and it panics rather than
+// put the name into SQL.
+func (c Columns) quoted() Columns {
+	return Columns{
+		Time:   mustQuote(c.Time),
+		Name:   mustQuote(c.Name),
+		Value:  mustQuote(c.Value),
+		Labels: mustQuote(c.Labels),
+	}
+}
+
+func mustQuote(name string) string {
+	quoted, err := sanitizeIdentifier(name)
+	if err != nil {
+		panic(fmt.Sprintf("column name not validated: %v", err))
+	}
+	return quoted
+}
+
+// columns returns the column names of the metrics table.
+func (cfg *Config) columns() Columns {
+	return cfg.Columns.withDefaults()
+}
@@ -0,0 +1,58 @@
+package postgresql
+
+import "testing"
+
+func TestColumnsQuoted(t *testing.T) {
+	got := Columns{Time: "ts", Name: "metric_name", Value: "_value", Labels: "tags"}.quoted()
+	want := Columns{Time: `"ts"`, Name: `"metric_name"`, Value: `"_value"`, Labels: `"tags"`}
+	if got != want {
+		t.Errorf("quoted %+v, want %+v", got, want)
+	}
+	if got := defaultColumns.quoted(); got.Time != `"time"` || got.Labels != `"labels"` {
+		t.Errorf("default columns quoted %+v", got)
+	}
+}
+
+func TestColumnsQuotedRejects(t *testing.T) {
+	for _, name := range []string{
+		`time"; DROP TABLE metrics; --`,
+		"Time",
+		"time stamp",
+		"public.time",
+		"1time",
+		"tíme",
+		"",
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("column %q quoted", name)
+				}
+			}()
+			columns := defaultColumns
+			columns.Value = name
+			columns.quoted()
+		})
+	}
+}
+
+func TestColumnsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		columns Columns
+		valid   bool
+	}{
+		{"defaults", Columns{}.withDefaults(), true},
+		{"renamed", Columns{Time: "ts", Name: "metric", Value: "val", Labels: "tags"}, true},
+		{"quote", Columns{Time: `ts"`}.withDefaults(), false},
+		{"upper case", Columns{Labels: "Tags"}.withDefaults(), false},
+		{"mapped twice", Columns{Time: "value"}.withDefaults(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.columns.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
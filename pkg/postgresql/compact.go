@@ -0,0 +1,191 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Which of the duplicate rows of a (time, name, labels) compaction keeps,
+// by their physical position, i.e. roughly the order they were inserted in.
+const (
+	CompactKeepFirst = "first"
+	CompactKeepLast  = "last"
+)
+
+// compactionTable persists how far each partition has been compacted, so
+// that an interrupted compaction resumes where it stopped.
+const compactionTable = "adapter_compaction"
+
+const compactionSchema = `CREATE TABLE IF NOT EXISTS ` + compactionTable + ` (
+	partition text PRIMARY KEY,
+	compacted_until timestamptz NOT NULL,
+	finished boolean NOT NULL DEFAULT false,
+	deleted bigint NOT NULL DEFAULT 0
+)`
+
+// CompactOptions configure CompactDuplicates.
+type CompactOptions struct {
+	// Keep is CompactKeepFirst or CompactKeepLast.
+	Keep string
+	// Batch is the time range of the rows deleted from per statement.
+	Batch time.Duration
+	// DryRun only reports the duplicates of every partition.
+	DryRun bool
+}
+
+// CompactDuplicates deletes duplicate (time, name, labels) rows from the
+// closed partitions of metrics, as accumulated by installations running
+// without the unique constraint, keeping one row of each. Partitions whose
+// range has not ended MaintenanceGrace ago are left alone, since they may
+// still be written to. Progress is kept in adapter_compaction, a partition
+// compacted completely is skipped by later runs.
+func CompactDuplicates(ctx context.Context, logger log.Logger, cfg *Config, opts CompactOptions) error {
+	if opts.Keep != CompactKeepFirst && opts.Keep != CompactKeepLast {
+		return fmt.Errorf("unknown compaction keep mode %q, expected %s or %s", opts.Keep, CompactKeepFirst, CompactKeepLast)
+	}
+	if opts.Batch <= 0 {
+		return fmt.Errorf("compaction batch %s is not positive", opts.Batch)
+	}
+	db, err := newPool(cfg, WriterPool, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var partitioned bool
+	if err := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = to_regclass('metrics'))").Scan(&partitioned); err != nil {
+		return err
+	}
+	if !partitioned {
+		return errors.New("metrics is not partitioned, migrate it with --migrate-to-partitioned first")
+	}
+	partitions, err := leafPartitionRanges(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	closed := time.Now().Add(-cfg.MaintenanceGrace)
+	if opts.DryRun {
+		var total int64
+		for _, p := range partitions {
+			if p.upper.After(closed) {
+				level.Info(logger).Log("msg", "Skipping partition still written to", "partition", p.name)
+				continue
+			}
+			duplicates, err := countDuplicates(ctx, db, cfg.columns().quoted(), p.name)
+			if err != nil {
+				return fmt.Errorf("counting duplicates in %s: %w", p.name, err)
+			}
+			total += duplicates
+			level.Info(logger).Log("msg", "Duplicate rows", "partition", p.name, "duplicates", duplicates)
+		}
+		level.Info(logger).Log("msg", "Dry run finished, nothing deleted", "duplicates", total)
+		return nil
+	}
+
+	if _, err := db.Exec(ctx, compactionSchema); err != nil {
+		return fmt.Errorf("creating %s: %w", compactionTable, err)
+	}
+	for _, p := range partitions {
+		if p.upper.After(closed) {
+			level.Info(logger).Log("msg", "Skipping partition still written to", "partition", p.name)
+			continue
+		}
+		if err := compactPartitionRows(ctx, db, logger, cfg.columns().quoted(), p, opts); err != nil {
+			return fmt.Errorf("compacting %s: %w", p.name, err)
+		}
+	}
+	return nil
+}
+
+// countDuplicates returns the number of rows of partition a compaction
+// would delete.
+func countDuplicates(ctx context.Context, db *pgxpool.Pool, col Columns, partition string) (int64, error) {
+	var duplicates int64
+	err := db.QueryRow(ctx, fmt.Sprintf("SELECT coalesce(sum(n - 1), 0)::bigint FROM (SELECT count(*) AS n FROM %s GROUP BY %s, %s, %s HAVING count(*) > 1) d",
+		partition, col.Time, col.Name, col.Labels)).Scan(&duplicates)
+	return duplicates, err
+}
+
+// compactDeleteSQL deletes the duplicates among the rows of a partition in
+// the time range ($1, $2], keeping the first or last of each by ctid.
+func compactDeleteSQL(col Columns, partition string, keep string) string {
+	order := "ASC"
+	if keep == CompactKeepLast {
+		order = "DESC"
+	}
+	return fmt.Sprintf(`DELETE FROM %s WHERE ctid = ANY(ARRAY(
+	SELECT ctid FROM (
+		SELECT ctid, row_number() OVER (PARTITION BY %s, %s, %s ORDER BY ctid %s) AS n
+		FROM %s WHERE %s > $1 AND %s <= $2
+	) d WHERE n > 1))`, partition, col.Time, col.Name, col.Labels, order, partition, col.Time, col.Time)
+}
+
+// compactPartitionRows compacts one partition in batches of opts.Batch,
+// recording the end of every batch in the same transaction as its delete.
+func compactPartitionRows(ctx context.Context, db *pgxpool.Pool, logger log.Logger, col Columns, p partitionRange, opts CompactOptions) error {
+	// Rows at exactly the lower bound belong to the partition, the first
+	// batch starts just before it.
+	cursor := p.lower.Add(-time.Microsecond)
+	var until time.Time
+	var finished bool
+	var deleted int64
+	err := db.QueryRow(ctx, "SELECT compacted_until, finished, deleted FROM "+compactionTable+" WHERE partition = $1", p.name).Scan(&until, &finished, &deleted)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+	case err != nil:
+		return err
+	case finished:
+		level.Debug(logger).Log("msg", "Partition compacted already", "partition", p.name)
+		return nil
+	default:
+		cursor = until
+		level.Info(logger).Log("msg", "Resuming compaction", "partition", p.name, "from", cursor)
+	}
+
+	statement := compactDeleteSQL(col, p.name, opts.Keep)
+	for cursor.Before(p.upper) {
+		begin := time.Now()
+		end := cursor.Add(opts.Batch)
+		if end.After(p.upper) {
+			end = p.upper
+		}
+		n, err := compactBatch(ctx, db, statement, p.name, cursor, end, !end.Before(p.upper))
+		if err != nil {
+			return err
+		}
+		deleted += n
+		cursor = end
+		level.Info(logger).Log("msg", "Compacted batch", "partition", p.name, "until", cursor, "deleted", n, "duration", time.Since(begin))
+	}
+	level.Info(logger).Log("msg", "Compacted partition", "partition", p.name, "deleted", deleted)
+	return nil
+}
+
+// compactBatch deletes the duplicates in (from, to] and records the
+// progress in one transaction, returning the rows deleted.
+func compactBatch(ctx context.Context, db *pgxpool.Pool, statement string, partition string, from time.Time, to time.Time, last bool) (int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, statement, from, to)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO `+compactionTable+` (partition, compacted_until, finished, deleted) VALUES ($1, $2, $3, $4)
+ON CONFLICT (partition) DO UPDATE SET compacted_until = excluded.compacted_until, finished = excluded.finished,
+	deleted = `+compactionTable+`.deleted + excluded.deleted`, partition, to, last, tag.RowsAffected())
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
@@ -0,0 +1,80 @@
+package postgresql
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Schema modes reported by adapter_config_info.
+const (
+	schemaModeFull            = "full"
+	schemaModeDeferredIndexes = "deferred_indexes"
+	schemaModeSkip            = "skip"
+)
+
+// infoConfig is the configuration of the last client created, reported by
+// configInfoCollector.
+var (
+	infoMutex  sync.Mutex
+	infoConfig *Config
+)
+
+func setInfoConfig(cfg *Config) {
+	infoMutex.Lock()
+	infoConfig = cfg
+	infoMutex.Unlock()
+}
+
+func schemaMode(cfg *Config) string {
+	switch {
+	case cfg.SkipSchemaSetup:
+		return schemaModeSkip
+	case cfg.DeferredIndexes:
+		return schemaModeDeferredIndexes
+	default:
+		return schemaModeFull
+	}
+}
+
+// configInfoCollector exports the effective configuration as the labels of a
+// gauge set to 1. It is built at scrape time, so values changed through the
+// admin API show up on the next scrape.
+type configInfoCollector struct {
+	info *prometheus.Desc
+}
+
+func (ic *configInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ic.info
+}
+
+func (ic *configInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	infoMutex.Lock()
+	cfg := infoConfig
+	infoMutex.Unlock()
+	if cfg == nil {
+		return
+	}
+	commitRows, commitSecs := cfg.CommitRows, cfg.CommitSecs
+	writersMutex.Lock()
+	if len(writers) > 0 {
+		commitRows, commitSecs = writers[0].CommitRows(), writers[0].CommitSecs()
+	}
+	writersMutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(ic.info, prometheus.GaugeValue, 1,
+		cfg.PartitionScheme,
+		schemaMode(cfg),
+		strconv.Itoa(cfg.PGWriters),
+		strconv.Itoa(cfg.PGParsers),
+		strconv.Itoa(commitRows),
+		strconv.Itoa(commitSecs),
+	)
+}
+
+func init() {
+	prometheus.MustRegister(&configInfoCollector{
+		info: prometheus.NewDesc("adapter_config_info", "Effective configuration of the adapter as labels, always 1.",
+			[]string{"partition_scheme", "schema_mode", "writers", "parsers", "commit_rows", "commit_secs"}, nil),
+	})
+}
@@ -0,0 +1,78 @@
+package postgresql
+
+import (
+	"io/ioutil"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// AvailableCPUs returns GOMAXPROCS, lowered to the container CPU quota when
+// one can be read from the cgroup filesystem.
+func AvailableCPUs() int {
+	cpus := runtime.GOMAXPROCS(0)
+	if quota := cgroupCPUQuota(); quota > 0 && quota < cpus {
+		cpus = quota
+	}
+	return cpus
+}
+
+// DefaultWorkers derives the number of writers and parsers per writer from
+// the available CPUs: a writer for every four CPUs and enough parsers for
+// about one per CPU in total.
+func DefaultWorkers(cpus int) (writers int, parsers int) {
+	if cpus < 1 {
+		cpus = 1
+	}
+	writers = cpus / 4
+	if writers < 1 {
+		writers = 1
+	}
+	parsers = cpus / writers
+	if parsers < 1 {
+		parsers = 1
+	}
+	return writers, parsers
+}
+
+// cgroupCPUQuota returns the CPU quota rounded up to whole CPUs, or 0 when
+// there is none.
+func cgroupCPUQuota() int {
+	// cgroup v2: "<quota> <period>" or "max <period>"
+	if b, err := ioutil.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		return cpuMaxCPUs(string(b))
+	}
+
+	// cgroup v1: quota is -1 when unlimited
+	quota, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	period, err := ioutil.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return quotaCPUs(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+// cpuMaxCPUs returns the quota of the contents of a cgroup v2 cpu.max file.
+func cpuMaxCPUs(cpuMax string) int {
+	fields := strings.Fields(cpuMax)
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+	return quotaCPUs(fields[0], fields[1])
+}
+
+func quotaCPUs(quota string, period string) int {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return int(math.Ceil(q / p))
+}
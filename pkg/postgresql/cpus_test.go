@@ -0,0 +1,71 @@
+package postgresql
+
+import "testing"
+
+func TestDefaultWorkers(t *testing.T) {
+	tests := []struct {
+		cpus    int
+		writers int
+		parsers int
+	}{
+		{-1, 1, 1},
+		{0, 1, 1},
+		{1, 1, 1},
+		{4, 1, 4},
+		{7, 1, 7},
+		{8, 2, 4},
+		{64, 16, 4},
+	}
+	for _, tt := range tests {
+		writers, parsers := DefaultWorkers(tt.cpus)
+		if writers != tt.writers || parsers != tt.parsers {
+			t.Errorf("DefaultWorkers(%d) = %d writers, %d parsers, want %d and %d", tt.cpus, writers, parsers, tt.writers, tt.parsers)
+		}
+	}
+}
+
+func TestQuotaCPUs(t *testing.T) {
+	tests := []struct {
+		name   string
+		quota  string
+		period string
+		want   int
+	}{
+		{"whole CPUs", "200000", "100000", 2},
+		{"half a CPU", "50000", "100000", 1},
+		{"fraction above one", "150000", "100000", 2},
+		{"fractional quota", "12500.5", "100000", 1},
+		{"unlimited v1", "-1", "100000", 0},
+		{"unlimited v2", "max", "100000", 0},
+		{"zero quota", "0", "100000", 0},
+		{"zero period", "100000", "0", 0},
+		{"garbage", "lots", "100000", 0},
+		{"empty", "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quotaCPUs(tt.quota, tt.period); got != tt.want {
+				t.Errorf("quotaCPUs(%q, %q) = %d, want %d", tt.quota, tt.period, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPUMaxCPUs(t *testing.T) {
+	tests := []struct {
+		cpuMax string
+		want   int
+	}{
+		{"max 100000\n", 0},
+		{"400000 100000\n", 4},
+		{"25000 100000\n", 1},
+		{"250000 100000", 3},
+		{"", 0},
+		{"100000\n", 0},
+	}
+	for _, tt := range tests {
+		if got := cpuMaxCPUs(tt.cpuMax); got != tt.want {
+			t.Errorf("cpuMaxCPUs(%q) = %d, want %d", tt.cpuMax, got, tt.want)
+		}
+	}
+}
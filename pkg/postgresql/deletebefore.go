@@ -0,0 +1,160 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ErrUnsafeCutoff is returned by DeleteBefore for a cutoff later than
+// DeleteSafetyMargin before now.
+var ErrUnsafeCutoff = errors.New("refusing to delete data this recent, see --admin-delete-safety-margin")
+
+// deleteBeforeTable persists how many rows DeleteBefore deleted from each
+// partition straddling a cutoff, so that a run interrupted by a restart and
+// issued again reports the rows of the whole deletion.
+const deleteBeforeTable = "adapter_delete_before"
+
+const deleteBeforeSchema = `CREATE TABLE IF NOT EXISTS ` + deleteBeforeTable + ` (
+	partition text PRIMARY KEY,
+	cutoff timestamptz NOT NULL,
+	deleted bigint NOT NULL DEFAULT 0,
+	finished boolean NOT NULL DEFAULT false,
+	updated_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// DeleteBeforeResult reports what DeleteBefore reclaimed.
+type DeleteBeforeResult struct {
+	Cutoff time.Time `json:"cutoff"`
+	// Dropped are the partitions wholly before the cutoff, DroppedRows the
+	// rows they held as estimated by the planner statistics.
+	Dropped     []string `json:"dropped"`
+	DroppedRows int64    `json:"dropped_rows"`
+	// Deleted is the number of rows deleted from the partition straddling
+	// the cutoff, including those of earlier runs for the same cutoff.
+	Deleted int64 `json:"deleted"`
+}
+
+// DeleteBefore reclaims space by removing every row of metrics before
+// cutoff, oldest partition first: partitions whose range ends at or before
+// cutoff are dropped, and rows before it are deleted from the partition
+// straddling it, batchSize rows per transaction. The progress of that
+// partition is recorded with every batch in adapter_delete_before, and
+// running DeleteBefore again after an interruption picks up where it
+// stopped. Cutoffs later than DeleteSafetyMargin before now are refused
+// with ErrUnsafeCutoff. The default partition is left alone.
+func (c *Client) DeleteBefore(ctx context.Context, cutoff time.Time, batchSize int) (*DeleteBeforeResult, error) {
+	if cutoff.After(time.Now().Add(-c.cfg.DeleteSafetyMargin)) {
+		return nil, ErrUnsafeCutoff
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("delete batch size %d is not positive", batchSize)
+	}
+	db, err := c.pool()
+	if err != nil {
+		return nil, err
+	}
+	var partitioned bool
+	if err := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = to_regclass('metrics'))").Scan(&partitioned); err != nil {
+		return nil, err
+	}
+	if !partitioned {
+		return nil, errors.New("metrics is not partitioned, migrate it with --migrate-to-partitioned first")
+	}
+	partitions, err := leafPartitionRanges(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	level.Warn(c.logger).Log("msg", "Deleting data before cutoff", "cutoff", cutoff, "batch", batchSize)
+
+	result := &DeleteBeforeResult{Cutoff: cutoff, Dropped: []string{}}
+	for _, p := range partitions {
+		if !p.lower.Before(cutoff) {
+			break
+		}
+		if !p.upper.After(cutoff) {
+			var estimate float64
+			if err := db.QueryRow(ctx, "SELECT reltuples FROM pg_class WHERE oid = $1::regclass", p.name).Scan(&estimate); err != nil {
+				return result, fmt.Errorf("estimating the rows of %s: %w", p.name, err)
+			}
+			if _, err := db.Exec(ctx, "DROP TABLE "+p.name); err != nil {
+				return result, fmt.Errorf("dropping %s: %w", p.name, err)
+			}
+			if estimate > 0 {
+				result.DroppedRows += int64(estimate)
+			}
+			result.Dropped = append(result.Dropped, p.name)
+			level.Warn(c.logger).Log("msg", "Dropped partition before cutoff", "partition", p.name, "upper", p.upper, "estimated_rows", int64(estimate))
+			continue
+		}
+		deleted, err := c.deletePartitionBefore(ctx, db, p, cutoff, batchSize)
+		result.Deleted += deleted
+		if err != nil {
+			return result, fmt.Errorf("deleting from %s: %w", p.name, err)
+		}
+	}
+	level.Warn(c.logger).Log("msg", "Deleted data before cutoff", "cutoff", cutoff, "dropped", len(result.Dropped), "dropped_rows", result.DroppedRows, "deleted", result.Deleted)
+	return result, nil
+}
+
+// deletePartitionBefore deletes the rows of the partition p before cutoff in
+// batches, recording the progress in the transaction of every batch, and
+// returns the rows deleted for this cutoff so far.
+func (c *Client) deletePartitionBefore(ctx context.Context, db *pgxpool.Pool, p partitionRange, cutoff time.Time, batchSize int) (int64, error) {
+	if _, err := db.Exec(ctx, deleteBeforeSchema); err != nil {
+		return 0, fmt.Errorf("creating %s: %w", deleteBeforeTable, err)
+	}
+	// Progress of an earlier cutoff does not count towards this one.
+	var deleted int64
+	err := db.QueryRow(ctx, `INSERT INTO `+deleteBeforeTable+` (partition, cutoff) VALUES ($1, $2)
+ON CONFLICT (partition) DO UPDATE SET
+	deleted = CASE WHEN `+deleteBeforeTable+`.cutoff = excluded.cutoff THEN `+deleteBeforeTable+`.deleted ELSE 0 END,
+	finished = `+deleteBeforeTable+`.finished AND `+deleteBeforeTable+`.cutoff = excluded.cutoff,
+	cutoff = excluded.cutoff, updated_at = now()
+RETURNING deleted`, p.name, cutoff).Scan(&deleted)
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		level.Info(c.logger).Log("msg", "Resuming delete before cutoff", "partition", p.name, "deleted", deleted)
+	}
+
+	timeColumn := c.cfg.columns().quoted().Time
+	statement := fmt.Sprintf("DELETE FROM %s WHERE ctid = ANY(ARRAY(SELECT ctid FROM %s WHERE %s < $1 LIMIT %d))", p.name, p.name, timeColumn, batchSize)
+	for {
+		begin := time.Now()
+		n, err := deleteBeforeBatch(ctx, db, statement, p.name, cutoff, batchSize)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		level.Info(c.logger).Log("msg", "Deleted batch before cutoff", "partition", p.name, "rows", n, "deleted", deleted, "duration", time.Since(begin))
+		if n < int64(batchSize) {
+			return deleted, nil
+		}
+	}
+}
+
+// deleteBeforeBatch deletes one batch and records it in one transaction,
+// returning the rows deleted. A short batch finishes the partition.
+func deleteBeforeBatch(ctx context.Context, db *pgxpool.Pool, statement string, partition string, cutoff time.Time, batchSize int) (int64, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, statement, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(ctx, `UPDATE `+deleteBeforeTable+` SET deleted = deleted + $2, finished = $3, updated_at = now() WHERE partition = $1`,
+		partition, tag.RowsAffected(), tag.RowsAffected() < int64(batchSize))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
@@ -0,0 +1,102 @@
+package postgresql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// downsampleRule keeps one sample per interval of the series whose metric
+// name matches.
+type downsampleRule struct {
+	source   string
+	pattern  *regexp.Regexp
+	interval int64 // milliseconds
+}
+
+// parseDownsampleRules parses REGEX=INTERVAL rules. The regular expression
+// is anchored and matched against the metric name; the first matching rule
+// applies.
+func parseDownsampleRules(rules []string) ([]downsampleRule, error) {
+	parsed := make([]downsampleRule, 0, len(rules))
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("downsampling rule %q is not REGEX=INTERVAL", rule)
+		}
+		pattern, err := regexp.Compile("^(?:" + rule[:i] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("downsampling rule %q: %w", rule, err)
+		}
+		interval, err := time.ParseDuration(rule[i+1:])
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("downsampling rule %q needs a positive interval", rule)
+		}
+		parsed = append(parsed, downsampleRule{source: rule, pattern: pattern, interval: int64(interval / time.Millisecond)})
+	}
+	return parsed, nil
+}
+
+// downsampler remembers, for up to size series, the timestamp of the last
+// sample kept. Series are evicted least recently used first; a sample of a
+// series that is not remembered is always kept, so eviction never loses
+// data, it only lets an extra sample through.
+type downsampler struct {
+	rules []downsampleRule
+
+	mutex sync.Mutex
+	kept  *seriesLRU
+}
+
+func newDownsampler(cfg *Config) *downsampler {
+	// Validate has checked the rules already.
+	rules, _ := parseDownsampleRules(cfg.DownsampleRules)
+	if len(rules) == 0 {
+		return nil
+	}
+	return &downsampler{
+		rules: rules,
+		kept:  newSeriesLRU(cfg.DownsampleSeries),
+	}
+}
+
+// keep reports whether a sample of metric at timestamp ms is stored, and
+// counts it against its rule when it is not.
+func (d *downsampler) keep(metric model.Metric, ms int64) bool {
+	name := string(metric[model.MetricNameLabel])
+	var rule *downsampleRule
+	for i := range d.rules {
+		if d.rules[i].pattern.MatchString(name) {
+			rule = &d.rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return true
+	}
+
+	fingerprint := metric.Fingerprint()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if kept := d.kept.get(fingerprint); kept != nil {
+		if ms >= kept.timestamp && ms-kept.timestamp < rule.interval {
+			downsampledSamples.WithLabelValues(rule.source).Inc()
+			return false
+		}
+		kept.timestamp = ms
+		return true
+	}
+	d.kept.add(fingerprint, ms, 0)
+	return true
+}
+
+// The downsampler is shared by the parsers of all writers, since samples of
+// one series may be popped by any of them.
+var (
+	downsamplerOnce   sync.Once
+	activeDownsampler *downsampler
+)
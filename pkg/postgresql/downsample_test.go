@@ -0,0 +1,106 @@
+package postgresql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func testMetric(name string, instance string) model.Metric {
+	return model.Metric{model.MetricNameLabel: model.LabelValue(name), "instance": model.LabelValue(instance)}
+}
+
+func TestSeriesLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newSeriesLRU(2)
+	a, b, c := model.Fingerprint(1), model.Fingerprint(2), model.Fingerprint(3)
+	l.add(a, 1, 0)
+	l.add(b, 2, 0)
+	// a is used last, b is evicted for c.
+	if l.get(a) == nil {
+		t.Fatal("a not remembered")
+	}
+	l.add(c, 3, 0)
+	if l.get(b) != nil {
+		t.Error("b still remembered after eviction")
+	}
+	if l.get(a) == nil || l.get(c) == nil {
+		t.Error("a or c evicted")
+	}
+	if l.lru.Len() != 2 || len(l.series) != 2 {
+		t.Errorf("%d entries and %d series, want 2", l.lru.Len(), len(l.series))
+	}
+}
+
+func TestDownsamplerKeep(t *testing.T) {
+	d := newDownsampler(&Config{DownsampleRules: []string{"node_.*=1m"}, DownsampleSeries: 10})
+	m := testMetric("node_load1", "a")
+	tests := []struct {
+		name string
+		ms   int64
+		want bool
+	}{
+		{"first sample", 0, true},
+		{"within the interval", 15000, false},
+		{"just before the interval", 59999, false},
+		{"a full interval later", 60000, true},
+		{"out of order", 30000, true},
+		{"within the interval of the last kept", 65000, false},
+	}
+	for _, tt := range tests {
+		if got := d.keep(m, tt.ms); got != tt.want {
+			t.Errorf("%s: keep at %d = %v, want %v", tt.name, tt.ms, got, tt.want)
+		}
+	}
+	if !d.keep(testMetric("up", "a"), 1) || !d.keep(testMetric("up", "a"), 2) {
+		t.Error("samples of a metric without a rule dropped")
+	}
+}
+
+// TestDownsamplerEvictionFailsOpen drops a series from a full cache and
+// checks that its next sample is kept, though it falls within the interval.
+func TestDownsamplerEvictionFailsOpen(t *testing.T) {
+	d := newDownsampler(&Config{DownsampleRules: []string{"node_.*=1m"}, DownsampleSeries: 2})
+	a, b, c := testMetric("node_load1", "a"), testMetric("node_load1", "b"), testMetric("node_load1", "c")
+	for _, m := range []model.Metric{a, b} {
+		if !d.keep(m, 0) {
+			t.Fatalf("first sample of %s dropped", m)
+		}
+	}
+	if d.keep(a, 1000) {
+		t.Fatal("sample of a within the interval kept before eviction")
+	}
+	// c evicts b, the least recently used.
+	if !d.keep(c, 2000) {
+		t.Fatal("first sample of c dropped")
+	}
+	if !d.keep(b, 3000) {
+		t.Error("sample of evicted series b dropped, eviction must keep it")
+	}
+	// b came back and evicted a.
+	if !d.keep(a, 4000) {
+		t.Error("sample of evicted series a dropped, eviction must keep it")
+	}
+	if d.keep(a, 5000) {
+		t.Error("sample of a within the interval kept after a was remembered again")
+	}
+}
+
+// TestUnchangedEvictionFailsOpen does the same for the filter of unchanged
+// samples: a series evicted gets its repeated value stored.
+func TestUnchangedEvictionFailsOpen(t *testing.T) {
+	f := newUnchangedFilter(&Config{SuppressUnchangedMaxGap: time.Minute, SuppressUnchangedSeries: 1})
+	a, b := testMetric("up", "a"), testMetric("up", "b")
+	if !f.keep(a, 0, 1) {
+		t.Fatal("first sample of a suppressed")
+	}
+	if f.keep(a, 1000, 1) {
+		t.Fatal("repeated value of a stored before eviction")
+	}
+	if !f.keep(b, 2000, 1) {
+		t.Fatal("first sample of b suppressed")
+	}
+	if !f.keep(a, 3000, 1) {
+		t.Error("repeated value of evicted series a suppressed, eviction must store it")
+	}
+}
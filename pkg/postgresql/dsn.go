@@ -0,0 +1,69 @@
+package postgresql
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var (
+	dsnPasswordKeyword = regexp.MustCompile(`(?i)(password\s*=\s*)('(\\.|[^'])*'|\S+)`)
+	dsnPasswordURL     = regexp.MustCompile(`(://[^:/@\s]*:)\S*@`)
+)
+
+// databaseURL returns the connection string the pools connect with.
+func databaseURL() string {
+	return os.Getenv("DATABASE_URL")
+}
+
+// secondaryDatabaseURL returns the connection string of the dual-write
+// target, empty when dual-write is off.
+func secondaryDatabaseURL() string {
+	return os.Getenv("SECONDARY_DATABASE_URL")
+}
+
+// redactedDSN describes the connection target of dsn without its secrets.
+func redactedDSN(dsn string) string {
+	connConfig, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return redactString(dsn, dsn)
+	}
+	return fmt.Sprintf("host=%s port=%d database=%s user=%s password=***", connConfig.Host, connConfig.Port, connConfig.Database, connConfig.User)
+}
+
+// redactString masks passwords in s, whether given as a keyword/value pair,
+// in a URL or as the literal password of dsn.
+func redactString(s string, dsn string) string {
+	if connConfig, err := pgx.ParseConfig(dsn); err == nil && connConfig.Password != "" {
+		s = strings.Replace(s, connConfig.Password, "***", -1)
+	}
+	s = dsnPasswordKeyword.ReplaceAllString(s, "${1}***")
+	return dsnPasswordURL.ReplaceAllString(s, "${1}***@")
+}
+
+// redactedError keeps the wrapped error for errors.Is and errors.As but
+// masks passwords in its message.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError masks any password of dsn that err's message may carry, as
+// pgx includes the connection string in parse errors.
+func redactError(err error, dsn string) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{msg: redactString(err.Error(), dsn), err: err}
+}
@@ -0,0 +1,112 @@
+package postgresql
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// emptyReadCacheSize bounds the number of empty results remembered.
+const emptyReadCacheSize = 10000
+
+// emptyReadCache remembers for ttl the queries that found no series, so
+// that rules asking again and again for metrics this backend does not have
+// stop scanning their time range. Queries are keyed by their matchers and
+// their start and end rounded to ttl, so a query repeated with a moving
+// range is answered from the cache until its range moves to the next bucket.
+// An entry is never used longer than ttl, so a series written for the first
+// time shows up within ttl. Queries ending less than recent ago are not
+// cached at all, their newest rows may still be on their way.
+type emptyReadCache struct {
+	ttl    int64 // milliseconds
+	recent int64 // milliseconds
+
+	mutex   sync.Mutex
+	entries map[string]time.Time
+}
+
+func newEmptyReadCache(cfg *Config) *emptyReadCache {
+	if cfg.EmptyReadCacheTTL <= 0 {
+		return nil
+	}
+	recent := cfg.EmptyReadCacheRecent
+	if recent <= 0 {
+		recent = cfg.EmptyReadCacheTTL
+	}
+	return &emptyReadCache{
+		ttl:     int64(cfg.EmptyReadCacheTTL / time.Millisecond),
+		recent:  int64(recent / time.Millisecond),
+		entries: make(map[string]time.Time),
+	}
+}
+
+// key identifies q by its matchers, in a fixed order, and its time range
+// rounded to the ttl. A query ending less than recent ago, or in the
+// future, is not cached, rows for its range are still to be written; "" is
+// returned for it.
+func (e *emptyReadCache) key(q *prompb.Query, now time.Time) string {
+	if q.EndTimestampMs > fromTimestamp(now)-e.recent {
+		return ""
+	}
+	matchers := make([]*prompb.LabelMatcher, len(q.Matchers))
+	copy(matchers, q.Matchers)
+	sort.Slice(matchers, func(i, j int) bool {
+		if matchers[i].Name != matchers[j].Name {
+			return matchers[i].Name < matchers[j].Name
+		}
+		if matchers[i].Type != matchers[j].Type {
+			return matchers[i].Type < matchers[j].Type
+		}
+		return matchers[i].Value < matchers[j].Value
+	})
+	return matchersString(matchers) + "\xff" + strconv.FormatInt(q.StartTimestampMs/e.ttl, 10) + "\xff" + strconv.FormatInt(q.EndTimestampMs/e.ttl, 10)
+}
+
+// empty reports whether q found no series within the last ttl.
+func (e *emptyReadCache) empty(q *prompb.Query) bool {
+	now := time.Now()
+	key := e.key(q, now)
+	if key == "" {
+		return false
+	}
+	e.mutex.Lock()
+	cached, ok := e.entries[key]
+	if ok && now.Sub(cached) >= time.Duration(e.ttl)*time.Millisecond {
+		delete(e.entries, key)
+		ok = false
+	}
+	e.mutex.Unlock()
+	if ok {
+		emptyReadCacheLookups.WithLabelValues("hit").Inc()
+	} else {
+		emptyReadCacheLookups.WithLabelValues("miss").Inc()
+	}
+	return ok
+}
+
+// remember records that q found no series. When the cache is full the
+// expired entries are dropped, and all of them if that frees nothing.
+func (e *emptyReadCache) remember(q *prompb.Query) {
+	now := time.Now()
+	key := e.key(q, now)
+	if key == "" {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if len(e.entries) >= emptyReadCacheSize {
+		ttl := time.Duration(e.ttl) * time.Millisecond
+		for k, cached := range e.entries {
+			if now.Sub(cached) >= ttl {
+				delete(e.entries, k)
+			}
+		}
+		if len(e.entries) >= emptyReadCacheSize {
+			e.entries = make(map[string]time.Time)
+		}
+	}
+	e.entries[key] = now
+}
@@ -0,0 +1,70 @@
+package postgresql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// emptyQuery asks for it_absent over the hour ending end.
+func emptyQuery(end time.Time) *prompb.Query {
+	return &prompb.Query{
+		StartTimestampMs: fromTimestamp(end.Add(-time.Hour)),
+		EndTimestampMs:   fromTimestamp(end),
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_absent"}},
+	}
+}
+
+func TestEmptyReadCacheSkipsRecent(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		recent time.Duration
+		end    time.Time
+		cached bool
+	}{
+		{"future", 0, now.Add(time.Minute), false},
+		{"now", 0, now, false},
+		{"within one TTL", 0, now.Add(-30 * time.Second), false},
+		{"one TTL ago", 0, now.Add(-time.Minute - time.Second), true},
+		{"within the recent window", 10 * time.Minute, now.Add(-5 * time.Minute), false},
+		{"before the recent window", 10 * time.Minute, now.Add(-11 * time.Minute), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEmptyReadCache(&Config{EmptyReadCacheTTL: time.Minute, EmptyReadCacheRecent: tt.recent})
+			if cached := e.key(emptyQuery(tt.end), now) != ""; cached != tt.cached {
+				t.Errorf("cached %v, want %v", cached, tt.cached)
+			}
+		})
+	}
+}
+
+// TestEmptyReadCacheExpires shows that a series written after a read found
+// nothing is read within one TTL: the query is answered from the cache
+// until then and from the database after.
+func TestEmptyReadCacheExpires(t *testing.T) {
+	e := newEmptyReadCache(&Config{EmptyReadCacheTTL: time.Minute})
+	q := emptyQuery(time.Now().Add(-time.Hour))
+	if e.empty(q) {
+		t.Fatal("query answered from the cache before it ran")
+	}
+	e.remember(q)
+	if !e.empty(q) {
+		t.Fatal("empty query not cached")
+	}
+
+	key := e.key(q, time.Now())
+	e.entries[key] = e.entries[key].Add(-59 * time.Second)
+	if !e.empty(q) {
+		t.Error("query not answered from the cache within its TTL")
+	}
+	e.entries[key] = e.entries[key].Add(-time.Second)
+	if e.empty(q) {
+		t.Error("query answered from the cache after its TTL")
+	}
+	if len(e.entries) != 0 {
+		t.Errorf("expired entry kept: %v", e.entries)
+	}
+}
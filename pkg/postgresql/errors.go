@@ -0,0 +1,105 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Errors returned by Client.Write. ErrQueueFull and ErrThrottled are
+// transient and meant to be answered with 429 Too Many Requests and a
+// Retry-After header, ErrShuttingDown with 503 Service Unavailable. Any other
+// error means the samples could not be stored.
+var (
+	// ErrQueueFull is returned when the samples do not fit in the queue.
+	ErrQueueFull = errors.New("sample queue is full")
+	// ErrThrottled is returned when samples were rejected because a tenant
+	// exceeded its ingestion rate or new series exceeded the active series
+	// limit.
+	ErrThrottled = errors.New("ingestion rate exceeded")
+	// ErrShuttingDown is returned once the writers have been asked to stop.
+	ErrShuttingDown = errors.New("adapter is shutting down")
+)
+
+// ErrLookbackExceeded is returned by Client.Read and Client.QuerySeries for
+// queries starting before the read lookback horizon when LookbackReject is
+// configured, wrapped in a *ReadError of kind ReadLimitExceeded.
+var ErrLookbackExceeded = errors.New("query starts before the read lookback horizon")
+
+// ErrTooManyRows is returned by Client.Read and Client.QuerySeries for
+// queries estimated to read more than MaxQueryRows rows, wrapped in a
+// *ReadError of kind ReadLimitExceeded.
+var ErrTooManyRows = errors.New("query would read too many rows")
+
+// Kinds of read errors. ReadInvalidQuery and ReadLimitExceeded are the
+// caller's fault, ReadTimeout and ReadUnavailable are transient, anything
+// else is ReadInternal.
+const (
+	ReadInvalidQuery  = "invalid_query"
+	ReadLimitExceeded = "limit_exceeded"
+	ReadTimeout       = "timeout"
+	ReadUnavailable   = "unavailable"
+	ReadInternal      = "internal"
+)
+
+// ReadError is the error returned by Client.Read and Client.QuerySeries. It
+// wraps the cause, so errors.Is still finds ErrLookbackExceeded, and tells by
+// Kind how the request should be answered.
+type ReadError struct {
+	Kind string
+	Err  error
+}
+
+func (e *ReadError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ReadError) Unwrap() error {
+	return e.Err
+}
+
+// readError wraps err in a *ReadError of the kind it is classified as.
+// Errors already wrapped are returned as they are.
+func readError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var re *ReadError
+	if errors.As(err, &re) {
+		return err
+	}
+	return &ReadError{Kind: readErrorKind(err), Err: err}
+}
+
+func readErrorKind(err error) string {
+	if errors.Is(err, ErrLookbackExceeded) || errors.Is(err, ErrTooManyRows) {
+		return ReadLimitExceeded
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return ReadTimeout
+	}
+	var sqlErr interface{ SQLState() string }
+	if errors.As(err, &sqlErr) {
+		state := sqlErr.SQLState()
+		switch {
+		case state == "2201B": // invalid_regular_expression
+			return ReadInvalidQuery
+		case state == "57014": // query_canceled, by statement_timeout
+			return ReadTimeout
+		case strings.HasPrefix(state, "08"), strings.HasPrefix(state, "53"), strings.HasPrefix(state, "57P"):
+			// Connection exceptions, insufficient resources and the
+			// server shutting down or starting up.
+			return ReadUnavailable
+		}
+		return ReadInternal
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return ReadTimeout
+		}
+		return ReadUnavailable
+	}
+	return ReadInternal
+}
@@ -0,0 +1,107 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// netError is a network error, timing out or not.
+type netError struct {
+	timeout bool
+}
+
+func (e *netError) Error() string   { return "network error" }
+func (e *netError) Timeout() bool   { return e.timeout }
+func (e *netError) Temporary() bool { return false }
+
+var _ net.Error = &netError{}
+
+func TestReadErrorKind(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind string
+	}{
+		{"lookback exceeded", ErrLookbackExceeded, ReadLimitExceeded},
+		{"wrapped lookback exceeded", fmt.Errorf("query 0: %w", ErrLookbackExceeded), ReadLimitExceeded},
+		{"too many rows", ErrTooManyRows, ReadLimitExceeded},
+		{"deadline", context.DeadlineExceeded, ReadTimeout},
+		{"canceled", fmt.Errorf("reading: %w", context.Canceled), ReadTimeout},
+		{"invalid regexp in the database", &sqlError{state: "2201B", msg: "invalid regular expression"}, ReadInvalidQuery},
+		{"statement timeout", &sqlError{state: "57014", msg: "canceling statement due to statement timeout"}, ReadTimeout},
+		{"connection failure", &sqlError{state: "08006", msg: "connection failure"}, ReadUnavailable},
+		{"too many connections", &sqlError{state: "53300", msg: "too many connections"}, ReadUnavailable},
+		{"admin shutdown", &sqlError{state: "57P01", msg: "terminating connection"}, ReadUnavailable},
+		{"undefined table", &sqlError{state: "42P01", msg: `relation "metrics" does not exist`}, ReadInternal},
+		{"network timeout", &netError{timeout: true}, ReadTimeout},
+		{"connection refused", fmt.Errorf("dial: %w", &netError{}), ReadUnavailable},
+		{"anything else", errors.New("scan failed"), ReadInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := readError(tt.err)
+			var re *ReadError
+			if !errors.As(err, &re) {
+				t.Fatalf("readError(%v) is not a *ReadError", tt.err)
+			}
+			if re.Kind != tt.kind {
+				t.Errorf("kind %s, want %s", re.Kind, tt.kind)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%v does not wrap %v", err, tt.err)
+			}
+			if err.Error() != tt.err.Error() {
+				t.Errorf("message %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadErrorKeepsKind(t *testing.T) {
+	if readError(nil) != nil {
+		t.Error("readError(nil) is not nil")
+	}
+	invalid := invalidQuery("bad matcher")
+	wrapped := fmt.Errorf("query 1: %w", invalid)
+	var re *ReadError
+	if err := readError(wrapped); !errors.As(err, &re) || re.Kind != ReadInvalidQuery {
+		t.Errorf("readError reclassified %v as %v", wrapped, err)
+	}
+}
+
+func TestBuildWhereInvalidQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		matcher *prompb.LabelMatcher
+	}{
+		{"invalid regexp", &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api("}},
+		{"invalid negated regexp", &prompb.LabelMatcher{Type: prompb.LabelMatcher_NRE, Name: "job", Value: "[z-a]"}},
+		{"invalid regexp on the name", &prompb.LabelMatcher{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "*up"}},
+		{"unknown match type", &prompb.LabelMatcher{Type: prompb.LabelMatcher_Type(9), Name: "job", Value: "api"}},
+		{"unknown match type on the name", &prompb.LabelMatcher{Type: prompb.LabelMatcher_Type(9), Name: "__name__", Value: "up"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args sqlArgs
+			_, err := buildWhere(defaultColumns, []*prompb.LabelMatcher{tt.matcher}, 0, 1000, &args)
+			var re *ReadError
+			if !errors.As(err, &re) || re.Kind != ReadInvalidQuery {
+				t.Errorf("got %v, want a %s read error", err, ReadInvalidQuery)
+			}
+		})
+	}
+
+	var args sqlArgs
+	valid := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api|db"},
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+	}
+	if _, err := buildWhere(defaultColumns, valid, 0, 1000, &args); err != nil {
+		t.Errorf("valid matchers: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// explainsPerMinute limits how many slow reads are explained.
+	explainsPerMinute = 3
+	// slowQueryLog is the number of recent slow queries kept for the status
+	// endpoint.
+	slowQueryLog = 20
+)
+
+// SlowQuery is a read that took longer than Config.ExplainSlowReads, with
+// the plan PostgreSQL chose for it.
+type SlowQuery struct {
+	Time     time.Time `json:"time"`
+	Matchers string    `json:"matchers"`
+	StartMs  int64     `json:"start_ms"`
+	EndMs    int64     `json:"end_ms"`
+	Seconds  float64   `json:"seconds"`
+	Plan     string    `json:"plan"`
+}
+
+// explainAllowed reports whether another plan may be taken now, keeping to
+// explainsPerMinute. Callers hold statusMutex.
+func (c *Client) explainAllowed(now time.Time) bool {
+	recent := c.explained[:0]
+	for _, t := range c.explained {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	c.explained = recent
+	if len(c.explained) >= explainsPerMinute {
+		return false
+	}
+	c.explained = append(c.explained, now)
+	return true
+}
+
+// explainSlowRead logs the plan of a read query that took duration, if it
+// exceeded ExplainSlowReads. The query is only planned, never executed
+// again, so explaining does not double its cost.
+func (c *Client) explainSlowRead(ctx context.Context, q *prompb.Query, command string, args []interface{}, duration time.Duration) {
+	if c.cfg.ExplainSlowReads <= 0 || duration < c.cfg.ExplainSlowReads {
+		return
+	}
+	now := time.Now()
+	c.statusMutex.Lock()
+	allowed := c.explainAllowed(now)
+	c.statusMutex.Unlock()
+	if !allowed {
+		return
+	}
+
+	db, err := c.pool()
+	if err != nil {
+		return
+	}
+	var plan string
+	if err := db.QueryRow(ctx, "EXPLAIN (ANALYZE false, FORMAT JSON) "+command, args...).Scan(&plan); err != nil {
+		level.Warn(c.logger).Log("msg", "Explaining slow read failed", "err", err)
+		return
+	}
+	slow := SlowQuery{
+		Time:     now,
+		Matchers: matchersString(q.Matchers),
+		StartMs:  q.StartTimestampMs,
+		EndMs:    q.EndTimestampMs,
+		Seconds:  duration.Seconds(),
+		Plan:     plan,
+	}
+	level.Warn(c.logger).Log("msg", "Slow read", "matchers", slow.Matchers, "start", slow.StartMs, "end", slow.EndMs, "duration", duration, "plan", plan)
+
+	c.statusMutex.Lock()
+	c.slowQueries = append(c.slowQueries, slow)
+	if len(c.slowQueries) > slowQueryLog {
+		c.slowQueries = c.slowQueries[len(c.slowQueries)-slowQueryLog:]
+	}
+	c.statusMutex.Unlock()
+}
+
+// ExplainedQuery is a query a read would run against one table.
+type ExplainedQuery struct {
+	Table string        `json:"table"`
+	SQL   string        `json:"sql"`
+	Args  []interface{} `json:"args"`
+	// Partitions are the leaf partitions of metrics whose range overlaps
+	// the read, empty for legacy or unpartitioned tables.
+	Partitions []string `json:"partitions,omitempty"`
+	// Plan is the EXPLAIN (FORMAT JSON) output if asked for, and Scanned
+	// the relations it scans.
+	Plan    json.RawMessage `json:"plan,omitempty"`
+	Scanned []string        `json:"scanned,omitempty"`
+}
+
+// MatchersExplanation is what ExplainMatchers found out about a read.
+type MatchersExplanation struct {
+	// StartMs is the start of the read after MaxReadLookback was applied.
+	StartMs int64 `json:"start_ms"`
+	EndMs   int64 `json:"end_ms"`
+	// Rejected is why Read would reject the query, empty if it would not.
+	Rejected string           `json:"rejected,omitempty"`
+	Queries  []ExplainedQuery `json:"queries"`
+}
+
+// ExplainMatchers returns the queries Read would run for matchers between
+// start and end, built by the same code, with their parameters and the
+// partitions they target. With plan the queries are also planned, but never
+// executed. Errors are returned as a *ReadError.
+func (c *Client) ExplainMatchers(ctx context.Context, matchers []*prompb.LabelMatcher, start time.Time, end time.Time, plan bool) (*MatchersExplanation, error) {
+	q, err := c.limitLookback(&prompb.Query{
+		StartTimestampMs: fromTimestamp(start),
+		EndTimestampMs:   fromTimestamp(end),
+		Matchers:         matchers,
+	})
+	if err != nil {
+		return nil, readError(err)
+	}
+	explanation := &MatchersExplanation{StartMs: q.StartTimestampMs, EndMs: q.EndTimestampMs}
+	if err := c.checkResolution(ctx, q); err != nil {
+		explanation.Rejected = err.Error()
+	}
+	db, err := c.pool()
+	if err != nil {
+		return nil, readError(err)
+	}
+
+	command, args, err := c.readQuery(ctx, q, c.cfg.ReadOrder)
+	if err != nil {
+		return nil, readError(err)
+	}
+	partitions, err := leafPartitionRanges(ctx, db)
+	if err != nil {
+		return nil, readError(err)
+	}
+	metrics := ExplainedQuery{Table: "metrics", SQL: command, Args: args}
+	from, to := toTimestamp(q.StartTimestampMs), toTimestamp(q.EndTimestampMs)
+	for _, p := range partitions {
+		if !p.lower.After(to) && p.upper.After(from) {
+			metrics.Partitions = append(metrics.Partitions, p.name)
+		}
+	}
+	explanation.Queries = append(explanation.Queries, metrics)
+	for _, t := range c.legacy {
+		if !t.covers(ctx, c, q.StartTimestampMs, q.EndTimestampMs) {
+			continue
+		}
+		command, args, err := c.legacyQuery(t, q)
+		if err != nil {
+			return nil, readError(err)
+		}
+		explanation.Queries = append(explanation.Queries, ExplainedQuery{Table: t.name, SQL: command, Args: args})
+	}
+
+	if !plan {
+		return explanation, nil
+	}
+	for i := range explanation.Queries {
+		eq := &explanation.Queries[i]
+		var out string
+		if err := db.QueryRow(ctx, "EXPLAIN (ANALYZE false, FORMAT JSON) "+eq.SQL, eq.Args...).Scan(&out); err != nil {
+			return nil, readError(err)
+		}
+		var tree interface{}
+		if err := json.Unmarshal([]byte(out), &tree); err != nil {
+			return nil, readError(err)
+		}
+		eq.Plan = json.RawMessage(out)
+		eq.Scanned = planRelations(tree, nil)
+	}
+	return explanation, nil
+}
@@ -0,0 +1,197 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4"
+)
+
+// PartitionPlaceholder is replaced by the quoted name of the new partition in
+// every Config.PartitionCreateHookSQL statement.
+const PartitionPlaceholder = "{partition}"
+
+// pendingHooks holds the hooks that failed per partition, by index into
+// PartitionCreateHookSQL, until a maintenance pass retries them.
+var (
+	pendingHooksMutex sync.Mutex
+	pendingHooks      = make(map[string][]int)
+)
+
+// partitionLockID is the advisory lock serializing partition creation and
+// its hooks across writers and instances.
+func partitionLockID(cfg *Config) int64 {
+	return cfg.LeaderLockID + 1
+}
+
+// partitionLeaves returns the names of the leaf partitions covering day, the
+// tables that receive rows and that hooks are run on.
+func partitionLeaves(partitionScheme string, day time.Time) ([]string, error) {
+	hours, err := partitionHours(partitionScheme)
+	if err != nil {
+		return nil, err
+	}
+	day = partitionTime(day)
+	if partitionScheme == PartitionDaily {
+		return []string{"metrics_" + day.Format("20060102")}, nil
+	}
+	var leaves []string
+	for h := 0; h < 24; h += hours {
+		leaves = append(leaves, fmt.Sprintf("metrics_%s_%02d", day.Format("20060102"), h))
+	}
+	return leaves, nil
+}
+
+// beginner starts transactions, on a pool or on a single connection.
+type beginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// createPartitions creates the partitions covering day and runs the create
+// hooks on those that did not exist before, all under the partition lock.
+// A failing hook is rolled back on its own and left for the next maintenance
+// pass; it never fails the partition creation.
+func createPartitions(ctx context.Context, db beginner, logger log.Logger, cfg *Config, partitionScheme string, day time.Time) error {
+	statements, err := partitionDDL("metrics", partitionScheme, cfg.columns().quoted().Time, day)
+	if err != nil {
+		return err
+	}
+	leaves, err := partitionLeaves(partitionScheme, day)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", partitionLockID(cfg)); err != nil {
+		return err
+	}
+	var created []string
+	if len(cfg.PartitionCreateHookSQL) > 0 {
+		rows, err := tx.Query(ctx, "SELECT name FROM unnest($1::text[]) AS name WHERE to_regclass(name) IS NULL", leaves)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return err
+			}
+			created = append(created, name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, strings.Join(statements, ";\n")); err != nil {
+		return err
+	}
+
+	all := make([]int, len(cfg.PartitionCreateHookSQL))
+	for i := range all {
+		all[i] = i
+	}
+	failed := make(map[string][]int)
+	for _, partition := range created {
+		if f := runPartitionHooks(ctx, tx, logger, cfg, partition, all); len(f) > 0 {
+			failed[partition] = f
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	if len(failed) > 0 {
+		pendingHooksMutex.Lock()
+		for partition, hooks := range failed {
+			pendingHooks[partition] = hooks
+		}
+		pendingHooksMutex.Unlock()
+	}
+	return nil
+}
+
+// runPartitionHooks runs the given hooks on partition, each in its own
+// savepoint, and returns the ones that failed.
+func runPartitionHooks(ctx context.Context, tx pgx.Tx, logger log.Logger, cfg *Config, partition string, hooks []int) []int {
+	name, err := sanitizeIdentifier(partition)
+	if err != nil {
+		level.Error(logger).Log("msg", "Partition create hook skipped", "partition", partition, "err", err)
+		return nil
+	}
+	var failed []int
+	for _, i := range hooks {
+		command := strings.Replace(cfg.PartitionCreateHookSQL[i], PartitionPlaceholder, name, -1)
+		if err := execSavepoint(ctx, tx, command); err != nil {
+			level.Error(logger).Log("msg", "Partition create hook failed, retrying on the next maintenance pass", "partition", partition, "hook", i, "err", err)
+			failed = append(failed, i)
+			continue
+		}
+		level.Info(logger).Log("msg", "Partition create hook", "partition", partition, "hook", i)
+	}
+	return failed
+}
+
+func execSavepoint(ctx context.Context, tx pgx.Tx, command string) error {
+	savepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := savepoint.Exec(ctx, command); err != nil {
+		savepoint.Rollback(ctx)
+		return err
+	}
+	return savepoint.Commit(ctx)
+}
+
+// retryPartitionHooks runs the hooks that failed earlier again, under the
+// partition lock.
+func (c *PGWriter) retryPartitionHooks(ctx context.Context) {
+	pendingHooksMutex.Lock()
+	pending := pendingHooks
+	pendingHooks = make(map[string][]int)
+	pendingHooksMutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	failed := pending
+	err := func() error {
+		tx, err := c.DB.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", partitionLockID(c.cfg)); err != nil {
+			return err
+		}
+		failed = make(map[string][]int)
+		for partition, hooks := range pending {
+			if f := runPartitionHooks(ctx, tx, c.logger, c.cfg, partition, hooks); len(f) > 0 {
+				failed[partition] = f
+			}
+		}
+		return tx.Commit(ctx)
+	}()
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Retrying partition create hooks failed", "err", err)
+		failed = pending
+	}
+
+	pendingHooksMutex.Lock()
+	for partition, hooks := range failed {
+		pendingHooks[partition] = hooks
+	}
+	pendingHooksMutex.Unlock()
+}
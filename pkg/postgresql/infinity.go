@@ -0,0 +1,45 @@
+package postgresql
+
+import (
+	"fmt"
+	"math"
+)
+
+// Handling of sample values of +Inf and -Inf. NaN, which Prometheus uses as
+// staleness marker, is always stored as it is.
+const (
+	InfinityKeep  = "keep"
+	InfinityDrop  = "drop"
+	InfinityClamp = "clamp"
+)
+
+// checkInfinity validates the clamp bound.
+func (cfg *Config) checkInfinity() error {
+	if cfg.InfinityMode == InfinityClamp && (cfg.InfinityClampMax <= 0 || math.IsInf(cfg.InfinityClampMax, 0) || math.IsNaN(cfg.InfinityClampMax)) {
+		return fmt.Errorf("infinity clamp bound %v is not a positive finite number", cfg.InfinityClampMax)
+	}
+	return nil
+}
+
+// infinity applies InfinityMode to an infinite value v, counting the
+// decision, and reports whether the sample is stored and with which value.
+// Finite values and NaN are returned as they are.
+func (cfg *Config) infinity(v float64) (float64, bool) {
+	if !math.IsInf(v, 0) {
+		return v, true
+	}
+	switch cfg.InfinityMode {
+	case InfinityDrop:
+		infiniteSamples.WithLabelValues(InfinityDrop).Inc()
+		return v, false
+	case InfinityClamp:
+		infiniteSamples.WithLabelValues(InfinityClamp).Inc()
+		if v > 0 {
+			return cfg.InfinityClampMax, true
+		}
+		return -cfg.InfinityClampMax, true
+	default:
+		infiniteSamples.WithLabelValues(InfinityKeep).Inc()
+		return v, true
+	}
+}
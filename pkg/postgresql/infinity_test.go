@@ -0,0 +1,120 @@
+package postgresql
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestCheckInfinity(t *testing.T) {
+	tests := []struct {
+		mode  string
+		clamp float64
+		valid bool
+	}{
+		{InfinityKeep, 0, true},
+		{InfinityDrop, 0, true},
+		{InfinityClamp, 1e300, true},
+		{InfinityClamp, 0, false},
+		{InfinityClamp, -1, false},
+		{InfinityClamp, math.Inf(1), false},
+		{InfinityClamp, math.NaN(), false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{InfinityMode: tt.mode, InfinityClampMax: tt.clamp}
+		if err := cfg.checkInfinity(); (err == nil) != tt.valid {
+			t.Errorf("mode %s with bound %v: got %v, want valid %v", tt.mode, tt.clamp, err, tt.valid)
+		}
+	}
+}
+
+// specialValues are the values whose exact bits must survive, by name.
+var specialValues = []struct {
+	name  string
+	value float64
+}{
+	{"+Inf", math.Inf(1)},
+	{"-Inf", math.Inf(-1)},
+	{"NaN", math.NaN()},
+	{"stale NaN", math.Float64frombits(value.StaleNaN)},
+	{"finite", 1.5},
+}
+
+// TestInfinityParse runs the special values through the conversion of a
+// parser under every mode and checks the bits of the values stored.
+func TestInfinityParse(t *testing.T) {
+	tests := []struct {
+		mode string
+		// want maps the name of a value to the bits stored, absent when
+		// the sample is dropped.
+		want map[string]uint64
+	}{
+		{InfinityKeep, map[string]uint64{
+			"+Inf": math.Float64bits(math.Inf(1)), "-Inf": math.Float64bits(math.Inf(-1)),
+			"NaN": math.Float64bits(math.NaN()), "stale NaN": value.StaleNaN, "finite": math.Float64bits(1.5),
+		}},
+		{InfinityDrop, map[string]uint64{
+			"NaN": math.Float64bits(math.NaN()), "stale NaN": value.StaleNaN, "finite": math.Float64bits(1.5),
+		}},
+		{InfinityClamp, map[string]uint64{
+			"+Inf": math.Float64bits(1e300), "-Inf": math.Float64bits(-1e300),
+			"NaN": math.Float64bits(math.NaN()), "stale NaN": value.StaleNaN, "finite": math.Float64bits(1.5),
+		}},
+	}
+	ts := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := &Config{InfinityMode: tt.mode, InfinityClampMax: 1e300}
+			var samples model.Samples
+			for _, v := range specialValues {
+				samples = append(samples, &model.Sample{
+					Metric:    model.Metric{model.MetricNameLabel: "special", "value": model.LabelValue(v.name)},
+					Value:     model.SampleValue(v.value),
+					Timestamp: model.TimeFromUnixNano(ts.UnixNano()),
+				})
+			}
+			var p PGParser
+			_, dropped, _ := p.parseBatch(cfg, PartitionHourly, samples, func(time.Time) bool { return true })
+			if want := len(specialValues) - len(tt.want); dropped != want {
+				t.Errorf("%d dropped, want %d", dropped, want)
+			}
+			if len(p.valueRows) != len(tt.want) {
+				t.Fatalf("%d rows, want %d", len(p.valueRows), len(tt.want))
+			}
+			for _, row := range p.valueRows {
+				name := row[3].(map[string]interface{})["value"].(string)
+				want, ok := tt.want[name]
+				if !ok {
+					t.Errorf("%s stored, want it dropped", name)
+					continue
+				}
+				if got := math.Float64bits(row[2].(float64)); got != want {
+					t.Errorf("%s stored as %#x, want %#x", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestOrderSamplesKeepsSpecialValues checks that the series assembly of the
+// read path passes the bits of special values on untouched.
+func TestOrderSamplesKeepsSpecialValues(t *testing.T) {
+	var samples []prompb.Sample
+	for i := len(specialValues) - 1; i >= 0; i-- {
+		samples = append(samples, prompb.Sample{Timestamp: int64(i), Value: specialValues[i].value})
+	}
+	ordered := orderSamples(log.NewNopLogger(), nil, samples)
+	if len(ordered) != len(specialValues) {
+		t.Fatalf("%d samples, want %d", len(ordered), len(specialValues))
+	}
+	for i, v := range specialValues {
+		if got, want := math.Float64bits(ordered[i].Value), math.Float64bits(v.value); got != want {
+			t.Errorf("%s read as %#x, want %#x", v.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package postgresql
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// ingestOther is the name the samples of metric names beyond
+// IngestStatsTopN are recorded under.
+const ingestOther = "__other__"
+
+const ingestStatsTable = `CREATE TABLE IF NOT EXISTS ingest_stats (
+	name TEXT NOT NULL,
+	day DATE NOT NULL,
+	samples BIGINT NOT NULL,
+	label_bytes BIGINT NOT NULL,
+	suppressed BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (name, day)
+)`
+
+// ingestStatsSuppressed adds the suppressed column to tables created before
+// it existed.
+const ingestStatsSuppressed = `ALTER TABLE ingest_stats ADD COLUMN IF NOT EXISTS suppressed BIGINT NOT NULL DEFAULT 0`
+
+// ingestStatsUpsert adds one interval's counts to the daily totals in a single
+// statement.
+const ingestStatsUpsert = `INSERT INTO ingest_stats (name, day, samples, label_bytes, suppressed)
+SELECT n, $1::date, s, b, u FROM unnest($2::text[], $3::bigint[], $4::bigint[], $5::bigint[]) AS t(n, s, b, u)
+ON CONFLICT (name, day) DO UPDATE
+SET samples = ingest_stats.samples + excluded.samples, label_bytes = ingest_stats.label_bytes + excluded.label_bytes,
+	suppressed = ingest_stats.suppressed + excluded.suppressed`
+
+// ingestCount counts the samples stored for one metric name, and those not
+// stored because their value was unchanged.
+type ingestCount struct {
+	samples    int64
+	labelBytes int64
+	suppressed int64
+}
+
+// ingestCounts are per metric name. Parsers count into their own map without
+// locking and merge it here when they hand their rows to the writer.
+var (
+	ingestMutex  sync.Mutex
+	ingestCounts = make(map[string]*ingestCount)
+)
+
+// count records one sample in the parser's map.
+func (p *PGParser) count(name string, labelBytes int) {
+	if n := p.ingest[name]; n != nil {
+		n.samples++
+		n.labelBytes += int64(labelBytes)
+		return
+	}
+	p.ingest[name] = &ingestCount{samples: 1, labelBytes: int64(labelBytes)}
+}
+
+// countSuppressed records one suppressed sample in the parser's map.
+func (p *PGParser) countSuppressed(name string) {
+	if n := p.ingest[name]; n != nil {
+		n.suppressed++
+		return
+	}
+	p.ingest[name] = &ingestCount{suppressed: 1}
+}
+
+// mergeIngest moves the parser's counts to ingestCounts.
+func (p *PGParser) mergeIngest() {
+	if len(p.ingest) == 0 {
+		return
+	}
+	ingestMutex.Lock()
+	for name, n := range p.ingest {
+		if total := ingestCounts[name]; total != nil {
+			total.samples += n.samples
+			total.labelBytes += n.labelBytes
+			total.suppressed += n.suppressed
+		} else {
+			ingestCounts[name] = n
+		}
+	}
+	ingestMutex.Unlock()
+	p.ingest = make(map[string]*ingestCount, len(p.ingest))
+}
+
+// runIngestStats writes the counts collected every IngestStatsInterval to
+// ingest_stats for as long as the writer runs, and once more when it stops.
+func (c *PGWriter) runIngestStats() {
+	for c.KeepRunning {
+		for wait := time.Duration(0); wait < c.cfg.IngestStatsInterval && c.KeepRunning; wait += time.Second {
+			time.Sleep(time.Second)
+		}
+		if err := c.flushIngestStats(context.Background()); err != nil {
+			level.Error(c.logger).Log("msg", "Writing ingest stats failed", "err", err)
+		}
+	}
+}
+
+// flushIngestStats upserts the counts collected since the last call for the
+// IngestStatsTopN metric names with the most samples, and the sum of the
+// others as ingestOther. The counts are dropped if the upsert fails.
+func (c *PGWriter) flushIngestStats(ctx context.Context) error {
+	ingestMutex.Lock()
+	counts := ingestCounts
+	ingestCounts = make(map[string]*ingestCount, len(counts))
+	ingestMutex.Unlock()
+	if len(counts) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return counts[names[i]].samples > counts[names[j]].samples })
+
+	top := c.cfg.IngestStatsTopN
+	if top > len(names) {
+		top = len(names)
+	}
+	samples := make([]int64, 0, top+1)
+	labelBytes := make([]int64, 0, top+1)
+	suppressed := make([]int64, 0, top+1)
+	for _, name := range names[:top] {
+		samples = append(samples, counts[name].samples)
+		labelBytes = append(labelBytes, counts[name].labelBytes)
+		suppressed = append(suppressed, counts[name].suppressed)
+	}
+	if top < len(names) {
+		var other ingestCount
+		for _, name := range names[top:] {
+			other.samples += counts[name].samples
+			other.labelBytes += counts[name].labelBytes
+			other.suppressed += counts[name].suppressed
+		}
+		names = append(names[:top], ingestOther)
+		samples = append(samples, other.samples)
+		labelBytes = append(labelBytes, other.labelBytes)
+		suppressed = append(suppressed, other.suppressed)
+	}
+
+	day := time.Now().UTC().Format("2006-01-02")
+	_, err := c.DB.Exec(ctx, ingestStatsUpsert, day, names, samples, labelBytes, suppressed)
+	return err
+}
@@ -0,0 +1,69 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// InstantSample is the latest sample of a series at the time of an instant
+// query.
+type InstantSample struct {
+	Labels []prompb.Label
+	Sample prompb.Sample
+}
+
+// QueryInstant returns the latest sample at or before at of every series
+// matching matchers, looking back at most InstantQueryLookback. Series whose
+// latest sample is a staleness marker are left out, as in Prometheus. Errors
+// are returned as a *ReadError.
+func (c *Client) QueryInstant(ctx context.Context, matchers []*prompb.LabelMatcher, at time.Time) ([]InstantSample, error) {
+	q, err := c.limitLookback(&prompb.Query{
+		StartTimestampMs: fromTimestamp(at.Add(-c.cfg.InstantQueryLookback)),
+		EndTimestampMs:   fromTimestamp(at),
+		Matchers:         matchers,
+	})
+	if err != nil {
+		return nil, readError(err)
+	}
+	columns := c.cfg.columns()
+	var args sqlArgs
+	where, err := buildWhere(columns, q.Matchers, q.StartTimestampMs, q.EndTimestampMs, &args)
+	if err != nil {
+		return nil, readError(err)
+	}
+	tombstones, err := c.activeTombstones(ctx)
+	if err != nil {
+		return nil, readError(err)
+	}
+	exclude, err := tombstoneWhere(columns, tombstones, q.StartTimestampMs, q.EndTimestampMs, &args)
+	if err != nil {
+		return nil, readError(err)
+	}
+	if exclude != "" {
+		where += " AND " + exclude
+	}
+	col := columns.quoted()
+	command := fmt.Sprintf("SELECT DISTINCT ON (%s, %s) %s, %s, %s, %s FROM metrics WHERE %s ORDER BY %s, %s, %s DESC",
+		col.Name, col.Labels, col.Time, col.Name, col.Value, col.Labels, where, col.Name, col.Labels, col.Time)
+
+	db, err := c.pool()
+	if err != nil {
+		return nil, readError(err)
+	}
+	var result []InstantSample
+	err = scanRows(ctx, db, command, args, func(name string, labels *sampleLabels, sample prompb.Sample) error {
+		if value.IsStaleNaN(sample.Value) {
+			return nil
+		}
+		result = append(result, InstantSample{Labels: seriesLabels(name, labels), Sample: sample})
+		return nil
+	})
+	if err != nil {
+		return nil, readError(err)
+	}
+	return result, nil
+}
@@ -0,0 +1,892 @@
+//go:build integration
+// +build integration
+
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// roundTripStart is the first sample time of the round trip, two days of
+// samples every ten minutes follow.
+var roundTripStart = time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	roundTripStep  = 10 * time.Minute
+	roundTripSteps = 2 * 24 * 6
+)
+
+// roundTripSamples returns the samples of 12 series over two days: two
+// metric names, three jobs and two instances. Every value is distinct and
+// derived from the series and the step.
+func roundTripSamples() model.Samples {
+	var samples model.Samples
+	series := 0
+	for _, name := range []string{"it_up", "it_requests"} {
+		for _, job := range []string{"api", "db", "web"} {
+			for _, instance := range []string{"a", "b"} {
+				metric := model.Metric{model.MetricNameLabel: model.LabelValue(name), "job": model.LabelValue(job), "instance": model.LabelValue(instance)}
+				for step := 0; step < roundTripSteps; step++ {
+					ts := roundTripStart.Add(time.Duration(step) * roundTripStep)
+					samples = append(samples, &model.Sample{
+						Metric:    metric,
+						Value:     model.SampleValue(series*100000 + step),
+						Timestamp: model.TimeFromUnixNano(ts.UnixNano()),
+					})
+				}
+				series++
+			}
+		}
+	}
+	return samples
+}
+
+// matches reports whether metric satisfies every matcher, as Prometheus
+// evaluates them: regular expressions are anchored, a missing label is "".
+func matches(t *testing.T, metric model.Metric, matchers []*prompb.LabelMatcher) bool {
+	for _, m := range matchers {
+		value := string(metric[model.LabelName(m.Name)])
+		var ok bool
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			ok = value == m.Value
+		case prompb.LabelMatcher_NEQ:
+			ok = value != m.Value
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				t.Fatalf("matcher %s: %v", m.Value, err)
+			}
+			ok = re.MatchString(value) == (m.Type == prompb.LabelMatcher_RE)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// expectedSeries returns the samples of q among samples, by series.
+func expectedSeries(t *testing.T, samples model.Samples, q *prompb.Query) map[string][]prompb.Sample {
+	series := make(map[string][]prompb.Sample)
+	for _, s := range samples {
+		ms := int64(s.Timestamp)
+		if ms < q.StartTimestampMs || ms > q.EndTimestampMs || !matches(t, s.Metric, q.Matchers) {
+			continue
+		}
+		key := s.Metric.String()
+		series[key] = append(series[key], prompb.Sample{Value: float64(s.Value), Timestamp: ms})
+	}
+	return series
+}
+
+// readRoundTrip returns the samples of q read through Client.Read, by series.
+func readRoundTrip(t *testing.T, h *testHarness, q *prompb.Query) map[string][]prompb.Sample {
+	resp, err := h.client.Read(&prompb.ReadRequest{Queries: []*prompb.Query{q}})
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	series := make(map[string][]prompb.Sample)
+	for _, ts := range resp.Results[0].Timeseries {
+		metric := make(model.Metric, len(ts.Labels))
+		for _, l := range ts.Labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		key := metric.String()
+		if _, dup := series[key]; dup {
+			t.Errorf("series %s returned twice", key)
+		}
+		series[key] = ts.Samples
+	}
+	return series
+}
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	day := int64(24 * time.Hour / time.Millisecond)
+	start := int64(model.TimeFromUnixNano(roundTripStart.UnixNano()))
+	queries := []struct {
+		name     string
+		matchers []*prompb.LabelMatcher
+		start    int64
+		end      int64
+	}{
+		{"EQ", []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_up"},
+			{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "api"},
+		}, start, start + 2*day},
+		{"NEQ", []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_up"},
+			{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "api"},
+		}, start, start + 2*day},
+		{"RE", []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "it_.*"},
+			{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api|db"},
+		}, start, start + 2*day},
+		{"NRE", []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_requests"},
+			{Type: prompb.LabelMatcher_NRE, Name: "instance", Value: "a"},
+		}, start, start + 2*day},
+		{"time bounds across midnight", []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_up"},
+		}, start + day/2, start + day + day/4},
+		{"no match", []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_missing"},
+		}, start, start + 2*day},
+	}
+
+	for _, scheme := range []string{PartitionDaily, PartitionHourly} {
+		t.Run(scheme, func(t *testing.T) {
+			h := newTestHarness(t, &Config{PartitionScheme: scheme})
+			defer h.close()
+
+			samples := roundTripSamples()
+			for i := 0; i < len(samples); i += 500 {
+				end := i + 500
+				if end > len(samples) {
+					end = len(samples)
+				}
+				h.write(samples[i:end])
+			}
+			h.flush()
+
+			if got := h.count("SELECT count(*) FROM metrics"); got != int64(len(samples)) {
+				t.Fatalf("%d rows stored, want %d", got, len(samples))
+			}
+			partitions := h.count("SELECT count(*) FROM pg_inherits WHERE inhparent = 'metrics'::regclass")
+			if want := map[string]int64{PartitionDaily: 2, PartitionHourly: 48}[scheme]; partitions < want {
+				t.Errorf("%d partitions below metrics, want at least %d", partitions, want)
+			}
+
+			for _, tt := range queries {
+				t.Run(tt.name, func(t *testing.T) {
+					q := &prompb.Query{StartTimestampMs: tt.start, EndTimestampMs: tt.end, Matchers: tt.matchers}
+					want := expectedSeries(t, samples, q)
+					got := readRoundTrip(t, h, q)
+					if len(got) != len(want) {
+						t.Fatalf("%d series read, want %d: %v", len(got), len(want), sortedKeys(got))
+					}
+					for key, wantSamples := range want {
+						gotSamples, ok := got[key]
+						if !ok {
+							t.Errorf("series %s missing", key)
+							continue
+						}
+						if len(gotSamples) != len(wantSamples) {
+							t.Errorf("series %s has %d samples, want %d", key, len(gotSamples), len(wantSamples))
+							continue
+						}
+						for i := range wantSamples {
+							if gotSamples[i] != wantSamples[i] {
+								t.Errorf("series %s sample %d is %v, want %v", key, i, gotSamples[i], wantSamples[i])
+								break
+							}
+						}
+					}
+				})
+			}
+		})
+	}
+}
+
+// BenchmarkReadOrder reads two days of 200 series, 57600 rows, with each
+// ReadOrder.
+func BenchmarkReadOrder(b *testing.B) {
+	h := newTestHarness(b, &Config{PartitionScheme: PartitionDaily})
+	defer h.close()
+	for step := 0; step < roundTripSteps; step++ {
+		h.write(testSamples(200, roundTripStart.Add(time.Duration(step)*roundTripStep)))
+	}
+	h.flush()
+
+	start := int64(model.TimeFromUnixNano(roundTripStart.UnixNano()))
+	req := &prompb.ReadRequest{Queries: []*prompb.Query{{
+		StartTimestampMs: start,
+		EndTimestampMs:   start + int64(2*24*time.Hour/time.Millisecond),
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "__name__", Value: "bench_metric_.*"}},
+	}}}
+	for _, order := range []string{ReadOrderTime, ReadOrderSeries, ReadOrderNone} {
+		b.Run(order, func(b *testing.B) {
+			h.cfg.ReadOrder = order
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				resp, err := h.client.Read(req)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n := len(resp.Results[0].Timeseries); n != 200 {
+					b.Fatalf("%d series read, want 200", n)
+				}
+			}
+		})
+	}
+}
+
+func sortedKeys(series map[string][]prompb.Sample) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRoundTripSamplesSpanTwoDays(t *testing.T) {
+	samples := roundTripSamples()
+	first := model.Time(samples[0].Timestamp).Time().UTC()
+	last := model.Time(samples[roundTripSteps-1].Timestamp).Time().UTC()
+	if first.Day() == last.Day() {
+		t.Fatalf("samples from %s to %s stay within a day", first, last)
+	}
+	if len(samples) != 12*roundTripSteps {
+		t.Fatalf("%d samples, want %d", len(samples), 12*roundTripSteps)
+	}
+}
+
+// TestSpecialValuesRoundTrip stores +Inf, -Inf, NaN and the staleness
+// marker and checks that reads return their exact bits, and what clamping
+// stores instead.
+func TestSpecialValuesRoundTrip(t *testing.T) {
+	for _, mode := range []string{InfinityKeep, InfinityClamp} {
+		t.Run(mode, func(t *testing.T) {
+			h := newTestHarness(t, &Config{InfinityMode: mode, InfinityClampMax: 1e300})
+			defer h.close()
+
+			metric := model.Metric{model.MetricNameLabel: "it_special"}
+			var samples model.Samples
+			for i, v := range specialValues {
+				samples = append(samples, &model.Sample{
+					Metric:    metric,
+					Value:     model.SampleValue(v.value),
+					Timestamp: model.TimeFromUnixNano(roundTripStart.Add(time.Duration(i) * time.Minute).UnixNano()),
+				})
+			}
+			h.write(samples)
+			h.flush()
+
+			start := int64(model.TimeFromUnixNano(roundTripStart.UnixNano()))
+			got := readRoundTrip(t, h, &prompb.Query{
+				StartTimestampMs: start,
+				EndTimestampMs:   start + int64(time.Hour/time.Millisecond),
+				Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_special"}},
+			})[metric.String()]
+			if len(got) != len(specialValues) {
+				t.Fatalf("%d samples read, want %d", len(got), len(specialValues))
+			}
+			for i, v := range specialValues {
+				want := v.value
+				if mode == InfinityClamp && math.IsInf(want, 0) {
+					want = math.Copysign(1e300, want)
+				}
+				if math.Float64bits(got[i].Value) != math.Float64bits(want) {
+					t.Errorf("%s read as %#x, want %#x", v.name, math.Float64bits(got[i].Value), math.Float64bits(want))
+				}
+			}
+		})
+	}
+}
+
+// TestEmptyReadCacheNewSeries writes a series after reads found nothing and
+// checks when reads see it: at once for a query of the latest data, which
+// is not cached, and within one TTL for an older range.
+func TestEmptyReadCacheNewSeries(t *testing.T) {
+	ttl := 2 * time.Second
+	h := newTestHarness(t, &Config{EmptyReadCacheTTL: ttl})
+	defer h.close()
+
+	now := time.Now()
+	matchers := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_late"}}
+	latest := &prompb.Query{StartTimestampMs: fromTimestamp(now.Add(-time.Hour)), EndTimestampMs: fromTimestamp(now), Matchers: matchers}
+	older := &prompb.Query{StartTimestampMs: fromTimestamp(now.Add(-time.Hour)), EndTimestampMs: fromTimestamp(now.Add(-time.Minute)), Matchers: matchers}
+	cached := time.Now()
+	for _, q := range []*prompb.Query{latest, older} {
+		if got := readRoundTrip(t, h, q); len(got) != 0 {
+			t.Fatalf("%d series read before any was written", len(got))
+		}
+	}
+
+	h.write(model.Samples{&model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "it_late"},
+		Value:     1,
+		Timestamp: model.TimeFromUnixNano(now.Add(-30 * time.Minute).UnixNano()),
+	}})
+	h.flush()
+	if got := readRoundTrip(t, h, latest); len(got) != 1 {
+		t.Errorf("%d series read of the latest data, want 1", len(got))
+	}
+	h.waitFor("the older range to show the series", func() bool { return len(readRoundTrip(t, h, older)) == 1 })
+	if waited := time.Since(cached); waited > ttl+time.Second {
+		t.Errorf("series read %s after the empty read, TTL %s", waited, ttl)
+	}
+}
+
+// TestCopyCreatesBatchPartitions copies a batch spanning two days whose
+// partitions do not exist yet. They are created on the connection of the
+// COPY before it runs, so the first COPY succeeds without the retry for a
+// missing partition.
+func TestCopyCreatesBatchPartitions(t *testing.T) {
+	h := newTestHarness(t, &Config{PartitionScheme: PartitionHourly})
+	defer h.close()
+
+	var mutex sync.Mutex
+	var logged []string
+	w := &PGWriter{DB: h.db, cfg: h.cfg, logger: log.LoggerFunc(func(keyvals ...interface{}) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		logged = append(logged, fmt.Sprint(keyvals...))
+		return nil
+	})}
+
+	midnight := time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC)
+	var leaves []string
+	for _, day := range []time.Time{midnight.AddDate(0, 0, -1), midnight} {
+		names, err := partitionLeaves(PartitionHourly, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, names...)
+	}
+	if n := h.count("SELECT count(*) FROM unnest($1::text[]) AS name WHERE to_regclass(name) IS NOT NULL", leaves); n != 0 {
+		t.Fatalf("%d partitions of the batch exist before the COPY", n)
+	}
+
+	rows := make([][]interface{}, 120)
+	for i := range rows {
+		rows[i] = []interface{}{midnight.Add(time.Duration(i-60) * time.Minute), "it_two_days", float64(i), "{}"}
+	}
+	n, err := w.copyOrBisect(rows)
+	if err != nil {
+		t.Fatalf("COPY: %v", err)
+	}
+	if n != int64(len(rows)) {
+		t.Errorf("%d rows copied, want %d", n, len(rows))
+	}
+	if got := h.count("SELECT count(*) FROM metrics WHERE name = 'it_two_days'"); got != int64(len(rows)) {
+		t.Errorf("%d rows stored, want %d", got, len(rows))
+	}
+	if n := h.count("SELECT count(*) FROM unnest($1::text[]) AS name WHERE to_regclass(name) IS NOT NULL", leaves); n != int64(len(leaves)) {
+		t.Errorf("%d of the %d partitions of both days exist", n, len(leaves))
+	}
+	for _, line := range logged {
+		if strings.Contains(line, "partition missing") || strings.Contains(line, "bisecting") {
+			t.Errorf("COPY not done on the first attempt: %s", line)
+		}
+	}
+}
+
+// TestConcurrentSchemaSetup starts the schema setup of several adapters at
+// once against a schema without any table, as replicas of a deployment do
+// on their first start. All of them must succeed.
+func TestConcurrentSchemaSetup(t *testing.T) {
+	h := newTestHarness(t, &Config{})
+	defer h.close()
+
+	ctx := context.Background()
+	schema := h.schema + "_setup"
+	if _, err := h.db.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	defer h.db.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+
+	const adapters = 8
+	errs := make(chan error, adapters)
+	begin := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < adapters; i++ {
+		pool, err := pgxpool.Connect(ctx, withSearchPath(os.Getenv(testDatabaseEnv), schema))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pool.Close()
+		w := &PGWriter{DB: pool, id: i, cfg: h.cfg, logger: log.NewNopLogger()}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-begin
+			if _, err := w.setupPgPrometheus(); err != nil {
+				errs <- fmt.Errorf("adapter %d: %w", w.id, err)
+			}
+		}()
+	}
+	// All connected, the setups start together.
+	close(begin)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("schema setup failed: %v", err)
+	}
+	if n := h.count("SELECT count(*) FROM pg_class WHERE oid = to_regclass($1)", schema+".metrics"); n != 1 {
+		t.Errorf("no metrics table in %s after the setup", schema)
+	}
+}
+
+// TestRenamedColumnsRoundTrip creates the metrics table with columns of
+// its own names and reads back what was written through them.
+func TestRenamedColumnsRoundTrip(t *testing.T) {
+	columns := Columns{Time: "ts", Name: "metric", Value: "val", Labels: "tags"}
+	h := newTestHarness(t, &Config{Columns: columns})
+	defer h.close()
+
+	got := h.count(`SELECT count(*) FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'metrics' AND column_name = ANY($1)`, columns.list())
+	if got != 4 {
+		t.Fatalf("%d of the columns %v in metrics", got, columns.list())
+	}
+
+	// it_up of the api and db jobs on both instances.
+	samples := roundTripSamples()[:4*roundTripSteps]
+	h.write(samples)
+	h.flush()
+	if got := h.count("SELECT count(*) FROM metrics WHERE metric = 'it_up'"); got != int64(len(samples)) {
+		t.Fatalf("%d rows stored, want %d", got, len(samples))
+	}
+
+	start := int64(model.TimeFromUnixNano(roundTripStart.UnixNano()))
+	q := &prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   start + int64(24*time.Hour/time.Millisecond),
+		Matchers: []*prompb.LabelMatcher{
+			{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_up"},
+			{Type: prompb.LabelMatcher_RE, Name: "job", Value: "api|db"},
+		},
+	}
+	want := expectedSeries(t, samples, q)
+	read := readRoundTrip(t, h, q)
+	if len(read) != len(want) {
+		t.Fatalf("%d series read, want %d: %v", len(read), len(want), sortedKeys(read))
+	}
+	for key, wantSamples := range want {
+		if len(read[key]) != len(wantSamples) {
+			t.Errorf("series %s has %d samples, want %d", key, len(read[key]), len(wantSamples))
+			continue
+		}
+		for i := range wantSamples {
+			if read[key][i] != wantSamples[i] {
+				t.Errorf("series %s sample %d is %v, want %v", key, i, read[key][i], wantSamples[i])
+				break
+			}
+		}
+	}
+}
+
+// TestTombstoneHidesSeries tombstones a series and checks that reads stop
+// returning it while its rows are still stored, until the leader deletes
+// them and the tombstone.
+func TestTombstoneHidesSeries(t *testing.T) {
+	h := newTestHarness(t, &Config{})
+	defer h.close()
+
+	var samples model.Samples
+	for _, job := range []string{"hidden", "kept"} {
+		for step := 0; step < 6; step++ {
+			samples = append(samples, &model.Sample{
+				Metric:    model.Metric{model.MetricNameLabel: "it_tombstoned", "job": model.LabelValue(job)},
+				Value:     model.SampleValue(step),
+				Timestamp: model.TimeFromUnixNano(roundTripStart.Add(time.Duration(step) * roundTripStep).UnixNano()),
+			})
+		}
+	}
+	h.write(samples)
+	h.flush()
+
+	start := int64(model.TimeFromUnixNano(roundTripStart.UnixNano()))
+	q := &prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   start + int64(time.Hour/time.Millisecond),
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_tombstoned"}},
+	}
+	if got := readRoundTrip(t, h, q); len(got) != 2 {
+		t.Fatalf("%d series read before the tombstone, want 2", len(got))
+	}
+
+	ctx := context.Background()
+	matchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_tombstoned"},
+		{Type: prompb.LabelMatcher_EQ, Name: "job", Value: "hidden"},
+	}
+	if _, err := h.client.TombstoneSeries(ctx, matchers, roundTripStart, roundTripStart.Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	got := readRoundTrip(t, h, q)
+	if len(got) != 1 || got[`it_tombstoned{job="kept"}`] == nil {
+		t.Errorf("series read with the tombstone %v, want only the kept one", sortedKeys(got))
+	}
+	if n := h.count(`SELECT count(*) FROM metrics WHERE labels->>'job' = 'hidden'`); n != 6 {
+		t.Errorf("%d rows of the tombstoned series stored, want all 6 until the leader deletes them", n)
+	}
+
+	h.writers[0].processTombstones(ctx)
+	if n := h.count(`SELECT count(*) FROM metrics WHERE labels->>'job' = 'hidden'`); n != 0 {
+		t.Errorf("%d rows of the tombstoned series left after deleting them", n)
+	}
+	if n := h.count("SELECT count(*) FROM tombstones"); n != 0 {
+		t.Errorf("%d tombstones left after deleting their rows", n)
+	}
+	if got := readRoundTrip(t, h, q); len(got) != 1 {
+		t.Errorf("%d series read after deleting the tombstoned one, want 1", len(got))
+	}
+}
+
+// TestQuerySeriesStopsOnError checks that an error returned by the
+// SeriesFunc stops the scan after that series and is returned as it is,
+// not as a *ReadError.
+func TestQuerySeriesStopsOnError(t *testing.T) {
+	h := newTestHarness(t, &Config{})
+	defer h.close()
+
+	var samples model.Samples
+	for _, job := range []string{"api", "db", "web"} {
+		for step := 0; step < 6; step++ {
+			samples = append(samples, &model.Sample{
+				Metric:    model.Metric{model.MetricNameLabel: "it_stopped", "job": model.LabelValue(job)},
+				Value:     model.SampleValue(step),
+				Timestamp: model.TimeFromUnixNano(roundTripStart.Add(time.Duration(step) * roundTripStep).UnixNano()),
+			})
+		}
+	}
+	h.write(samples)
+	h.flush()
+
+	start := int64(model.TimeFromUnixNano(roundTripStart.UnixNano()))
+	q := &prompb.Query{
+		StartTimestampMs: start,
+		EndTimestampMs:   start + int64(time.Hour/time.Millisecond),
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_stopped"}},
+	}
+	var calls int
+	if err := h.client.QuerySeries(context.Background(), q, func([]prompb.Label, []prompb.Sample) error {
+		calls++
+		return nil
+	}); err != nil || calls != 3 {
+		t.Fatalf("QuerySeries passed on %d series (%v), want 3", calls, err)
+	}
+
+	stop := errors.New("enough series")
+	calls = 0
+	err := h.client.QuerySeries(context.Background(), q, func(labels []prompb.Label, samples []prompb.Sample) error {
+		calls++
+		if len(samples) != 6 {
+			t.Errorf("series %v with %d samples, want 6", labels, len(samples))
+		}
+		return stop
+	})
+	if err != stop {
+		t.Errorf("QuerySeries returned %v, want the SeriesFunc's error itself", err)
+	}
+	var re *ReadError
+	if errors.As(err, &re) {
+		t.Errorf("the SeriesFunc's error was wrapped in %v", re)
+	}
+	if calls != 1 {
+		t.Errorf("SeriesFunc called %d times after returning an error, want once", calls)
+	}
+}
+
+// TestLegacyTableMerged reads a series stored both in a legacy table and
+// in the partitioned one, next to a series only the legacy table has. At
+// the timestamps in both tables the partitioned rows are kept.
+func TestLegacyTableMerged(t *testing.T) {
+	h := newTestHarness(t, &Config{LegacyTables: []string{"metrics_legacy"}})
+	defer h.close()
+
+	var samples model.Samples
+	for step := 0; step < 6; step++ {
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "it_legacy", "job": "both"},
+			Value:     model.SampleValue(step),
+			Timestamp: model.TimeFromUnixNano(roundTripStart.Add(time.Duration(step) * roundTripStep).UnixNano()),
+		})
+	}
+	h.write(samples)
+	h.flush()
+
+	// The legacy table has the same samples with other values, the hour
+	// before them and a series of its own. It is filled before the first
+	// read looks up its time range.
+	for _, stmt := range []string{
+		"CREATE TABLE metrics_legacy (LIKE metrics)",
+		"INSERT INTO metrics_legacy (time, name, value, labels) SELECT time, name, value + 100, labels FROM metrics",
+		"INSERT INTO metrics_legacy (time, name, value, labels) SELECT time - interval '1 hour', name, value + 200, labels FROM metrics",
+		`INSERT INTO metrics_legacy (time, name, value, labels) SELECT time, name, value + 300, labels || '{"job": "legacy"}' FROM metrics`,
+	} {
+		if _, err := h.db.Exec(context.Background(), stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	start := roundTripStart.Add(-time.Hour)
+	var both, legacy []prompb.Sample
+	for step := 0; step < 6; step++ {
+		ts := fromTimestamp(start.Add(time.Duration(step) * roundTripStep))
+		both = append(both, prompb.Sample{Timestamp: ts, Value: float64(step + 200)})
+	}
+	for step := 0; step < 6; step++ {
+		ts := fromTimestamp(roundTripStart.Add(time.Duration(step) * roundTripStep))
+		both = append(both, prompb.Sample{Timestamp: ts, Value: float64(step)})
+		legacy = append(legacy, prompb.Sample{Timestamp: ts, Value: float64(step + 300)})
+	}
+	want := map[string][]prompb.Sample{
+		`it_legacy{job="both"}`:   both,
+		`it_legacy{job="legacy"}`: legacy,
+	}
+
+	q := &prompb.Query{
+		StartTimestampMs: fromTimestamp(start),
+		EndTimestampMs:   fromTimestamp(roundTripStart.Add(time.Hour)),
+		Matchers:         []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_legacy"}},
+	}
+	queried := make(map[string][]prompb.Sample)
+	err := h.client.QuerySeries(context.Background(), q, func(labels []prompb.Label, samples []prompb.Sample) error {
+		metric := make(model.Metric, len(labels))
+		for _, l := range labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		queried[metric.String()] = samples
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, got := range map[string]map[string][]prompb.Sample{
+		"Read":        readRoundTrip(t, h, q),
+		"QuerySeries": queried,
+	} {
+		if len(got) != len(want) {
+			t.Errorf("%s: series %v, want %v", name, sortedKeys(got), sortedKeys(want))
+		}
+		for key, samples := range want {
+			if fmt.Sprint(got[key]) != fmt.Sprint(samples) {
+				t.Errorf("%s: %s\ngot  %v\nwant %v", name, key, got[key], samples)
+			}
+		}
+	}
+}
+
+// TestBoundedReadPrunesPartitions plans bounded reads through
+// ExplainMatchers and checks that they scan only the leaf partitions
+// overlapping their time range.
+func TestBoundedReadPrunesPartitions(t *testing.T) {
+	day := roundTripStart
+	next := day.Add(24 * time.Hour)
+	tests := []struct {
+		name       string
+		scheme     string
+		start, end time.Time
+		scanned    []string
+	}{
+		{"two hours", PartitionHourly, day.Add(10 * time.Hour), day.Add(12*time.Hour - time.Millisecond), []string{"metrics_20200301_10", "metrics_20200301_11"}},
+		{"one sample", PartitionHourly, day.Add(5 * time.Hour), day.Add(5 * time.Hour), []string{"metrics_20200301_05"}},
+		{"hours across midnight", PartitionHourly, day.Add(23*time.Hour + 30*time.Minute), next.Add(30 * time.Minute), []string{"metrics_20200301_23", "metrics_20200302_00"}},
+		{"within a day", PartitionDaily, day.Add(time.Hour), day.Add(20 * time.Hour), []string{"metrics_20200301"}},
+		{"days across midnight", PartitionDaily, day.Add(12 * time.Hour), next.Add(6 * time.Hour), []string{"metrics_20200301", "metrics_20200302"}},
+	}
+	for _, scheme := range []string{PartitionHourly, PartitionDaily} {
+		t.Run(scheme, func(t *testing.T) {
+			h := newTestHarness(t, &Config{PartitionScheme: scheme})
+			defer h.close()
+
+			samples := roundTripSamples()
+			for i := 0; i < len(samples); i += 500 {
+				end := i + 500
+				if end > len(samples) {
+					end = len(samples)
+				}
+				h.write(samples[i:end])
+			}
+			h.flush()
+			if problem, err := verifyPruning(context.Background(), h.db, h.cfg.columns()); err != nil || problem != "" {
+				t.Errorf("verifyPruning: %q, %v", problem, err)
+			}
+
+			matchers := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "it_up"}}
+			for _, tt := range tests {
+				if tt.scheme != scheme {
+					continue
+				}
+				t.Run(tt.name, func(t *testing.T) {
+					explanation, err := h.client.ExplainMatchers(context.Background(), matchers, tt.start, tt.end, true)
+					if err != nil {
+						t.Fatal(err)
+					}
+					metrics := explanation.Queries[0]
+					scanned := make(map[string]bool)
+					for _, relation := range metrics.Scanned {
+						scanned[relation] = true
+					}
+					var got []string
+					for relation := range scanned {
+						got = append(got, relation)
+					}
+					sort.Strings(got)
+					if fmt.Sprint(got) != fmt.Sprint(tt.scanned) {
+						t.Errorf("plan scans %v, want %v\n%s", got, tt.scanned, metrics.Plan)
+					}
+					sort.Strings(metrics.Partitions)
+					if fmt.Sprint(metrics.Partitions) != fmt.Sprint(tt.scanned) {
+						t.Errorf("partitions %v, want %v", metrics.Partitions, tt.scanned)
+					}
+				})
+			}
+		})
+	}
+}
+
+// TestLeaderElectionFailover runs two elections on the same lock, each with
+// a pool of its own named by application_name. The first takes the lock and
+// the second waits; when the first loses its connection and cannot
+// reconnect, the second takes over.
+func TestLeaderElectionFailover(t *testing.T) {
+	h := newTestHarness(t, &Config{})
+	defer h.close()
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	var down int32
+	instance := func(name string) *Config {
+		return &Config{LeaderLockID: h.cfg.LeaderLockID, PoolConfigHook: func(kind PoolKind, poolConfig *pgxpool.Config) error {
+			if name == "leader_a" && atomic.LoadInt32(&down) != 0 {
+				return fmt.Errorf("%s is down", name)
+			}
+			poolConfig.ConnConfig.RuntimeParams["application_name"] = name
+			return nil
+		}}
+	}
+	holder := func() string {
+		var name string
+		h.db.QueryRow(context.Background(), `SELECT s.application_name FROM pg_locks l JOIN pg_stat_activity s USING (pid)
+			WHERE l.locktype = 'advisory' AND l.granted AND (l.classid::bigint << 32) + l.objid::bigint = $1`, h.cfg.LeaderLockID).Scan(&name)
+		return name
+	}
+
+	var a, b int32
+	done := make(chan struct{}, 2)
+	go func() {
+		runLeaderElection(log.NewNopLogger(), instance("leader_a"), &a)
+		done <- struct{}{}
+	}()
+	h.waitFor("leader_a to take the lock", func() bool { return atomic.LoadInt32(&a) == 1 })
+	go func() {
+		runLeaderElection(log.NewNopLogger(), instance("leader_b"), &b)
+		done <- struct{}{}
+	}()
+	h.waitFor("leader_b to try the lock", func() bool {
+		return h.count(`SELECT count(*) FROM pg_stat_activity WHERE application_name = 'leader_b' AND query LIKE '%pg_try_advisory_lock%'`) == 1
+	})
+	if atomic.LoadInt32(&b) != 0 || holder() != "leader_a" {
+		t.Fatalf("leader_b leads too or the lock is held by %q", holder())
+	}
+	if IsLeader() {
+		t.Error("the adapter's leader flag set by a test election")
+	}
+
+	// leader_a loses its connection and cannot reconnect.
+	atomic.StoreInt32(&down, 1)
+	if _, err := h.db.Exec(context.Background(), "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE application_name = 'leader_a'"); err != nil {
+		t.Fatal(err)
+	}
+	h.waitFor("leader_a to step down", func() bool { return atomic.LoadInt32(&a) == 0 })
+	h.waitFor("leader_b to take over", func() bool { return atomic.LoadInt32(&b) == 1 })
+	if name := holder(); name != "leader_b" {
+		t.Errorf("lock held by %q after the failover, want leader_b", name)
+	}
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Minute):
+			t.Fatal("elections still running after shutdown")
+		}
+	}
+	if atomic.LoadInt32(&b) != 0 || holder() != "" {
+		t.Errorf("lock still held by %q after shutdown", holder())
+	}
+}
+
+// TestMetricsCatalog checks that flushes record the metric names written
+// and that later upserts only widen what is known of a name: the earliest
+// first sample, the latest last sample and every label key seen.
+func TestMetricsCatalog(t *testing.T) {
+	h := newTestHarness(t, &Config{MetricsCatalog: true})
+	defer h.close()
+	ctx := context.Background()
+
+	at := func(minutes int) time.Time {
+		return roundTripStart.Add(time.Duration(minutes) * time.Minute)
+	}
+	catalog := func() map[string]string {
+		metrics, err := h.client.MetricCatalog(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for _, m := range metrics {
+			got[m.Name] = fmt.Sprintf("%s..%s %v", m.FirstSeen.UTC().Format(time.RFC3339), m.LastSeen.UTC().Format(time.RFC3339), m.LabelKeys)
+		}
+		return got
+	}
+	expect := func(stage string, want map[string]string) {
+		t.Helper()
+		var got map[string]string
+		deadline := time.Now().Add(10 * time.Second)
+		for got = catalog(); fmt.Sprint(got) != fmt.Sprint(want) && time.Now().Before(deadline); got = catalog() {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: catalog %v, want %v", stage, got, want)
+		}
+	}
+
+	// Names written are recorded by the flush storing them.
+	var samples model.Samples
+	for minute := 10; minute <= 30; minute += 10 {
+		for _, name := range []string{"it_catalog_up", "it_catalog_requests"} {
+			samples = append(samples, &model.Sample{
+				Metric:    model.Metric{model.MetricNameLabel: model.LabelValue(name), "job": "api"},
+				Timestamp: model.TimeFromUnixNano(at(minute).UnixNano()),
+			})
+		}
+	}
+	h.write(samples)
+	h.flush()
+	expect("written", map[string]string{
+		"it_catalog_requests": "2020-03-01T00:10:00Z..2020-03-01T00:30:00Z [job]",
+		"it_catalog_up":       "2020-03-01T00:10:00Z..2020-03-01T00:30:00Z [job]",
+	})
+
+	// Upserts widen the range and add label keys, they never narrow them.
+	upsert := func(name string, first, last int, keys ...string) {
+		e := &catalogEntry{firstSeen: fromTimestamp(at(first)), lastSeen: fromTimestamp(at(last)), labelKeys: make(map[string]struct{})}
+		for _, k := range keys {
+			e.labelKeys[k] = struct{}{}
+		}
+		catalogMutex.Lock()
+		catalogDirty[name] = e
+		catalogMutex.Unlock()
+	}
+	upsert("it_catalog_up", 0, 20, "instance")
+	upsert("it_catalog_requests", 15, 45)
+	upsert("it_catalog_new", 5, 5, "zone")
+	if err := h.writers[0].flushCatalog(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expect("upserted", map[string]string{
+		"it_catalog_new":      "2020-03-01T00:05:00Z..2020-03-01T00:05:00Z [zone]",
+		"it_catalog_requests": "2020-03-01T00:10:00Z..2020-03-01T00:45:00Z [job]",
+		"it_catalog_up":       "2020-03-01T00:00:00Z..2020-03-01T00:30:00Z [instance job]",
+	})
+}
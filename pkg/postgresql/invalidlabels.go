@@ -0,0 +1,206 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// ParseErrorLabel marks the series invalid label rows are reported in when
+// ReportInvalidLabels is set.
+const ParseErrorLabel = "__parse_error__"
+
+// decodeLabels decodes the labels column. Label values written as JSON
+// numbers or booleans by old versions are turned into strings; labels that
+// are no JSON object or hold nested values are an error. Labels stored by
+// LabelEncodingBase64 are decoded.
+func decodeLabels(raw []byte) (map[string]string, error) {
+	m := make(map[string]string)
+	if err := json.Unmarshal(raw, &m); err == nil {
+		decodeBase64Labels(m)
+		return m, nil
+	}
+	var loose map[string]interface{}
+	if err := json.Unmarshal(raw, &loose); err != nil {
+		return nil, err
+	}
+	for k, v := range loose {
+		switch v := v.(type) {
+		case string:
+			m[k] = v
+		case float64:
+			m[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			m[k] = strconv.FormatBool(v)
+		case nil:
+			m[k] = ""
+		default:
+			return nil, fmt.Errorf("label %q holds a nested value", k)
+		}
+	}
+	invalidLabelRows.WithLabelValues("repaired").Inc()
+	decodeBase64Labels(m)
+	return m, nil
+}
+
+// invalidLabels decides what happens to read rows whose labels cannot be
+// decoded: they are skipped, or reported in a series labeled
+// ParseErrorLabel. Violations are logged once per validationLogInterval.
+type invalidLabels struct {
+	mutex  sync.Mutex
+	logger log.Logger
+	report bool
+
+	lastLog int64 // unix nanoseconds, accessed atomically
+}
+
+// activeInvalidLabels is shared by all clients, like the scan path.
+var activeInvalidLabels = &invalidLabels{logger: log.NewNopLogger()}
+
+func (il *invalidLabels) configure(logger log.Logger, cfg *Config) {
+	il.mutex.Lock()
+	defer il.mutex.Unlock()
+	il.logger = logger
+	il.report = cfg.ReportInvalidLabels
+}
+
+// handle counts and logs a row with undecodable labels and reports whether
+// it is passed on, with labels replaced by the ParseErrorLabel.
+func (il *invalidLabels) handle(name string, ts time.Time, labels *sampleLabels) bool {
+	il.mutex.Lock()
+	logger, report := il.logger, il.report
+	il.mutex.Unlock()
+
+	action := "skipped"
+	if report {
+		action = "reported"
+	}
+	invalidLabelRows.WithLabelValues(action).Inc()
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&il.lastLog)
+	if now-last >= int64(validationLogInterval) && atomic.CompareAndSwapInt64(&il.lastLog, last, now) {
+		level.Warn(logger).Log("msg", "Read a row with invalid labels, run --repair-labels", "name", name, "time", ts, "labels", string(labels.JSON), "err", labels.err, "action", action)
+	}
+	if !report {
+		return false
+	}
+	*labels = sampleLabels{
+		JSON:        labels.JSON,
+		Map:         map[string]string{ParseErrorLabel: "true"},
+		OrderedKeys: []string{ParseErrorLabel},
+	}
+	return true
+}
+
+// invalidLabelsTable keeps the rows RepairLabels could not repair.
+const invalidLabelsTable = "adapter_invalid_labels"
+
+const invalidLabelsSchema = `CREATE TABLE IF NOT EXISTS ` + invalidLabelsTable + ` (
+	partition text NOT NULL,
+	time timestamptz,
+	name text,
+	value float8,
+	labels jsonb,
+	moved_at timestamptz NOT NULL DEFAULT now()
+)`
+
+// labelsPredicates returns the conditions on the labels column l matching
+// rows RepairLabels repairs, whose labels are an object with number or
+// boolean values, and rows it moves away, whose labels are no object or
+// hold nested values. jsonb_each is only given objects.
+func labelsPredicates(l string) (repairable string, unrepairable string) {
+	values := fmt.Sprintf("jsonb_each(CASE WHEN jsonb_typeof(%s) = 'object' THEN %s ELSE '{}' END)", l, l)
+	repairable = fmt.Sprintf("jsonb_typeof(%s) = 'object' AND EXISTS (SELECT 1 FROM %s e WHERE jsonb_typeof(e.value) IN ('number', 'boolean')) AND NOT EXISTS (SELECT 1 FROM %s e WHERE jsonb_typeof(e.value) IN ('object', 'array'))", l, values, values)
+	unrepairable = fmt.Sprintf("(jsonb_typeof(%s) <> 'object' OR EXISTS (SELECT 1 FROM %s e WHERE jsonb_typeof(e.value) IN ('object', 'array')))", l, values)
+	return repairable, unrepairable
+}
+
+// RepairLabels finds the rows of every leaf partition of metrics, or of
+// metrics itself if it is not partitioned, whose labels the read path
+// cannot decode as they are. Unless dryRun is set, labels with number or
+// boolean values get them as strings, as the read path decodes them, and
+// rows that cannot be repaired are moved to adapter_invalid_labels. A
+// repaired row that turns out to duplicate an existing one is dropped.
+func RepairLabels(ctx context.Context, logger log.Logger, cfg *Config, dryRun bool) error {
+	db, err := newPool(cfg, WriterPool, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tables := []string{"metrics"}
+	var partitioned bool
+	if err := db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = to_regclass('metrics'))").Scan(&partitioned); err != nil {
+		return err
+	}
+	if partitioned {
+		partitions, err := leafPartitionRanges(ctx, db)
+		if err != nil {
+			return err
+		}
+		tables = tables[:0]
+		for _, p := range partitions {
+			tables = append(tables, p.name)
+		}
+	}
+	if !dryRun {
+		if _, err := db.Exec(ctx, invalidLabelsSchema); err != nil {
+			return fmt.Errorf("creating %s: %w", invalidLabelsTable, err)
+		}
+	}
+
+	var repairedTotal, movedTotal int64
+	for _, table := range tables {
+		repaired, moved, err := repairTableLabels(ctx, db, cfg.columns().quoted(), table, dryRun)
+		if err != nil {
+			return fmt.Errorf("repairing labels in %s: %w", table, err)
+		}
+		if repaired > 0 || moved > 0 {
+			level.Info(logger).Log("msg", "Invalid labels", "table", table, "repairable", repaired, "unrepairable", moved, "dry_run", dryRun)
+		}
+		repairedTotal += repaired
+		movedTotal += moved
+	}
+	level.Info(logger).Log("msg", "Label repair finished", "repairable", repairedTotal, "unrepairable", movedTotal, "dry_run", dryRun)
+	return nil
+}
+
+// repairTableLabels counts, or repairs and moves, the rows with invalid
+// labels of one table in a transaction.
+func repairTableLabels(ctx context.Context, db *pgxpool.Pool, col Columns, table string, dryRun bool) (int64, int64, error) {
+	repairable, unrepairable := labelsPredicates(col.Labels)
+	if dryRun {
+		var repaired, moved int64
+		err := db.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FILTER (WHERE %s), count(*) FILTER (WHERE %s) FROM %s", repairable, unrepairable, table)).Scan(&repaired, &moved)
+		return repaired, moved, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+	fixed := fmt.Sprintf("(SELECT jsonb_object_agg(e.key, CASE WHEN jsonb_typeof(e.value) IN ('number', 'boolean') THEN to_jsonb(e.value #>> '{}') ELSE e.value END) FROM jsonb_each(%s) e)", col.Labels)
+	repaired, err := tx.Exec(ctx, fmt.Sprintf(`WITH bad AS (DELETE FROM %s WHERE %s RETURNING %s, %s, %s, %s)
+INSERT INTO %s (%s, %s, %s, %s) SELECT %s, %s, %s, %s FROM bad ON CONFLICT DO NOTHING`,
+		table, repairable, col.Time, col.Name, col.Value, col.Labels,
+		table, col.Time, col.Name, col.Value, col.Labels, col.Time, col.Name, col.Value, fixed))
+	if err != nil {
+		return 0, 0, err
+	}
+	moved, err := tx.Exec(ctx, fmt.Sprintf(`WITH bad AS (DELETE FROM %s WHERE %s RETURNING %s, %s, %s, %s)
+INSERT INTO `+invalidLabelsTable+` (partition, time, name, value, labels) SELECT $1, %s, %s, %s, %s FROM bad`,
+		table, unrepairable, col.Time, col.Name, col.Value, col.Labels, col.Time, col.Name, col.Value, col.Labels), table)
+	if err != nil {
+		return 0, 0, err
+	}
+	return repaired.RowsAffected(), moved.RowsAffected(), tx.Commit(ctx)
+}
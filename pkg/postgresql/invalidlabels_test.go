@@ -0,0 +1,87 @@
+package postgresql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var undecodableLabels = []struct {
+	name string
+	raw  string
+}{
+	{"array", `["job", "api"]`},
+	{"string", `"job=api"`},
+	{"number", `42`},
+	{"nested object", `{"job": {"name": "api"}}`},
+	{"nested array", `{"job": ["api"]}`},
+	{"invalid JSON", `{"job": "api"`},
+}
+
+func TestInvalidLabelsModes(t *testing.T) {
+	for _, report := range []bool{false, true} {
+		action := map[bool]string{false: "skipped", true: "reported"}[report]
+		for _, tt := range undecodableLabels {
+			t.Run(action+"/"+tt.name, func(t *testing.T) {
+				var labels sampleLabels
+				if err := labels.Scan([]byte(tt.raw)); err != nil {
+					t.Fatalf("scan failed instead of marking the row: %v", err)
+				}
+				if labels.err == nil {
+					t.Fatalf("labels %s decoded as %v", tt.raw, labels.Map)
+				}
+
+				il := &invalidLabels{logger: log.NewNopLogger(), report: report}
+				before := testutil.ToFloat64(invalidLabelRows.WithLabelValues(action))
+				passed := il.handle("up", time.Now(), &labels)
+				if passed != report {
+					t.Errorf("row passed on %v, want %v", passed, report)
+				}
+				if got := testutil.ToFloat64(invalidLabelRows.WithLabelValues(action)) - before; got != 1 {
+					t.Errorf("%v rows counted as %s, want 1", got, action)
+				}
+				if !report {
+					return
+				}
+				if want := map[string]string{ParseErrorLabel: "true"}; !reflect.DeepEqual(labels.Map, want) {
+					t.Errorf("reported with labels %v, want %v", labels.Map, want)
+				}
+				if string(labels.JSON) != tt.raw {
+					t.Errorf("reported row lost its stored labels %s", labels.JSON)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeLabelsRepairs(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want map[string]string
+	}{
+		{"strings", `{"job": "api"}`, map[string]string{"job": "api"}},
+		{"number", `{"code": 200, "ratio": 0.5}`, map[string]string{"code": "200", "ratio": "0.5"}},
+		{"boolean", `{"canary": true}`, map[string]string{"canary": "true"}},
+		{"null", `{"job": null}`, map[string]string{"job": ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(invalidLabelRows.WithLabelValues("repaired"))
+			got, err := decodeLabels([]byte(tt.raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %v, want %v", got, tt.want)
+			}
+			repaired := testutil.ToFloat64(invalidLabelRows.WithLabelValues("repaired")) - before
+			if want := map[bool]float64{true: 0, false: 1}[tt.name == "strings"]; repaired != want {
+				t.Errorf("%v rows counted as repaired, want %v", repaired, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package postgresql
+
+import (
+	"container/list"
+	"encoding/json"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// encodedSeries are the metric name and the encoded labels column of a
+// series, as stored in the rows of its samples.
+type encodedSeries struct {
+	fingerprint model.Fingerprint
+	metric      model.Metric
+	name        string
+	labels      []byte
+	// labelBytes is the length of the labels as counted by ingest stats.
+	labelBytes int
+}
+
+// labelsLRU remembers the encoded labels of up to size series, evicting the
+// least recently used first. Every parser has its own, it is not safe for
+// concurrent use.
+type labelsLRU struct {
+	size   int
+	lru    *list.List
+	series map[model.Fingerprint]*list.Element
+
+	hits, misses int
+}
+
+func newLabelsLRU(size int) *labelsLRU {
+	return &labelsLRU{
+		size:   size,
+		lru:    list.New(),
+		series: make(map[model.Fingerprint]*list.Element),
+	}
+}
+
+// get returns the encoded labels of metric and marks them as used, or nil
+// if they are not remembered. The metric is compared as a whole, so that a
+// fingerprint collision is a miss.
+func (l *labelsLRU) get(fingerprint model.Fingerprint, metric model.Metric) *encodedSeries {
+	e, ok := l.series[fingerprint]
+	if !ok || !e.Value.(*encodedSeries).metric.Equal(metric) {
+		l.misses++
+		return nil
+	}
+	l.hits++
+	l.lru.MoveToFront(e)
+	return e.Value.(*encodedSeries)
+}
+
+// add remembers a series, replacing the one with the same fingerprint, and
+// evicts the least recently used ones beyond size.
+func (l *labelsLRU) add(s *encodedSeries) {
+	if e, ok := l.series[s.fingerprint]; ok {
+		l.lru.Remove(e)
+	}
+	l.series[s.fingerprint] = l.lru.PushFront(s)
+	for l.lru.Len() > l.size {
+		oldest := l.lru.Back()
+		delete(l.series, oldest.Value.(*encodedSeries).fingerprint)
+		l.lru.Remove(oldest)
+	}
+}
+
+// flushCounts adds the hits and misses since the last call to
+// adapter_labels_cache_lookups_total.
+func (l *labelsLRU) flushCounts() {
+	if l.hits > 0 {
+		labelsCacheLookups.WithLabelValues("hit").Add(float64(l.hits))
+	}
+	if l.misses > 0 {
+		labelsCacheLookups.WithLabelValues("miss").Add(float64(l.misses))
+	}
+	l.hits, l.misses = 0, 0
+}
+
+// encodeLabels returns the metric name of a sample, the value of its labels
+// column and the length of its labels. Without a cache the labels are the
+// parsed map, with one they are the map encoded once per series as JSON,
+// whose object keys are sorted, so that repeated series reuse the bytes.
+// Label values jsonb cannot store are encoded by activeLabelEncoder first. ok
+// is false if the labels could not be parsed; they are stored empty then
+// and not remembered.
+func (p *PGParser) encodeLabels(metric model.Metric) (name string, labels interface{}, labelBytes int, ok bool) {
+	var fingerprint model.Fingerprint
+	if p.labels != nil {
+		fingerprint = metric.Fingerprint()
+		if s := p.labels.get(fingerprint, metric); s != nil {
+			return s.name, s.labels, s.labelBytes, true
+		}
+	}
+
+	sMetric := metricString(activeLabelEncoder.encode(metric))
+	i := strings.Index(sMetric, "{")
+	jsonbMap := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(sMetric[i:]), &jsonbMap); err != nil {
+		return sMetric[:i], jsonbMap, len(sMetric) - i, false
+	}
+	if p.labels == nil {
+		return sMetric[:i], jsonbMap, len(sMetric) - i, true
+	}
+	encoded, err := json.Marshal(jsonbMap)
+	if err != nil {
+		return sMetric[:i], jsonbMap, len(sMetric) - i, true
+	}
+	p.labels.add(&encodedSeries{fingerprint: fingerprint, metric: metric, name: sMetric[:i], labels: encoded, labelBytes: len(sMetric) - i})
+	return sMetric[:i], encoded, len(sMetric) - i, true
+}
@@ -0,0 +1,136 @@
+package postgresql
+
+import (
+	"encoding/base64"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+// Label value encodings, for values jsonb cannot store: invalid UTF-8 and
+// NUL bytes. LabelEncodingReplace replaces every invalid sequence and NUL
+// with U+FFFD, LabelEncodingBase64 stores the value base64 encoded under the
+// label name with Base64LabelSuffix appended, and LabelEncodingDrop drops
+// the label.
+const (
+	LabelEncodingReplace = "replace"
+	LabelEncodingBase64  = "base64"
+	LabelEncodingDrop    = "drop"
+)
+
+// Base64LabelSuffix marks a label whose value is stored base64 encoded.
+// Reads decode such labels and remove the suffix again.
+const Base64LabelSuffix = "__b64"
+
+// storableLabelValue reports whether jsonb can store v as it is.
+func storableLabelValue(v string) bool {
+	return utf8.ValidString(v) && strings.IndexByte(v, 0) < 0
+}
+
+// replaceInvalidUTF8 replaces the invalid UTF-8 sequences and NUL bytes of
+// v with U+FFFD.
+func replaceInvalidUTF8(v string) string {
+	var b strings.Builder
+	b.Grow(len(v))
+	for i := 0; i < len(v); {
+		r, size := utf8.DecodeRuneInString(v[i:])
+		if r == 0 || (r == utf8.RuneError && size == 1) {
+			b.WriteRune(utf8.RuneError)
+		} else {
+			b.WriteString(v[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// labelEncoder encodes the label values jsonb cannot store, with the
+// encoding shared by all parsers. Encoded series are logged by metric name
+// once per validationLogInterval.
+type labelEncoder struct {
+	mutex    sync.Mutex
+	logger   log.Logger
+	encoding string
+
+	lastLog int64 // unix nanoseconds, accessed atomically
+}
+
+// activeLabelEncoder is shared by the parsers of all writers.
+var activeLabelEncoder = &labelEncoder{logger: log.NewNopLogger(), encoding: LabelEncodingReplace}
+
+func (e *labelEncoder) configure(logger log.Logger, cfg *Config) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.logger = logger
+	e.encoding = LabelEncodingReplace
+	if cfg.LabelValueEncoding != "" {
+		e.encoding = cfg.LabelValueEncoding
+	}
+}
+
+// encode returns metric with the label values jsonb cannot store encoded,
+// or metric itself if there are none.
+func (e *labelEncoder) encode(metric model.Metric) model.Metric {
+	var bad []model.LabelName
+	for name, value := range metric {
+		if !storableLabelValue(string(value)) {
+			bad = append(bad, name)
+		}
+	}
+	if len(bad) == 0 {
+		return metric
+	}
+
+	e.mutex.Lock()
+	logger, encoding := e.logger, e.encoding
+	e.mutex.Unlock()
+
+	encoded := make(model.Metric, len(metric))
+	for name, value := range metric {
+		encoded[name] = value
+	}
+	for _, name := range bad {
+		value := string(metric[name])
+		switch encoding {
+		case LabelEncodingBase64:
+			delete(encoded, name)
+			encoded[name+Base64LabelSuffix] = model.LabelValue(base64.StdEncoding.EncodeToString([]byte(value)))
+		case LabelEncodingDrop:
+			delete(encoded, name)
+		default:
+			encoded[name] = model.LabelValue(replaceInvalidUTF8(value))
+		}
+	}
+	encodedLabels.WithLabelValues(encoding).Add(float64(len(bad)))
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&e.lastLog)
+	if now-last >= int64(validationLogInterval) && atomic.CompareAndSwapInt64(&e.lastLog, last, now) {
+		level.Warn(logger).Log("msg", "Encoded label values jsonb cannot store", "name", metric[model.MetricNameLabel], "labels", len(bad), "encoding", encoding)
+	}
+	return encoded
+}
+
+// decodeBase64Labels restores the labels stored by LabelEncodingBase64 in
+// m. A value that is no valid base64 is left as it is.
+func decodeBase64Labels(m map[string]string) {
+	var encoded []string
+	for k := range m {
+		if strings.HasSuffix(k, Base64LabelSuffix) {
+			encoded = append(encoded, k)
+		}
+	}
+	for _, k := range encoded {
+		decoded, err := base64.StdEncoding.DecodeString(m[k])
+		if err != nil {
+			continue
+		}
+		delete(m, k)
+		m[strings.TrimSuffix(k, Base64LabelSuffix)] = string(decoded)
+	}
+}
@@ -0,0 +1,171 @@
+package postgresql
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+)
+
+// unstorableValues are label values jsonb rejects, by name.
+var unstorableValues = []struct {
+	name  string
+	value string
+}{
+	{"NUL byte", "a\x00b"},
+	{"only NUL", "\x00"},
+	{"overlong slash", "path\xc0\xafetc"},
+	{"overlong NUL", "\xc0\x80"},
+	{"lone high surrogate", "x\xed\xa0\x80y"},
+	{"lone low surrogate", "\xed\xbf\xbf"},
+	{"truncated sequence", "caf\xc3"},
+	{"stray continuation byte", "\x80abc"},
+}
+
+func TestStorableLabelValue(t *testing.T) {
+	for _, v := range unstorableValues {
+		if storableLabelValue(v.value) {
+			t.Errorf("%s %q reported storable", v.name, v.value)
+		}
+	}
+	for _, v := range []string{"", "plain", "café", "日本語", "emoji 🎉", " "} {
+		if !storableLabelValue(v) {
+			t.Errorf("%q reported unstorable", v)
+		}
+	}
+}
+
+func TestReplaceInvalidUTF8(t *testing.T) {
+	tests := map[string]string{
+		"a\x00b":          "a�b",
+		"path\xc0\xafetc": "path��etc",
+		"x\xed\xa0\x80y":  "x���y",
+		"caf\xc3":         "caf�",
+		"café":            "café",
+	}
+	for in, want := range tests {
+		if got := replaceInvalidUTF8(in); got != want {
+			t.Errorf("replaceInvalidUTF8(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func newTestLabelEncoder(encoding string) *labelEncoder {
+	e := &labelEncoder{}
+	e.configure(log.NewNopLogger(), &Config{LabelValueEncoding: encoding})
+	return e
+}
+
+// TestLabelEncodingStorable encodes every unstorable value with every
+// encoding and checks that the labels can be stored, and read back as they
+// were sent with base64.
+func TestLabelEncodingStorable(t *testing.T) {
+	for _, encoding := range []string{LabelEncodingReplace, LabelEncodingBase64, LabelEncodingDrop} {
+		e := newTestLabelEncoder(encoding)
+		for _, v := range unstorableValues {
+			t.Run(encoding+"/"+v.name, func(t *testing.T) {
+				metric := model.Metric{model.MetricNameLabel: "up", "job": "api", "bad": model.LabelValue(v.value)}
+				encoded := e.encode(metric)
+				if metric["bad"] != model.LabelValue(v.value) {
+					t.Fatal("encode changed the metric passed")
+				}
+				for name, value := range encoded {
+					if !storableLabelValue(string(name)) || !storableLabelValue(string(value)) {
+						t.Errorf("label %q=%q is still unstorable", name, value)
+					}
+				}
+				if encoded["job"] != "api" {
+					t.Errorf("valid label job changed to %q", encoded["job"])
+				}
+
+				raw, err := json.Marshal(encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(string(raw), `\u0000`) {
+					t.Errorf("labels %s hold a NUL, which jsonb rejects", raw)
+				}
+				decoded, err := decodeLabels(raw)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, present := decoded["bad"]
+				switch encoding {
+				case LabelEncodingBase64:
+					if got != v.value {
+						t.Errorf("read back %q, want %q", got, v.value)
+					}
+					if _, ok := decoded["bad"+Base64LabelSuffix]; ok {
+						t.Error("encoded label read back")
+					}
+				case LabelEncodingDrop:
+					if present {
+						t.Errorf("dropped label read back as %q", got)
+					}
+				default:
+					if !utf8.ValidString(got) || !strings.ContainsRune(got, utf8.RuneError) {
+						t.Errorf("read back %q, want the value with replacement characters", got)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLabelEncodingLeavesStorableMetrics(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "up", "job": "café"}
+	for _, encoding := range []string{LabelEncodingReplace, LabelEncodingBase64, LabelEncodingDrop} {
+		encoded := newTestLabelEncoder(encoding).encode(metric)
+		if !encoded.Equal(metric) {
+			t.Errorf("%s changed %s to %s", encoding, metric, encoded)
+		}
+	}
+}
+
+// TestLabelEncodingBatch runs a batch mixing valid and unstorable series
+// through a parser: every sample becomes a row whose labels jsonb accepts.
+func TestLabelEncodingBatch(t *testing.T) {
+	defer activeLabelEncoder.configure(log.NewNopLogger(), &Config{})
+	ts := model.TimeFromUnixNano(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	for _, encoding := range []string{LabelEncodingReplace, LabelEncodingBase64, LabelEncodingDrop} {
+		t.Run(encoding, func(t *testing.T) {
+			activeLabelEncoder.configure(log.NewNopLogger(), &Config{LabelValueEncoding: encoding})
+			var samples model.Samples
+			for _, v := range unstorableValues {
+				samples = append(samples,
+					&model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "value": model.LabelValue(v.value)}, Timestamp: ts},
+					&model.Sample{Metric: model.Metric{model.MetricNameLabel: "up", "value": "fine"}, Timestamp: ts},
+				)
+			}
+			for _, cache := range []int{0, 100} {
+				var p PGParser
+				if cache > 0 {
+					p.labels = newLabelsLRU(cache)
+				}
+				_, dropped, _ := p.parseBatch(&Config{}, PartitionHourly, samples, func(time.Time) bool { return true })
+				if dropped != 0 || len(p.valueRows) != len(samples) {
+					t.Fatalf("labels cache %d: %d rows and %d dropped for %d samples", cache, len(p.valueRows), dropped, len(samples))
+				}
+				if p.parseErrors != 0 {
+					t.Errorf("labels cache %d: %d parse errors", cache, p.parseErrors)
+				}
+				for _, row := range p.valueRows {
+					raw, ok := row[3].([]byte)
+					if !ok {
+						var err error
+						if raw, err = json.Marshal(row[3]); err != nil {
+							t.Fatal(err)
+						}
+					}
+					if !utf8.Valid(raw) || strings.Contains(string(raw), `\u0000`) {
+						t.Errorf("labels cache %d: labels %q are unstorable", cache, raw)
+					}
+				}
+			}
+		})
+	}
+}
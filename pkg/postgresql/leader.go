@@ -0,0 +1,134 @@
+package postgresql
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// leaderCheckInterval is how often a follower retries the lock and the
+	// leader checks that its connection is still alive.
+	leaderCheckInterval = 5 * time.Second
+	// leaderMaxBackoff bounds the wait between reconnects.
+	leaderMaxBackoff = time.Minute
+)
+
+// leader is 1 while this instance holds the leader lock.
+var leader int32
+
+// IsLeader reports whether this instance holds the leader lock. Partition
+// pre-creation, maintenance and cardinality sampling only run on the leader.
+func IsLeader() bool {
+	return atomic.LoadInt32(&leader) == 1
+}
+
+// setLeader stores in state, the leader flag of an election, whether it
+// holds the lock, logging changes.
+func setLeader(l log.Logger, state *int32, isLeader bool) {
+	var v int32
+	if isLeader {
+		v = 1
+	}
+	if atomic.SwapInt32(state, v) != v {
+		if isLeader {
+			level.Info(l).Log("msg", "Acquired leadership")
+		} else {
+			level.Warn(l).Log("msg", "Lost leadership")
+		}
+	}
+}
+
+// RunLeaderElection competes for a session-level advisory lock on a dedicated
+// connection until the adapter shuts down. The lock is held for as long as
+// that connection lives; when it drops, the lock is released by the server
+// and another instance can take over, while this one reconnects with backoff.
+func RunLeaderElection(l log.Logger, cfg *Config) {
+	runLeaderElection(l, cfg, &leader)
+}
+
+// runLeaderElection is RunLeaderElection with the leader flag it maintains,
+// so that tests can run competing elections in one process.
+func runLeaderElection(l log.Logger, cfg *Config, state *int32) {
+	backoff := time.Second
+	for {
+		connected := time.Now()
+		pool, err := newLeaderPool(cfg)
+		if err == nil {
+			err = holdLeaderLock(l, cfg, pool, state)
+			pool.Close()
+		}
+		setLeader(l, state, false)
+		if atomic.LoadInt32(&shuttingDown) != 0 {
+			return
+		}
+		// A connection that lasted a while starts over with a short backoff.
+		if time.Since(connected) > leaderMaxBackoff {
+			backoff = time.Second
+		}
+		level.Error(l).Log("msg", "Leader election connection failed", "err", err, "retry", backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > leaderMaxBackoff {
+			backoff = leaderMaxBackoff
+		}
+	}
+}
+
+// newLeaderPool connects the pool of the single connection holding the lock.
+func newLeaderPool(cfg *Config) (*pgxpool.Pool, error) {
+	return newPool(cfg, LeaderPool, func(poolConfig *pgxpool.Config) {
+		poolConfig.MaxConns = 1
+	})
+}
+
+// holdLeaderLock tries to take the lock on one connection and keeps checking
+// that connection while it holds the lock. It returns when the connection
+// fails or on shutdown, releasing the lock.
+func holdLeaderLock(l log.Logger, cfg *Config, pool *pgxpool.Pool, state *int32) error {
+	ctx := context.Background()
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	for atomic.LoadInt32(&shuttingDown) == 0 {
+		if atomic.LoadInt32(state) == 1 {
+			if _, err := conn.Exec(ctx, "SELECT 1"); err != nil {
+				return err
+			}
+		} else {
+			var acquired bool
+			if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", cfg.LeaderLockID).Scan(&acquired); err != nil {
+				return err
+			}
+			if !acquired {
+				level.Debug(l).Log("msg", "Not leader", "lock", cfg.LeaderLockID)
+			}
+			setLeader(l, state, acquired)
+		}
+		time.Sleep(leaderCheckInterval)
+	}
+
+	if atomic.LoadInt32(state) == 1 {
+		_, err = conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", cfg.LeaderLockID)
+	}
+	return err
+}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "adapter_leader",
+			Help: "1 if this instance holds the leader lock.",
+		},
+		func() float64 {
+			return float64(atomic.LoadInt32(&leader))
+		},
+	))
+}
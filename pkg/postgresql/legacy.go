@@ -0,0 +1,142 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Legacy table flavors. FlavorAdapter is the layout of the metrics table,
+// (time, name, value, labels), e.g. a renamed copy of it.
+const (
+	FlavorAdapter = "adapter"
+)
+
+// legacyTable is a table holding history from before a schema migration,
+// read alongside metrics.
+type legacyTable struct {
+	name   string
+	flavor string
+
+	// The time range of the table is looked up once, legacy tables do not
+	// receive new samples.
+	once     sync.Once
+	min, max time.Time
+	empty    bool
+	err      error
+}
+
+// parseLegacyTable parses NAME or NAME:FLAVOR.
+func parseLegacyTable(s string) (*legacyTable, error) {
+	t := &legacyTable{name: s, flavor: FlavorAdapter}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		t.name, t.flavor = s[:i], s[i+1:]
+	}
+	if _, err := sanitizeIdentifier(t.name); err != nil {
+		return nil, err
+	}
+	if t.flavor != FlavorAdapter {
+		return nil, fmt.Errorf("unsupported flavor %q of legacy table %s", t.flavor, t.name)
+	}
+	return t, nil
+}
+
+func parseLegacyTables(tables []string) ([]*legacyTable, error) {
+	var parsed []*legacyTable
+	for _, s := range tables {
+		t, err := parseLegacyTable(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, t)
+	}
+	return parsed, nil
+}
+
+// covers reports whether the table may hold samples between startMs and endMs.
+func (t *legacyTable) covers(ctx context.Context, c *Client, startMs int64, endMs int64) bool {
+	db, err := c.pool()
+	if err != nil {
+		// The read fails anyway, leave the range to be looked up later.
+		return true
+	}
+	t.once.Do(func() {
+		var min, max *time.Time
+		t.err = db.QueryRow(ctx, fmt.Sprintf("SELECT min(time), max(time) FROM %s", t.name)).Scan(&min, &max)
+		if t.err == nil {
+			t.empty = min == nil
+			if !t.empty {
+				t.min, t.max = *min, *max
+			}
+		}
+	})
+	if t.err != nil {
+		// Without the range the table is always read.
+		return true
+	}
+	return !t.empty && !toTimestamp(endMs).Before(t.min) && !toTimestamp(startMs).After(t.max)
+}
+
+// legacyQuery builds the query reading q from the legacy table t.
+func (c *Client) legacyQuery(t *legacyTable, q *prompb.Query) (string, []interface{}, error) {
+	return buildTableQuery(t.name, defaultColumns, q, c.cfg.ReadOrder, nil)
+}
+
+// readLegacy runs q against every legacy table covering its time range and
+// merges the result into labelsToSeries.
+func (c *Client) readLegacy(ctx context.Context, q *prompb.Query, labelsToSeries map[string]*prompb.TimeSeries) error {
+	if len(c.legacy) == 0 {
+		return nil
+	}
+	db, err := c.pool()
+	if err != nil {
+		return err
+	}
+	for _, t := range c.legacy {
+		if !t.covers(ctx, c, q.StartTimestampMs, q.EndTimestampMs) {
+			continue
+		}
+		command, args, err := c.legacyQuery(t, q)
+		if err != nil {
+			return err
+		}
+		level.Debug(c.logger).Log("msg", "Executed legacy query", "table", t.name, "query", command, "args", fmt.Sprint(args))
+		legacy := map[string]*prompb.TimeSeries{}
+		if err := readSeries(ctx, db, command, args, legacy); err != nil {
+			return fmt.Errorf("reading legacy table %s: %w", t.name, err)
+		}
+		mergeSeries(labelsToSeries, legacy)
+	}
+	return nil
+}
+
+// mergeSeries adds the series of other to labelsToSeries. Samples of a series
+// found in both are merged in time order; where both have a sample at the
+// same timestamp the one already in labelsToSeries is kept.
+func mergeSeries(labelsToSeries map[string]*prompb.TimeSeries, other map[string]*prompb.TimeSeries) {
+	for key, ts := range other {
+		existing, ok := labelsToSeries[key]
+		if !ok {
+			labelsToSeries[key] = ts
+			continue
+		}
+		samples := append(existing.Samples, ts.Samples...)
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Timestamp < samples[j].Timestamp
+		})
+		merged := samples[:0]
+		for i, s := range samples {
+			if i > 0 && s.Timestamp == merged[len(merged)-1].Timestamp {
+				continue
+			}
+			merged = append(merged, s)
+		}
+		existing.Samples = merged
+	}
+}
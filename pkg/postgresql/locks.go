@@ -0,0 +1,95 @@
+package postgresql
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lockWait accumulates the time spent waiting for a mutex. Reading the clock
+// around every acquisition would cost more than most of them, so only one in
+// lockWaitSample is timed and the totals are scaled up from those.
+type lockWait struct {
+	total        int64 // nanoseconds
+	max          int64 // nanoseconds
+	contended    int64
+	acquisitions uint32
+}
+
+const (
+	// lockWaitSample is how many acquisitions one timed acquisition stands
+	// for.
+	lockWaitSample = 64
+	// lockWaitContended is the wait from which an acquisition counts as
+	// contended, well above the cost of taking a free mutex.
+	lockWaitContended = time.Microsecond
+)
+
+var (
+	writerLockWait lockWait
+	queueLockWait  lockWait
+)
+
+func (w *lockWait) lock(m *sync.Mutex) {
+	if atomic.AddUint32(&w.acquisitions, 1)%lockWaitSample != 0 {
+		m.Lock()
+		return
+	}
+	begin := time.Now()
+	m.Lock()
+	waited := int64(time.Since(begin))
+	if waited < int64(lockWaitContended) {
+		return
+	}
+
+	atomic.AddInt64(&w.total, waited*lockWaitSample)
+	atomic.AddInt64(&w.contended, lockWaitSample)
+	for {
+		max := atomic.LoadInt64(&w.max)
+		if waited <= max || atomic.CompareAndSwapInt64(&w.max, max, waited) {
+			return
+		}
+	}
+}
+
+// LockWaitStatus is the accumulated wait for one lock.
+type LockWaitStatus struct {
+	TotalSeconds float64 `json:"total_seconds"`
+	MaxSeconds   float64 `json:"max_seconds"`
+	Contended    int64   `json:"contended"`
+}
+
+func (w *lockWait) status() LockWaitStatus {
+	return LockWaitStatus{
+		TotalSeconds: time.Duration(atomic.LoadInt64(&w.total)).Seconds(),
+		MaxSeconds:   time.Duration(atomic.LoadInt64(&w.max)).Seconds(),
+		Contended:    atomic.LoadInt64(&w.contended),
+	}
+}
+
+func (w *lockWait) register(name string) {
+	labels := prometheus.Labels{"lock": name}
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Name:        "adapter_lock_wait_seconds_total",
+			Help:        "Total time spent waiting for a contended lock.",
+			ConstLabels: labels,
+		},
+		func() float64 { return w.status().TotalSeconds },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "adapter_lock_wait_max_seconds",
+			Help:        "Longest single wait for a lock.",
+			ConstLabels: labels,
+		},
+		func() float64 { return w.status().MaxSeconds },
+	))
+}
+
+func init() {
+	writerLockWait.register("writer")
+	queueLockWait.register("queue")
+}
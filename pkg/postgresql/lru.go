@@ -0,0 +1,53 @@
+package postgresql
+
+import (
+	"container/list"
+
+	"github.com/prometheus/common/model"
+)
+
+// seriesLRU remembers the last sample of up to size series, evicting the
+// least recently used first, 0 for no bound. It is not safe for concurrent
+// use.
+type seriesLRU struct {
+	size   int
+	lru    *list.List
+	series map[model.Fingerprint]*list.Element
+}
+
+// lastSample is the remembered sample of a series.
+type lastSample struct {
+	fingerprint model.Fingerprint
+	timestamp   int64
+	value       float64
+}
+
+func newSeriesLRU(size int) *seriesLRU {
+	return &seriesLRU{
+		size:   size,
+		lru:    list.New(),
+		series: make(map[model.Fingerprint]*list.Element),
+	}
+}
+
+// get returns the remembered sample of a series and marks it as used, or
+// nil if the series is not remembered.
+func (l *seriesLRU) get(fingerprint model.Fingerprint) *lastSample {
+	e, ok := l.series[fingerprint]
+	if !ok {
+		return nil
+	}
+	l.lru.MoveToFront(e)
+	return e.Value.(*lastSample)
+}
+
+// add remembers a series not remembered yet, evicting the least recently
+// used ones beyond size.
+func (l *seriesLRU) add(fingerprint model.Fingerprint, timestamp int64, value float64) {
+	l.series[fingerprint] = l.lru.PushFront(&lastSample{fingerprint: fingerprint, timestamp: timestamp, value: value})
+	for l.size > 0 && l.lru.Len() > l.size {
+		oldest := l.lru.Back()
+		delete(l.series, oldest.Value.(*lastSample).fingerprint)
+		l.lru.Remove(oldest)
+	}
+}
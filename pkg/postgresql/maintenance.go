@@ -0,0 +1,263 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// maintenanceInterval is how often closed partitions are looked for.
+	maintenanceInterval = 5 * time.Minute
+	// maintenanceLookback limits maintenance to partitions closed recently,
+	// so that a restart does not walk the whole history again.
+	maintenanceLookback = 24 * time.Hour
+)
+
+// closedPartition is a leaf partition whose time range has ended.
+type closedPartition struct {
+	name     string
+	upper    time.Time
+	inserted int64
+}
+
+// leafPartitionsQuery lists the leaf partitions of metrics with the upper
+// bound of their range and the rows inserted into them so far.
+const leafPartitionsQuery = `WITH RECURSIVE parts AS (
+	SELECT inhrelid FROM pg_inherits WHERE inhparent = 'metrics'::regclass
+	UNION ALL
+	SELECT i.inhrelid FROM pg_inherits i JOIN parts p ON i.inhparent = p.inhrelid
+)
+SELECT c.oid::regclass::text,
+	substring(pg_get_expr(c.relpartbound, c.oid) from 'TO \(''([^'']+)''\)')::timestamptz AS upper,
+	coalesce(s.n_tup_ins, 0)
+FROM parts p
+JOIN pg_class c ON c.oid = p.inhrelid
+LEFT JOIN pg_stat_user_tables s ON s.relid = c.oid
+WHERE c.relkind = 'r'`
+
+// partitionIndexQuery finds the index of a partition that belongs to the
+// given index on metrics.
+const partitionIndexQuery = `WITH RECURSIVE idx AS (
+	SELECT $1::regclass::oid AS oid
+	UNION ALL
+	SELECT i.inhrelid FROM pg_inherits i JOIN idx ON i.inhparent = idx.oid
+)
+SELECT x.indexrelid::regclass::text FROM pg_index x JOIN idx ON x.indexrelid = idx.oid WHERE x.indrelid = $2::regclass`
+
+// maintenanceEnabled reports whether any post-rotation step is switched on.
+func (cfg *Config) maintenanceEnabled() bool {
+	return cfg.MaintenanceAnalyze || cfg.MaintenanceCluster || cfg.MaintenanceSummarize || cfg.DeferredIndexes
+}
+
+// runMaintenance periodically retries failed partition create hooks and runs
+// the configured steps on partitions whose range closed more than
+// MaintenanceGrace ago, for as long as the writer runs. Only the leader
+// runs the steps; hooks that failed in this process are retried regardless.
+func (c *PGWriter) runMaintenance() {
+	inserted := make(map[string]int64)
+	done := make(map[string]bool)
+	for c.KeepRunning {
+		c.retryPartitionHooks(context.Background())
+		switch {
+		case !c.cfg.maintenanceEnabled():
+		case IsLeader():
+			if c.cfg.DeferredIndexes {
+				c.buildDeferredIndexes(context.Background())
+			}
+			c.maintainClosedPartitions(context.Background(), inserted, done)
+		default:
+			level.Debug(c.logger).Log("msg", "Not leader, skipping partition maintenance")
+		}
+		for wait := time.Duration(0); wait < maintenanceInterval && c.KeepRunning; wait += time.Second {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// maintainClosedPartitions runs one maintenance pass. A partition is only
+// processed once its inserted row count stayed the same across two passes,
+// i.e. it no longer receives late data.
+func (c *PGWriter) maintainClosedPartitions(ctx context.Context, inserted map[string]int64, done map[string]bool) {
+	now := time.Now()
+	rows, err := c.DB.Query(ctx, leafPartitionsQuery)
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Listing partitions failed", "err", err)
+		return
+	}
+	var closed []closedPartition
+	for rows.Next() {
+		var p closedPartition
+		if err := rows.Scan(&p.name, &p.upper, &p.inserted); err != nil {
+			level.Error(c.logger).Log("msg", "Listing partitions failed", "err", err)
+			rows.Close()
+			return
+		}
+		if done[p.name] || p.upper.Add(c.cfg.MaintenanceGrace).After(now) || p.upper.Before(now.Add(-maintenanceLookback)) {
+			continue
+		}
+		closed = append(closed, p)
+	}
+	rows.Close()
+
+	for _, p := range closed {
+		last, seen := inserted[p.name]
+		inserted[p.name] = p.inserted
+		if !seen || last != p.inserted {
+			level.Debug(c.logger).Log("msg", "Partition still receiving data, postponing maintenance", "partition", p.name)
+			continue
+		}
+		if err := c.maintainPartition(ctx, p.name); err != nil {
+			level.Error(c.logger).Log("msg", "Partition maintenance failed", "partition", p.name, "err", err)
+			continue
+		}
+		done[p.name] = true
+		delete(inserted, p.name)
+	}
+}
+
+// maintainPartition runs the enabled steps on one closed partition.
+func (c *PGWriter) maintainPartition(ctx context.Context, partition string) error {
+	if c.cfg.MaintenanceAnalyze {
+		if err := c.maintenanceStep(ctx, partition, "analyze", "ANALYZE "+partition); err != nil {
+			return err
+		}
+	}
+	if c.cfg.MaintenanceCluster {
+		index, err := c.nameTimeIndex(ctx, partition)
+		if err != nil {
+			return err
+		}
+		if err := c.maintenanceStep(ctx, partition, "cluster", fmt.Sprintf("CLUSTER %s USING %s", partition, index)); err != nil {
+			return err
+		}
+	}
+	if c.cfg.MaintenanceSummarize {
+		index, err := c.partitionIndex(ctx, "metrics_time_brin_idx", partition)
+		if err != nil {
+			return err
+		}
+		if err := c.maintenanceStep(ctx, partition, "brin_summarize", fmt.Sprintf("SELECT brin_summarize_new_values('%s'::regclass)", escapeValue(index))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *PGWriter) maintenanceStep(ctx context.Context, partition string, step string, command string) error {
+	begin := time.Now()
+	if _, err := c.DB.Exec(ctx, command); err != nil {
+		return fmt.Errorf("%s: %w", step, err)
+	}
+	level.Info(c.logger).Log("msg", "Partition maintenance", "partition", partition, "step", step, "duration", time.Since(begin))
+	return nil
+}
+
+// partitionIndex returns the name of the partition's index attached to the
+// given index on metrics.
+func (c *PGWriter) partitionIndex(ctx context.Context, parentIndex string, partition string) (string, error) {
+	var index string
+	if err := c.DB.QueryRow(ctx, partitionIndexQuery, parentIndex, partition).Scan(&index); err != nil {
+		return "", fmt.Errorf("finding %s on %s: %w", parentIndex, partition, err)
+	}
+	return index, nil
+}
+
+// nameTimeIndex returns the name/time index of a partition, either inherited
+// from metrics or built by buildDeferredIndexes.
+func (c *PGWriter) nameTimeIndex(ctx context.Context, partition string) (string, error) {
+	if c.cfg.DeferredIndexes {
+		var index string
+		err := c.DB.QueryRow(ctx, "SELECT $1::regclass::text", deferredIndexName(partition)).Scan(&index)
+		if err == nil {
+			return index, nil
+		}
+	}
+	return c.partitionIndex(ctx, "metrics_name_time_idx", partition)
+}
+
+// nameTimeColumns is the end of the name/time index definition as
+// pg_get_indexdef prints it, without the quotes it puts around some names.
+func nameTimeColumns(columns Columns) string {
+	return fmt.Sprintf("(%s, %s DESC)", columns.Name, columns.Time)
+}
+
+// deferredIndexName is the name of the name/time index built on a partition.
+func deferredIndexName(partition string) string {
+	return partition + "_name_time_idx"
+}
+
+// missingIndexesQuery lists the closed leaf partitions that have no valid
+// name/time index of their own, neither inherited nor built afterwards. The
+// catalog is the record of the work left, so builds resume after a restart.
+// $2 is the index definition's column list with quotes stripped, see
+// nameTimeColumns.
+const missingIndexesQuery = `WITH RECURSIVE parts AS (
+	SELECT inhrelid FROM pg_inherits WHERE inhparent = 'metrics'::regclass
+	UNION ALL
+	SELECT i.inhrelid FROM pg_inherits i JOIN parts p ON i.inhparent = p.inhrelid
+)
+SELECT c.relname
+FROM parts p
+JOIN pg_class c ON c.oid = p.inhrelid
+WHERE c.relkind = 'r'
+AND substring(pg_get_expr(c.relpartbound, c.oid) from 'TO \(''([^'']+)''\)')::timestamptz < $1
+AND NOT EXISTS (
+	SELECT 1 FROM pg_index x
+	WHERE x.indrelid = c.oid AND x.indisvalid AND replace(pg_get_indexdef(x.indexrelid), '"', '') LIKE '%' || $2
+)
+ORDER BY 1`
+
+// buildDeferredIndexes builds the name/time index on every closed partition
+// lacking one. Indexes are built concurrently, so writes that still arrive
+// are not blocked; an invalid index left by an interrupted build is dropped
+// and built again.
+func (c *PGWriter) buildDeferredIndexes(ctx context.Context) {
+	rows, err := c.DB.Query(ctx, missingIndexesQuery, time.Now().Add(-c.cfg.MaintenanceGrace), nameTimeColumns(c.cfg.columns()))
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Listing partitions without indexes failed", "err", err)
+		return
+	}
+	var partitions []string
+	for rows.Next() {
+		var partition string
+		if err := rows.Scan(&partition); err != nil {
+			level.Error(c.logger).Log("msg", "Listing partitions without indexes failed", "err", err)
+			rows.Close()
+			return
+		}
+		partitions = append(partitions, partition)
+	}
+	rows.Close()
+	if len(partitions) > 0 {
+		level.Info(c.logger).Log("msg", "Partitions without indexes", "count", len(partitions))
+	}
+
+	for _, partition := range partitions {
+		if !c.KeepRunning {
+			return
+		}
+		table, err := sanitizeIdentifier(partition)
+		if err != nil {
+			level.Error(c.logger).Log("msg", "Index build skipped", "partition", partition, "err", err)
+			continue
+		}
+		index := pgx.Identifier{deferredIndexName(partition)}.Sanitize()
+		if _, err := c.DB.Exec(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+index); err != nil {
+			level.Error(c.logger).Log("msg", "Index build failed", "partition", partition, "err", err)
+			continue
+		}
+		begin := time.Now()
+		col := c.cfg.columns().quoted()
+		if _, err := c.DB.Exec(ctx, fmt.Sprintf("CREATE INDEX CONCURRENTLY %s ON %s USING btree (%s, %s DESC)", index, table, col.Name, col.Time)); err != nil {
+			level.Error(c.logger).Log("msg", "Index build failed", "partition", partition, "err", err)
+			continue
+		}
+		duration := time.Since(begin)
+		indexBuildDuration.Observe(duration.Seconds())
+		level.Info(c.logger).Log("msg", "Built index", "partition", partition, "index", index, "duration", duration)
+	}
+}
@@ -0,0 +1,214 @@
+package postgresql
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	seriesCardinality = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "adapter_series_cardinality",
+			Help: "Distinct label sets per metric name over the last cardinality window, top N only.",
+		},
+		[]string{"name"},
+	)
+	tenantAcceptedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_tenant_samples_accepted_total",
+			Help: "Total number of samples accepted per tenant.",
+		},
+		[]string{"tenant"},
+	)
+	tenantThrottledSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_tenant_samples_throttled_total",
+			Help: "Total number of samples dropped or rejected because the tenant was over its rate.",
+		},
+		[]string{"tenant"},
+	)
+	seriesLimitedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "adapter_series_limited_samples_total",
+			Help: "Total number of samples dropped or rejected because their series was new while the active series limit was reached.",
+		},
+	)
+	writerSaturated = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "adapter_writer_saturated",
+			Help: "1 if the last flush of the writer took longer than its share of the commit interval.",
+		},
+		[]string{"writer"},
+	)
+	partitionBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "adapter_partition_size_bytes",
+			Help: "Total size of a partition including indexes and TOAST, newest partitions only.",
+		},
+		[]string{"partition"},
+	)
+	partitionRows = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "adapter_partition_rows_estimate",
+			Help: "Estimated number of rows in a partition as of its last ANALYZE, newest partitions only.",
+		},
+		[]string{"partition"},
+	)
+	targetBatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_target_batches_total",
+			Help: "Total number of batches written per target, by result: success, error or, on the secondary, dead_letter.",
+		},
+		[]string{"target", "result"},
+	)
+	targetRows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_target_rows_total",
+			Help: "Total number of rows written successfully per target.",
+		},
+		[]string{"target"},
+	)
+	shadowReads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_shadow_reads_total",
+			Help: "Total number of reads repeated on the secondary, by result: match, mismatch, error or skipped.",
+		},
+		[]string{"result"},
+	)
+	indexBuildDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "adapter_index_build_duration_seconds",
+			Help:    "Duration of deferred index builds on closed partitions.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+	downsampledSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_downsampled_samples_total",
+			Help: "Total number of samples dropped by a downsampling rule.",
+		},
+		[]string{"rule"},
+	)
+	suppressedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "adapter_suppressed_samples_total",
+			Help: "Total number of samples not stored because they repeated the last stored value of their series.",
+		},
+	)
+	infiniteSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_infinite_samples_total",
+			Help: "Total number of samples with a value of +Inf or -Inf, by action taken: keep, drop or clamp.",
+		},
+		[]string{"action"},
+	)
+	invalidSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_invalid_samples_total",
+			Help: "Total number of samples dropped or clamped by a validation rule, by rule and failed check: min, max or monotonic.",
+		},
+		[]string{"rule", "check"},
+	)
+	queuedSamplesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_queued_samples_total",
+			Help: "Total number of samples queued for a parser, by queue: live or backfill.",
+		},
+		[]string{"queue"},
+	)
+	parsedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_parsed_samples_total",
+			Help: "Total number of samples taken from the queue by a parser, by queue: live or backfill.",
+		},
+		[]string{"queue"},
+	)
+	labelsCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_labels_cache_lookups_total",
+			Help: "Total number of lookups of encoded labels in the parsers' caches, by result: hit or miss.",
+		},
+		[]string{"result"},
+	)
+	encodedLabels = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_encoded_label_values_total",
+			Help: "Total number of label values jsonb cannot store that were encoded, by encoding: replace, base64 or drop.",
+		},
+		[]string{"encoding"},
+	)
+	invalidLabelRows = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_invalid_label_rows_total",
+			Help: "Total number of read rows whose labels could not be decoded as stored, by action: repaired, skipped or reported.",
+		},
+		[]string{"action"},
+	)
+	rejectedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_rejected_samples_total",
+			Help: "Total number of samples rejected or dropped while a write was received, by reason.",
+		},
+		[]string{"reason"},
+	)
+	emptyReadCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_empty_read_cache_lookups_total",
+			Help: "Total number of read queries looked up in the cache of queries that found no series, by result: hit or miss.",
+		},
+		[]string{"result"},
+	)
+	duplicateReadSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "adapter_read_duplicate_samples_total",
+			Help: "Total number of read samples dropped as their series had another one at the same timestamp, by values: equal or conflicting.",
+		},
+		[]string{"values"},
+	)
+	poisonRows = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "adapter_poison_rows_total",
+			Help: "Total number of rows isolated and dropped by bisecting a batch the database rejected.",
+		},
+	)
+	schemaCreated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "adapter_schema_created_total",
+			Help: "Total number of times the schema setup found no metrics table and created it.",
+		},
+	)
+	schemaAttached = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "adapter_schema_attached",
+			Help: "1 if the schema setup found the metrics table existing, 0 if it created it.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(seriesCardinality)
+	prometheus.MustRegister(tenantAcceptedSamples)
+	prometheus.MustRegister(tenantThrottledSamples)
+	prometheus.MustRegister(seriesLimitedSamples)
+	prometheus.MustRegister(writerSaturated)
+	prometheus.MustRegister(partitionBytes)
+	prometheus.MustRegister(partitionRows)
+	prometheus.MustRegister(targetBatches)
+	prometheus.MustRegister(targetRows)
+	prometheus.MustRegister(shadowReads)
+	prometheus.MustRegister(indexBuildDuration)
+	prometheus.MustRegister(poisonRows)
+	prometheus.MustRegister(downsampledSamples)
+	prometheus.MustRegister(suppressedSamples)
+	prometheus.MustRegister(infiniteSamples)
+	prometheus.MustRegister(invalidSamples)
+	prometheus.MustRegister(queuedSamplesTotal)
+	prometheus.MustRegister(parsedSamples)
+	prometheus.MustRegister(labelsCacheLookups)
+	prometheus.MustRegister(invalidLabelRows)
+	prometheus.MustRegister(encodedLabels)
+	prometheus.MustRegister(duplicateReadSamples)
+	prometheus.MustRegister(emptyReadCacheLookups)
+	prometheus.MustRegister(rejectedSamples)
+	prometheus.MustRegister(schemaCreated)
+	prometheus.MustRegister(schemaAttached)
+}
@@ -0,0 +1,217 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// migrateQuietPeriod is how long the insert counter of metrics must stay
+// unchanged before a migration starts. It covers several stats reports,
+// which the server sends at most every 500ms.
+const migrateQuietPeriod = 5 * time.Second
+
+// Tables of a migration. metricsNew is built next to metrics and takes its
+// place at the end, the old table is kept as metricsOld.
+const (
+	metricsNew = "metrics_new"
+	metricsOld = "metrics_old"
+)
+
+// MigrateToPartitioned converts an unpartitioned metrics table, as created by
+// early versions of the adapter, into a partitioned one. It creates
+// metrics_new with the partitions covering the existing rows, copies them in
+// time ordered batches of batch each, and then swaps the tables in one
+// transaction, keeping the old one as metrics_old for the operator to drop.
+//
+// Ingestion must be stopped: it refuses to start while rows are still being
+// inserted, and rows arriving during the copy anyway are copied by a last
+// pass under an exclusive lock before the swap. An interrupted migration
+// resumes from the newest row copied; once the tables have been swapped it
+// has nothing left to do.
+func MigrateToPartitioned(ctx context.Context, logger log.Logger, cfg *Config, batch time.Duration) error {
+	if batch <= 0 {
+		return fmt.Errorf("migration batch %s is not positive", batch)
+	}
+	db, err := newPool(cfg, WriterPool, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var exists, partitioned, oldExists bool
+	err = db.QueryRow(ctx, `SELECT to_regclass('metrics') IS NOT NULL,
+	EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = to_regclass('metrics')),
+	to_regclass($1) IS NOT NULL`, metricsOld).Scan(&exists, &partitioned, &oldExists)
+	switch {
+	case err != nil:
+		return err
+	case !exists:
+		return errors.New("table metrics does not exist")
+	case partitioned && oldExists:
+		level.Info(logger).Log("msg", "metrics is partitioned already, drop metrics_old once it is no longer needed")
+		return nil
+	case partitioned:
+		level.Info(logger).Log("msg", "metrics is partitioned already, nothing to migrate")
+		return nil
+	case oldExists:
+		return fmt.Errorf("table %s exists already, drop or rename it first", metricsOld)
+	}
+
+	if err := waitForQuiet(ctx, db, logger); err != nil {
+		return err
+	}
+
+	col := cfg.columns().quoted()
+	var first, last *time.Time
+	level.Info(logger).Log("msg", "Finding the time range of metrics, this scans the table")
+	if err := db.QueryRow(ctx, fmt.Sprintf("SELECT min(%s), max(%s) FROM metrics", col.Time, col.Time)).Scan(&first, &last); err != nil {
+		return err
+	}
+
+	steps := tableSteps(metricsNew, cfg.columns(), cfg.DeferredIndexes)
+	if err := createSchema(ctx, db, logger, schemaLockID(cfg), steps); err != nil {
+		return err
+	}
+
+	var cursor time.Time
+	if first != nil {
+		ddl, err := migrationPartitionsSQL(cfg, *first, *last)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(ctx, ddl); err != nil {
+			return fmt.Errorf("creating partitions: %w", err)
+		}
+		// Batches take the rows after the cursor, so that resuming after
+		// the newest row copied neither skips nor repeats any.
+		var copied *time.Time
+		if err := db.QueryRow(ctx, fmt.Sprintf("SELECT max(%s) FROM %s", col.Time, metricsNew)).Scan(&copied); err != nil {
+			return err
+		}
+		cursor = first.Add(-time.Microsecond)
+		if copied != nil {
+			cursor = *copied
+			level.Info(logger).Log("msg", "Resuming migration", "from", cursor)
+		}
+		for cursor.Before(*last) {
+			begin := time.Now()
+			end := cursor.Add(batch)
+			tag, err := db.Exec(ctx, migrateCopySQL(col, "AND "+col.Time+" <= $2"), cursor, end)
+			if err != nil {
+				return fmt.Errorf("copying rows after %s: %w", cursor.Format(time.RFC3339), err)
+			}
+			cursor = end
+			done := cursor.Sub(*first).Seconds() / last.Sub(*first).Seconds()
+			if done > 1 || last.Equal(*first) {
+				done = 1
+			}
+			level.Info(logger).Log("msg", "Copied batch", "until", cursor, "rows", tag.RowsAffected(), "progress", fmt.Sprintf("%.1f%%", done*100), "duration", time.Since(begin))
+		}
+	}
+
+	return swapMetrics(ctx, db, logger, cfg, cursor)
+}
+
+// waitForQuiet returns an error if rows are inserted into metrics during
+// migrateQuietPeriod.
+func waitForQuiet(ctx context.Context, db *pgxpool.Pool, logger log.Logger) error {
+	const insertsQuery = "SELECT coalesce(n_tup_ins, 0) FROM pg_stat_user_tables WHERE relid = 'metrics'::regclass"
+	var before, after int64
+	if err := db.QueryRow(ctx, insertsQuery).Scan(&before); err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "Checking that ingestion is stopped", "wait", migrateQuietPeriod)
+	time.Sleep(migrateQuietPeriod)
+	if err := db.QueryRow(ctx, insertsQuery).Scan(&after); err != nil {
+		return err
+	}
+	if after != before {
+		return fmt.Errorf("%d rows were inserted into metrics in %s, stop every adapter writing to it first", after-before, migrateQuietPeriod)
+	}
+	return nil
+}
+
+// migrateCopySQL copies the rows of metrics after $1 and matching extra
+// into metrics_new. Rows already there, and duplicates the unpartitioned
+// table may hold, are skipped.
+func migrateCopySQL(col Columns, extra string) string {
+	columns := strings.Join(col.list(), ", ")
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM metrics WHERE %s > $1 %s ON CONFLICT DO NOTHING",
+		metricsNew, columns, columns, col.Time, extra)
+}
+
+// migrationPartitionsSQL returns the statements creating the partitions of
+// metrics_new covering every day from first through last.
+func migrationPartitionsSQL(cfg *Config, first time.Time, last time.Time) (string, error) {
+	timeColumn := cfg.columns().quoted().Time
+	var all []string
+	t := partitionTime(first)
+	for day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location()); !day.After(last); day = day.AddDate(0, 0, 1) {
+		statements, err := partitionDDL(metricsNew, cfg.PartitionScheme, timeColumn, day)
+		if err != nil {
+			return "", err
+		}
+		all = append(all, statements...)
+	}
+	return strings.Join(all, ";\n"), nil
+}
+
+// swapMetrics copies the rows written after cursor and renames metrics to
+// metrics_old and metrics_new to metrics, together with their indexes, in
+// one transaction holding an exclusive lock on metrics.
+func swapMetrics(ctx context.Context, db *pgxpool.Pool, logger log.Logger, cfg *Config, cursor time.Time) error {
+	col := cfg.columns().quoted()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "LOCK TABLE metrics IN ACCESS EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+	var last *time.Time
+	if err := tx.QueryRow(ctx, fmt.Sprintf("SELECT max(%s) FROM metrics WHERE %s > $1", col.Time, col.Time), cursor).Scan(&last); err != nil {
+		return err
+	}
+	if last != nil {
+		ddl, err := migrationPartitionsSQL(cfg, cursor, *last)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, ddl); err != nil {
+			return fmt.Errorf("creating partitions: %w", err)
+		}
+		tag, err := tx.Exec(ctx, migrateCopySQL(col, ""), cursor)
+		if err != nil {
+			return fmt.Errorf("copying rows written during the migration: %w", err)
+		}
+		level.Warn(logger).Log("msg", "Copied rows written during the migration", "rows", tag.RowsAffected())
+	}
+
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE metrics RENAME TO %s", metricsOld),
+		fmt.Sprintf("ALTER INDEX IF EXISTS metrics_time_brin_idx RENAME TO %s_time_brin_idx", metricsOld),
+		fmt.Sprintf("ALTER INDEX IF EXISTS metrics_name_time_idx RENAME TO %s_name_time_idx", metricsOld),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO metrics", metricsNew),
+		fmt.Sprintf("ALTER INDEX %s_time_brin_idx RENAME TO metrics_time_brin_idx", metricsNew),
+		fmt.Sprintf("ALTER INDEX IF EXISTS %s_name_time_idx RENAME TO metrics_name_time_idx", metricsNew),
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("swapping tables: %w", err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	level.Info(logger).Log("msg", "Migrated metrics to a partitioned table, the old one is kept as metrics_old")
+	return nil
+}
@@ -0,0 +1,81 @@
+package postgresql
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ParserStatus describes the activity of one parser.
+type ParserStatus struct {
+	ID             int       `json:"id"`
+	Batches        int64     `json:"batches"`
+	Samples        int64     `json:"samples"`
+	ParseErrors    int64     `json:"parse_errors"`
+	HandoffSeconds float64   `json:"handoff_seconds"`
+	LastActivity   time.Time `json:"last_activity"`
+}
+
+// status reads the parser's counters; id is its index within its writer.
+func (p *PGParser) status(id int) ParserStatus {
+	return ParserStatus{
+		ID:             id,
+		Batches:        atomic.LoadInt64(&p.batches),
+		Samples:        atomic.LoadInt64(&p.samples),
+		ParseErrors:    atomic.LoadInt64(&p.parseErrors),
+		HandoffSeconds: time.Duration(atomic.LoadInt64(&p.handoffNanos)).Seconds(),
+		LastActivity:   time.Unix(0, atomic.LoadInt64(&p.lastActivity)),
+	}
+}
+
+// parserCollector exports the parser counters labelled by writer and parser.
+// It reads the atomics at scrape time, so the parsers never touch the
+// registry in their loop.
+type parserCollector struct {
+	batches     *prometheus.Desc
+	samples     *prometheus.Desc
+	parseErrors *prometheus.Desc
+	handoff     *prometheus.Desc
+}
+
+func newParserCollector() *parserCollector {
+	labels := []string{"writer", "parser"}
+	return &parserCollector{
+		batches:     prometheus.NewDesc("adapter_parser_batches_total", "Total number of sample batches popped from the queue per parser.", labels, nil),
+		samples:     prometheus.NewDesc("adapter_parser_samples_total", "Total number of samples parsed per parser.", labels, nil),
+		parseErrors: prometheus.NewDesc("adapter_parser_errors_total", "Total number of samples whose labels could not be parsed per parser.", labels, nil),
+		handoff:     prometheus.NewDesc("adapter_parser_handoff_seconds_total", "Total time spent handing rows to the writer, including waiting for its lock, per parser.", labels, nil),
+	}
+}
+
+func (pc *parserCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.batches
+	ch <- pc.samples
+	ch <- pc.parseErrors
+	ch <- pc.handoff
+}
+
+func (pc *parserCollector) Collect(ch chan<- prometheus.Metric) {
+	writersMutex.Lock()
+	defer writersMutex.Unlock()
+	for _, w := range writers {
+		w.PGWriterMutex.Lock()
+		parsers := w.parsers
+		w.PGWriterMutex.Unlock()
+		writer := strconv.Itoa(w.id)
+		for id, p := range parsers {
+			s := p.status(id)
+			parser := strconv.Itoa(id)
+			ch <- prometheus.MustNewConstMetric(pc.batches, prometheus.CounterValue, float64(s.Batches), writer, parser)
+			ch <- prometheus.MustNewConstMetric(pc.samples, prometheus.CounterValue, float64(s.Samples), writer, parser)
+			ch <- prometheus.MustNewConstMetric(pc.parseErrors, prometheus.CounterValue, float64(s.ParseErrors), writer, parser)
+			ch <- prometheus.MustNewConstMetric(pc.handoff, prometheus.CounterValue, s.HandoffSeconds, writer, parser)
+		}
+	}
+}
+
+func init() {
+	prometheus.MustRegister(newParserCollector())
+}
@@ -0,0 +1,60 @@
+package postgresql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// ParserTarget converts samples to rows like a parser does and discards the
+// rows, to measure the parsers apart from the queue and the database. It
+// needs no connection: partitions count as in place.
+type ParserTarget struct {
+	mutex    sync.Mutex
+	cfg      *Config
+	parser   PGParser
+	received int64
+	parsed   int64
+	dropped  int64
+}
+
+// NewParserTarget returns a ParserTarget converting as configured by cfg,
+// with the labels cache if LabelsCacheSeries is set.
+func NewParserTarget(cfg *Config) *ParserTarget {
+	t := &ParserTarget{cfg: cfg}
+	if cfg.LabelsCacheSeries > 0 {
+		t.parser.labels = newLabelsLRU(cfg.LabelsCacheSeries)
+	}
+	return t
+}
+
+// Write converts samples on the caller's goroutine, one call at a time.
+func (t *ParserTarget) Write(samples model.Samples) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	downsampled, dropped, suppressed := t.parser.parseBatch(t.cfg, t.cfg.PartitionScheme, samples, func(time.Time) bool { return true })
+	if t.parser.labels != nil {
+		t.parser.labels.flushCounts()
+	}
+	t.received += int64(len(samples))
+	t.parsed += int64(len(t.parser.valueRows))
+	t.dropped += int64(downsampled + dropped + suppressed)
+	for i := range t.parser.valueRows {
+		t.parser.valueRows[i] = nil
+	}
+	t.parser.valueRows = t.parser.valueRows[:0]
+	return nil
+}
+
+// Stats reports the samples converted as written, nothing is ever queued.
+func (t *ParserTarget) Stats() Stats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return Stats{
+		Received: t.received,
+		Outcomes: map[string]int64{OutcomeCommitted: t.parsed},
+		Written:  t.parsed,
+		Dropped:  t.dropped,
+	}
+}
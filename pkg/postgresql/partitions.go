@@ -0,0 +1,448 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Partition schemes.
+const (
+	PartitionDaily  = "daily"
+	PartitionHourly = "hourly"
+)
+
+// maxIdentifierLength is PostgreSQL's NAMEDATALEN - 1, longer names would be
+// silently truncated.
+const maxIdentifierLength = 63
+
+var identifierPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// sanitizeIdentifier checks a generated relation name against an allowlist
+// of characters and the length limit, and returns it quoted for use in SQL.
+func sanitizeIdentifier(name string) (string, error) {
+	if len(name) > maxIdentifierLength || !identifierPattern.MatchString(name) {
+		return "", fmt.Errorf("invalid identifier %q", name)
+	}
+	return pgx.Identifier{name}.Sanitize(), nil
+}
+
+// partitionHours returns the hours covered by one leaf partition under the
+// given scheme: daily, hourly, or an interval like 6h or 12h that evenly
+// divides a day.
+func partitionHours(partitionScheme string) (int, error) {
+	switch partitionScheme {
+	case PartitionDaily:
+		return 24, nil
+	case PartitionHourly:
+		return 1, nil
+	}
+	if strings.HasSuffix(partitionScheme, "h") {
+		hours, err := strconv.Atoi(strings.TrimSuffix(partitionScheme, "h"))
+		if err == nil && hours > 0 && 24%hours == 0 {
+			return hours, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown partition scheme %q, expected %s, %s or an interval evenly dividing 24h like 6h or 12h", partitionScheme, PartitionDaily, PartitionHourly)
+}
+
+// Validate checks the values of the configuration that end up in SQL.
+func (cfg *Config) Validate() error {
+	if _, err := partitionHours(cfg.PartitionScheme); err != nil {
+		return err
+	}
+	if _, err := parseLegacyTables(cfg.LegacyTables); err != nil {
+		return err
+	}
+	if _, err := parseDownsampleRules(cfg.DownsampleRules); err != nil {
+		return err
+	}
+	if _, err := cfg.validationRules(); err != nil {
+		return err
+	}
+	if err := cfg.checkInfinity(); err != nil {
+		return err
+	}
+	if err := cfg.columns().validate(); err != nil {
+		return err
+	}
+	if cfg.ReadySoftWatermark < 0 || cfg.ReadyHardWatermark < 0 {
+		return errors.New("readiness watermarks must not be negative")
+	}
+	if cfg.ReadySoftWatermark > 0 && cfg.ReadyHardWatermark > 0 && cfg.ReadySoftWatermark >= cfg.ReadyHardWatermark {
+		return fmt.Errorf("soft readiness watermark %d is not below the hard one %d", cfg.ReadySoftWatermark, cfg.ReadyHardWatermark)
+	}
+	if cfg.LabelsCacheSeries < 0 {
+		return fmt.Errorf("labels cache size %d is negative", cfg.LabelsCacheSeries)
+	}
+	if cfg.BackfillWatermark < 0 {
+		return fmt.Errorf("backfill watermark %d is negative", cfg.BackfillWatermark)
+	}
+	if cfg.QueueShards < 0 {
+		return fmt.Errorf("queue shards %d is negative", cfg.QueueShards)
+	}
+	if cfg.TenantBurst < 0 {
+		return fmt.Errorf("tenant burst %v is negative", cfg.TenantBurst)
+	}
+	if cfg.MaxTenants < 0 {
+		return fmt.Errorf("max tenants %d is negative", cfg.MaxTenants)
+	}
+	if cfg.MaxActiveSeries > 0 && cfg.ActiveSeriesWindow < time.Minute {
+		return fmt.Errorf("active series window %s is shorter than a minute", cfg.ActiveSeriesWindow)
+	}
+	if cfg.RequireTLS {
+		if cfg.MinSSLMode != SSLModeVerifyCA && cfg.MinSSLMode != SSLModeVerifyFull {
+			return fmt.Errorf("unknown minimum sslmode %q, expected %s or %s", cfg.MinSSLMode, SSLModeVerifyCA, SSLModeVerifyFull)
+		}
+		if err := cfg.checkTLSDSN(WriterPool, databaseURL()); err != nil {
+			return err
+		}
+		if dsn := secondaryDatabaseURL(); dsn != "" {
+			if err := cfg.checkTLSDSN(SecondaryPool, dsn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// partitionTime returns ts in UTC, which partitions of every scheme are
+// named and bounded in, whatever the time zone of the host or the database
+// session.
+func partitionTime(ts time.Time) time.Time {
+	return ts.UTC()
+}
+
+// partitionDDL returns the statements creating the partitions of table that
+// cover day under the given scheme. timeColumn is the quoted name of the
+// partition key.
+func partitionDDL(table string, partitionScheme string, timeColumn string, day time.Time) ([]string, error) {
+	hours, err := partitionHours(partitionScheme)
+	if err != nil {
+		return nil, err
+	}
+	day = partitionTime(day)
+	parent, err := sanitizeIdentifier(table)
+	if err != nil {
+		return nil, err
+	}
+	dayTable, err := sanitizeIdentifier("metrics_" + day.Format("20060102"))
+	if err != nil {
+		return nil, err
+	}
+	start := day.Format("2006-01-02")
+	end := day.AddDate(0, 0, 1).Format("2006-01-02")
+
+	switch partitionScheme {
+	case PartitionDaily:
+		return []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s 00:00:00+00') TO ('%s 00:00:00+00')", dayTable, parent, start, end),
+		}, nil
+	case PartitionHourly:
+		statements := []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s 00:00:00+00') TO ('%s 00:00:00+00') PARTITION BY RANGE (%s)", dayTable, parent, start, end, timeColumn),
+		}
+		for h := 0; h < 24; h++ {
+			hourTable, err := sanitizeIdentifier(fmt.Sprintf("metrics_%s_%02d", day.Format("20060102"), h))
+			if err != nil {
+				return nil, err
+			}
+			to := fmt.Sprintf("%s %02d:00:00+00", start, h+1)
+			if h == 23 {
+				to = end + " 00:00:00+00"
+			}
+			statements = append(statements, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s %02d:00:00+00') TO ('%s')", hourTable, dayTable, start, h, to))
+		}
+		return statements, nil
+	default:
+		// Interval partitions hang directly off metrics.
+		var statements []string
+		for h := 0; h < 24; h += hours {
+			table, err := sanitizeIdentifier(fmt.Sprintf("metrics_%s_%02d", day.Format("20060102"), h))
+			if err != nil {
+				return nil, err
+			}
+			to := fmt.Sprintf("%s %02d:00:00+00", start, h+hours)
+			if h+hours == 24 {
+				to = end + " 00:00:00+00"
+			}
+			statements = append(statements, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s %02d:00:00+00') TO ('%s')", table, parent, start, h, to))
+		}
+		return statements, nil
+	}
+}
+
+// ensuredPartitions caches the partitions known to exist, keyed by
+// partitionKey, so that backfill streams hopping between days do not re-run
+// the DDL for every sample.
+var (
+	ensuredMutex      sync.Mutex
+	ensuredPartitions = make(map[int]bool)
+)
+
+// partitionKey identifies the leaf partition that stores ts under the given
+// scheme, without allocating: yyyymmddhh, with the hour zeroed for daily
+// partitions.
+func partitionKey(partitionScheme string, ts time.Time) int {
+	ts = partitionTime(ts)
+	year, month, day := ts.Date()
+	key := year*1000000 + int(month)*10000 + day*100
+	if hours, err := partitionHours(partitionScheme); err == nil && hours < 24 {
+		key += ts.Hour() / hours * hours
+	}
+	return key
+}
+
+// ensurePartition creates the partitions needed to store ts unless they are
+// already known to exist. All partitions of the day are created at once, so
+// every one of them is cached afterwards. Nothing is created when schema
+// setup is skipped.
+func (c *PGWriter) ensurePartition(partitionScheme string, ts time.Time) error {
+	if c.cfg.SkipSchemaSetup {
+		return nil
+	}
+	key := partitionKey(partitionScheme, ts)
+	ensuredMutex.Lock()
+	ok := ensuredPartitions[key]
+	ensuredMutex.Unlock()
+	if ok {
+		return nil
+	}
+
+	if err := c.setupPgPartitions(partitionScheme, ts); err != nil {
+		return err
+	}
+
+	hours, _ := partitionHours(partitionScheme)
+	dayKey := partitionKey(PartitionDaily, partitionTime(ts))
+	ensuredMutex.Lock()
+	for h := 0; h < 24; h += hours {
+		ensuredPartitions[dayKey+h] = true
+	}
+	ensuredMutex.Unlock()
+	return nil
+}
+
+// leafRangesQuery lists the leaf partitions of metrics with the
+// bounds of their range.
+const leafRangesQuery = `WITH RECURSIVE parts AS (
+	SELECT inhrelid FROM pg_inherits WHERE inhparent = 'metrics'::regclass
+	UNION ALL
+	SELECT i.inhrelid FROM pg_inherits i JOIN parts p ON i.inhparent = p.inhrelid
+)
+SELECT c.oid::regclass::text,
+	substring(pg_get_expr(c.relpartbound, c.oid) from 'FROM \(''([^'']+)''\)')::timestamptz AS lower,
+	substring(pg_get_expr(c.relpartbound, c.oid) from 'TO \(''([^'']+)''\)')::timestamptz AS upper
+FROM parts p
+JOIN pg_class c ON c.oid = p.inhrelid
+WHERE c.relkind = 'r'
+ORDER BY lower`
+
+// partitionRange is a leaf partition with the bounds of its range.
+type partitionRange struct {
+	name         string
+	lower, upper time.Time
+}
+
+// leafPartitionRanges lists the leaf partitions of metrics that have a
+// range, in time order.
+func leafPartitionRanges(ctx context.Context, db *pgxpool.Pool) ([]partitionRange, error) {
+	rows, err := db.Query(ctx, leafRangesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var partitions []partitionRange
+	for rows.Next() {
+		var p partitionRange
+		var lower, upper *time.Time
+		if err := rows.Scan(&p.name, &lower, &upper); err != nil {
+			return nil, err
+		}
+		// A default partition has no range and is never closed.
+		if lower == nil || upper == nil {
+			continue
+		}
+		p.lower, p.upper = *lower, *upper
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// isMissingPartition reports whether a COPY failed because no partition
+// accepts a row, typically because it was dropped or detached while the
+// adapter had it cached as existing.
+func isMissingPartition(err error) bool {
+	var sqlErr interface{ SQLState() string }
+	return errors.As(err, &sqlErr) && sqlErr.SQLState() == "23514" && strings.Contains(err.Error(), "no partition of relation")
+}
+
+// partitionDays returns the UTC days from the earliest to the latest row of
+// rows. A COPY of rows needs the partitions of all of them.
+func partitionDays(rows [][]interface{}) []time.Time {
+	if len(rows) == 0 {
+		return nil
+	}
+	first, last := rows[0][0].(time.Time), rows[0][0].(time.Time)
+	for _, row := range rows[1:] {
+		ts := row[0].(time.Time)
+		if ts.Before(first) {
+			first = ts
+		}
+		if ts.After(last) {
+			last = ts
+		}
+	}
+	first = partitionTime(first)
+	last = partitionTime(last)
+	var days []time.Time
+	year, month, day := first.Date()
+	for d := time.Date(year, month, day, 0, 0, 0, 0, first.Location()); !d.After(last); d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	return days
+}
+
+// ensureBatchPartitions checks on conn that the partitions of every day
+// rows span exist, and creates the missing ones on conn too, so that a COPY
+// on the same connection sees them even if DDL through another connection
+// would not be visible to it yet. Unlike ensurePartition it does not trust
+// the cache; it fills it instead. Nothing is created when schema setup is
+// skipped.
+func (c *PGWriter) ensureBatchPartitions(ctx context.Context, conn *pgxpool.Conn, rows [][]interface{}) error {
+	if c.cfg.SkipSchemaSetup || len(rows) == 0 {
+		return nil
+	}
+	partitionScheme := c.cfg.PartitionScheme
+	hours, err := partitionHours(partitionScheme)
+	if err != nil {
+		return err
+	}
+	days := partitionDays(rows)
+	var leaves []string
+	leafDays := make(map[string]time.Time)
+	for _, day := range days {
+		names, err := partitionLeaves(partitionScheme, day)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			leaves = append(leaves, name)
+			leafDays[name] = day
+		}
+	}
+
+	missing, err := conn.Query(ctx, "SELECT name FROM unnest($1::text[]) AS name WHERE to_regclass(name) IS NULL", leaves)
+	if err != nil {
+		return err
+	}
+	create := make(map[time.Time]bool)
+	for missing.Next() {
+		var name string
+		if err := missing.Scan(&name); err != nil {
+			missing.Close()
+			return err
+		}
+		create[leafDays[name]] = true
+	}
+	missing.Close()
+	if err := missing.Err(); err != nil {
+		return err
+	}
+	for day := range create {
+		level.Info(c.logger).Log("msg", "Creating partitions for a batch", "day", day.Format("2006-01-02"), "writer", c.id)
+		if err := createPartitions(ctx, conn, c.logger, c.cfg, partitionScheme, day); err != nil {
+			return fmt.Errorf("creating partitions for %s: %w", day.Format("2006-01-02"), err)
+		}
+	}
+
+	ensuredMutex.Lock()
+	for _, day := range days {
+		dayKey := partitionKey(PartitionDaily, day)
+		for h := 0; h < 24; h += hours {
+			ensuredPartitions[dayKey+h] = true
+		}
+	}
+	ensuredMutex.Unlock()
+	return nil
+}
+
+func (c *PGWriter) setupPgPartitions(partitionScheme string, lastPartitionTS time.Time) error {
+	if _, err := partitionHours(partitionScheme); err != nil {
+		level.Error(c.logger).Log("msg", "Invalid partition", "err", err)
+		return err
+	}
+	level.Info(c.logger).Log("msg", "Creating partition, "+partitionScheme)
+	return createPartitions(context.Background(), c.DB, c.logger, c.cfg, partitionScheme, lastPartitionTS)
+}
+
+// CreatePartitions creates every partition covering the days from through to,
+// inclusive, under the configured scheme, together with the metrics table if
+// it does not exist yet. It uses the same DDL as the writers and can be run
+// repeatedly, existing partitions are left alone.
+func CreatePartitions(ctx context.Context, logger log.Logger, cfg *Config, from time.Time, to time.Time) error {
+	if to.Before(from) {
+		return fmt.Errorf("partition range ends before it starts: %s > %s", from.Format("2006-01-02"), to.Format("2006-01-02"))
+	}
+	db, err := newPool(cfg, WriterPool, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := createSchema(ctx, db, logger, schemaLockID(cfg), primarySchemaSteps(cfg)); err != nil {
+		return err
+	}
+	if cfg.DeferredIndexes {
+		if err := warnParentIndex(ctx, db, logger); err != nil {
+			return err
+		}
+	}
+
+	days := int(to.Sub(from).Hours()/24) + 1
+	for i, day := 0, from; !day.After(to); i, day = i+1, day.AddDate(0, 0, 1) {
+		begin := time.Now()
+		if err := createPartitions(ctx, db, logger, cfg, cfg.PartitionScheme, day); err != nil {
+			return fmt.Errorf("creating partitions for %s: %w", day.Format("2006-01-02"), err)
+		}
+		level.Info(logger).Log("msg", "Created partitions", "day", day.Format("2006-01-02"), "progress", fmt.Sprintf("%d/%d", i+1, days), "duration", time.Since(begin))
+	}
+	return nil
+}
+
+// precreationInterval is how often the leader checks that the next partition
+// exists.
+const precreationInterval = time.Minute
+
+// runPartitionPrecreation creates the partition following the current one
+// ahead of time while this instance is the leader, so that writers of all
+// instances find it in place when the clock rolls over.
+func (c *PGWriter) runPartitionPrecreation(partitionScheme string) {
+	hours, err := partitionHours(partitionScheme)
+	if err != nil {
+		return
+	}
+	for c.KeepRunning {
+		if IsLeader() {
+			next := time.Now().Add(time.Duration(hours) * time.Hour)
+			if err := c.ensurePartition(partitionScheme, next); err != nil {
+				level.Error(c.logger).Log("msg", "Partition pre-creation failed", "err", err)
+			}
+		} else {
+			level.Debug(c.logger).Log("msg", "Not leader, skipping partition pre-creation")
+		}
+		for wait := time.Duration(0); wait < precreationInterval && c.KeepRunning; wait += time.Second {
+			time.Sleep(time.Second)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package postgresql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeIdentifier(t *testing.T) {
+	tests := []struct {
+		name  string
+		ident string
+		want  string
+	}{
+		{"table", "metrics", `"metrics"`},
+		{"partition", "metrics_20200301_07", `"metrics_20200301_07"`},
+		{"leading underscore", "_metrics", `"_metrics"`},
+		{"longest name", strings.Repeat("m", maxIdentifierLength), `"` + strings.Repeat("m", maxIdentifierLength) + `"`},
+		{"double quote", `metrics"; DROP TABLE metrics; --`, ""},
+		{"single quote", "metrics'", ""},
+		{"semicolon", "metrics;", ""},
+		{"space", "metrics old", ""},
+		{"dot", "public.metrics", ""},
+		{"upper case", "Metrics", ""},
+		{"leading digit", "1metrics", ""},
+		{"unicode letter", "métrics", ""},
+		{"unicode lookalike", "metrics_а", ""},
+		{"empty", "", ""},
+		{"over-length", strings.Repeat("m", maxIdentifierLength+1), ""},
+		{"over-length in bytes", strings.Repeat("m", maxIdentifierLength-1) + "é", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeIdentifier(tt.ident)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("sanitizeIdentifier(%q) = %s, want an error", tt.ident, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sanitizeIdentifier(%q): %v", tt.ident, err)
+			}
+			if got != tt.want {
+				t.Errorf("sanitizeIdentifier(%q) = %s, want %s", tt.ident, got, tt.want)
+			}
+		})
+	}
+}
+
+var partitionStatement = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS "(\w+)" PARTITION OF "(\w+)" FOR VALUES FROM \('([^']+)'\) TO \('([^']+)'\)( PARTITION BY RANGE \("time"\))?$`)
+
+// ddlPartition is a partition parsed from the DDL of partitionDDL.
+type ddlPartition struct {
+	name, parent string
+	from, to     time.Time
+	leaf         bool
+}
+
+func parsePartitionDDL(t *testing.T, statements []string) []ddlPartition {
+	t.Helper()
+	var partitions []ddlPartition
+	for _, s := range statements {
+		m := partitionStatement.FindStringSubmatch(s)
+		if m == nil {
+			t.Fatalf("unexpected statement %q", s)
+		}
+		var bounds [2]time.Time
+		for i, bound := range m[3:5] {
+			if !strings.HasSuffix(bound, ":00:00+00") {
+				t.Fatalf("bound %q of %s is not a whole UTC hour", bound, m[1])
+			}
+			ts, err := time.Parse("2006-01-02 15:04:05-07", bound)
+			if err != nil {
+				t.Fatalf("bound %q of %s: %v", bound, m[1], err)
+			}
+			bounds[i] = ts
+		}
+		partitions = append(partitions, ddlPartition{name: m[1], parent: m[2], from: bounds[0], to: bounds[1], leaf: m[5] == ""})
+	}
+	return partitions
+}
+
+// TestPartitionDDL checks the partitions created for samples on three
+// non-contiguous days, some given in other time zones: the leaves of each
+// day tile it without gaps in UTC, and every sample lands in the leaf its
+// partition key names.
+func TestPartitionDDL(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	newYork := time.FixedZone("EST", -5*60*60)
+	samples := []time.Time{
+		time.Date(2020, 2, 28, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 2, 28, 23, 59, 59, 999999999, time.UTC),
+		// 2020-02-29 03:30 UTC, a leap day.
+		time.Date(2020, 2, 29, 12, 30, 0, 0, tokyo),
+		// 2020-03-15 04:00 UTC, the previous day in New York.
+		time.Date(2020, 3, 14, 23, 0, 0, 0, newYork),
+		time.Date(2020, 3, 15, 17, 45, 0, 0, time.UTC),
+	}
+	for _, scheme := range []string{PartitionDaily, PartitionHourly, "6h"} {
+		t.Run(scheme, func(t *testing.T) {
+			hours, _ := partitionHours(scheme)
+			for _, ts := range samples {
+				statements, err := partitionDDL("metrics", scheme, `"time"`, ts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				partitions := parsePartitionDDL(t, statements)
+				day := ts.UTC().Truncate(24 * time.Hour)
+
+				var leaves []string
+				var containing []string
+				next := day
+				for _, p := range partitions {
+					if !p.leaf {
+						if scheme != PartitionHourly || p.parent != "metrics" || !p.from.Equal(day) || !p.to.Equal(day.AddDate(0, 0, 1)) {
+							t.Errorf("unexpected parent partition %+v", p)
+						}
+						continue
+					}
+					wantParent := "metrics"
+					if scheme == PartitionHourly {
+						wantParent = "metrics_" + day.Format("20060102")
+					}
+					if p.parent != wantParent {
+						t.Errorf("%s is a partition of %s, want %s", p.name, p.parent, wantParent)
+					}
+					if !p.from.Equal(next) || p.to.Sub(p.from) != time.Duration(hours)*time.Hour {
+						t.Errorf("%s covers %s to %s, want %d hours from %s", p.name, p.from, p.to, hours, next)
+					}
+					next = p.to
+					leaves = append(leaves, p.name)
+					if !ts.Before(p.from) && ts.Before(p.to) {
+						containing = append(containing, p.name)
+					}
+				}
+				if !next.Equal(day.AddDate(0, 0, 1)) {
+					t.Errorf("leaves of %s end at %s", day, next)
+				}
+
+				want, err := partitionLeaves(scheme, ts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Join(leaves, ",") != strings.Join(want, ",") {
+					t.Errorf("DDL creates %v, partitionLeaves lists %v", leaves, want)
+				}
+
+				key := partitionKey(scheme, ts)
+				wantLeaf := fmt.Sprintf("metrics_%d", key/100)
+				if scheme != PartitionDaily {
+					wantLeaf = fmt.Sprintf("metrics_%d_%02d", key/100, key%100)
+				}
+				if len(containing) != 1 || containing[0] != wantLeaf {
+					t.Errorf("sample at %s lands in %v, want %s", ts.UTC(), containing, wantLeaf)
+				}
+			}
+		})
+	}
+}
+
+func TestPartitionKeyUnique(t *testing.T) {
+	// Keys of different days never collide, whatever the hour.
+	seen := make(map[int]time.Time)
+	for _, day := range []time.Time{
+		time.Date(2020, 2, 28, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		for h := 0; h < 24; h++ {
+			ts := day.Add(time.Duration(h) * time.Hour)
+			key := partitionKey(PartitionHourly, ts)
+			if other, ok := seen[key]; ok {
+				t.Errorf("%s and %s share the key %d", ts, other, key)
+			}
+			seen[key] = ts
+		}
+	}
+}
+
+func TestIsMissingPartition(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"missing partition", &sqlError{state: "23514", msg: `no partition of relation "metrics" found for row`}, true},
+		{"wrapped missing partition", fmt.Errorf("copy: %w", &sqlError{state: "23514", msg: `no partition of relation "metrics" found for row`}), true},
+		{"check violation", &sqlError{state: "23514", msg: `new row for relation "metrics_20200301" violates check constraint "metrics_value_check"`}, false},
+		{"partition constraint", &sqlError{state: "23514", msg: `new row for relation "metrics_20200301" violates partition constraint`}, false},
+		{"other state", &sqlError{state: "22P02", msg: `no partition of relation "metrics" found for row`}, false},
+		{"no SQLSTATE", fmt.Errorf(`no partition of relation "metrics" found for row`), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isMissingPartition(tt.err); got != tt.want {
+				t.Errorf("isMissingPartition(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
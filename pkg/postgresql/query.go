@@ -0,0 +1,324 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// readOrderGrouped orders rows by series and time, so that the rows of a
+// series arrive together and can be passed on before the next one is read.
+const readOrderGrouped = "grouped"
+
+// SeriesFunc receives the labels and the samples, in time order, of one
+// series. Returning an error stops the query, the error is passed on.
+type SeriesFunc func(labels []prompb.Label, samples []prompb.Sample) error
+
+// QuerySeries runs q and calls fn once per series found, without building a
+// ReadResponse. Rows are ordered by series, so each series is passed on as
+// soon as its rows have been read; only when legacy tables have to be merged
+// in are all series read first. Errors returned by fn are passed on as they
+// are, any other error as a *ReadError.
+func (c *Client) QuerySeries(ctx context.Context, q *prompb.Query, fn SeriesFunc) error {
+	q, err := c.limitLookback(q)
+	if err != nil {
+		return readError(err)
+	}
+	if err := c.checkResolution(ctx, q); err != nil {
+		return readError(err)
+	}
+	var fnErr error
+	err = c.querySeries(ctx, q, readOrderGrouped, func(labels []prompb.Label, samples []prompb.Sample) error {
+		fnErr = fn(labels, samples)
+		return fnErr
+	})
+	if err != nil && err == fnErr {
+		return err
+	}
+	return readError(err)
+}
+
+// Read lookback modes.
+const (
+	LookbackClamp  = "clamp"
+	LookbackReject = "reject"
+)
+
+// limitLookback applies MaxReadLookback to q before any query is built, so
+// that partitions before the horizon are pruned. A clamped query is a copy,
+// q itself is never changed.
+func (c *Client) limitLookback(q *prompb.Query) (*prompb.Query, error) {
+	if c.cfg.MaxReadLookback <= 0 {
+		return q, nil
+	}
+	horizon := fromTimestamp(time.Now().Add(-c.cfg.MaxReadLookback))
+	if q.StartTimestampMs >= horizon {
+		return q, nil
+	}
+	if c.cfg.ReadLookbackMode == LookbackReject {
+		return nil, fmt.Errorf("%w: start %s, horizon %s", ErrLookbackExceeded, toTimestamp(q.StartTimestampMs).Format(time.RFC3339), toTimestamp(horizon).Format(time.RFC3339))
+	}
+	level.Info(c.logger).Log("msg", "Clamped query start to the read lookback horizon", "start", toTimestamp(q.StartTimestampMs), "horizon", toTimestamp(horizon))
+	clamped := *q
+	clamped.StartTimestampMs = horizon
+	return &clamped, nil
+}
+
+// querySeries runs q with rows ordered as given by one of the ReadOrder
+// constants or readOrderGrouped and calls fn once per series.
+func (c *Client) querySeries(ctx context.Context, q *prompb.Query, order string, fn SeriesFunc) (err error) {
+	if c.emptyReads != nil {
+		if c.emptyReads.empty(q) {
+			return nil
+		}
+		found := false
+		counted := fn
+		fn = func(labels []prompb.Label, samples []prompb.Sample) error {
+			found = true
+			return counted(labels, samples)
+		}
+		defer func() {
+			if err == nil && !found {
+				c.emptyReads.remember(q)
+			}
+		}()
+	}
+
+	command, args, err := c.readQuery(ctx, q, order)
+	if err != nil {
+		return err
+	}
+	level.Debug(c.logger).Log("msg", "Executed query", "query", command, "args", fmt.Sprint(args))
+	db, err := c.pool()
+	if err != nil {
+		return err
+	}
+
+	series := fn
+	fn = func(labels []prompb.Label, samples []prompb.Sample) error {
+		return series(labels, orderSamples(c.logger, labels, samples))
+	}
+
+	begin := time.Now()
+	if order == readOrderGrouped && !c.readsLegacy(ctx, q) {
+		err := scanGrouped(ctx, db, command, args, fn)
+		c.explainSlowRead(ctx, q, command, args, time.Since(begin))
+		return err
+	}
+
+	labelsToSeries := map[string]*prompb.TimeSeries{}
+	if err := readSeries(ctx, db, command, args, labelsToSeries); err != nil {
+		return err
+	}
+	c.explainSlowRead(ctx, q, command, args, time.Since(begin))
+	if err := c.readLegacy(ctx, q, labelsToSeries); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(labelsToSeries))
+	for key := range labelsToSeries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ts := labelsToSeries[key]
+		if err := fn(ts.Labels, ts.Samples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readQuery builds the query reading q from metrics, with rows ordered as
+// given to querySeries and tombstoned rows left out. ExplainMatchers shows
+// the same query.
+func (c *Client) readQuery(ctx context.Context, q *prompb.Query, order string) (string, []interface{}, error) {
+	tombstones, err := c.activeTombstones(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	return buildTableQuery("metrics", c.cfg.columns(), q, order, tombstones)
+}
+
+// readsLegacy reports whether any legacy table has to be read for q.
+func (c *Client) readsLegacy(ctx context.Context, q *prompb.Query) bool {
+	for _, t := range c.legacy {
+		if t.covers(ctx, c, q.StartTimestampMs, q.EndTimestampMs) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanRows runs a query built by buildTableQuery on db and calls fn for every
+// row. It is the only place rows of a read are scanned.
+func scanRows(ctx context.Context, db *pgxpool.Pool, command string, args []interface{}, fn func(name string, labels *sampleLabels, sample prompb.Sample) error) error {
+	rows, err := db.Query(ctx, command, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			value  float64
+			name   string
+			labels sampleLabels
+			ts     time.Time
+		)
+		// value is decoded from the binary format, so +Inf, -Inf and NaN,
+		// including the staleness marker, keep their exact bits.
+		if err := rows.Scan(&ts, &name, &value, &labels); err != nil {
+			return err
+		}
+		if labels.err != nil && !activeInvalidLabels.handle(name, ts, &labels) {
+			continue
+		}
+		if err := fn(name, &labels, prompb.Sample{Timestamp: fromTimestamp(ts), Value: value}); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// readSeries runs a query built by buildTableQuery on db and adds the
+// returned samples to labelsToSeries, keyed by series.
+func readSeries(ctx context.Context, db *pgxpool.Pool, command string, args []interface{}, labelsToSeries map[string]*prompb.TimeSeries) error {
+	return scanRows(ctx, db, command, args, func(name string, labels *sampleLabels, sample prompb.Sample) error {
+		key := labels.key(name)
+		ts, ok := labelsToSeries[key]
+		if !ok {
+			ts = &prompb.TimeSeries{
+				Labels:  seriesLabels(name, labels),
+				Samples: make([]prompb.Sample, 0, 100),
+			}
+			labelsToSeries[key] = ts
+		}
+		ts.Samples = append(ts.Samples, sample)
+		return nil
+	})
+}
+
+// scanGrouped runs a query ordered by readOrderGrouped and calls fn with
+// every series as soon as its last row has been read.
+func scanGrouped(ctx context.Context, db *pgxpool.Pool, command string, args []interface{}, fn SeriesFunc) error {
+	var (
+		key     string
+		current *prompb.TimeSeries
+	)
+	err := scanRows(ctx, db, command, args, func(name string, labels *sampleLabels, sample prompb.Sample) error {
+		k := labels.key(name)
+		if current != nil && k == key {
+			current.Samples = append(current.Samples, sample)
+			return nil
+		}
+		if current != nil {
+			if err := fn(current.Labels, current.Samples); err != nil {
+				return err
+			}
+		}
+		key = k
+		current = &prompb.TimeSeries{Labels: seriesLabels(name, labels), Samples: []prompb.Sample{sample}}
+		return nil
+	})
+	if err != nil || current == nil {
+		return err
+	}
+	return fn(current.Labels, current.Samples)
+}
+
+// lastDuplicateLog is when orderSamples last logged conflicting samples, in
+// unix nanoseconds, accessed atomically.
+var lastDuplicateLog int64
+
+// orderSamples returns the samples of a series strictly in time order, as
+// the streamed remote read encoder requires and every other read relies on.
+// Samples are sorted if needed and of several at the same timestamp only the
+// last one read is kept. Dropped samples are counted; samples with different
+// values at the same timestamp are logged once per validationLogInterval.
+func orderSamples(logger log.Logger, labels []prompb.Label, samples []prompb.Sample) []prompb.Sample {
+	ordered := true
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Timestamp <= samples[i-1].Timestamp {
+			ordered = false
+			break
+		}
+	}
+	if ordered {
+		return samples
+	}
+
+	// A stable sort keeps samples at the same timestamp in the order read.
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp < samples[j].Timestamp
+	})
+	var equal, conflicting int
+	kept := samples[:1]
+	for _, sample := range samples[1:] {
+		last := &kept[len(kept)-1]
+		if sample.Timestamp != last.Timestamp {
+			kept = append(kept, sample)
+			continue
+		}
+		// Compared by bits, so that NaNs, staleness markers included, equal.
+		if math.Float64bits(sample.Value) == math.Float64bits(last.Value) {
+			equal++
+		} else {
+			conflicting++
+		}
+		*last = sample
+	}
+	if equal > 0 {
+		duplicateReadSamples.WithLabelValues("equal").Add(float64(equal))
+	}
+	if conflicting > 0 {
+		duplicateReadSamples.WithLabelValues("conflicting").Add(float64(conflicting))
+		now := time.Now().UnixNano()
+		last := atomic.LoadInt64(&lastDuplicateLog)
+		if now-last >= int64(validationLogInterval) && atomic.CompareAndSwapInt64(&lastDuplicateLog, last, now) {
+			level.Warn(logger).Log("msg", "Read samples with different values at the same timestamp, kept the last one read", "series", fmt.Sprint(labels), "samples", conflicting)
+		}
+	}
+	return kept
+}
+
+// seriesLabels returns the labels of a series, the metric name first.
+func seriesLabels(name string, labels *sampleLabels) []prompb.Label {
+	labelPairs := make([]prompb.Label, 0, labels.len()+1)
+	labelPairs = append(labelPairs, prompb.Label{
+		Name:  model.MetricNameLabel,
+		Value: name,
+	})
+	for _, k := range labels.OrderedKeys {
+		labelPairs = append(labelPairs, prompb.Label{
+			Name:  k,
+			Value: labels.Map[k],
+		})
+	}
+	return labelPairs
+}
+
+// labelsKey returns the same key as sampleLabels.key for labels built by
+// seriesLabels.
+func labelsKey(labels []prompb.Label) string {
+	separator := "\xff"
+	pairs := make([]string, 0, len(labels))
+	for i, l := range labels {
+		if i == 0 && l.Name == model.MetricNameLabel {
+			pairs = append(pairs, l.Value+separator)
+			continue
+		}
+		pairs = append(pairs, l.Name+separator+l.Value)
+	}
+	return strings.Join(pairs, separator)
+}
@@ -0,0 +1,91 @@
+package postgresql
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func samplesOf(pairs ...float64) []prompb.Sample {
+	samples := make([]prompb.Sample, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		samples = append(samples, prompb.Sample{Timestamp: int64(pairs[i]), Value: pairs[i+1]})
+	}
+	return samples
+}
+
+func TestOrderSamples(t *testing.T) {
+	stale := math.Float64frombits(value.StaleNaN)
+	tests := []struct {
+		name        string
+		samples     []prompb.Sample
+		want        []prompb.Sample
+		equal       float64
+		conflicting float64
+	}{
+		{"empty", nil, nil, 0, 0},
+		{"one sample", samplesOf(5, 1), samplesOf(5, 1), 0, 0},
+		{"in order", samplesOf(1, 1, 2, 2, 3, 3), samplesOf(1, 1, 2, 2, 3, 3), 0, 0},
+		{"reversed", samplesOf(3, 3, 2, 2, 1, 1), samplesOf(1, 1, 2, 2, 3, 3), 0, 0},
+		{"shuffled", samplesOf(2, 2, 4, 4, 1, 1, 3, 3), samplesOf(1, 1, 2, 2, 3, 3, 4, 4), 0, 0},
+		{"equal duplicate", samplesOf(1, 1, 2, 2, 2, 2, 3, 3), samplesOf(1, 1, 2, 2, 3, 3), 1, 0},
+		{"conflicting duplicate keeps the last read", samplesOf(1, 1, 2, 5, 2, 6, 3, 3), samplesOf(1, 1, 2, 6, 3, 3), 0, 1},
+		{"disordered duplicates", samplesOf(3, 3, 1, 7, 2, 2, 1, 8, 3, 3), samplesOf(1, 8, 2, 2, 3, 3), 1, 1},
+		{"all at one timestamp", samplesOf(1, 1, 1, 2, 1, 3), samplesOf(1, 3), 0, 2},
+		{"NaN duplicates are equal", samplesOf(1, math.NaN(), 1, math.NaN()), samplesOf(1, math.NaN()), 1, 0},
+		{"stale marker after NaN conflicts", samplesOf(1, math.NaN(), 1, stale), samplesOf(1, stale), 0, 1},
+		{"negative timestamps", samplesOf(-1, 1, -3, 3, -2, 2), samplesOf(-3, 3, -2, 2, -1, 1), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			equal := testutil.ToFloat64(duplicateReadSamples.WithLabelValues("equal"))
+			conflicting := testutil.ToFloat64(duplicateReadSamples.WithLabelValues("conflicting"))
+			got := orderSamples(log.NewNopLogger(), nil, tt.samples)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Timestamp != tt.want[i].Timestamp || math.Float64bits(got[i].Value) != math.Float64bits(tt.want[i].Value) {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+			if d := testutil.ToFloat64(duplicateReadSamples.WithLabelValues("equal")) - equal; d != tt.equal {
+				t.Errorf("%v equal duplicates counted, want %v", d, tt.equal)
+			}
+			if d := testutil.ToFloat64(duplicateReadSamples.WithLabelValues("conflicting")) - conflicting; d != tt.conflicting {
+				t.Errorf("%v conflicting duplicates counted, want %v", d, tt.conflicting)
+			}
+		})
+	}
+}
+
+// TestOrderSamplesStrictlyAscending feeds random rows with many repeated
+// timestamps and checks the invariant the streamed encoder relies on.
+func TestOrderSamplesStrictlyAscending(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for run := 0; run < 100; run++ {
+		samples := make([]prompb.Sample, rnd.Intn(200))
+		last := make(map[int64]float64)
+		for i := range samples {
+			samples[i] = prompb.Sample{Timestamp: rnd.Int63n(50), Value: float64(rnd.Intn(3))}
+			last[samples[i].Timestamp] = samples[i].Value
+		}
+		got := orderSamples(log.NewNopLogger(), nil, samples)
+		if len(got) != len(last) {
+			t.Fatalf("run %d: %d samples for %d timestamps", run, len(got), len(last))
+		}
+		for i, s := range got {
+			if i > 0 && s.Timestamp <= got[i-1].Timestamp {
+				t.Fatalf("run %d: sample %d at %d after %d", run, i, s.Timestamp, got[i-1].Timestamp)
+			}
+			if s.Value != last[s.Timestamp] {
+				t.Fatalf("run %d: kept %v at %d, want the last read %v", run, s.Value, s.Timestamp, last[s.Timestamp])
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package postgresql
+
+import (
+	"container/list"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// queuedBatch is a batch of samples waiting in a queue shard.
+type queuedBatch struct {
+	samples  *model.Samples
+	enqueued time.Time
+}
+
+// queueShard is one of the independent sub-queues samples wait in for a
+// parser. batches mirrors the length of the list, so that parsers looking
+// for work skip empty shards without taking their lock, and queued points to
+// the sample count of the queue the shard belongs to.
+type queueShard struct {
+	mutex   sync.Mutex
+	list    *list.List
+	batches int64
+	queued  *int64
+}
+
+var (
+	queueOnce   sync.Once
+	queueShards []*queueShard
+	// queueNext rotates the shard Push appends to.
+	queueNext uint32
+	// queuedSamples is the number of samples in all shards, accessed
+	// atomically.
+	queuedSamples int64
+
+	// backfillQueue holds the batches of writes marked as backfill, apart
+	// from the shards of live samples.
+	backfillQueue   = &queueShard{list: list.New(), queued: &backfillSamples}
+	backfillSamples int64
+)
+
+// sampleQueue returns the queue shards, creating QueueShards of them on the
+// first call, or one per GOMAXPROCS if it is not set. The number of shards
+// does not change afterwards.
+func sampleQueue(cfg *Config) []*queueShard {
+	queueOnce.Do(func() {
+		n := runtime.GOMAXPROCS(0)
+		if cfg != nil && cfg.QueueShards > 0 {
+			n = cfg.QueueShards
+		}
+		queueShards = make([]*queueShard, n)
+		for i := range queueShards {
+			queueShards[i] = &queueShard{list: list.New(), queued: &queuedSamples}
+		}
+	})
+	return queueShards
+}
+
+// Push - Push element at the end of the next shard
+func Push(samples *model.Samples) {
+	pushShard(sampleQueue(nil), samples)
+}
+
+func pushShard(shards []*queueShard, samples *model.Samples) {
+	shards[int(atomic.AddUint32(&queueNext, 1))%len(shards)].push(samples)
+}
+
+func (s *queueShard) push(samples *model.Samples) {
+	batch := queuedBatch{samples: samples, enqueued: time.Now()}
+	queueLockWait.lock(&s.mutex)
+	s.list.PushBack(batch)
+	atomic.AddInt64(&s.batches, 1)
+	atomic.AddInt64(s.queued, int64(len(*samples)))
+	s.mutex.Unlock()
+}
+
+// QueueLength - Number of samples waiting in all shards
+func QueueLength() int {
+	return int(atomic.LoadInt64(&queuedSamples))
+}
+
+// BackfillQueueLength returns the number of backfill samples waiting for a
+// parser.
+func BackfillQueueLength() int {
+	return int(atomic.LoadInt64(&backfillSamples))
+}
+
+// popBackfill pops the first backfill batch, but only while fewer than
+// watermark live samples are queued, or none for a watermark of 0, so that a
+// backfill does not delay live samples. Backfill batches are never evicted,
+// they are old by nature.
+func popBackfill(watermark int) *model.Samples {
+	if watermark < 1 {
+		watermark = 1
+	}
+	if atomic.LoadInt64(&backfillQueue.batches) == 0 || QueueLength() >= watermark {
+		return nil
+	}
+	return backfillQueue.pop(0, 0)
+}
+
+// Pop - Pop the first element of the first shard holding one
+func Pop() *model.Samples {
+	return popFresh(sampleQueue(nil), 0, 0, 0)
+}
+
+// popFresh pops the first batch of shard home, or of the next shard holding
+// one when home is empty. While more than watermark samples are queued in
+// total, batches that waited longer than maxAge are evicted first; a maxAge
+// of 0 never evicts.
+func popFresh(shards []*queueShard, home int, maxAge time.Duration, watermark int) *model.Samples {
+	for i := range shards {
+		s := shards[(home+i)%len(shards)]
+		if atomic.LoadInt64(&s.batches) == 0 {
+			continue
+		}
+		if samples := s.pop(maxAge, watermark); samples != nil {
+			return samples
+		}
+	}
+	return nil
+}
+
+func (s *queueShard) pop(maxAge time.Duration, watermark int) *model.Samples {
+	queueLockWait.lock(&s.mutex)
+	defer s.mutex.Unlock()
+	for p := s.list.Front(); p != nil; p = s.list.Front() {
+		batch := s.list.Remove(p).(queuedBatch)
+		atomic.AddInt64(&s.batches, -1)
+		queued := atomic.AddInt64(s.queued, -int64(len(*batch.samples)))
+		if maxAge > 0 && int(queued)+len(*batch.samples) > watermark && time.Since(batch.enqueued) > maxAge {
+			books.settle(OutcomeEvicted, int64(len(*batch.samples)))
+			continue
+		}
+		return batch.samples
+	}
+	return nil
+}
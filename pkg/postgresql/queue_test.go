@@ -0,0 +1,35 @@
+package postgresql
+
+import (
+	"container/list"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestShards(n int) []*queueShard {
+	var queued int64
+	shards := make([]*queueShard, n)
+	for i := range shards {
+		shards[i] = &queueShard{list: list.New(), queued: &queued}
+	}
+	return shards
+}
+
+func BenchmarkQueue(b *testing.B) {
+	samples := testSamples(100, time.Now())
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			shards := newTestShards(n)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				home := 0
+				for pb.Next() {
+					pushShard(shards, &samples)
+					popFresh(shards, home, 0, 0)
+					home++
+				}
+			})
+		})
+	}
+}
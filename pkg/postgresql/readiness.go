@@ -0,0 +1,141 @@
+package postgresql
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Readiness states, from best to worst.
+const (
+	ReadinessReady       = "ready"
+	ReadinessDegraded    = "degraded"
+	ReadinessUnavailable = "unavailable"
+)
+
+// readinessRecovery is the fraction of a watermark the queue has to fall
+// below before the state the watermark caused is left, so that a queue
+// hovering around a watermark does not flap.
+const readinessRecovery = 0.8
+
+// Readiness tells a load balancer whether to send writes to the adapter:
+// ready, degraded while it still accepts samples but falls behind, or
+// unavailable.
+type Readiness struct {
+	State string `json:"state"`
+	// Reasons explain a state other than ready.
+	Reasons       []string `json:"reasons,omitempty"`
+	QueuedSamples int      `json:"queued_samples"`
+}
+
+// readinessTracker holds the readiness state between evaluations, which the
+// hysteresis depends on.
+type readinessTracker struct {
+	mutex               sync.Mutex
+	logger              log.Logger
+	soft, hard          int
+	saturationIntervals int
+	state               string
+}
+
+// activeReadiness is shared by all clients, like the queue it watches.
+var activeReadiness = &readinessTracker{logger: log.NewNopLogger(), state: ReadinessReady}
+
+func (r *readinessTracker) configure(logger log.Logger, cfg *Config) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.logger = logger
+	r.soft = cfg.ReadySoftWatermark
+	r.hard = cfg.ReadyHardWatermark
+	r.saturationIntervals = cfg.SaturationIntervals
+}
+
+// evaluate determines the current state. The queue makes the adapter
+// unavailable at the hard watermark and degraded at the soft one, and it
+// only recovers once the queue is below readinessRecovery of the watermark.
+// A saturated writer, as reported by Status, degrades it too, and shutting
+// down makes it unavailable.
+func (r *readinessTracker) evaluate() Readiness {
+	queued := QueueLength()
+	saturated := saturatedWriters(r.saturationIntervals)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	soft, hard := r.soft, r.hard
+	if r.state != ReadinessReady {
+		soft = int(float64(soft) * readinessRecovery)
+	}
+	if r.state == ReadinessUnavailable {
+		hard = int(float64(hard) * readinessRecovery)
+	}
+
+	readiness := Readiness{State: ReadinessReady, QueuedSamples: queued}
+	switch {
+	case atomic.LoadInt32(&shuttingDown) != 0:
+		readiness.State = ReadinessUnavailable
+		readiness.Reasons = append(readiness.Reasons, "shutting down")
+	case r.hard > 0 && queued >= hard:
+		readiness.State = ReadinessUnavailable
+		readiness.Reasons = append(readiness.Reasons, fmt.Sprintf("%d samples queued, hard watermark %d", queued, r.hard))
+	default:
+		if r.soft > 0 && queued >= soft {
+			readiness.State = ReadinessDegraded
+			readiness.Reasons = append(readiness.Reasons, fmt.Sprintf("%d samples queued, soft watermark %d", queued, r.soft))
+		}
+		if saturated > 0 {
+			readiness.State = ReadinessDegraded
+			readiness.Reasons = append(readiness.Reasons, fmt.Sprintf("%d writers saturated", saturated))
+		}
+	}
+	if readiness.State != r.state {
+		level.Warn(r.logger).Log("msg", "Readiness changed", "from", r.state, "to", readiness.State, "queued", queued, "saturated_writers", saturated)
+		r.state = readiness.State
+	}
+	return readiness
+}
+
+// saturatedWriters counts the writers with more than intervals saturated
+// flushes in a row, 0 if intervals is not positive.
+func saturatedWriters(intervals int) int {
+	if intervals <= 0 {
+		return 0
+	}
+	saturated := 0
+	writersMutex.Lock()
+	defer writersMutex.Unlock()
+	for _, w := range writers {
+		writerLockWait.lock(&w.PGWriterMutex)
+		if w.saturatedFlushes > intervals {
+			saturated++
+		}
+		w.PGWriterMutex.Unlock()
+	}
+	return saturated
+}
+
+// Readiness evaluates the readiness of the adapter.
+func (c *Client) Readiness() Readiness {
+	return activeReadiness.evaluate()
+}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "adapter_readiness",
+			Help: "Readiness of the adapter: 0 ready, 1 degraded, 2 unavailable.",
+		},
+		func() float64 {
+			switch activeReadiness.evaluate().State {
+			case ReadinessDegraded:
+				return 1
+			case ReadinessUnavailable:
+				return 2
+			}
+			return 0
+		},
+	))
+}
@@ -0,0 +1,132 @@
+package postgresql
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+// withQueued simulates queued samples for the duration of a test, returning
+// a function restoring the queue length.
+func withQueued() (set func(n int), restore func()) {
+	saved := atomic.LoadInt64(&queuedSamples)
+	return func(n int) { atomic.StoreInt64(&queuedSamples, int64(n)) },
+		func() { atomic.StoreInt64(&queuedSamples, saved) }
+}
+
+func newTestReadiness(soft, hard, intervals int) *readinessTracker {
+	r := &readinessTracker{state: ReadinessReady}
+	r.configure(log.NewNopLogger(), &Config{ReadySoftWatermark: soft, ReadyHardWatermark: hard, SaturationIntervals: intervals})
+	return r
+}
+
+// TestReadinessTransitions lets the queue grow past both watermarks and
+// drain again. A state is only left below 80% of the watermark that caused
+// it.
+func TestReadinessTransitions(t *testing.T) {
+	setQueued, restore := withQueued()
+	defer restore()
+	r := newTestReadiness(100, 200, 0)
+	steps := []struct {
+		queued int
+		state  string
+	}{
+		{0, ReadinessReady},
+		{99, ReadinessReady},
+		{100, ReadinessDegraded},
+		{85, ReadinessDegraded},
+		{80, ReadinessDegraded},
+		{79, ReadinessReady},
+		{95, ReadinessReady},
+		{150, ReadinessDegraded},
+		{199, ReadinessDegraded},
+		{200, ReadinessUnavailable},
+		{170, ReadinessUnavailable},
+		{160, ReadinessUnavailable},
+		{159, ReadinessDegraded},
+		{90, ReadinessDegraded},
+		{79, ReadinessReady},
+		{1000, ReadinessUnavailable},
+		{0, ReadinessReady},
+	}
+	for i, step := range steps {
+		setQueued(step.queued)
+		got := r.evaluate()
+		if got.State != step.state {
+			t.Errorf("step %d: %d queued is %s, want %s", i, step.queued, got.State, step.state)
+		}
+		if got.QueuedSamples != step.queued {
+			t.Errorf("step %d: %d queued samples reported, want %d", i, got.QueuedSamples, step.queued)
+		}
+		if (got.State == ReadinessReady) != (len(got.Reasons) == 0) {
+			t.Errorf("step %d: state %s with reasons %v", i, got.State, got.Reasons)
+		}
+	}
+}
+
+func TestReadinessWithoutWatermarks(t *testing.T) {
+	setQueued, restore := withQueued()
+	defer restore()
+	r := newTestReadiness(0, 0, 0)
+	for _, queued := range []int{0, 1000, 1000000} {
+		setQueued(queued)
+		if got := r.evaluate(); got.State != ReadinessReady {
+			t.Errorf("%d queued without watermarks is %s", queued, got.State)
+		}
+	}
+}
+
+func TestReadinessShuttingDown(t *testing.T) {
+	setQueued, restore := withQueued()
+	defer restore()
+	setQueued(0)
+	r := newTestReadiness(100, 200, 0)
+	atomic.StoreInt32(&shuttingDown, 1)
+	got := r.evaluate()
+	atomic.StoreInt32(&shuttingDown, 0)
+	if got.State != ReadinessUnavailable || len(got.Reasons) != 1 || got.Reasons[0] != "shutting down" {
+		t.Errorf("shutting down is %s %v", got.State, got.Reasons)
+	}
+}
+
+func TestReadinessSaturatedWriters(t *testing.T) {
+	setQueued, restore := withQueued()
+	defer restore()
+	writersMutex.Lock()
+	saved := writers
+	writers = []*PGWriter{{saturatedFlushes: 2}, {saturatedFlushes: 4}}
+	writersMutex.Unlock()
+	defer func() {
+		writersMutex.Lock()
+		writers = saved
+		writersMutex.Unlock()
+	}()
+
+	setQueued(0)
+	if got := newTestReadiness(100, 200, 0).evaluate(); got.State != ReadinessReady {
+		t.Errorf("saturation counted without intervals: %s %v", got.State, got.Reasons)
+	}
+	r := newTestReadiness(100, 200, 3)
+	got := r.evaluate()
+	if got.State != ReadinessDegraded || len(got.Reasons) != 1 || !strings.Contains(got.Reasons[0], "1 writers saturated") {
+		t.Errorf("one saturated writer: %s %v", got.State, got.Reasons)
+	}
+	// The hard watermark wins over saturation.
+	setQueued(200)
+	if got := r.evaluate(); got.State != ReadinessUnavailable {
+		t.Errorf("saturated writer at the hard watermark is %s", got.State)
+	}
+	// Recovered from the queue, still degraded by the writer.
+	setQueued(0)
+	if got := r.evaluate(); got.State != ReadinessDegraded {
+		t.Errorf("saturated writer with an empty queue is %s", got.State)
+	}
+	writersMutex.Lock()
+	writers[1].saturatedFlushes = 0
+	writersMutex.Unlock()
+	if got := r.evaluate(); got.State != ReadinessReady {
+		t.Errorf("recovered writer is %s %v", got.State, got.Reasons)
+	}
+}
@@ -0,0 +1,86 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// readPoolMaxBackoff bounds the wait between attempts to connect the read
+// pool.
+const readPoolMaxBackoff = time.Minute
+
+// pool returns the read pool, connecting it on first use unless
+// EagerReadPool had it connected by NewClient. After a failed attempt, reads
+// fail without trying again until the backoff has passed.
+func (c *Client) pool() (*pgxpool.Pool, error) {
+	c.poolMutex.Lock()
+	defer c.poolMutex.Unlock()
+	if c.db != nil {
+		return c.db, nil
+	}
+	if now := time.Now(); now.Before(c.poolRetry) {
+		return nil, fmt.Errorf("read pool unavailable, retrying in %s: %w", c.poolRetry.Sub(now).Round(time.Second), c.poolErr)
+	}
+	db, err := newPool(c.cfg, ReadPool, nil)
+	if err != nil {
+		if c.poolBackoff *= 2; c.poolBackoff == 0 {
+			c.poolBackoff = time.Second
+		} else if c.poolBackoff > readPoolMaxBackoff {
+			c.poolBackoff = readPoolMaxBackoff
+		}
+		c.poolErr = err
+		c.poolRetry = time.Now().Add(c.poolBackoff)
+		level.Error(c.logger).Log("msg", "Connecting the read pool failed", "err", err, "retry", c.poolBackoff)
+		return nil, err
+	}
+	level.Info(c.logger).Log("msg", "Connected the read pool")
+	c.db = db
+	c.poolBackoff = 0
+	return db, nil
+}
+
+// healthPool returns the read pool if it exists, otherwise the pool of a
+// running writer, so that health checks of a write-only adapter do not
+// connect the read pool. Only when neither exists is the read pool
+// connected.
+func (c *Client) healthPool() (*pgxpool.Pool, error) {
+	c.poolMutex.Lock()
+	db := c.db
+	c.poolMutex.Unlock()
+	if db != nil {
+		return db, nil
+	}
+	writersMutex.Lock()
+	for _, w := range writers {
+		if w.DB != nil {
+			db = w.DB
+			break
+		}
+	}
+	writersMutex.Unlock()
+	if db != nil {
+		return db, nil
+	}
+	return c.pool()
+}
+
+// HealthCheck implements the healtcheck interface
+func (c *Client) HealthCheck() error {
+	db, err := c.healthPool()
+	if err != nil {
+		level.Debug(c.logger).Log("msg", "Health check error", "err", err)
+		return err
+	}
+	rows, err := db.Query(context.Background(), "SELECT 1")
+	defer rows.Close()
+	if err != nil {
+		level.Debug(c.logger).Log("msg", "Health check error", "err", err)
+		return err
+	}
+
+	return nil
+}
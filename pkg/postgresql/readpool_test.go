@@ -0,0 +1,83 @@
+package postgresql
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// withDatabaseURL sets DATABASE_URL to dsn and returns the function
+// restoring it.
+func withDatabaseURL(dsn string) func() {
+	saved, set := os.LookupEnv("DATABASE_URL")
+	os.Setenv("DATABASE_URL", dsn)
+	return func() {
+		if set {
+			os.Setenv("DATABASE_URL", saved)
+		} else {
+			os.Unsetenv("DATABASE_URL")
+		}
+	}
+}
+
+// TestReadPoolBackoff fails every connect of the read pool in the
+// PoolConfigHook, which counts the attempts: NewClient makes none, a read
+// makes one and those in its backoff make none until it has passed.
+func TestReadPoolBackoff(t *testing.T) {
+	defer withDatabaseURL("postgres://adapter@127.0.0.1:1/metrics")()
+
+	attempts := make(map[PoolKind]int)
+	refused := errors.New("refused by the test")
+	cfg := &Config{PoolConfigHook: func(kind PoolKind, _ *pgxpool.Config) error {
+		attempts[kind]++
+		return refused
+	}}
+	c := NewClient(nil, cfg)
+	if c.db != nil || attempts[ReadPool] != 0 {
+		t.Fatalf("NewClient connected the read pool in %d attempts", attempts[ReadPool])
+	}
+
+	if _, err := c.pool(); !errors.Is(err, refused) {
+		t.Fatalf("first read: error %v, want the hook's", err)
+	}
+	if attempts[ReadPool] != 1 || c.poolBackoff != time.Second {
+		t.Fatalf("first read: %d attempts, backoff %s; want 1 and 1s", attempts[ReadPool], c.poolBackoff)
+	}
+
+	// Within the backoff reads fail with the last error, without trying.
+	_, err := c.pool()
+	if !errors.Is(err, refused) || !strings.Contains(err.Error(), "read pool unavailable, retrying in") {
+		t.Errorf("read within the backoff: error %v", err)
+	}
+	if attempts[ReadPool] != 1 {
+		t.Errorf("read within the backoff made %d attempts, want 1", attempts[ReadPool])
+	}
+
+	// Once it has passed a read tries again, doubling the backoff up to
+	// readPoolMaxBackoff.
+	for i, want := range []time.Duration{2 * time.Second, 4 * time.Second} {
+		c.poolRetry = time.Now().Add(-time.Millisecond)
+		if _, err := c.pool(); !errors.Is(err, refused) {
+			t.Fatalf("retry %d: error %v, want the hook's", i+1, err)
+		}
+		if attempts[ReadPool] != i+2 || c.poolBackoff != want {
+			t.Errorf("retry %d: %d attempts, backoff %s; want %d and %s", i+1, attempts[ReadPool], c.poolBackoff, i+2, want)
+		}
+	}
+	c.poolBackoff = readPoolMaxBackoff
+	c.poolRetry = time.Now().Add(-time.Millisecond)
+	c.pool()
+	if c.poolBackoff != readPoolMaxBackoff {
+		t.Errorf("backoff %s, want at most %s", c.poolBackoff, readPoolMaxBackoff)
+	}
+	if c.db != nil {
+		t.Error("read pool set after failed connects")
+	}
+	if attempts[WriterPool] != 0 {
+		t.Errorf("%d writer pools connected", attempts[WriterPool])
+	}
+}
@@ -0,0 +1,143 @@
+package postgresql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Reasons samples of a write are rejected for.
+const (
+	RejectQueueFull       = "queue_full"
+	RejectShuttingDown    = "shutting_down"
+	RejectTenantRate      = "tenant_rate"
+	RejectSeriesLimit     = "series_limit"
+	RejectDuplicateLabels = "duplicate_labels"
+)
+
+const (
+	// rejectionExamples is the number of example series a summary keeps,
+	// however many samples were rejected.
+	rejectionExamples = 10
+	// rejectionLog is the number of recent summaries kept for the status
+	// endpoint.
+	rejectionLog = 20
+)
+
+// RejectionExample is a series with samples rejected for Reason.
+type RejectionExample struct {
+	Reason string `json:"reason"`
+	Series string `json:"series"`
+}
+
+// RejectionSummary sums up the samples of one write that were rejected: the
+// count per reason, and the first few series affected. Its size is bounded
+// whatever the size of the write. The zero value is ready to use, a nil
+// summary ignores everything added.
+type RejectionSummary struct {
+	Time     time.Time          `json:"time"`
+	Samples  map[string]int     `json:"samples"`
+	Examples []RejectionExample `json:"examples"`
+}
+
+// Add records samples of metric as rejected for reason.
+func (r *RejectionSummary) Add(reason string, metric model.Metric, samples int) {
+	if r == nil || samples <= 0 {
+		return
+	}
+	if r.Samples == nil {
+		r.Samples = make(map[string]int)
+	}
+	r.Samples[reason] += samples
+	if len(r.Examples) >= rejectionExamples {
+		return
+	}
+	example := RejectionExample{Reason: reason, Series: metricString(metric)}
+	for _, e := range r.Examples {
+		if e == example {
+			return
+		}
+	}
+	r.Examples = append(r.Examples, example)
+}
+
+// Total is the number of samples rejected.
+func (r *RejectionSummary) Total() int {
+	if r == nil {
+		return 0
+	}
+	total := 0
+	for _, n := range r.Samples {
+		total += n
+	}
+	return total
+}
+
+// String describes the summary in one line, e.g. for a response body.
+func (r *RejectionSummary) String() string {
+	reasons := make([]string, 0, len(r.Samples))
+	for reason := range r.Samples {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	counts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		counts = append(counts, fmt.Sprintf("%s=%d", reason, r.Samples[reason]))
+	}
+	examples := make([]string, 0, len(r.Examples))
+	for _, e := range r.Examples {
+		examples = append(examples, fmt.Sprintf("%s (%s)", e.Series, e.Reason))
+	}
+	return fmt.Sprintf("rejected %d samples: %s; e.g. %s", r.Total(), strings.Join(counts, ", "), strings.Join(examples, ", "))
+}
+
+// RejectionError is returned by Client.Write when samples were rejected. It
+// wraps the error the rejection is answered with, e.g. ErrThrottled, and
+// describes the rejected samples.
+type RejectionError struct {
+	Err     error
+	Summary *RejectionSummary
+}
+
+func (e *RejectionError) Error() string {
+	return e.Err.Error() + ": " + e.Summary.String()
+}
+
+func (e *RejectionError) Unwrap() error {
+	return e.Err
+}
+
+// recentRejections keeps the latest summaries for Status.
+var (
+	rejectionsMutex  sync.Mutex
+	recentRejections []RejectionSummary
+)
+
+// recordRejections counts the samples of r by reason and keeps r for
+// Status, if anything was rejected.
+func recordRejections(r *RejectionSummary) {
+	if r.Total() == 0 {
+		return
+	}
+	for reason, n := range r.Samples {
+		rejectedSamples.WithLabelValues(reason).Add(float64(n))
+	}
+	summary := *r
+	summary.Time = time.Now()
+	rejectionsMutex.Lock()
+	recentRejections = append(recentRejections, summary)
+	if len(recentRejections) > rejectionLog {
+		recentRejections = recentRejections[len(recentRejections)-rejectionLog:]
+	}
+	rejectionsMutex.Unlock()
+}
+
+func recentRejectionSummaries() []RejectionSummary {
+	rejectionsMutex.Lock()
+	defer rejectionsMutex.Unlock()
+	return append([]RejectionSummary(nil), recentRejections...)
+}
@@ -0,0 +1,220 @@
+package postgresql
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+)
+
+// tenantSamples returns n samples of distinct series of tenant.
+func tenantSamples(tenant string, n int) model.Samples {
+	samples := make(model.Samples, n)
+	for i := range samples {
+		samples[i] = &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "up", "tenant": model.LabelValue(tenant), "series": model.LabelValue(fmt.Sprint(i))},
+			Timestamp: model.TimeFromUnixNano(time.Now().UnixNano()),
+		}
+	}
+	return samples
+}
+
+func TestRejectionSummaryBounded(t *testing.T) {
+	var lengths []int
+	for _, n := range []int{100, 10000} {
+		var r RejectionSummary
+		samples := testSamples(n, time.Now())
+		for i, s := range samples {
+			reason := RejectSeriesLimit
+			if i%2 == 1 {
+				reason = RejectTenantRate
+			}
+			r.Add(reason, s.Metric, 1)
+			// The same series twice gives a single example.
+			r.Add(reason, s.Metric, 1)
+		}
+		if got := r.Total(); got != 2*n {
+			t.Errorf("%d samples: total %d, want %d", n, got, 2*n)
+		}
+		if r.Samples[RejectSeriesLimit] != n || r.Samples[RejectTenantRate] != n {
+			t.Errorf("%d samples: counts %v, want %d each", n, r.Samples, n)
+		}
+		if len(r.Examples) != rejectionExamples {
+			t.Errorf("%d samples: %d examples, want %d", n, len(r.Examples), rejectionExamples)
+		}
+		seen := make(map[RejectionExample]bool)
+		for _, e := range r.Examples {
+			if seen[e] {
+				t.Errorf("%d samples: example %v twice", n, e)
+			}
+			seen[e] = true
+		}
+		s := r.String()
+		if !strings.Contains(s, fmt.Sprintf("rejected %d samples: %s=%d, %s=%d; e.g. ", 2*n, RejectSeriesLimit, n, RejectTenantRate, n)) {
+			t.Errorf("%d samples: description %q", n, s)
+		}
+		lengths = append(lengths, len(s))
+	}
+	// A hundred times the samples only adds digits to the counts.
+	if lengths[1]-lengths[0] > 10 {
+		t.Errorf("description grows from %d to %d bytes with the batch", lengths[0], lengths[1])
+	}
+}
+
+func TestRejectionSummaryNil(t *testing.T) {
+	var r *RejectionSummary
+	r.Add(RejectQueueFull, model.Metric{model.MetricNameLabel: "up"}, 1)
+	if r.Total() != 0 {
+		t.Errorf("nil summary totals %d", r.Total())
+	}
+
+	var zero RejectionSummary
+	zero.Add(RejectQueueFull, model.Metric{model.MetricNameLabel: "up"}, 0)
+	if zero.Total() != 0 || len(zero.Examples) != 0 {
+		t.Errorf("no samples recorded as %v", zero)
+	}
+}
+
+func TestRejectionSummaryMixedBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		admit    func(model.Samples, *RejectionSummary) (model.Samples, error)
+		samples  model.Samples
+		admitted int
+		reason   string
+	}{
+		{
+			"tenant rate",
+			(&tenantLimiter{
+				label:   "tenant",
+				rates:   map[string]float64{"small": 3},
+				mode:    ThrottleDrop,
+				buckets: make(map[string]*tokenBucket),
+			}).admit,
+			append(tenantSamples("small", 8), tenantSamples("unlimited", 5)...),
+			3 + 5,
+			RejectTenantRate,
+		},
+		{
+			"series limit",
+			(&seriesBudget{
+				mode:      ThrottleDrop,
+				maxSeries: 4,
+				window:    time.Hour,
+				lru:       list.New(),
+				series:    make(map[model.Fingerprint]*list.Element),
+			}).admit,
+			testSamples(30, time.Now()),
+			4,
+			RejectSeriesLimit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RejectionSummary{}
+			admitted, err := tt.admit(tt.samples, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(admitted) != tt.admitted {
+				t.Fatalf("%d samples admitted, want %d", len(admitted), tt.admitted)
+			}
+			want := len(tt.samples) - tt.admitted
+			if r.Total() != want || r.Samples[tt.reason] != want {
+				t.Errorf("rejections %v, want %s=%d", r.Samples, tt.reason, want)
+			}
+			// Every rejected sample is of its own series.
+			wantExamples := want
+			if wantExamples > rejectionExamples {
+				wantExamples = rejectionExamples
+			}
+			if len(r.Examples) != wantExamples {
+				t.Errorf("%d examples, want %d", len(r.Examples), wantExamples)
+			}
+			kept := make(map[string]bool)
+			for _, s := range admitted {
+				kept[metricString(s.Metric)] = true
+			}
+			for _, e := range r.Examples {
+				if kept[e.Series] {
+					t.Errorf("admitted series %s given as a rejection example", e.Series)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteRejectionError(t *testing.T) {
+	// The small tenant's bucket is empty, a full one would take the write
+	// into debt.
+	c := &Client{cfg: &Config{}, limiter: &tenantLimiter{
+		label:   "tenant",
+		rates:   map[string]float64{"small": 1},
+		mode:    ThrottleReject,
+		buckets: map[string]*tokenBucket{"small": {rate: 1, burst: 1, last: time.Now()}},
+	}}
+	before := testutil.ToFloat64(rejectedSamples.WithLabelValues(RejectTenantRate))
+
+	// Samples the caller rejected already are reported with the write's own.
+	r := &RejectionSummary{}
+	r.Add(RejectDuplicateLabels, model.Metric{model.MetricNameLabel: "dup"}, 2)
+	err := c.WriteWithOptions(append(tenantSamples("small", 5), tenantSamples("other", 5)...), WriteOptions{Rejected: r})
+
+	var re *RejectionError
+	if !errors.As(err, &re) {
+		t.Fatalf("error %v is not a *RejectionError", err)
+	}
+	if !errors.Is(err, ErrThrottled) {
+		t.Errorf("error %v does not wrap ErrThrottled", err)
+	}
+	if re.Summary.Samples[RejectTenantRate] != 10 || re.Summary.Samples[RejectDuplicateLabels] != 2 {
+		t.Errorf("rejections %v, want %s=10 and %s=2", re.Summary.Samples, RejectTenantRate, RejectDuplicateLabels)
+	}
+	for _, want := range []string{ErrThrottled.Error(), "rejected 12 samples", RejectDuplicateLabels + "=2", RejectTenantRate + "=10", `dup (duplicate_labels)`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if got := testutil.ToFloat64(rejectedSamples.WithLabelValues(RejectTenantRate)) - before; got != 10 {
+		t.Errorf("%v samples counted as rejected, want 10", got)
+	}
+	recent := recentRejectionSummaries()
+	if len(recent) == 0 || recent[len(recent)-1].Total() != 12 || recent[len(recent)-1].Time.IsZero() {
+		t.Errorf("write not among the recent rejections: %v", recent)
+	}
+}
+
+func TestRecordRejectionsKeepsRecent(t *testing.T) {
+	rejectionsMutex.Lock()
+	saved := recentRejections
+	recentRejections = nil
+	rejectionsMutex.Unlock()
+	defer func() {
+		rejectionsMutex.Lock()
+		recentRejections = saved
+		rejectionsMutex.Unlock()
+	}()
+
+	recordRejections(&RejectionSummary{})
+	recordRejections(nil)
+	if got := recentRejectionSummaries(); len(got) != 0 {
+		t.Fatalf("summaries without rejections kept: %v", got)
+	}
+	for i := 1; i <= rejectionLog+5; i++ {
+		r := &RejectionSummary{}
+		r.Add(RejectQueueFull, model.Metric{model.MetricNameLabel: "up"}, i)
+		recordRejections(r)
+	}
+	got := recentRejectionSummaries()
+	if len(got) != rejectionLog {
+		t.Fatalf("%d summaries kept, want %d", len(got), rejectionLog)
+	}
+	if first, last := got[0].Total(), got[len(got)-1].Total(); first != 6 || last != rejectionLog+5 {
+		t.Errorf("kept the writes rejecting %d to %d samples, want 6 to %d", first, last, rejectionLog+5)
+	}
+}
@@ -0,0 +1,154 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// seriesProbeWindow is how far back the probe counts the series of a
+	// metric name, so that only the newest partition is read.
+	seriesProbeWindow = 5 * time.Minute
+	// seriesProbeTimeout is the statement timeout of the probe. A probe
+	// that does not finish in time leaves the query unchecked.
+	seriesProbeTimeout = 5 * time.Millisecond
+	// seriesProbeTTL is how long a probed series count is reused.
+	seriesProbeTTL = 10 * time.Minute
+)
+
+type probedSeries struct {
+	series int64
+	at     time.Time
+}
+
+// seriesProbes caches the series counts found by probes per metric name.
+type seriesProbes struct {
+	sync.Mutex
+	names map[string]probedSeries
+}
+
+// checkResolution rejects q with ErrTooManyRows if it is estimated to read
+// more than MaxQueryRows rows: the matched series times the samples a series
+// has in the queried range at ResolutionScrapeInterval. The series are
+// taken from the cardinality sampler, or counted by a probe bounded by
+// seriesProbeTimeout for an equality matched name it does not know; if
+// neither helps the query is not checked.
+func (c *Client) checkResolution(ctx context.Context, q *prompb.Query) error {
+	if c.cfg.MaxQueryRows <= 0 || c.cfg.ResolutionScrapeInterval <= 0 {
+		return nil
+	}
+	series, ok := c.estimateSeries(ctx, q.Matchers)
+	if !ok {
+		return nil
+	}
+	queried := time.Duration(q.EndTimestampMs-q.StartTimestampMs) * time.Millisecond
+	rows := series * (int64(queried/c.cfg.ResolutionScrapeInterval) + 1)
+	if rows <= c.cfg.MaxQueryRows {
+		return nil
+	}
+	return fmt.Errorf("%w: about %d rows, %d series over %s at one sample per %s, limit %d; narrow the time range or the selector, or query a downsampled metric",
+		ErrTooManyRows, rows, series, queried, c.cfg.ResolutionScrapeInterval, c.cfg.MaxQueryRows)
+}
+
+// estimateSeries estimates the series matched by the metric name matchers.
+// Label matchers are ignored, which makes it an upper bound.
+func (c *Client) estimateSeries(ctx context.Context, matchers []*prompb.LabelMatcher) (int64, bool) {
+	var nameMatchers []*prompb.LabelMatcher
+	var name string
+	for _, m := range matchers {
+		if m.Name != model.MetricNameLabel {
+			continue
+		}
+		nameMatchers = append(nameMatchers, m)
+		if m.Type == prompb.LabelMatcher_EQ {
+			name = m.Value
+		}
+	}
+
+	c.statusMutex.Lock()
+	sampled := c.cardinality
+	c.statusMutex.Unlock()
+
+	var series int64
+	found := false
+	for _, sc := range sampled {
+		if matchesName(nameMatchers, sc.Name) {
+			series += sc.Series
+			found = true
+		}
+	}
+	if found || name == "" {
+		return series, found
+	}
+	return c.probeSeries(ctx, name)
+}
+
+// matchesName reports whether name satisfies all matchers on __name__.
+func matchesName(matchers []*prompb.LabelMatcher, name string) bool {
+	for _, m := range matchers {
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			if name != m.Value {
+				return false
+			}
+		case prompb.LabelMatcher_NEQ:
+			if name == m.Value {
+				return false
+			}
+		case prompb.LabelMatcher_RE, prompb.LabelMatcher_NRE:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil || re.MatchString(name) != (m.Type == prompb.LabelMatcher_RE) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// probeSeries counts the series of name written within seriesProbeWindow.
+func (c *Client) probeSeries(ctx context.Context, name string) (int64, bool) {
+	c.probes.Lock()
+	probed, ok := c.probes.names[name]
+	c.probes.Unlock()
+	if ok && time.Since(probed.at) < seriesProbeTTL {
+		return probed.series, true
+	}
+
+	db, err := c.pool()
+	if err != nil {
+		return 0, false
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, false
+	}
+	defer tx.Rollback(ctx)
+	// A statement timeout, unlike a cancelled context, keeps the
+	// connection usable.
+	if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", seriesProbeTimeout/time.Millisecond)); err != nil {
+		return 0, false
+	}
+	col := c.cfg.columns().quoted()
+	var series int64
+	err = tx.QueryRow(ctx, fmt.Sprintf("SELECT count(DISTINCT %s) FROM metrics WHERE %s = $1 AND %s > $2", col.Labels, col.Name, col.Time),
+		name, time.Now().Add(-seriesProbeWindow).UTC()).Scan(&series)
+	if err != nil {
+		level.Debug(c.logger).Log("msg", "Series probe failed, query not checked", "name", name, "err", err)
+		return 0, false
+	}
+
+	c.probes.Lock()
+	if c.probes.names == nil {
+		c.probes.names = make(map[string]probedSeries)
+	}
+	c.probes.names[name] = probedSeries{series: series, at: time.Now()}
+	c.probes.Unlock()
+	return series, true
+}
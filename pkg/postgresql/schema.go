@@ -0,0 +1,219 @@
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// schemaStep is one idempotent statement of the schema setup.
+type schemaStep struct {
+	name string
+	sql  string
+}
+
+// schemaSteps returns the steps creating the partitioned metrics table with
+// the given columns and its indexes, and the ingest_stats table if
+// ingestStats is set. With deferIndexes the name/time index is left off the
+// parent, so that new partitions do not inherit it; maintenance builds it
+// per partition.
+func schemaSteps(columns Columns, deferIndexes bool, ingestStats bool) []schemaStep {
+	steps := tableSteps("metrics", columns, deferIndexes)
+	if ingestStats {
+		steps = append(steps, schemaStep{"ingest_stats table", ingestStatsTable}, schemaStep{"ingest_stats suppressed column", ingestStatsSuppressed})
+	}
+	return steps
+}
+
+// tableSteps returns the steps creating a partitioned metrics table named
+// table, which must be a valid identifier, and its indexes, named after it.
+func tableSteps(table string, columns Columns, deferIndexes bool) []schemaStep {
+	col := columns.quoted()
+	steps := []schemaStep{
+		{table + " table", fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ( %s timestamptz, %s TEXT NOT NULL, %s FLOAT8, %s jsonb, UNIQUE(%s, %s, %s) ) PARTITION BY RANGE (%s)",
+			table, col.Time, col.Name, col.Value, col.Labels, col.Time, col.Name, col.Labels, col.Time)},
+		{"time index", fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_time_brin_idx ON %s USING BRIN (%s)", table, table, col.Time)},
+	}
+	if !deferIndexes {
+		steps = append(steps, schemaStep{"name/time index", fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_name_time_idx on %s USING btree (%s, %s DESC)", table, table, col.Name, col.Time)})
+	}
+	return steps
+}
+
+// primarySchemaSteps are the schemaSteps for the database configured by cfg.
+func primarySchemaSteps(cfg *Config) []schemaStep {
+	steps := schemaSteps(cfg.columns(), cfg.DeferredIndexes, cfg.IngestStatsInterval > 0)
+	if cfg.CheckpointInterval > 0 {
+		steps = append(steps, schemaStep{"ingest_checkpoints table", checkpointsTable})
+	}
+	if cfg.MetricsCatalog {
+		steps = append(steps, schemaStep{"metrics_catalog table", catalogTable})
+	}
+	return steps
+}
+
+// schemaLockID is the advisory lock serializing schema setup across
+// instances, so that replicas starting together do not race on the catalog.
+func schemaLockID(cfg *Config) int64 {
+	return cfg.LeaderLockID + 2
+}
+
+// createSchema runs the steps in order in one transaction holding the
+// schema lock, logging each with its duration, and stops at the first one
+// failing. An instance waiting for the lock finds the objects created by
+// the one holding it, its IF NOT EXISTS steps do nothing.
+func createSchema(ctx context.Context, db *pgxpool.Pool, logger log.Logger, lockID int64, steps []schemaStep) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	begin := time.Now()
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", lockID); err != nil {
+		return fmt.Errorf("taking the schema lock: %w", err)
+	}
+	if waited := time.Since(begin); waited > time.Second {
+		level.Info(logger).Log("msg", "Waited for another instance setting up the schema", "duration", waited)
+	}
+	for _, step := range steps {
+		begin := time.Now()
+		if _, err := tx.Exec(ctx, step.sql); err != nil {
+			level.Error(logger).Log("msg", "Schema step failed", "step", step.name, "duration", time.Since(begin), "err", err)
+			return fmt.Errorf("schema step %s: %w", step.name, err)
+		}
+		level.Info(logger).Log("msg", "Schema step", "step", step.name, "duration", time.Since(begin))
+	}
+	return tx.Commit(ctx)
+}
+
+// warnParentIndex warns if metrics still has the name/time index although
+// index builds are deferred, new partitions would inherit it.
+func warnParentIndex(ctx context.Context, db *pgxpool.Pool, logger log.Logger) error {
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT to_regclass('metrics_name_time_idx') IS NOT NULL").Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		level.Warn(logger).Log("msg", "metrics_name_time_idx exists on metrics, new partitions still get it; drop it to defer index builds")
+	}
+	return nil
+}
+
+// existingTableQuery sums up the leaf partitions of metrics, or the table
+// itself if it is not partitioned. reltuples is -1 for tables never
+// analyzed since PostgreSQL 14.
+const existingTableQuery = `WITH RECURSIVE tree(oid) AS (
+	SELECT 'metrics'::regclass::oid
+	UNION ALL
+	SELECT i.inhrelid FROM pg_inherits i JOIN tree t ON i.inhparent = t.oid
+)
+SELECT count(*) FILTER (WHERE c.relkind = 'r' AND c.oid <> 'metrics'::regclass),
+	coalesce(sum(greatest(c.reltuples, 0)) FILTER (WHERE c.relkind = 'r'), 0)::float8
+FROM tree JOIN pg_class c ON c.oid = tree.oid`
+
+// existingTable is what the catalog knows of a metrics table found at
+// startup.
+type existingTable struct {
+	partitions int64
+	rows       float64 // estimated
+}
+
+// findExistingTable looks the metrics table up in the catalog, returning
+// nil if it does not exist.
+func findExistingTable(ctx context.Context, db *pgxpool.Pool) (*existingTable, error) {
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT to_regclass('metrics') IS NOT NULL").Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+	var t existingTable
+	if err := db.QueryRow(ctx, existingTableQuery).Scan(&t.partitions, &t.rows); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// setupPgPrometheus creates the schema unless it is in place, and reports
+// whether it attached to a metrics table that existed before. Whether it
+// did is logged in one line, so that a table created by mistake, e.g.
+// against the wrong database, stands out.
+func (c *PGWriter) setupPgPrometheus() (bool, error) {
+	ctx := context.Background()
+	existing, err := findExistingTable(ctx, c.DB)
+	if err != nil {
+		return false, fmt.Errorf("looking up the metrics table: %w", err)
+	}
+	if existing != nil {
+		schemaAttached.Set(1)
+		level.Info(c.logger).Log("msg", "Attached to existing table metrics", "rows_estimate", int64(existing.rows), "partitions", existing.partitions)
+	}
+	if c.cfg.SkipSchemaSetup {
+		level.Info(c.logger).Log("msg", "Skipping schema setup")
+		return existing != nil, nil
+	}
+	// A schema matching the configuration needs no DDL, so replicas
+	// starting after the first do not queue up for the schema lock. The
+	// verification does not cover ingest_stats, ingest_checkpoints and
+	// metrics_catalog.
+	if c.cfg.IngestStatsInterval <= 0 && c.cfg.CheckpointInterval <= 0 && !c.cfg.MetricsCatalog && verifySchema(ctx, c.DB, c.cfg) == nil {
+		level.Info(c.logger).Log("msg", "Schema in place, skipping setup")
+	} else if err := createSchema(ctx, c.DB, c.logger, schemaLockID(c.cfg), primarySchemaSteps(c.cfg)); err != nil {
+		return existing != nil, err
+	}
+	if existing == nil {
+		// Another instance may have won the schema lock and created it,
+		// this one then counts it as well.
+		schemaCreated.Inc()
+		schemaAttached.Set(0)
+		level.Info(c.logger).Log("msg", "Created new table metrics")
+	}
+	if c.cfg.DeferredIndexes {
+		return existing != nil, warnParentIndex(ctx, c.DB, c.logger)
+	}
+	return existing != nil, nil
+}
+
+// SchemaSQL returns the statements the adapter would run to set up the
+// schema under cfg, as a script with each step named in a comment: the
+// tables and indexes, and the partitions of the day of now and the next day
+// together with their create hooks.
+func SchemaSQL(cfg *Config, now time.Time) (string, error) {
+	var b strings.Builder
+	for _, step := range primarySchemaSteps(cfg) {
+		fmt.Fprintf(&b, "-- %s\n%s;\n\n", step.name, step.sql)
+	}
+	for _, day := range []time.Time{now, now.AddDate(0, 0, 1)} {
+		statements, err := partitionDDL("metrics", cfg.PartitionScheme, cfg.columns().quoted().Time, day)
+		if err != nil {
+			return "", err
+		}
+		leaves, err := partitionLeaves(cfg.PartitionScheme, day)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "-- partitions of %s\n", partitionTime(day).Format("2006-01-02"))
+		for _, statement := range statements {
+			fmt.Fprintf(&b, "%s;\n", statement)
+		}
+		b.WriteString("\n")
+		if len(cfg.PartitionCreateHookSQL) == 0 {
+			continue
+		}
+		for _, leaf := range leaves {
+			name, err := sanitizeIdentifier(leaf)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "-- create hooks of %s\n", leaf)
+			for _, hook := range cfg.PartitionCreateHookSQL {
+				fmt.Fprintf(&b, "%s;\n", strings.Replace(hook, PartitionPlaceholder, name, -1))
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,183 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// secondaryMaxBackoff bounds the wait between retries of a batch.
+const secondaryMaxBackoff = 30 * time.Second
+
+// secondaryTarget replicates batches that were copied to the primary to a
+// second database. It has its own queue, so that a slow or unavailable
+// secondary never holds up the writers.
+type secondaryTarget struct {
+	logger  log.Logger
+	cfg     *Config
+	DB      *pgxpool.Pool
+	table   pgx.Identifier
+	batches chan [][]interface{}
+	// ensured caches the partitions known to exist on the secondary. It is
+	// only used by the replicating goroutine.
+	ensured map[int]bool
+}
+
+// secondary is the dual-write target, nil unless SECONDARY_DATABASE_URL is set.
+var secondary *secondaryTarget
+
+// StartSecondary connects to the secondary target named by
+// SECONDARY_DATABASE_URL, if any, and starts replicating batches to it. It
+// must be called before the writers are started.
+func StartSecondary(l log.Logger, cfg *Config) error {
+	dsn := secondaryDatabaseURL()
+	if dsn == "" {
+		return nil
+	}
+	if _, err := sanitizeIdentifier(cfg.SecondaryTable); err != nil {
+		return err
+	}
+	db, err := connectPool(cfg, SecondaryPool, dsn, nil)
+	if err != nil {
+		return err
+	}
+	s := &secondaryTarget{
+		logger:  l,
+		cfg:     cfg,
+		DB:      db,
+		table:   pgx.Identifier{cfg.SecondaryTable},
+		batches: make(chan [][]interface{}, cfg.SecondaryQueueBatches),
+		ensured: make(map[int]bool),
+	}
+	if s.managesSchema() {
+		if err := createSchema(context.Background(), db, l, schemaLockID(cfg), schemaSteps(defaultColumns, false, false)); err != nil {
+			db.Close()
+			return redactError(err, dsn)
+		}
+	}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "adapter_secondary_pending_batches",
+			Help: "Batches copied to the primary and still waiting for the secondary.",
+		},
+		func() float64 {
+			return float64(len(s.batches))
+		},
+	))
+	level.Info(l).Log("msg", "Dual-write enabled", "secondary", redactedDSN(dsn), "table", cfg.SecondaryTable)
+	secondary = s
+	go s.run()
+	return nil
+}
+
+// managesSchema reports whether the adapter creates the secondary's table
+// and partitions.
+func (s *secondaryTarget) managesSchema() bool {
+	return s.cfg.SecondaryTable == "metrics"
+}
+
+// enqueue hands a batch to the secondary without blocking. The batch is
+// copied, as the writer reuses its buffer; the rows themselves are never
+// modified after they are built. A full queue dead-letters the batch.
+func (s *secondaryTarget) enqueue(batch [][]interface{}) {
+	if len(batch) == 0 {
+		return
+	}
+	select {
+	case s.batches <- append([][]interface{}(nil), batch...):
+	default:
+		s.deadLetter(len(batch), errors.New("secondary queue full"))
+	}
+}
+
+func (s *secondaryTarget) run() {
+	for batch := range s.batches {
+		s.replicate(batch)
+	}
+}
+
+// replicate copies one batch, retrying with backoff up to SecondaryRetries
+// times before it gives up on it.
+func (s *secondaryTarget) replicate(batch [][]interface{}) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err := s.copy(batch)
+		if err == nil {
+			targetBatches.WithLabelValues("secondary", "success").Inc()
+			targetRows.WithLabelValues("secondary").Add(float64(len(batch)))
+			return
+		}
+		targetBatches.WithLabelValues("secondary", "error").Inc()
+		if attempt >= s.cfg.SecondaryRetries {
+			s.deadLetter(len(batch), err)
+			return
+		}
+		level.Warn(s.logger).Log("msg", "COPY to secondary failed, retrying", "attempt", attempt+1, "retry", backoff, "err", err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > secondaryMaxBackoff {
+			backoff = secondaryMaxBackoff
+		}
+	}
+}
+
+func (s *secondaryTarget) copy(batch [][]interface{}) error {
+	ctx := context.Background()
+	if s.managesSchema() {
+		if err := s.ensurePartitions(ctx, batch); err != nil {
+			return err
+		}
+	}
+	count, err := s.DB.CopyFrom(ctx, s.table, []string{"time", "name", "value", "labels"}, pgx.CopyFromRows(batch))
+	if err != nil {
+		return err
+	}
+	if count != int64(len(batch)) {
+		return fmt.Errorf("copied %d of %d rows", count, len(batch))
+	}
+	return nil
+}
+
+// ensurePartitions creates the secondary's partitions for every time in the
+// batch, with the same DDL and scheme as the primary.
+func (s *secondaryTarget) ensurePartitions(ctx context.Context, batch [][]interface{}) error {
+	scheme := s.cfg.PartitionScheme
+	hours, err := partitionHours(scheme)
+	if err != nil {
+		return err
+	}
+	for _, row := range batch {
+		ts, ok := row[0].(time.Time)
+		if !ok {
+			continue
+		}
+		if s.ensured[partitionKey(scheme, ts)] {
+			continue
+		}
+		statements, err := partitionDDL("metrics", scheme, defaultColumns.quoted().Time, ts)
+		if err != nil {
+			return err
+		}
+		if _, err := s.DB.Exec(ctx, strings.Join(statements, ";\n")); err != nil {
+			return err
+		}
+		dayKey := partitionKey(PartitionDaily, partitionTime(ts))
+		for h := 0; h < 24; h += hours {
+			s.ensured[dayKey+h] = true
+		}
+	}
+	return nil
+}
+
+// deadLetter records a batch the secondary will never receive.
+func (s *secondaryTarget) deadLetter(rows int, err error) {
+	targetBatches.WithLabelValues("secondary", "dead_letter").Inc()
+	level.Error(s.logger).Log("msg", "Batch dropped for secondary", "rows", rows, "err", err)
+}
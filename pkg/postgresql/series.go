@@ -0,0 +1,188 @@
+package postgresql
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// seriesBudget caps the number of active series, those with a sample within
+// the window. Series are kept in least recently seen order, so expiring the
+// ones outside the window only looks at the back of the list. The set never
+// holds more series than the cap.
+type seriesBudget struct {
+	mutex     sync.Mutex
+	mode      string
+	maxSeries int
+	window    time.Duration
+	lru       *list.List
+	series    map[model.Fingerprint]*list.Element
+}
+
+type activeSeries struct {
+	fingerprint model.Fingerprint
+	lastSeen    time.Time
+}
+
+// activeSeriesBudget is shared by all clients, the series they write end up
+// in the same table.
+var activeSeriesBudget = &seriesBudget{
+	lru:    list.New(),
+	series: make(map[model.Fingerprint]*list.Element),
+}
+
+// configure applies the configured cap, window and mode.
+func (b *seriesBudget) configure(cfg *Config) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.mode = cfg.SeriesLimitMode
+	b.maxSeries = cfg.MaxActiveSeries
+	b.window = cfg.ActiveSeriesWindow
+}
+
+// expire forgets the series not seen within the window. The caller must hold
+// the mutex.
+func (b *seriesBudget) expire(now time.Time) {
+	for e := b.lru.Back(); e != nil && now.Sub(e.Value.(*activeSeries).lastSeen) > b.window; e = b.lru.Back() {
+		delete(b.series, e.Value.(*activeSeries).fingerprint)
+		b.lru.Remove(e)
+	}
+}
+
+// admit returns the samples of known series and of new series that fit in
+// the budget. In reject mode nothing is admitted if any new series does not
+// fit, and ErrThrottled is returned so that the sender retries later.
+func (b *seriesBudget) admit(samples model.Samples, rejected *RejectionSummary) (model.Samples, error) {
+	now := time.Now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.maxSeries <= 0 {
+		return samples, nil
+	}
+	b.expire(now)
+
+	fingerprints := make([]model.Fingerprint, len(samples))
+	for i, s := range samples {
+		fingerprints[i] = s.Metric.Fingerprint()
+	}
+
+	if b.mode == ThrottleReject {
+		fresh := make(map[model.Fingerprint]bool)
+		for _, fp := range fingerprints {
+			if _, ok := b.series[fp]; !ok {
+				fresh[fp] = true
+			}
+		}
+		if len(b.series)+len(fresh) > b.maxSeries {
+			seriesLimitedSamples.Add(float64(len(samples)))
+			// The new series first, they are the ones at fault.
+			for i, s := range samples {
+				if fresh[fingerprints[i]] {
+					rejected.Add(RejectSeriesLimit, s.Metric, 1)
+				}
+			}
+			for i, s := range samples {
+				if !fresh[fingerprints[i]] {
+					rejected.Add(RejectSeriesLimit, s.Metric, 1)
+				}
+			}
+			return nil, ErrThrottled
+		}
+		for _, fp := range fingerprints {
+			b.touch(fp, now)
+		}
+		return samples, nil
+	}
+
+	admitted := samples[:0:0]
+	for i, s := range samples {
+		if !b.touch(fingerprints[i], now) {
+			seriesLimitedSamples.Inc()
+			rejected.Add(RejectSeriesLimit, s.Metric, 1)
+			continue
+		}
+		admitted = append(admitted, s)
+	}
+	return admitted, nil
+}
+
+// touch marks a series as seen, adding it if it fits in the budget. It
+// reports whether the series is active. The caller must hold the mutex.
+func (b *seriesBudget) touch(fp model.Fingerprint, now time.Time) bool {
+	if e, ok := b.series[fp]; ok {
+		e.Value.(*activeSeries).lastSeen = now
+		b.lru.MoveToFront(e)
+		return true
+	}
+	if len(b.series) >= b.maxSeries {
+		return false
+	}
+	b.series[fp] = b.lru.PushFront(&activeSeries{fingerprint: fp, lastSeen: now})
+	return true
+}
+
+// limits returns the cap and the window.
+func (b *seriesBudget) limits() (int, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.maxSeries, b.window
+}
+
+func (b *seriesBudget) active() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.expire(time.Now())
+	return len(b.series)
+}
+
+// SeriesLimit returns the active series cap, 0 for none, and the window a
+// series stays active for after its last sample.
+func (c *Client) SeriesLimit() (int, time.Duration) {
+	return activeSeriesBudget.limits()
+}
+
+// SetSeriesLimit changes the active series cap and window until the adapter
+// restarts. Lowering the cap below the number of active series forgets none
+// of them, new series are refused until enough have expired.
+func (c *Client) SetSeriesLimit(maxSeries int, window time.Duration) error {
+	if maxSeries < 0 {
+		return fmt.Errorf("max series %d is negative", maxSeries)
+	}
+	if window < time.Minute {
+		return fmt.Errorf("series window %s is shorter than a minute", window)
+	}
+	b := activeSeriesBudget
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.maxSeries = maxSeries
+	b.window = window
+	if maxSeries == 0 {
+		b.lru.Init()
+		b.series = make(map[model.Fingerprint]*list.Element)
+	}
+	return nil
+}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "adapter_active_series",
+			Help: "Number of series with a sample within the active series window, tracked while a cap is set.",
+		},
+		func() float64 { return float64(activeSeriesBudget.active()) },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "adapter_active_series_limit",
+			Help: "Maximum number of active series, 0 for no limit.",
+		},
+		func() float64 {
+			maxSeries, _ := activeSeriesBudget.limits()
+			return float64(maxSeries)
+		},
+	))
+}
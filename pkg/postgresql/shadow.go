@@ -0,0 +1,166 @@
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// shadowConcurrency bounds the comparisons running at once; reads
+	// sampled while all slots are busy are skipped.
+	shadowConcurrency = 2
+	// shadowMismatchLog is the number of recent mismatches kept for the
+	// status endpoint.
+	shadowMismatchLog = 20
+)
+
+// ShadowMismatch describes a read whose result differed on the secondary.
+type ShadowMismatch struct {
+	Time    time.Time `json:"time"`
+	Queries []string  `json:"queries"`
+	Reason  string    `json:"reason"`
+}
+
+// shadowReader repeats a sample of the remote reads against the secondary
+// target in the background and compares the results with the primary's.
+type shadowReader struct {
+	logger log.Logger
+	cfg    *Config
+	DB     *pgxpool.Pool
+	slots  chan struct{}
+
+	mutex      sync.Mutex
+	mismatches []ShadowMismatch
+}
+
+func newShadowReader(l log.Logger, cfg *Config) (*shadowReader, error) {
+	if secondaryDatabaseURL() == "" {
+		return nil, errors.New("shadow reads need SECONDARY_DATABASE_URL")
+	}
+	if _, err := sanitizeIdentifier(cfg.SecondaryTable); err != nil {
+		return nil, err
+	}
+	db, err := connectPool(cfg, SecondaryPool, secondaryDatabaseURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	level.Info(l).Log("msg", "Shadow reads enabled", "rate", cfg.ShadowReadRate, "values", cfg.ShadowReadValues)
+	return &shadowReader{
+		logger: l,
+		cfg:    cfg,
+		DB:     db,
+		slots:  make(chan struct{}, shadowConcurrency),
+	}, nil
+}
+
+// compare starts comparing the primary's result for req with the
+// secondary's, if the read is sampled and a slot is free. The primary result
+// is only read, never modified.
+func (s *shadowReader) compare(req *prompb.ReadRequest, primary map[string]*prompb.TimeSeries) {
+	if rand.Float64() >= s.cfg.ShadowReadRate {
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		shadowReads.WithLabelValues("skipped").Inc()
+		return
+	}
+	go func() {
+		defer func() { <-s.slots }()
+		s.run(req, primary)
+	}()
+}
+
+func (s *shadowReader) run(req *prompb.ReadRequest, primary map[string]*prompb.TimeSeries) {
+	secondary := map[string]*prompb.TimeSeries{}
+	for _, q := range req.Queries {
+		command, args, err := buildTableQuery(s.cfg.SecondaryTable, defaultColumns, q, s.cfg.ReadOrder, nil)
+		if err == nil {
+			err = readSeries(context.Background(), s.DB, command, args, secondary)
+		}
+		if err != nil {
+			shadowReads.WithLabelValues("error").Inc()
+			level.Warn(s.logger).Log("msg", "Shadow read failed", "err", err)
+			return
+		}
+	}
+
+	if s.cfg.ReadOrder == ReadOrderNone {
+		sortSeries(secondary)
+	}
+
+	reason := s.diff(primary, secondary)
+	if reason == "" {
+		shadowReads.WithLabelValues("match").Inc()
+		return
+	}
+	shadowReads.WithLabelValues("mismatch").Inc()
+
+	queries := make([]string, 0, len(req.Queries))
+	for _, q := range req.Queries {
+		queries = append(queries, fmt.Sprintf("%s [%d, %d]", matchersString(q.Matchers), q.StartTimestampMs, q.EndTimestampMs))
+	}
+	level.Warn(s.logger).Log("msg", "Shadow read mismatch", "queries", strings.Join(queries, " "), "reason", reason)
+
+	s.mutex.Lock()
+	s.mismatches = append(s.mismatches, ShadowMismatch{Time: time.Now(), Queries: queries, Reason: reason})
+	if len(s.mismatches) > shadowMismatchLog {
+		s.mismatches = s.mismatches[len(s.mismatches)-shadowMismatchLog:]
+	}
+	s.mutex.Unlock()
+}
+
+// diff describes the first difference between two results, or returns ""
+// when they agree.
+func (s *shadowReader) diff(primary map[string]*prompb.TimeSeries, secondary map[string]*prompb.TimeSeries) string {
+	if len(primary) != len(secondary) {
+		return fmt.Sprintf("series count %d != %d", len(primary), len(secondary))
+	}
+	for key, p := range primary {
+		other, ok := secondary[key]
+		if !ok {
+			return fmt.Sprintf("series %s missing on secondary", key)
+		}
+		if len(p.Samples) != len(other.Samples) {
+			return fmt.Sprintf("series %s sample count %d != %d", key, len(p.Samples), len(other.Samples))
+		}
+		if !s.cfg.ShadowReadValues {
+			continue
+		}
+		for i, sample := range p.Samples {
+			o := other.Samples[i]
+			if sample.Timestamp != o.Timestamp {
+				return fmt.Sprintf("series %s sample %d timestamp %d != %d", key, i, sample.Timestamp, o.Timestamp)
+			}
+			if !valuesEqual(sample.Value, o.Value, s.cfg.ShadowReadTolerance) {
+				return fmt.Sprintf("series %s at %d value %g != %g", key, sample.Timestamp, sample.Value, o.Value)
+			}
+		}
+	}
+	return ""
+}
+
+func valuesEqual(a float64, b float64, tolerance float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return a == b || math.Abs(a-b) <= tolerance
+}
+
+func (s *shadowReader) recentMismatches() []ShadowMismatch {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]ShadowMismatch(nil), s.mismatches...)
+}
@@ -0,0 +1,91 @@
+package postgresql
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// PartitionSize describes a leaf partition of metrics. Rows is the planner
+// estimate from the last ANALYZE, not an exact count.
+type PartitionSize struct {
+	Name  string `json:"name"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Bytes int64  `json:"bytes"`
+	Rows  int64  `json:"rows"`
+}
+
+// partitionSizesQuery only reads the catalog and relation sizes, it never
+// scans a partition. Partition names sort by their start, newest first.
+const partitionSizesQuery = `SELECT t.relid::regclass::text,
+	coalesce(substring(pg_get_expr(c.relpartbound, c.oid) from 'FROM \(''([^'']+)''\)'), ''),
+	coalesce(substring(pg_get_expr(c.relpartbound, c.oid) from 'TO \(''([^'']+)''\)'), ''),
+	pg_total_relation_size(t.relid),
+	greatest(c.reltuples, 0)::bigint
+FROM pg_partition_tree('metrics') t
+JOIN pg_class c ON c.oid = t.relid
+WHERE t.isleaf
+ORDER BY 1 DESC`
+
+// runPartitionSizeCollector periodically records the size of every partition
+// until the client is closed.
+func (c *Client) runPartitionSizeCollector() {
+	ticker := time.NewTicker(c.cfg.PartitionSizeInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.collectPartitionSizes(context.Background()); err != nil {
+			level.Error(c.logger).Log("msg", "Collecting partition sizes failed", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) collectPartitionSizes(ctx context.Context) error {
+	db, err := c.pool()
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query(ctx, partitionSizesQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var sizes []PartitionSize
+	for rows.Next() {
+		var ps PartitionSize
+		if err := rows.Scan(&ps.Name, &ps.From, &ps.To, &ps.Bytes, &ps.Rows); err != nil {
+			return err
+		}
+		sizes = append(sizes, ps)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Only the newest partitions are exported so that the number of series
+	// does not grow with retention; the status endpoint lists all of them.
+	partitionBytes.Reset()
+	partitionRows.Reset()
+	for i, ps := range sizes {
+		if i >= c.cfg.PartitionSizeRecent {
+			break
+		}
+		partitionBytes.WithLabelValues(ps.Name).Set(float64(ps.Bytes))
+		partitionRows.WithLabelValues(ps.Name).Set(float64(ps.Rows))
+	}
+
+	c.statusMutex.Lock()
+	c.partitions = sizes
+	c.statusMutex.Unlock()
+
+	level.Debug(c.logger).Log("msg", "Collected partition sizes", "partitions", len(sizes))
+	return nil
+}
@@ -0,0 +1,50 @@
+package postgresql
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// oldestRowAge returns how long the oldest row not yet flushed, buffered or
+// being copied, has been with the writer, or 0 if there is none. The caller
+// must hold PGWriterMutex.
+func (c *PGWriter) oldestRowAge(now time.Time) time.Duration {
+	oldest := c.flushingSince
+	if oldest.IsZero() || (!c.bufferedSince.IsZero() && c.bufferedSince.Before(oldest)) {
+		oldest = c.bufferedSince
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return now.Sub(oldest)
+}
+
+// oldestRowCollector exports the age of each writer's oldest unflushed row,
+// computed at scrape time so that it keeps growing while a writer is stuck.
+type oldestRowCollector struct {
+	age *prometheus.Desc
+}
+
+func (oc *oldestRowCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- oc.age
+}
+
+func (oc *oldestRowCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	writersMutex.Lock()
+	defer writersMutex.Unlock()
+	for _, w := range writers {
+		w.PGWriterMutex.Lock()
+		age := w.oldestRowAge(now)
+		w.PGWriterMutex.Unlock()
+		ch <- prometheus.MustNewConstMetric(oc.age, prometheus.GaugeValue, age.Seconds(), strconv.Itoa(w.id))
+	}
+}
+
+func init() {
+	prometheus.MustRegister(&oldestRowCollector{
+		age: prometheus.NewDesc("adapter_writer_oldest_row_age_seconds", "Age of the oldest row buffered or being copied by the writer, 0 if there is none.", []string{"writer"}, nil),
+	})
+}
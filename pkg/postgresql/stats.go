@@ -0,0 +1,154 @@
+package postgresql
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stats are the counters of the write path, for programs embedding the
+// package that do not use the Prometheus client. The adapter_samples_* and
+// adapter_writer_* metrics are read from the same counters.
+type Stats struct {
+	// Received counts the samples given to Client.Write, Outcomes the ones
+	// that reached each outcome, see OutcomeCommitted and the others.
+	Received int64
+	Outcomes map[string]int64
+	// Written are the samples committed, Dropped those discarded on
+	// purpose: dropped, evicted, downsampled or deduplicated.
+	Written int64
+	Dropped int64
+	// Queued counts the live samples waiting for a parser, BackfillQueued
+	// the backfill ones, InFlight all samples received that have not reached
+	// an outcome yet.
+	Queued         int
+	BackfillQueued int
+	InFlight       int64
+	Writers        []WriterStats
+}
+
+// WriterStats are the counters of one writer.
+type WriterStats struct {
+	ID          int
+	PendingRows int
+	// LastFlush is the duration of the latest flush.
+	LastFlush   time.Duration
+	Flushes     int64
+	RowsFlushed int64
+	// FlushErrors counts the flushes that failed to copy some rows.
+	FlushErrors int64
+}
+
+// FlushStats describe one flush of a writer.
+type FlushStats struct {
+	Writer int
+	// Rows were taken from the writer's buffer, Committed of them copied.
+	Rows      int64
+	Committed int64
+	Duration  time.Duration
+	// Err is the error of the COPY, nil if it succeeded.
+	Err error
+}
+
+// StatsListener is told about every flush, on the writer's goroutine right
+// after the flush, so it must return quickly.
+type StatsListener interface {
+	Flushed(FlushStats)
+}
+
+// Stats returns the current write path counters.
+func (c *Client) Stats() Stats {
+	return collectStats()
+}
+
+func collectStats() Stats {
+	status := books.status()
+	stats := Stats{
+		Received:       status.Received,
+		Outcomes:       status.Outcomes,
+		Written:        status.Outcomes[OutcomeCommitted],
+		Queued:         QueueLength(),
+		BackfillQueued: BackfillQueueLength(),
+		InFlight:       status.InFlight,
+	}
+	for _, outcome := range []string{OutcomeDropped, OutcomeEvicted, OutcomeDownsampled, OutcomeSuppressed, OutcomeDeduplicated} {
+		stats.Dropped += status.Outcomes[outcome]
+	}
+
+	writersMutex.Lock()
+	defer writersMutex.Unlock()
+	for _, w := range writers {
+		w.PGWriterMutex.Lock()
+		stats.Writers = append(stats.Writers, WriterStats{
+			ID:          w.id,
+			PendingRows: len(w.valueRows),
+			LastFlush:   w.lastFlushDuration,
+			Flushes:     w.flushes,
+			RowsFlushed: w.flushedRows,
+			FlushErrors: w.flushErrors,
+		})
+		w.PGWriterMutex.Unlock()
+	}
+	return stats
+}
+
+// writerCollector exports the writer counters of Stats at scrape time.
+type writerCollector struct {
+	flushes   *prometheus.Desc
+	rows      *prometheus.Desc
+	errors    *prometheus.Desc
+	pending   *prometheus.Desc
+	lastFlush *prometheus.Desc
+	queued    *prometheus.Desc
+	backfill  *prometheus.Desc
+}
+
+func newWriterCollector() *writerCollector {
+	labels := []string{"writer"}
+	return &writerCollector{
+		flushes:   prometheus.NewDesc("adapter_writer_flushes_total", "Total number of flushes per writer.", labels, nil),
+		rows:      prometheus.NewDesc("adapter_writer_flushed_rows_total", "Total number of rows committed by the flushes of a writer.", labels, nil),
+		errors:    prometheus.NewDesc("adapter_writer_flush_errors_total", "Total number of flushes per writer that failed to copy some rows.", labels, nil),
+		pending:   prometheus.NewDesc("adapter_writer_pending_rows", "Rows buffered by a writer and not flushed yet.", labels, nil),
+		lastFlush: prometheus.NewDesc("adapter_writer_last_flush_seconds", "Duration of the latest flush of a writer.", labels, nil),
+		queued:    prometheus.NewDesc("adapter_queue_samples", "Samples waiting for a parser.", nil, nil),
+		backfill:  prometheus.NewDesc("adapter_backfill_queue_samples", "Backfill samples waiting for a parser.", nil, nil),
+	}
+}
+
+func (wc *writerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- wc.flushes
+	ch <- wc.rows
+	ch <- wc.errors
+	ch <- wc.pending
+	ch <- wc.lastFlush
+	ch <- wc.queued
+	ch <- wc.backfill
+}
+
+func (wc *writerCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := collectStats()
+	for _, w := range stats.Writers {
+		writer := strconv.Itoa(w.ID)
+		ch <- prometheus.MustNewConstMetric(wc.flushes, prometheus.CounterValue, float64(w.Flushes), writer)
+		ch <- prometheus.MustNewConstMetric(wc.rows, prometheus.CounterValue, float64(w.RowsFlushed), writer)
+		ch <- prometheus.MustNewConstMetric(wc.errors, prometheus.CounterValue, float64(w.FlushErrors), writer)
+		ch <- prometheus.MustNewConstMetric(wc.pending, prometheus.GaugeValue, float64(w.PendingRows), writer)
+		ch <- prometheus.MustNewConstMetric(wc.lastFlush, prometheus.GaugeValue, w.LastFlush.Seconds(), writer)
+	}
+	ch <- prometheus.MustNewConstMetric(wc.queued, prometheus.GaugeValue, float64(stats.Queued))
+	ch <- prometheus.MustNewConstMetric(wc.backfill, prometheus.GaugeValue, float64(stats.BackfillQueued))
+}
+
+func init() {
+	prometheus.MustRegister(newWriterCollector())
+}
+
+// notifyFlush passes a flush on to the configured StatsListener.
+func (c *PGWriter) notifyFlush(rows int64, committed int64, duration time.Duration, err error) {
+	if c.cfg.StatsListener == nil {
+		return
+	}
+	c.cfg.StatsListener.Flushed(FlushStats{Writer: c.id, Rows: rows, Committed: committed, Duration: duration, Err: err})
+}
@@ -0,0 +1,103 @@
+package postgresql
+
+import "time"
+
+// Status is a point-in-time snapshot of the adapter internals, served on the
+// status endpoint.
+type Status struct {
+	// Health is "ok", or "degraded" while a writer cannot keep up.
+	Health string `json:"health"`
+	// Leader is true while this instance holds the leader lock.
+	Leader      bool                `json:"leader"`
+	Cardinality []SeriesCardinality `json:"cardinality"`
+	Writers     []WriterStatus      `json:"writers"`
+	Partitions  []PartitionSize     `json:"partitions"`
+	// Samples accounts for every sample received by outcome.
+	Samples BooksStatus `json:"samples"`
+	// SlowQueries are the most recent explained slow reads.
+	SlowQueries []SlowQuery `json:"slow_queries,omitempty"`
+	// ShadowMismatches are the most recent reads that returned a different
+	// result on the secondary.
+	ShadowMismatches []ShadowMismatch `json:"shadow_mismatches,omitempty"`
+	// RecentRejections are the most recent writes with rejected samples.
+	RecentRejections []RejectionSummary `json:"recent_rejections,omitempty"`
+	// LockWaits is the time spent waiting for the writer and queue locks.
+	LockWaits map[string]LockWaitStatus `json:"lock_waits"`
+}
+
+// WriterStatus describes the row buffers of a writer.
+type WriterStatus struct {
+	ID             int `json:"id"`
+	PendingRows    int `json:"pending_rows"`
+	BufferCapacity int `json:"buffer_capacity"`
+	SpareCapacity  int `json:"spare_capacity"`
+
+	// CommitRows and CommitSecs are the commit thresholds in effect.
+	CommitRows int `json:"commit_rows"`
+	CommitSecs int `json:"commit_secs"`
+
+	LastFlushSeconds float64 `json:"last_flush_seconds"`
+	SaturatedFlushes int     `json:"saturated_flushes"`
+	// Flushes and RowsFlushed count the flushes of the writer and the rows
+	// they committed, so that an uneven spread over the writers shows.
+	Flushes     int64 `json:"flushes"`
+	RowsFlushed int64 `json:"rows_flushed"`
+	// OldestRowSeconds is the age of the oldest row not flushed yet.
+	OldestRowSeconds float64 `json:"oldest_row_seconds"`
+
+	Parsers []ParserStatus `json:"parsers"`
+}
+
+// Status returns the current status snapshot.
+func (c *Client) Status() Status {
+	c.statusMutex.Lock()
+	status := Status{
+		Health:      "ok",
+		Leader:      IsLeader(),
+		Cardinality: c.cardinality,
+		Partitions:  c.partitions,
+		SlowQueries: append([]SlowQuery(nil), c.slowQueries...),
+		LockWaits: map[string]LockWaitStatus{
+			"writer": writerLockWait.status(),
+			"queue":  queueLockWait.status(),
+		},
+	}
+	c.statusMutex.Unlock()
+	status.Samples = books.status()
+	status.RecentRejections = recentRejectionSummaries()
+	if c.shadow != nil {
+		status.ShadowMismatches = c.shadow.recentMismatches()
+	}
+
+	writersMutex.Lock()
+	defer writersMutex.Unlock()
+	for _, w := range writers {
+		w.PGWriterMutex.Lock()
+		parsers := make([]ParserStatus, 0, len(w.parsers))
+		for id, p := range w.parsers {
+			parsers = append(parsers, p.status(id))
+		}
+		status.Writers = append(status.Writers, WriterStatus{
+			ID:             w.id,
+			PendingRows:    len(w.valueRows),
+			BufferCapacity: cap(w.valueRows),
+			SpareCapacity:  cap(w.spareRows),
+
+			CommitRows: w.CommitRows(),
+			CommitSecs: w.CommitSecs(),
+
+			LastFlushSeconds: w.lastFlushDuration.Seconds(),
+			SaturatedFlushes: w.saturatedFlushes,
+			Flushes:          w.flushes,
+			RowsFlushed:      w.flushedRows,
+			OldestRowSeconds: w.oldestRowAge(time.Now()).Seconds(),
+
+			Parsers: parsers,
+		})
+		if c.cfg.SaturationIntervals > 0 && w.saturatedFlushes > c.cfg.SaturationIntervals {
+			status.Health = "degraded"
+		}
+		w.PGWriterMutex.Unlock()
+	}
+	return status
+}
@@ -0,0 +1,153 @@
+package postgresql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Tenant throttle modes.
+const (
+	ThrottleDrop   = "drop"
+	ThrottleReject = "reject"
+)
+
+// otherTenants is the bucket, and the tenant of the throttling metrics,
+// shared by the tenants without a rate of their own once maxTenants buckets
+// exist.
+const otherTenants = "__other__"
+
+// tokenBucket allows rate samples per second with bursts of up to burst
+// samples. A full bucket admits even a request larger than burst and is
+// left in debt, so that no request is too large to ever get through.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allows reports whether n samples may be taken from the bucket.
+func (b *tokenBucket) allows(n int) bool {
+	return b.rate <= 0 || b.tokens >= float64(n) || b.tokens >= b.burst
+}
+
+// tenantLimiter keeps one token bucket per value of the tenant label, up to
+// maxTenants of them.
+type tenantLimiter struct {
+	label      model.LabelName
+	rate       float64
+	rates      map[string]float64
+	burst      float64
+	maxTenants int
+	mode       string
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newTenantLimiter returns nil when no tenant label is configured.
+func newTenantLimiter(cfg *Config) *tenantLimiter {
+	if cfg.TenantLabel == "" {
+		return nil
+	}
+	return &tenantLimiter{
+		label:      model.LabelName(cfg.TenantLabel),
+		rate:       cfg.TenantRate,
+		rates:      cfg.TenantRates,
+		burst:      cfg.TenantBurst,
+		maxTenants: cfg.MaxTenants,
+		mode:       cfg.TenantThrottleMode,
+		buckets:    make(map[string]*tokenBucket),
+	}
+}
+
+// bucket returns the refilled bucket of tenant and the tenant it is counted
+// as, which is otherTenants for those folded into the shared bucket.
+func (l *tenantLimiter) bucket(tenant string, now time.Time) (*tokenBucket, string) {
+	b, ok := l.buckets[tenant]
+	if !ok {
+		rate, own := l.rates[tenant]
+		if !own {
+			rate = l.rate
+			if l.maxTenants > 0 && len(l.buckets) >= l.maxTenants {
+				tenant = otherTenants
+				b, ok = l.buckets[tenant]
+			}
+		}
+		if !ok {
+			burst := l.burst
+			if burst < rate {
+				burst = rate
+			}
+			b = &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+			l.buckets[tenant] = b
+		}
+	}
+	b.refill(now)
+	return b, tenant
+}
+
+// admit returns the samples that fit in their tenant's budget. In reject
+// mode nothing is admitted once any tenant is over budget and ErrThrottled
+// is returned so that the sender retries the whole request later.
+func (l *tenantLimiter) admit(samples model.Samples, rejected *RejectionSummary) (model.Samples, error) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.mode == ThrottleReject {
+		counts := make(map[string]int)
+		buckets := make(map[string]*tokenBucket)
+		for _, s := range samples {
+			b, tenant := l.bucket(string(s.Metric[l.label]), now)
+			counts[tenant]++
+			buckets[tenant] = b
+		}
+		for tenant, n := range counts {
+			if buckets[tenant].allows(n) {
+				continue
+			}
+			// Every tenant's samples are refused with the request.
+			for tenant, n := range counts {
+				tenantThrottledSamples.WithLabelValues(tenant).Add(float64(n))
+			}
+			for _, s := range samples {
+				rejected.Add(RejectTenantRate, s.Metric, 1)
+			}
+			return nil, ErrThrottled
+		}
+		for tenant, n := range counts {
+			if b := buckets[tenant]; b.rate > 0 {
+				b.tokens -= float64(n)
+			}
+			tenantAcceptedSamples.WithLabelValues(tenant).Add(float64(n))
+		}
+		return samples, nil
+	}
+
+	admitted := make(model.Samples, 0, len(samples))
+	for _, s := range samples {
+		b, tenant := l.bucket(string(s.Metric[l.label]), now)
+		if !b.allows(1) {
+			tenantThrottledSamples.WithLabelValues(tenant).Inc()
+			rejected.Add(RejectTenantRate, s.Metric, 1)
+			continue
+		}
+		if b.rate > 0 {
+			b.tokens--
+		}
+		tenantAcceptedSamples.WithLabelValues(tenant).Inc()
+		admitted = append(admitted, s)
+	}
+	return admitted, nil
+}
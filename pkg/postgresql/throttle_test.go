@@ -0,0 +1,121 @@
+package postgresql
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTenantRejectBurst(t *testing.T) {
+	tests := []struct {
+		name     string
+		burst    float64
+		requests []int
+		admitted []bool
+	}{
+		// A bucket holds one second of the rate without a burst.
+		{"within rate", 0, []int{40, 60, 1}, []bool{true, true, false}},
+		{"burst", 500, []int{400, 100, 1}, []bool{true, true, false}},
+		// A request larger than the bucket is admitted into a full one,
+		// which pays for it before admitting more.
+		{"larger than burst", 0, []int{1000, 1, 1000}, []bool{true, false, false}},
+		{"larger after a smaller one", 0, []int{50, 1000}, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &tenantLimiter{
+				label:   "tenant",
+				rate:    100,
+				burst:   tt.burst,
+				mode:    ThrottleReject,
+				buckets: make(map[string]*tokenBucket),
+			}
+			for i, n := range tt.requests {
+				_, err := l.admit(tenantSamples("burst", n), &RejectionSummary{})
+				if admitted := err == nil; admitted != tt.admitted[i] {
+					t.Errorf("request %d of %d samples admitted %v, want %v", i, n, admitted, tt.admitted[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTenantDebtPaidOff(t *testing.T) {
+	l := &tenantLimiter{label: "tenant", rate: 100, mode: ThrottleReject, buckets: make(map[string]*tokenBucket)}
+	if _, err := l.admit(tenantSamples("debt", 300), &RejectionSummary{}); err != nil {
+		t.Fatalf("request into a full bucket: %v", err)
+	}
+	b := l.buckets["debt"]
+	// The request leaves 200 samples of debt, paid off after two seconds
+	// of the rate and refilled after a third.
+	b.last = b.last.Add(-time.Second)
+	if _, err := l.admit(tenantSamples("debt", 300), &RejectionSummary{}); err == nil {
+		t.Error("request admitted into a bucket in debt")
+	}
+	b.last = b.last.Add(-2 * time.Second)
+	if _, err := l.admit(tenantSamples("debt", 300), &RejectionSummary{}); err != nil {
+		t.Errorf("request into a refilled bucket: %v", err)
+	}
+}
+
+func TestTenantRejectCountsOwnSamples(t *testing.T) {
+	l := &tenantLimiter{
+		label:   "tenant",
+		rates:   map[string]float64{"count-over": 1},
+		mode:    ThrottleReject,
+		buckets: map[string]*tokenBucket{"count-over": {rate: 1, burst: 1, last: time.Now()}},
+	}
+	over := testutil.ToFloat64(tenantThrottledSamples.WithLabelValues("count-over"))
+	within := testutil.ToFloat64(tenantThrottledSamples.WithLabelValues("count-within"))
+	r := &RejectionSummary{}
+	if _, err := l.admit(append(tenantSamples("count-over", 3), tenantSamples("count-within", 7)...), r); err != ErrThrottled {
+		t.Fatalf("error %v, want %v", err, ErrThrottled)
+	}
+	if got := testutil.ToFloat64(tenantThrottledSamples.WithLabelValues("count-over")) - over; got != 3 {
+		t.Errorf("%v samples of the tenant over its rate counted as throttled, want 3", got)
+	}
+	if got := testutil.ToFloat64(tenantThrottledSamples.WithLabelValues("count-within")) - within; got != 7 {
+		t.Errorf("%v samples of the tenant within its rate counted as throttled, want 7", got)
+	}
+	if r.Samples[RejectTenantRate] != 10 {
+		t.Errorf("rejections %v, want %s=10", r.Samples, RejectTenantRate)
+	}
+}
+
+func TestTenantLimiterBounded(t *testing.T) {
+	l := &tenantLimiter{
+		label:      "tenant",
+		rate:       5,
+		rates:      map[string]float64{"cap-override": 1000},
+		maxTenants: 3,
+		mode:       ThrottleDrop,
+		buckets:    make(map[string]*tokenBucket),
+	}
+	other := testutil.ToFloat64(tenantAcceptedSamples.WithLabelValues(otherTenants))
+	for i := 0; i < 100; i++ {
+		if _, err := l.admit(tenantSamples(fmt.Sprintf("cap-%d", i), 1), &RejectionSummary{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admitted, err := l.admit(tenantSamples("cap-override", 50), &RejectionSummary{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(admitted) != 50 {
+		t.Errorf("%d samples of the tenant with an override admitted, want 50", len(admitted))
+	}
+	if len(l.buckets) != 3+1+1 {
+		t.Errorf("%d buckets, want the first 3 tenants, the shared one and the override", len(l.buckets))
+	}
+	for _, tenant := range []string{"cap-0", "cap-2", otherTenants, "cap-override"} {
+		if l.buckets[tenant] == nil {
+			t.Errorf("no bucket for %s", tenant)
+		}
+	}
+	// The 97 later tenants share the default rate of 5.
+	if got := testutil.ToFloat64(tenantAcceptedSamples.WithLabelValues(otherTenants)) - other; got != 5 {
+		t.Errorf("%v samples of later tenants accepted, want 5", got)
+	}
+}
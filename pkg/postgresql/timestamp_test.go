@@ -0,0 +1,202 @@
+package postgresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// edgeMilliseconds are timestamps around the epoch, the limits of
+// UnixNano and of int64.
+var edgeMilliseconds = []int64{
+	0, 1, -1, 999, -999, 1000, -1000, 1001, -1001,
+	// time.Unix(0, math.MinInt64) and time.Unix(0, math.MaxInt64), the
+	// range UnixNano can represent.
+	math.MinInt64 / int64(time.Millisecond), math.MaxInt64 / int64(time.Millisecond),
+	math.MinInt64/int64(time.Millisecond) - 1, math.MaxInt64/int64(time.Millisecond) + 1,
+	math.MinInt64, math.MaxInt64,
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	roundTrip := func(ms int64) bool {
+		return fromTimestamp(toTimestamp(ms)) == ms
+	}
+	for _, ms := range edgeMilliseconds {
+		if !roundTrip(ms) {
+			t.Errorf("%d read back as %d", ms, fromTimestamp(toTimestamp(ms)))
+		}
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 100000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestToTimestamp(t *testing.T) {
+	// toTimestamp agrees with the conversion of the Prometheus client
+	// wherever UnixNano does not overflow, and is always in UTC.
+	agrees := func(ms int64) bool {
+		ms %= math.MaxInt64 / int64(time.Millisecond)
+		ts := toTimestamp(ms)
+		return ts.Equal(model.Time(ms).Time()) && ts.Location() == time.UTC
+	}
+	for _, ms := range edgeMilliseconds[:9] {
+		if !agrees(ms) {
+			t.Errorf("toTimestamp(%d) = %s, want %s", ms, toTimestamp(ms), model.Time(ms).Time().UTC())
+		}
+	}
+	if err := quick.Check(agrees, &quick.Config{MaxCount: 100000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestFromTimestampFloors checks that sub-millisecond parts are floored, also
+// before the epoch, where truncating division would round up.
+func TestFromTimestampFloors(t *testing.T) {
+	floors := func(sec int64, nsec uint32) bool {
+		sec %= 1 << 40
+		ts := time.Unix(sec, int64(nsec%uint32(time.Second)))
+		ms := fromTimestamp(ts)
+		floor := toTimestamp(ms)
+		return !floor.After(ts) && ts.Before(floor.Add(time.Millisecond))
+	}
+	if err := quick.Check(floors, &quick.Config{MaxCount: 100000}); err != nil {
+		t.Error(err)
+	}
+	tests := []struct {
+		ts   time.Time
+		want int64
+	}{
+		{time.Unix(0, 1), 0},
+		{time.Unix(0, -1), -1},
+		{time.Unix(-1, 999999999), -1},
+		{time.Unix(-1, 0), -1000},
+		{time.Unix(0, -1000001), -2},
+	}
+	for _, tt := range tests {
+		if got := fromTimestamp(tt.ts); got != tt.want {
+			t.Errorf("fromTimestamp(%s) = %d, want %d", tt.ts.UTC().Format(time.RFC3339Nano), got, tt.want)
+		}
+	}
+}
+
+// TestSampleTimestampRoundTrip checks that the timestamp a sample is sent
+// with is the one read back from the time stored by a parser.
+func TestSampleTimestampRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var samples model.Samples
+	for _, ms := range edgeMilliseconds[:9] {
+		samples = append(samples, &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up"}, Timestamp: model.Time(ms)})
+	}
+	for i := 0; i < 10000; i++ {
+		// Plus or minus about 300 years around the epoch.
+		ms := rnd.Int63n(2e13) - 1e13
+		samples = append(samples, &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up"}, Timestamp: model.Time(ms)})
+	}
+	var p PGParser
+	p.parseBatch(&Config{}, PartitionHourly, samples, func(time.Time) bool { return true })
+	if len(p.valueRows) != len(samples) {
+		t.Fatalf("%d rows for %d samples", len(p.valueRows), len(samples))
+	}
+	for i, row := range p.valueRows {
+		sent := int64(samples[i].Timestamp)
+		if read := fromTimestamp(row[0].(time.Time)); read != sent {
+			t.Errorf("sample sent at %d read back at %d", sent, read)
+		}
+	}
+}
+
+func TestRoundMilliseconds(t *testing.T) {
+	tests := []struct {
+		ms, step, want int64
+	}{
+		{0, 1000, 0},
+		{1000, 1000, 1000},
+		{1499, 1000, 1000},
+		// Halves round up, before the epoch too.
+		{1500, 1000, 2000},
+		{-500, 1000, 0},
+		{-501, 1000, -1000},
+		{-1500, 1000, -1000},
+		{-1000, 1000, -1000},
+		{7499, 15000, 0},
+		{7500, 15000, 15000},
+		{1583020807499, 15000, 1583020800000},
+		{1583020807500, 15000, 1583020815000},
+		// Odd steps have no half.
+		{1, 3, 0},
+		{2, 3, 3},
+		{-2, 3, -3},
+		// Steps below 2ms keep the time.
+		{1499, 1, 1499},
+		{1499, 0, 1499},
+		{-1499, -1000, -1499},
+	}
+	for _, tt := range tests {
+		if got := roundMilliseconds(tt.ms, tt.step); got != tt.want {
+			t.Errorf("roundMilliseconds(%d, %d) = %d, want %d", tt.ms, tt.step, got, tt.want)
+		}
+	}
+}
+
+// TestRoundedRowsDeduplicated parses samples that rounding makes collide
+// and checks that dedupRows keeps only the last sample of a series at each
+// rounded time.
+func TestRoundedRowsDeduplicated(t *testing.T) {
+	sample := func(instance string, ms int64, value float64) *model.Sample {
+		return &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "up", "instance": model.LabelValue(instance)},
+			Timestamp: model.Time(ms),
+			Value:     model.SampleValue(value),
+		}
+	}
+	samples := model.Samples{
+		sample("a", 999, 1),
+		sample("a", 1200, 2),
+		sample("b", 1200, 3),
+		sample("a", 1499, 4),
+		sample("a", 1500, 5),
+		sample("b", 2400, 6),
+		sample("a", -500, 7),
+		sample("a", 499, 8),
+	}
+	tests := []struct {
+		name     string
+		rounding time.Duration
+		// want are the rows kept, as instance@milliseconds=value.
+		want []string
+	}{
+		{"not rounded", 0, []string{"a@999=1", "a@1200=2", "b@1200=3", "a@1499=4", "a@1500=5", "b@2400=6", "a@-500=7", "a@499=8"}},
+		{"1s", time.Second, []string{"a@1000=4", "b@1000=3", "a@2000=5", "b@2000=6", "a@0=8"}},
+		{"15s", 15 * time.Second, []string{"a@0=8", "b@0=6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p PGParser
+			p.parseBatch(&Config{TimestampRounding: tt.rounding}, PartitionHourly, samples, func(time.Time) bool { return true })
+			var got []string
+			for _, row := range dedupRows(p.valueRows) {
+				raw, ok := row[3].([]byte)
+				if !ok {
+					var err error
+					if raw, err = json.Marshal(row[3]); err != nil {
+						t.Fatal(err)
+					}
+				}
+				var labels map[string]string
+				if err := json.Unmarshal(raw, &labels); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, fmt.Sprintf("%s@%d=%v", labels["instance"], fromTimestamp(row[0].(time.Time)), row[2]))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("rows %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package postgresql
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// sydney is Australia/Sydney, or its standard offset where the zone
+// database is missing. UTC+10 and +11 are where a local day starts before
+// the UTC one.
+func sydney() *time.Location {
+	if loc, err := time.LoadLocation("Australia/Sydney"); err == nil {
+		return loc
+	}
+	return time.FixedZone("AEST", 10*60*60)
+}
+
+// withLocal runs f with loc as the host's time zone, as TZ would set it.
+func withLocal(loc *time.Location, f func()) {
+	saved := time.Local
+	time.Local = loc
+	defer func() { time.Local = saved }()
+	f()
+}
+
+// zoneMilliseconds are sample times around UTC and Sydney midnights and
+// the Sydney daylight saving changes of 2020.
+var zoneMilliseconds = func() []int64 {
+	var ms []int64
+	for _, ts := range []time.Time{
+		time.Date(2020, 1, 15, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 1, 15, 13, 0, 0, 0, time.UTC),
+		time.Date(2020, 4, 4, 15, 59, 59, 999000000, time.UTC),
+		time.Date(2020, 4, 4, 16, 0, 0, 0, time.UTC),
+		time.Date(2020, 10, 3, 15, 30, 0, 0, time.UTC),
+		time.Date(2020, 10, 3, 16, 30, 0, 0, time.UTC),
+		time.Date(2020, 12, 31, 23, 59, 59, 999000000, time.UTC),
+	} {
+		for _, d := range []time.Duration{-time.Hour, -time.Millisecond, 0, time.Millisecond, time.Hour} {
+			ms = append(ms, fromTimestamp(ts.Add(d)))
+		}
+	}
+	return ms
+}()
+
+// timeBoundaries describes everything the write path derives from the
+// sample times in zoneMilliseconds: the partitions rows land in, the DDL
+// and leaves of their days, and the days a batch of them spans. Each time
+// is given as toTimestamp returns it, in the host's zone and in Sydney.
+func timeBoundaries(t *testing.T) []string {
+	var boundaries []string
+	var rows [][]interface{}
+	for _, ms := range zoneMilliseconds {
+		utc := toTimestamp(ms)
+		for _, ts := range []time.Time{utc, time.Unix(0, ms*int64(time.Millisecond)), utc.In(sydney())} {
+			for _, scheme := range []string{PartitionDaily, PartitionHourly, "6h"} {
+				ddl, err := partitionDDL("metrics", scheme, `"time"`, ts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				leaves, err := partitionLeaves(scheme, ts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				boundaries = append(boundaries, fmt.Sprintf("%d %s: key %d, leaves %v, DDL %v", ms, scheme, partitionKey(scheme, ts), leaves, ddl))
+			}
+			rows = append(rows, []interface{}{ts})
+		}
+	}
+	for _, day := range partitionDays(rows) {
+		boundaries = append(boundaries, "day "+day.Format(time.RFC3339))
+	}
+	return boundaries
+}
+
+// parsedBoundaries returns the times of the rows the parser makes of the
+// samples in zoneMilliseconds and the partitions it ensures.
+func parsedBoundaries(t *testing.T) []string {
+	samples := make(model.Samples, len(zoneMilliseconds))
+	for i, ms := range zoneMilliseconds {
+		samples[i] = &model.Sample{Metric: model.Metric{model.MetricNameLabel: "up"}, Timestamp: model.Time(ms)}
+	}
+	var boundaries []string
+	var p PGParser
+	p.parseBatch(&Config{}, PartitionHourly, samples, func(ts time.Time) bool {
+		boundaries = append(boundaries, "ensure "+ts.Format(time.RFC3339Nano))
+		return true
+	})
+	for _, row := range p.valueRows {
+		ts := row[0].(time.Time)
+		if ts.Location() != time.UTC {
+			t.Errorf("row at %s is not in UTC", ts)
+		}
+		boundaries = append(boundaries, "row "+ts.Format(time.RFC3339Nano))
+	}
+	return boundaries
+}
+
+// TestTimeHandlingIgnoresLocalZone fails if anything on the write path
+// depends on the host's time zone: everything derived from sample times
+// must be the same on a host in Sydney as on one in UTC.
+func TestTimeHandlingIgnoresLocalZone(t *testing.T) {
+	for name, boundaries := range map[string]func(*testing.T) []string{
+		"partitions": timeBoundaries,
+		"parser":     parsedBoundaries,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var utc, local []string
+			withLocal(time.UTC, func() { utc = boundaries(t) })
+			withLocal(sydney(), func() { local = boundaries(t) })
+			if len(utc) != len(local) {
+				t.Fatalf("%d boundaries in UTC, %d in Sydney", len(utc), len(local))
+			}
+			for i := range utc {
+				if utc[i] != local[i] {
+					t.Errorf("in UTC:    %s\nin Sydney: %s", utc[i], local[i])
+				}
+			}
+		})
+	}
+}
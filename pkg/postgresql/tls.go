@@ -0,0 +1,148 @@
+package postgresql
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// Minimum sslmodes RequireTLS can demand.
+const (
+	SSLModeVerifyCA   = "verify-ca"
+	SSLModeVerifyFull = "verify-full"
+)
+
+// sslModes orders the protection of the sslmodes pgx can end up with.
+var sslModes = map[string]int{
+	"disable":         0,
+	"require":         1,
+	SSLModeVerifyCA:   2,
+	SSLModeVerifyFull: 3,
+}
+
+// tlsSSLMode infers the sslmode a connection with tlsConfig gets. pgx turns
+// the sslmode into the TLS configuration: none for disable, skipped
+// verification for require, skipped verification with its own check of the
+// chain for verify-ca, and full verification for verify-full.
+func tlsSSLMode(tlsConfig *tls.Config) string {
+	switch {
+	case tlsConfig == nil:
+		return "disable"
+	case !tlsConfig.InsecureSkipVerify:
+		return SSLModeVerifyFull
+	case tlsConfig.VerifyPeerCertificate != nil:
+		return SSLModeVerifyCA
+	default:
+		return "require"
+	}
+}
+
+// poolSSLMode is the weakest sslmode any connection of poolConfig may get.
+// The fallbacks count: sslmode=prefer falls back to a connection without
+// TLS.
+func poolSSLMode(poolConfig *pgxpool.Config) string {
+	weakest := tlsSSLMode(poolConfig.ConnConfig.TLSConfig)
+	for _, fallback := range poolConfig.ConnConfig.Fallbacks {
+		if mode := tlsSSLMode(fallback.TLSConfig); sslModes[mode] < sslModes[weakest] {
+			weakest = mode
+		}
+	}
+	return weakest
+}
+
+// checkTLS returns an error if RequireTLS is set and poolConfig allows
+// connections protected less than MinSSLMode.
+func (cfg *Config) checkTLS(kind PoolKind, poolConfig *pgxpool.Config) error {
+	if !cfg.RequireTLS {
+		return nil
+	}
+	if mode := poolSSLMode(poolConfig); sslModes[mode] < sslModes[cfg.MinSSLMode] {
+		return fmt.Errorf("%s pool allows connections with sslmode=%s, but TLS with at least sslmode=%s is required", kind, mode, cfg.MinSSLMode)
+	}
+	return nil
+}
+
+// checkTLSDSN checks the pools of kind connecting to dsn at startup, before any of
+// them is connected. A PoolConfigHook may set up TLS itself, pools are then
+// only checked in connectPool.
+func (cfg *Config) checkTLSDSN(kind PoolKind, dsn string) error {
+	if !cfg.RequireTLS || cfg.PoolConfigHook != nil {
+		return nil
+	}
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return redactError(err, dsn)
+	}
+	return redactError(cfg.checkTLS(kind, poolConfig), dsn)
+}
+
+// tlsAudit logs the TLS state of the first connection of every pool kind,
+// as evidence of what was negotiated.
+type tlsAudit struct {
+	mutex  sync.Mutex
+	logger log.Logger
+	logged map[PoolKind]bool
+}
+
+// activeTLSAudit is shared by all clients, like the pools it logs.
+var activeTLSAudit = &tlsAudit{logger: log.NewNopLogger(), logged: make(map[PoolKind]bool)}
+
+func (a *tlsAudit) configure(logger log.Logger) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.logger = logger
+}
+
+// wrap has the first connection of poolConfig logged before the
+// AfterConnect already set runs.
+func (a *tlsAudit) wrap(kind PoolKind, poolConfig *pgxpool.Config) {
+	afterConnect := poolConfig.AfterConnect
+	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		a.log(kind, conn)
+		if afterConnect != nil {
+			return afterConnect(ctx, conn)
+		}
+		return nil
+	}
+}
+
+func (a *tlsAudit) log(kind PoolKind, conn *pgx.Conn) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.logged[kind] {
+		return
+	}
+	a.logged[kind] = true
+	tlsConn, ok := conn.PgConn().Conn().(*tls.Conn)
+	if !ok {
+		level.Info(a.logger).Log("msg", "Connected without TLS", "pool", kind, "host", conn.Config().Host)
+		return
+	}
+	state := tlsConn.ConnectionState()
+	commonName := ""
+	if len(state.PeerCertificates) > 0 {
+		commonName = state.PeerCertificates[0].Subject.CommonName
+	}
+	level.Info(a.logger).Log("msg", "Connected with TLS", "pool", kind, "host", conn.Config().Host,
+		"version", tlsVersionName(state.Version), "cipher", tls.CipherSuiteName(state.CipherSuite), "server_cn", commonName)
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("%#04x", version)
+}
@@ -0,0 +1,226 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	// tombstoneTTL is how long reads use the tombstones loaded last, so a
+	// tombstone written by another instance hides its series after at most
+	// this long.
+	tombstoneTTL = 10 * time.Second
+	// tombstoneInterval is how often the leader deletes the rows of
+	// tombstoned series.
+	tombstoneInterval = time.Minute
+)
+
+const tombstonesTable = `CREATE TABLE IF NOT EXISTS tombstones (
+	id BIGSERIAL PRIMARY KEY,
+	matchers jsonb NOT NULL,
+	start_time timestamptz NOT NULL,
+	end_time timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+)`
+
+const tombstonesQuery = `SELECT id, matchers, start_time, end_time FROM tombstones ORDER BY id`
+
+// tombstoneMatcher is a matcher as stored in the tombstones table.
+type tombstoneMatcher struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// tombstone hides the samples of the series matching matchers between
+// startMs and endMs from reads until its rows are deleted.
+type tombstone struct {
+	id             int64
+	matchers       []*prompb.LabelMatcher
+	startMs, endMs int64
+}
+
+// tombstoneCache holds the tombstones a client's reads apply.
+type tombstoneCache struct {
+	mutex      sync.Mutex
+	loaded     time.Time
+	tombstones []tombstone
+}
+
+func encodeTombstoneMatchers(matchers []*prompb.LabelMatcher) ([]byte, error) {
+	stored := make([]tombstoneMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		stored = append(stored, tombstoneMatcher{Name: m.Name, Type: m.Type.String(), Value: m.Value})
+	}
+	return json.Marshal(stored)
+}
+
+func decodeTombstoneMatchers(raw []byte) ([]*prompb.LabelMatcher, error) {
+	var stored []tombstoneMatcher
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		return nil, err
+	}
+	matchers := make([]*prompb.LabelMatcher, 0, len(stored))
+	for _, m := range stored {
+		t, ok := prompb.LabelMatcher_Type_value[m.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown matcher type %q", m.Type)
+		}
+		matchers = append(matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_Type(t), Name: m.Name, Value: m.Value})
+	}
+	return matchers, nil
+}
+
+// loadTombstones reads all tombstones from db, none if the table was never
+// created.
+func loadTombstones(ctx context.Context, db *pgxpool.Pool) ([]tombstone, error) {
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT to_regclass('tombstones') IS NOT NULL").Scan(&exists); err != nil || !exists {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, tombstonesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tombstones []tombstone
+	for rows.Next() {
+		var (
+			t          tombstone
+			raw        []byte
+			start, end time.Time
+		)
+		if err := rows.Scan(&t.id, &raw, &start, &end); err != nil {
+			return nil, err
+		}
+		if t.matchers, err = decodeTombstoneMatchers(raw); err != nil {
+			return nil, fmt.Errorf("tombstone %d: %w", t.id, err)
+		}
+		t.startMs, t.endMs = fromTimestamp(start), fromTimestamp(end)
+		tombstones = append(tombstones, t)
+	}
+	return tombstones, rows.Err()
+}
+
+// activeTombstones returns the tombstones reads apply, loaded at most
+// tombstoneTTL ago. A failed load fails the read rather than show
+// tombstoned samples.
+func (c *Client) activeTombstones(ctx context.Context) ([]tombstone, error) {
+	c.tombstones.mutex.Lock()
+	defer c.tombstones.mutex.Unlock()
+	if time.Since(c.tombstones.loaded) < tombstoneTTL {
+		return c.tombstones.tombstones, nil
+	}
+	db, err := c.pool()
+	if err != nil {
+		return nil, err
+	}
+	tombstones, err := loadTombstones(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("loading tombstones: %w", err)
+	}
+	c.tombstones.tombstones, c.tombstones.loaded = tombstones, time.Now()
+	return tombstones, nil
+}
+
+// tombstoneWhere returns the predicate excluding the rows of the tombstones
+// overlapping startMs to endMs, adding its parameters to args, or "" if
+// there are none. A tombstone predicate that is NULL for a row, e.g. as a
+// label is missing, does not match it.
+func tombstoneWhere(columns Columns, tombstones []tombstone, startMs int64, endMs int64, args *sqlArgs) (string, error) {
+	var predicates []string
+	for _, t := range tombstones {
+		if t.endMs < startMs || t.startMs > endMs {
+			continue
+		}
+		where, err := buildWhere(columns, t.matchers, t.startMs, t.endMs, args)
+		if err != nil {
+			return "", fmt.Errorf("tombstone %d: %w", t.id, err)
+		}
+		predicates = append(predicates, fmt.Sprintf("NOT COALESCE((%s), false)", where))
+	}
+	return strings.Join(predicates, " AND "), nil
+}
+
+// TombstoneSeries hides all samples matching the given matchers between
+// start and end from reads at once, and leaves deleting them to the leader,
+// which removes the tombstone when it is done. It returns the tombstone's
+// id. The same safety check as for DeleteSeries applies.
+func (c *Client) TombstoneSeries(ctx context.Context, matchers []*prompb.LabelMatcher, start time.Time, end time.Time, force bool) (int64, error) {
+	if !force && !hasEqualityMatcher(matchers) {
+		return 0, ErrUnsafeDelete
+	}
+	// Rejects what reads could not apply, e.g. invalid regular expressions.
+	if _, err := buildWhere(c.cfg.columns(), matchers, fromTimestamp(start), fromTimestamp(end), &sqlArgs{}); err != nil {
+		return 0, err
+	}
+	raw, err := encodeTombstoneMatchers(matchers)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := c.pool()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(ctx, tombstonesTable); err != nil {
+		return 0, fmt.Errorf("creating tombstones: %w", err)
+	}
+	var id int64
+	if err := db.QueryRow(ctx, "INSERT INTO tombstones (matchers, start_time, end_time) VALUES ($1, $2, $3) RETURNING id", raw, start, end).Scan(&id); err != nil {
+		return 0, err
+	}
+	// This instance's reads take it into account right away.
+	c.tombstones.mutex.Lock()
+	c.tombstones.loaded = time.Time{}
+	c.tombstones.mutex.Unlock()
+
+	level.Info(c.logger).Log("msg", "Tombstoned series", "id", id, "matchers", matchersString(matchers), "start", start, "end", end, "force", force)
+	return id, nil
+}
+
+// runTombstones deletes the rows of tombstoned series while this instance
+// is the leader, oldest tombstone first, and removes each tombstone once its
+// rows are gone.
+func (c *PGWriter) runTombstones() {
+	for c.KeepRunning {
+		if IsLeader() {
+			c.processTombstones(context.Background())
+		}
+		for wait := time.Duration(0); wait < tombstoneInterval && c.KeepRunning; wait += time.Second {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func (c *PGWriter) processTombstones(ctx context.Context) {
+	tombstones, err := loadTombstones(ctx, c.DB)
+	if err != nil {
+		level.Error(c.logger).Log("msg", "Loading tombstones failed", "err", err)
+		return
+	}
+	for _, t := range tombstones {
+		if !c.KeepRunning {
+			return
+		}
+		begin := time.Now()
+		deleted, err := deleteMatching(ctx, c.DB, c.logger, c.cfg.columns(), t.matchers, toTimestamp(t.startMs), toTimestamp(t.endMs))
+		if err != nil {
+			level.Error(c.logger).Log("msg", "Deleting tombstoned series failed, retrying on the next pass", "id", t.id, "deleted", deleted, "err", err)
+			continue
+		}
+		if _, err := c.DB.Exec(ctx, "DELETE FROM tombstones WHERE id = $1", t.id); err != nil {
+			level.Error(c.logger).Log("msg", "Removing tombstone failed", "id", t.id, "err", err)
+			continue
+		}
+		level.Info(c.logger).Log("msg", "Deleted tombstoned series", "id", t.id, "matchers", matchersString(t.matchers), "rows", deleted, "duration", time.Since(begin))
+	}
+}
@@ -0,0 +1,78 @@
+package postgresql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestTombstoneMatchersRoundTrip(t *testing.T) {
+	matchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "http.server.duration"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: `it's "quoted"`},
+		{Type: prompb.LabelMatcher_RE, Name: "path", Value: `/api/(v1|v2)/.+\?`},
+		{Type: prompb.LabelMatcher_NRE, Name: "k8s.pod", Value: "température-µ"},
+		{Type: prompb.LabelMatcher_EQ, Name: "empty", Value: ""},
+	}
+	raw, err := encodeTombstoneMatchers(matchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeTombstoneMatchers(raw)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", raw, err)
+	}
+	if !reflect.DeepEqual(decoded, matchers) {
+		t.Errorf("%s decoded as %v, want %v", raw, decoded, matchers)
+	}
+}
+
+func TestDecodeTombstoneMatchersInvalid(t *testing.T) {
+	for _, raw := range []string{
+		`[{"name": "job", "type": "LIKE", "value": "api"}]`,
+		`{"name": "job"}`,
+		`not json`,
+	} {
+		if matchers, err := decodeTombstoneMatchers([]byte(raw)); err == nil {
+			t.Errorf("%s decoded as %v", raw, matchers)
+		}
+	}
+}
+
+func TestTombstoneWhereOverlap(t *testing.T) {
+	matchers := []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}
+	tombstones := []tombstone{
+		{id: 1, matchers: matchers, startMs: 0, endMs: 999},
+		{id: 2, matchers: matchers, startMs: 500, endMs: 1000},
+		{id: 3, matchers: matchers, startMs: 1500, endMs: 1600},
+		{id: 4, matchers: matchers, startMs: 2000, endMs: 5000},
+		{id: 5, matchers: matchers, startMs: 2001, endMs: 3000},
+		{id: 6, matchers: matchers, startMs: 0, endMs: 9000},
+	}
+	var args sqlArgs
+	where, err := tombstoneWhere(defaultColumns, tombstones, 1000, 2000, &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tombstones 2, 3, 4 and 6 overlap, each with its name and range.
+	if n := strings.Count(where, "NOT COALESCE("); n != 4 {
+		t.Errorf("%d tombstones applied, want 4: %s", n, where)
+	}
+	if len(args) != 4*3 {
+		t.Errorf("%d args, want %d", len(args), 4*3)
+	}
+	for i, want := range []int64{500, 1000, 1500, 1600, 2000, 5000, 0, 9000} {
+		// Every tombstone adds its name, then its start and end.
+		if got := fromTimestamp(args[i/2*3+1+i%2].(time.Time)); got != want {
+			t.Errorf("range bound %d is %d, want %d", i, got, want)
+		}
+	}
+
+	args = nil
+	if where, err := tombstoneWhere(defaultColumns, tombstones[:1], 1000, 2000, &args); where != "" || err != nil || len(args) != 0 {
+		t.Errorf("tombstone before the range applied: %q, %v, %d args", where, err, len(args))
+	}
+}
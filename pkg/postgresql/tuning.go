@@ -0,0 +1,97 @@
+package postgresql
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Ranges accepted for the commit thresholds at runtime.
+const (
+	maxCommitRows = 10000000
+	maxCommitSecs = 3600
+)
+
+// CommitThresholds are the commit thresholds of the writers. Zero fields are
+// left unchanged by SetCommitThresholds.
+type CommitThresholds struct {
+	CommitRows int `json:"commit_rows"`
+	CommitSecs int `json:"commit_secs"`
+}
+
+func checkCommitRows(rows int) error {
+	if rows < 1 || rows > maxCommitRows {
+		return fmt.Errorf("commit rows %d out of range 1-%d", rows, maxCommitRows)
+	}
+	return nil
+}
+
+func checkCommitSecs(secs int) error {
+	if secs < 1 || secs > maxCommitSecs {
+		return fmt.Errorf("commit seconds %d out of range 1-%d", secs, maxCommitSecs)
+	}
+	return nil
+}
+
+// CommitRows returns the number of buffered rows above which the writer
+// flushes.
+func (c *PGWriter) CommitRows() int {
+	return int(atomic.LoadInt64(&c.commitRows))
+}
+
+// CommitSecs returns the longest time in seconds rows stay buffered before
+// the writer flushes.
+func (c *PGWriter) CommitSecs() int {
+	return int(atomic.LoadInt64(&c.commitSecs))
+}
+
+// SetCommitRows changes CommitRows until the adapter restarts.
+func (c *PGWriter) SetCommitRows(rows int) error {
+	if err := checkCommitRows(rows); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.commitRows, int64(rows))
+	c.notify()
+	return nil
+}
+
+// SetCommitSecs changes CommitSecs until the adapter restarts; a flush
+// period already running then ends at its start plus the new value.
+func (c *PGWriter) SetCommitSecs(secs int) error {
+	if err := checkCommitSecs(secs); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.commitSecs, int64(secs))
+	c.notify()
+	return nil
+}
+
+// SetCommitThresholds changes the commit thresholds of every running writer
+// until the adapter restarts, and returns the ones in effect before. Nothing
+// is changed unless all values are in range.
+func (c *Client) SetCommitThresholds(t CommitThresholds) (CommitThresholds, error) {
+	writersMutex.Lock()
+	defer writersMutex.Unlock()
+	var previous CommitThresholds
+	if len(writers) > 0 {
+		previous = CommitThresholds{CommitRows: writers[0].CommitRows(), CommitSecs: writers[0].CommitSecs()}
+	}
+	if t.CommitRows != 0 {
+		if err := checkCommitRows(t.CommitRows); err != nil {
+			return previous, err
+		}
+	}
+	if t.CommitSecs != 0 {
+		if err := checkCommitSecs(t.CommitSecs); err != nil {
+			return previous, err
+		}
+	}
+	for _, w := range writers {
+		if t.CommitRows != 0 {
+			w.SetCommitRows(t.CommitRows)
+		}
+		if t.CommitSecs != 0 {
+			w.SetCommitSecs(t.CommitSecs)
+		}
+	}
+	return previous, nil
+}
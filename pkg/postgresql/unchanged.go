@@ -0,0 +1,60 @@
+package postgresql
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// unchangedFilter remembers, for up to size series, the last sample stored,
+// and suppresses samples repeating its value until maxGap has passed, so
+// that a series still gets a row every maxGap. A sample of a series that is
+// not remembered is always stored, so eviction only lets an extra sample
+// through. NaN values, staleness markers included, never equal the last one
+// and are always stored.
+type unchangedFilter struct {
+	maxGap int64 // milliseconds
+
+	mutex sync.Mutex
+	last  *seriesLRU
+}
+
+func newUnchangedFilter(cfg *Config) *unchangedFilter {
+	if cfg.SuppressUnchangedMaxGap <= 0 {
+		return nil
+	}
+	return &unchangedFilter{
+		maxGap: int64(cfg.SuppressUnchangedMaxGap / time.Millisecond),
+		last:   newSeriesLRU(cfg.SuppressUnchangedSeries),
+	}
+}
+
+// keep reports whether a sample of metric at timestamp ms with value is
+// stored, and remembers it if so.
+func (f *unchangedFilter) keep(metric model.Metric, ms int64, value float64) bool {
+	fingerprint := metric.Fingerprint()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	last := f.last.get(fingerprint)
+	if last == nil {
+		f.last.add(fingerprint, ms, value)
+		return true
+	}
+	if ms < last.timestamp {
+		// Out of order, stored without moving the heartbeat.
+		return true
+	}
+	if value == last.value && ms-last.timestamp < f.maxGap {
+		return false
+	}
+	last.timestamp, last.value = ms, value
+	return true
+}
+
+// The filter is shared by the parsers of all writers, like the
+// downsampler.
+var (
+	unchangedOnce   sync.Once
+	activeUnchanged *unchangedFilter
+)
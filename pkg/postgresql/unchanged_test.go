@@ -0,0 +1,98 @@
+package postgresql
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/value"
+)
+
+// unchangedSample is a sample passed to an unchangedFilter and whether it
+// must be stored.
+type unchangedSample struct {
+	ms    int64
+	value float64
+	kept  bool
+}
+
+func TestUnchangedFilter(t *testing.T) {
+	stale := math.Float64frombits(value.StaleNaN)
+	tests := []struct {
+		name    string
+		samples []unchangedSample
+	}{
+		{"first sample and repeats", []unchangedSample{{0, 1, true}, {15000, 1, false}, {30000, 1, false}, {59999, 1, false}}},
+		{"changed value", []unchangedSample{{0, 1, true}, {15000, 2, true}, {30000, 2, false}, {45000, 1, true}}},
+		// A repeated value is stored again once maxGap has passed since the
+		// last stored sample, as a heartbeat, and the gap restarts there.
+		{"heartbeat", []unchangedSample{{0, 1, true}, {30000, 1, false}, {60000, 1, true}, {90000, 1, false}, {119999, 1, false}, {120000, 1, true}}},
+		{"staleness marker", []unchangedSample{{0, 1, true}, {15000, stale, true}, {30000, stale, true}, {45000, 1, true}}},
+		{"NaN", []unchangedSample{{0, math.NaN(), true}, {15000, math.NaN(), true}}},
+		{"out of order", []unchangedSample{{30000, 1, true}, {15000, 1, true}, {45000, 1, false}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newUnchangedFilter(&Config{SuppressUnchangedMaxGap: time.Minute, SuppressUnchangedSeries: 10})
+			metric := testMetric("up", "a")
+			for i, s := range tt.samples {
+				if kept := f.keep(metric, s.ms, s.value); kept != s.kept {
+					t.Errorf("sample %d at %dms with %v kept %v, want %v", i, s.ms, s.value, kept, s.kept)
+				}
+			}
+		})
+	}
+}
+
+// TestUnchangedParseCounts parses repeated values and checks what the
+// parser stores and counts as suppressed for ingest_stats.
+func TestUnchangedParseCounts(t *testing.T) {
+	saved := activeUnchanged
+	activeUnchanged = newUnchangedFilter(&Config{SuppressUnchangedMaxGap: time.Minute, SuppressUnchangedSeries: 10})
+	defer func() { activeUnchanged = saved }()
+	ingestMutex.Lock()
+	savedCounts := ingestCounts
+	ingestCounts = make(map[string]*ingestCount)
+	ingestMutex.Unlock()
+	defer func() {
+		ingestMutex.Lock()
+		ingestCounts = savedCounts
+		ingestMutex.Unlock()
+	}()
+
+	// Two minutes of a constant series every 15s: the first sample and the
+	// heartbeats at one and two minutes are stored.
+	start := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	var samples model.Samples
+	for i := 0; i <= 8; i++ {
+		samples = append(samples, &model.Sample{
+			Metric:    model.Metric{model.MetricNameLabel: "constant", "job": "a"},
+			Value:     1,
+			Timestamp: model.TimeFromUnixNano(start.Add(time.Duration(i) * 15 * time.Second).UnixNano()),
+		})
+	}
+	samples = append(samples, &model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "changing", "job": "a"},
+		Value:     2,
+		Timestamp: model.TimeFromUnixNano(start.UnixNano()),
+	})
+
+	p := &PGParser{ingest: make(map[string]*ingestCount)}
+	_, _, suppressed := p.parseBatch(&Config{}, PartitionDaily, samples, func(time.Time) bool { return true })
+	if suppressed != 6 {
+		t.Errorf("%d samples suppressed, want 6", suppressed)
+	}
+	if len(p.valueRows) != 4 {
+		t.Errorf("%d rows stored, want 4", len(p.valueRows))
+	}
+	p.mergeIngest()
+	ingestMutex.Lock()
+	defer ingestMutex.Unlock()
+	if n := ingestCounts["constant"]; n == nil || n.samples != 3 || n.suppressed != 6 {
+		t.Errorf("ingest stats of constant %+v, want 3 samples and 6 suppressed", n)
+	}
+	if n := ingestCounts["changing"]; n == nil || n.samples != 1 || n.suppressed != 0 {
+		t.Errorf("ingest stats of changing %+v, want 1 sample and none suppressed", n)
+	}
+}
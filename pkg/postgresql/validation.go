@@ -0,0 +1,213 @@
+package postgresql
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+// validationLogInterval is how often a violation of a rule is logged at
+// most, the others are only counted.
+const validationLogInterval = time.Minute
+
+// validationRule checks the values of the series whose metric name matches.
+type validationRule struct {
+	source    string
+	pattern   *regexp.Regexp
+	min, max  float64
+	monotonic bool
+	clamp     bool
+
+	lastLog int64 // unix nanoseconds, accessed atomically
+}
+
+// parseValidationRules parses REGEX=CHECKS rules, where CHECKS is a comma
+// separated list of min:VALUE, max:VALUE, monotonic and clamp. As for
+// downsampling, the regular expression is anchored and matched against the
+// metric name, and the first matching rule applies.
+func parseValidationRules(rules []string) ([]*validationRule, error) {
+	parsed := make([]*validationRule, 0, len(rules))
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("validation rule %q is not REGEX=CHECKS", rule)
+		}
+		pattern, err := regexp.Compile("^(?:" + rule[:i] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("validation rule %q: %w", rule, err)
+		}
+		r := &validationRule{source: rule, pattern: pattern, min: math.Inf(-1), max: math.Inf(1)}
+		for _, check := range strings.Split(rule[i+1:], ",") {
+			name, arg := check, ""
+			if j := strings.Index(check, ":"); j >= 0 {
+				name, arg = check[:j], check[j+1:]
+			}
+			switch name {
+			case "min", "max":
+				bound, err := strconv.ParseFloat(arg, 64)
+				if err != nil || math.IsNaN(bound) {
+					return nil, fmt.Errorf("validation rule %q: %s needs a number", rule, name)
+				}
+				if name == "min" {
+					r.min = bound
+				} else {
+					r.max = bound
+				}
+			case "monotonic":
+				r.monotonic = true
+			case "clamp":
+				r.clamp = true
+			default:
+				return nil, fmt.Errorf("validation rule %q: unknown check %q, expected min:VALUE, max:VALUE, monotonic or clamp", rule, check)
+			}
+		}
+		if r.min > r.max {
+			return nil, fmt.Errorf("validation rule %q: min is above max", rule)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// validationRules returns the rules given in ValidationRules followed by
+// those in ValidationRulesFile, one per line, ignoring empty lines and
+// lines starting with #.
+func (cfg *Config) validationRules() ([]*validationRule, error) {
+	rules := cfg.ValidationRules
+	if cfg.ValidationRulesFile != "" {
+		f, err := os.Open(cfg.ValidationRulesFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		rules = append([]string(nil), rules...)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				rules = append(rules, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return parseValidationRules(rules)
+}
+
+// validator applies the validation rules. The rules are swapped as a whole
+// on reload; the last sample of each series seen by a monotonic rule is
+// remembered in a bounded LRU and survives reloads.
+type validator struct {
+	rules  atomic.Value // []*validationRule
+	logger log.Logger
+
+	mutex sync.Mutex
+	last  *seriesLRU
+}
+
+// check reports whether a sample of metric with value v at timestamp ms is
+// stored and with which value. Violations are counted per rule and check.
+func (v *validator) check(metric model.Metric, ms int64, value float64) (float64, bool) {
+	rules, _ := v.rules.Load().([]*validationRule)
+	if len(rules) == 0 {
+		return value, true
+	}
+	name := string(metric[model.MetricNameLabel])
+	var rule *validationRule
+	for _, r := range rules {
+		if r.pattern.MatchString(name) {
+			rule = r
+			break
+		}
+	}
+	// NaN is a staleness marker, not a value.
+	if rule == nil || math.IsNaN(value) {
+		return value, true
+	}
+
+	switch {
+	case value < rule.min:
+		v.violation(rule, "min", name, value)
+		return rule.min, rule.clamp
+	case value > rule.max:
+		v.violation(rule, "max", name, value)
+		return rule.max, rule.clamp
+	case !rule.monotonic:
+		return value, true
+	}
+
+	// A decrease is a violation, but the new value is remembered anyway,
+	// so that a counter reset costs one sample, not all until the counter
+	// is back above its old value.
+	fingerprint := metric.Fingerprint()
+	v.mutex.Lock()
+	last := v.last.get(fingerprint)
+	if last == nil {
+		v.last.add(fingerprint, ms, value)
+		v.mutex.Unlock()
+		return value, true
+	}
+	previous, decreased := last.value, ms > last.timestamp && value < last.value
+	if ms > last.timestamp {
+		last.timestamp, last.value = ms, value
+	}
+	v.mutex.Unlock()
+	if decreased {
+		v.violation(rule, "monotonic", name, value)
+		return previous, rule.clamp
+	}
+	return value, true
+}
+
+func (v *validator) violation(rule *validationRule, check string, name string, value float64) {
+	action := "drop"
+	if rule.clamp {
+		action = "clamp"
+	}
+	invalidSamples.WithLabelValues(rule.source, check).Inc()
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&rule.lastLog)
+	if now-last >= int64(validationLogInterval) && atomic.CompareAndSwapInt64(&rule.lastLog, last, now) {
+		level.Warn(v.logger).Log("msg", "Sample failed validation", "rule", rule.source, "check", check, "name", name, "value", value, "action", action)
+	}
+}
+
+// activeValidator is shared by the parsers of all writers, like the
+// downsampler, and configured by the first writer started.
+var (
+	validatorOnce   sync.Once
+	activeValidator = &validator{logger: log.NewNopLogger(), last: newSeriesLRU(0)}
+)
+
+func configureValidator(logger log.Logger, cfg *Config) {
+	// Validate has checked the rules already.
+	rules, _ := cfg.validationRules()
+	activeValidator.mutex.Lock()
+	activeValidator.logger = logger
+	activeValidator.last = newSeriesLRU(cfg.ValidationSeries)
+	activeValidator.mutex.Unlock()
+	activeValidator.rules.Store(rules)
+}
+
+// ReloadValidationRules reads the validation rules again, including
+// ValidationRulesFile, and replaces the rules in effect. On error the rules
+// are left unchanged.
+func ReloadValidationRules(cfg *Config) (int, error) {
+	rules, err := cfg.validationRules()
+	if err != nil {
+		return 0, err
+	}
+	activeValidator.rules.Store(rules)
+	return len(rules), nil
+}
@@ -0,0 +1,238 @@
+package postgresql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Schema checks run when a writer starts.
+const (
+	SchemaCheckWarn = "warn"
+	SchemaCheckFail = "fail"
+	SchemaCheckOff  = "off"
+)
+
+// SchemaError lists every way the metrics table differs from what the
+// configuration expects.
+type SchemaError struct {
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return "metrics table does not match the configuration: " + strings.Join(e.Problems, "; ")
+}
+
+type expectedColumn struct {
+	name     string
+	dataType string
+}
+
+// expectedColumns are the columns COPY writes, with their format_type.
+func expectedColumns(columns Columns) []expectedColumn {
+	return []expectedColumn{
+		{columns.Time, "timestamp with time zone"},
+		{columns.Name, "text"},
+		{columns.Value, "double precision"},
+		{columns.Labels, "jsonb"},
+	}
+}
+
+const columnsQuery = `SELECT attname, format_type(atttypid, atttypmod), attnotnull, atthasdef
+FROM pg_attribute
+WHERE attrelid = 'metrics'::regclass AND attnum > 0 AND NOT attisdropped`
+
+const partitionKeyQuery = `SELECT p.partstrat::text, p.partnatts, coalesce(a.attname::text, '')
+FROM pg_partitioned_table p
+LEFT JOIN pg_attribute a ON a.attrelid = p.partrelid AND a.attnum = p.partattrs[0]
+WHERE p.partrelid = 'metrics'::regclass`
+
+const indexesQuery = `SELECT indisunique, pg_get_indexdef(indexrelid) FROM pg_index WHERE indrelid = 'metrics'::regclass`
+
+// VerifySchema compares the metrics table in the catalog with what the
+// configuration expects: its columns and their types, range partitioning on
+// time that reads actually prune, and the indexes createSchema creates. It returns a *SchemaError
+// listing every difference found.
+func (c *Client) VerifySchema(ctx context.Context) error {
+	db, err := c.pool()
+	if err != nil {
+		return err
+	}
+	return verifySchema(ctx, db, c.cfg)
+}
+
+// verifyPruning plans a read of the time range of the newest leaf partition,
+// built like every read with the bounds as timestamptz parameters, and
+// returns a problem if the plan scans any other partition.
+func verifyPruning(ctx context.Context, db *pgxpool.Pool, cols Columns) (string, error) {
+	partitions, err := leafPartitionRanges(ctx, db)
+	if err != nil || len(partitions) < 2 {
+		return "", err
+	}
+	newest := partitions[len(partitions)-1]
+	command, args, err := buildTableQuery("metrics", cols, &prompb.Query{
+		StartTimestampMs: fromTimestamp(newest.lower),
+		EndTimestampMs:   fromTimestamp(newest.upper) - 1,
+	}, ReadOrderNone, nil)
+	if err != nil {
+		return "", err
+	}
+	var plan string
+	if err := db.QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+command, args...).Scan(&plan); err != nil {
+		return "", err
+	}
+	var tree interface{}
+	if err := json.Unmarshal([]byte(plan), &tree); err != nil {
+		return "", err
+	}
+	scanned := planRelations(tree, nil)
+	for _, relation := range scanned {
+		if relation != newest.name {
+			return fmt.Sprintf("a read of the range of %s also scans %s, partitions are not pruned", newest.name, strings.Join(scanned, ", ")), nil
+		}
+	}
+	return "", nil
+}
+
+// planRelations collects the relations scanned in an EXPLAIN (FORMAT JSON)
+// plan.
+func planRelations(node interface{}, relations []string) []string {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if name, ok := n["Relation Name"].(string); ok {
+			relations = append(relations, name)
+		}
+		for _, child := range n {
+			relations = planRelations(child, relations)
+		}
+	case []interface{}:
+		for _, child := range n {
+			relations = planRelations(child, relations)
+		}
+	}
+	return relations
+}
+
+func verifySchema(ctx context.Context, db *pgxpool.Pool, cfg *Config) error {
+	var exists bool
+	if err := db.QueryRow(ctx, "SELECT to_regclass('metrics') IS NOT NULL").Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return &SchemaError{Problems: []string{"table metrics does not exist"}}
+	}
+
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	rows, err := db.Query(ctx, columnsQuery)
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]string)
+	var required []string
+	for rows.Next() {
+		var name, dataType string
+		var notNull, hasDefault bool
+		if err := rows.Scan(&name, &dataType, &notNull, &hasDefault); err != nil {
+			rows.Close()
+			return err
+		}
+		columns[name] = dataType
+		if notNull && !hasDefault {
+			required = append(required, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	cols := cfg.columns()
+	for _, col := range expectedColumns(cols) {
+		dataType, ok := columns[col.name]
+		switch {
+		case !ok:
+			add("column %s is missing", col.name)
+		case dataType != col.dataType:
+			add("column %s is %s, expected %s", col.name, dataType, col.dataType)
+		}
+		delete(columns, col.name)
+	}
+	// COPY only fills the expected columns, any other one must be nullable
+	// or have a default.
+	for _, name := range required {
+		if _, extra := columns[name]; extra {
+			add("column %s is NOT NULL without a default", name)
+		}
+	}
+
+	var strategy, keyColumn string
+	var keyColumns int
+	err = db.QueryRow(ctx, partitionKeyQuery).Scan(&strategy, &keyColumns, &keyColumn)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		add("table is not partitioned, expected PARTITION BY RANGE (time)")
+	case err != nil:
+		return err
+	case strategy != "r" || keyColumns != 1 || keyColumn != cols.Time:
+		add("table is partitioned by strategy %q on %d column(s) starting with %q, expected RANGE (%s)", strategy, keyColumns, keyColumn, cols.Time)
+	default:
+		problem, err := verifyPruning(ctx, db, cols)
+		if err != nil {
+			return err
+		}
+		if problem != "" {
+			add("%s", problem)
+		}
+	}
+
+	rows, err = db.Query(ctx, indexesQuery)
+	if err != nil {
+		return err
+	}
+	var unique, brin, nameTime bool
+	for rows.Next() {
+		var isUnique bool
+		var def string
+		if err := rows.Scan(&isUnique, &def); err != nil {
+			rows.Close()
+			return err
+		}
+		// pg_get_indexdef quotes names where needed, such as "time".
+		def = strings.Replace(def, `"`, "", -1)
+		switch {
+		case isUnique && strings.HasSuffix(def, fmt.Sprintf("USING btree (%s, %s, %s)", cols.Time, cols.Name, cols.Labels)):
+			unique = true
+		case strings.HasSuffix(def, fmt.Sprintf("USING brin (%s)", cols.Time)):
+			brin = true
+		case strings.HasSuffix(def, "USING btree "+nameTimeColumns(cols)):
+			nameTime = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !unique {
+		add("unique constraint on (%s, %s, %s) is missing", cols.Time, cols.Name, cols.Labels)
+	}
+	if !brin {
+		add("BRIN index on %s is missing", cols.Time)
+	}
+	if !nameTime && !cfg.DeferredIndexes {
+		add("btree index on %s is missing, expected unless --pg-deferred-indexes is set", nameTimeColumns(cols))
+	}
+
+	if len(problems) > 0 {
+		return &SchemaError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Package selector parses PromQL vector selectors such as
+// up{job="api", instance=~"10\\..*"} into label matchers, including the
+// quoted names of Prometheus 3 like {"http.server.duration", "k8s.pod"="a"}.
+// Nothing else of PromQL is supported.
+package selector
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// ErrUnsupported is returned for expressions that are not a plain vector
+// selector: functions, operators, range selectors, offsets and the like.
+var ErrUnsupported = errors.New("only plain vector selectors like metric{label=\"value\"} are supported, use Prometheus for PromQL")
+
+type parser struct {
+	input string
+	pos   int
+}
+
+// Parse parses a vector selector. The metric name, if given, becomes an
+// equality matcher on __name__. As in Prometheus, at least one matcher must
+// not match the empty string.
+func Parse(input string) ([]*prompb.LabelMatcher, error) {
+	p := &parser{input: input}
+	var matchers []*prompb.LabelMatcher
+
+	p.skipSpace()
+	named := false
+	if name := p.identifier(true); name != "" {
+		matchers = append(matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: name})
+		named = true
+	}
+	p.skipSpace()
+	if p.peek() == '{' {
+		p.pos++
+		m, err := p.matchers(named)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m...)
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) || len(matchers) == 0 {
+		return nil, ErrUnsupported
+	}
+
+	for _, m := range matchers {
+		if !matchesEmpty(m) {
+			return matchers, nil
+		}
+	}
+	return nil, errors.New("vector selector must contain at least one matcher that does not match the empty string")
+}
+
+// matchers parses the matchers up to and including the closing brace. A
+// quoted string standing alone is the metric name, which named tells was
+// given before the brace already.
+func (p *parser) matchers(named bool) ([]*prompb.LabelMatcher, error) {
+	var matchers []*prompb.LabelMatcher
+	for {
+		p.skipSpace()
+		if p.peek() == '}' {
+			p.pos++
+			return matchers, nil
+		}
+		var name string
+		if isQuote(p.peek()) {
+			quoted, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if c := p.peek(); c == ',' || c == '}' {
+				if named {
+					return nil, p.errorf("metric name %q given twice", quoted)
+				}
+				named = true
+				matchers = append(matchers, &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: model.MetricNameLabel, Value: quoted})
+				if c == ',' {
+					p.pos++
+				}
+				continue
+			}
+			name = quoted
+		} else {
+			name = p.identifier(false)
+		}
+		if name == "" {
+			return nil, p.errorf("expected a label name")
+		}
+		p.skipSpace()
+		t, err := p.operator()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		value, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		if t == prompb.LabelMatcher_RE || t == prompb.LabelMatcher_NRE {
+			if _, err := regexp.Compile(value); err != nil {
+				return nil, fmt.Errorf("invalid regexp for label %s: %v", name, err)
+			}
+		}
+		matchers = append(matchers, &prompb.LabelMatcher{Type: t, Name: name, Value: value})
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+		default:
+			return nil, p.errorf("expected , or }")
+		}
+	}
+}
+
+func (p *parser) operator() (prompb.LabelMatcher_Type, error) {
+	for _, op := range []struct {
+		token string
+		t     prompb.LabelMatcher_Type
+	}{
+		{"=~", prompb.LabelMatcher_RE},
+		{"!~", prompb.LabelMatcher_NRE},
+		{"!=", prompb.LabelMatcher_NEQ},
+		{"=", prompb.LabelMatcher_EQ},
+	} {
+		if strings.HasPrefix(p.input[p.pos:], op.token) {
+			p.pos += len(op.token)
+			return op.t, nil
+		}
+	}
+	return 0, p.errorf("expected one of =, !=, =~ or !~")
+}
+
+// identifier consumes a label name, or a metric name, which may also contain
+// colons. It returns "" if there is none at the current position.
+func (p *parser) identifier(metric bool) string {
+	start := p.pos
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || metric && c == ':' || p.pos > start && c >= '0' && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.input[start:p.pos]
+}
+
+// str consumes a string in double, single or back quotes, with the escapes
+// of Go strings in the first two.
+func (p *parser) str() (string, error) {
+	quote := p.peek()
+	if !isQuote(quote) {
+		return "", p.errorf("expected a quoted string")
+	}
+	start := p.pos
+	for p.pos++; p.pos < len(p.input); p.pos++ {
+		switch c := p.input[p.pos]; {
+		case c == '\\' && quote != '`':
+			p.pos++
+		case c == quote:
+			p.pos++
+			return unquote(p.input[start:p.pos])
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// unquote unquotes s, turning a single quoted string into a double quoted
+// one first, which strconv.Unquote only accepts for a single character.
+func unquote(s string) (string, error) {
+	if s[0] == '\'' {
+		var b strings.Builder
+		b.WriteByte('"')
+		body := s[1 : len(s)-1]
+		for i := 0; i < len(body); i++ {
+			switch {
+			case body[i] == '\\' && i+1 < len(body) && body[i+1] == '\'':
+				b.WriteByte('\'')
+				i++
+			case body[i] == '\\' && i+1 < len(body):
+				b.WriteString(body[i : i+2])
+				i++
+			case body[i] == '"':
+				b.WriteString(`\"`)
+			default:
+				b.WriteByte(body[i])
+			}
+		}
+		b.WriteByte('"')
+		s = b.String()
+	}
+	value, err := strconv.Unquote(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid string %s: %v", s, err)
+	}
+	return value, nil
+}
+
+func isQuote(c byte) bool {
+	return c == '"' || c == '\'' || c == '`'
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && strings.IndexByte(" \t\r\n", p.input[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *parser) peek() byte {
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+// matchesEmpty reports whether m matches a series without the label.
+func matchesEmpty(m *prompb.LabelMatcher) bool {
+	switch m.Type {
+	case prompb.LabelMatcher_EQ:
+		return m.Value == ""
+	case prompb.LabelMatcher_NEQ:
+		return m.Value != ""
+	case prompb.LabelMatcher_RE:
+		return regexp.MustCompile("^(?:" + m.Value + ")$").MatchString("")
+	default:
+		return !regexp.MustCompile("^(?:" + m.Value + ")$").MatchString("")
+	}
+}
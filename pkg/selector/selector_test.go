@@ -0,0 +1,88 @@
+package selector
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestParse(t *testing.T) {
+	eq := func(name, value string) *prompb.LabelMatcher {
+		return &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: name, Value: value}
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  []*prompb.LabelMatcher
+	}{
+		{"metric name", "up", []*prompb.LabelMatcher{eq("__name__", "up")}},
+		{"recording rule name", "job:up:sum", []*prompb.LabelMatcher{eq("__name__", "job:up:sum")}},
+		{"matchers", `up{job="api", instance!="a"}`, []*prompb.LabelMatcher{
+			eq("__name__", "up"),
+			eq("job", "api"),
+			{Type: prompb.LabelMatcher_NEQ, Name: "instance", Value: "a"},
+		}},
+		{"quoted name", `{"http.server.duration"}`, []*prompb.LabelMatcher{eq("__name__", "http.server.duration")}},
+		{"quoted name and labels", `{"http.server.duration", "k8s.pod"="a", region='eu'}`, []*prompb.LabelMatcher{
+			eq("__name__", "http.server.duration"),
+			eq("k8s.pod", "a"),
+			eq("region", "eu"),
+		}},
+		{"UTF-8 name", "{`température-µ`}", []*prompb.LabelMatcher{eq("__name__", "température-µ")}},
+		{"quotes in values", `up{path="it's \"quoted\"", q='a\'b"c'}`, []*prompb.LabelMatcher{
+			eq("__name__", "up"),
+			eq("path", `it's "quoted"`),
+			eq("q", `a'b"c`),
+		}},
+		{"dollar signs", `up{v="$1", "$name"="$"}`, []*prompb.LabelMatcher{
+			eq("__name__", "up"),
+			eq("v", "$1"),
+			eq("$name", "$"),
+		}},
+		{"regexp metacharacters", `up{path=~"/api/(v1|v2)/.+\\?", instance!~"10\\.0\\..*"}`, []*prompb.LabelMatcher{
+			eq("__name__", "up"),
+			{Type: prompb.LabelMatcher_RE, Name: "path", Value: `/api/(v1|v2)/.+\?`},
+			{Type: prompb.LabelMatcher_NRE, Name: "instance", Value: `10\.0\..*`},
+		}},
+		{"regexp in back quotes", "up{path=~`a\\.b`}", []*prompb.LabelMatcher{
+			eq("__name__", "up"),
+			{Type: prompb.LabelMatcher_RE, Name: "path", Value: `a\.b`},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.input)
+			if err != nil {
+				t.Fatalf("Parse(%s): %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%s) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"sum(up)",
+		"up[5m]",
+		"up offset 5m",
+		`up{job="api"} + 1`,
+		`{"a", "b"}`,
+		`up{"up"}`,
+		`{"unterminated}`,
+		`up{job=api}`,
+		`up{job~"api"}`,
+		`up{job=~"api("}`,
+		`{job=""}`,
+		`{job=~".*"}`,
+	} {
+		t.Run(input, func(t *testing.T) {
+			if got, err := Parse(input); err == nil {
+				t.Errorf("Parse(%s) = %v, want an error", input, got)
+			}
+		})
+	}
+}
@@ -20,8 +20,16 @@ log_format="${log_format:-'logfmt'}"
 pg_partition="${pg_partition:-'hourly'}"
 pg_commit_secs=${pg_commit_secs:-30}
 pg_commit_rows=${pg_commit_rows:-20000}
-pg_threads="${pg_threads:-1}"
-parser_threads="${parser_threads:-5}"
+pg_threads="${pg_threads:-0}"
+parser_threads="${parser_threads:-0}"
+pg_writer_async_commit="${pg_writer_async_commit:-false}"
+
+# kingpin bool flags take no value, only their --no- negation.
+if [[ "${pg_writer_async_commit}" == "true" ]]; then
+  pg_writer_async_commit_flag=--pg-writer-async-commit
+else
+  pg_writer_async_commit_flag=--no-pg-writer-async-commit
+fi
 
 echo /postgresql-prometheus-adapter \
   --adapter-send-timeout=${adapter_send_timeout} \
@@ -33,7 +41,8 @@ echo /postgresql-prometheus-adapter \
   --pg-commit-secs=${pg_commit_secs} \
   --pg-commit-rows=${pg_commit_rows} \
   --pg-threads=${pg_threads} \
-  --parser-threads=${parser_threads}
+  --parser-threads=${parser_threads} \
+  ${pg_writer_async_commit_flag}
 
 /postgresql-prometheus-adapter \
   --adapter-send-timeout=${adapter_send_timeout} \
@@ -45,5 +54,6 @@ echo /postgresql-prometheus-adapter \
   --pg-commit-secs=${pg_commit_secs} \
   --pg-commit-rows=${pg_commit_rows} \
   --pg-threads=${pg_threads} \
-  --parser-threads=${parser_threads}
+  --parser-threads=${parser_threads} \
+  ${pg_writer_async_commit_flag}
 